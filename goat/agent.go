@@ -7,7 +7,8 @@ type Agent interface{
     //Outbox() chan<- Message
     
     GetComponentId() int
-    Start()
+    // Start joins the infrastructure; on error the agent can not be used.
+    Start() error
     GetFirstMessageId() int
     SendMessage(Message)
     AskMid()
@@ -16,4 +17,25 @@ type Agent interface{
     GetMaxMid() int
     GetSendTime() map[int]int64
     GetReceiveTime() map[int]int64
+    // Close tells the infrastructure that the agent is leaving, then releases
+    // its connections and goroutines.
+    Close()
+}
+
+/*
+MidReserver is implemented by the agents that can reserve n consecutive mids with
+a single request: they arrive on the reply channel as n separate mids. A reserved
+mid that is not needed is released by sending an empty message with it.
+*/
+type MidReserver interface {
+    AskMids(n int)
+}
+
+/*
+ExpiryNotifier is implemented by the agents whose infrastructure can fill a mid
+whose message is late (see the SetMidLease of the infrastructures). The message,
+when it arrives, is dropped and given to handler, from a goroutine of the agent.
+*/
+type ExpiryNotifier interface {
+    OnExpired(handler func(Message))
 }
@@ -0,0 +1,101 @@
+package goat
+
+import (
+    "time"
+)
+
+// CommitAction is the action of a process that committed changes to the attributes
+type CommitAction int
+
+const (
+    CommitReceive CommitAction = iota // the receive of a message
+    CommitSend // the send of a message
+    CommitSet // Process.Set or Process.SetIf
+)
+
+func (a CommitAction) String() string {
+    switch a {
+        case CommitReceive:
+            return "receive"
+        case CommitSend:
+            return "send"
+    }
+    return "set"
+}
+
+/*
+AttributeCommit is a transaction in the history of the attributes of a component
+(see Component.KeepHistory): the changes it made, the action of the process that
+committed it at the mid Mid, and the time of the commit.
+*/
+type AttributeCommit struct {
+    AttributeChanges
+    Action CommitAction
+    Process string
+    Time time.Time
+}
+
+// record adds commit to the history of aw, dropping the oldest one if it is full
+func (aw *attributeWatchers) record(commit AttributeCommit) {
+    if aw.historySize <= 0 {
+        return
+    }
+    if len(aw.history) >= aw.historySize {
+        aw.history = append(aw.history[:0], aw.history[len(aw.history)-aw.historySize+1:]...)
+    }
+    aw.history = append(aw.history, commit)
+}
+
+// commitBy commits the transaction of the process named process, that performed action at mid
+func (attr *Attributes) commitBy(action CommitAction, process string, mid int) bool {
+    attr.mid = mid
+    attr.action = action
+    attr.process = process
+    return attr.commit()
+}
+
+/*
+KeepHistory makes c record the last n transactions that change its attributes,
+that can be read with History. With n <= 0 the history is dropped and no more
+recorded.
+*/
+func (c *Component) KeepHistory(n int) {
+    aw := c.attributes.watchers
+    aw.lock.Lock()
+    defer aw.lock.Unlock()
+    aw.historySize = n
+    if n <= 0 {
+        aw.history = nil
+    } else if len(aw.history) > n {
+        aw.history = append([]AttributeCommit{}, aw.history[len(aw.history)-n:]...)
+    }
+}
+
+/*
+History returns the transactions recorded (see KeepHistory) that changed at least
+one of the attributes keys (any attribute if no key is given), oldest first. Each
+transaction has all its changes, not only the ones to keys.
+*/
+func (c *Component) History(keys ...string) []AttributeCommit {
+    aw := c.attributes.watchers
+    aw.lock.Lock()
+    defer aw.lock.Unlock()
+    history := []AttributeCommit{}
+    for _, commit := range aw.history {
+        changed := len(keys) == 0
+        for _, key := range keys {
+            if _, has := commit.Changes[key]; has {
+                changed = true
+            }
+        }
+        if changed {
+            history = append(history, commit)
+        }
+    }
+    return history
+}
+
+// Name identifies p in the history of the attributes
+func (p *Process) Name() string {
+    return "process " + itoa(p.id)
+}
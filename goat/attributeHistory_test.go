@@ -0,0 +1,70 @@
+package goat
+
+import (
+    "testing"
+)
+
+func TestAttributeHistory(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+    sender := NewComponent(tst.agents[0], map[string]interface{}{"state": "idle"})
+    receiver := NewComponent(tst.agents[1], nil)
+    sender.KeepHistory(2)
+    receiver.KeepHistory(10)
+    
+    received := make(chan struct{})
+    NewProcess(receiver).Run(func(p *Process) {
+        p.Receive(func(attr *Attributes, msg Tuple) bool {
+            attr.Set("job", msg.Get(0))
+            return true
+        })
+        close(received)
+    })
+    var setter, sendingProc string
+    sent := make(chan struct{})
+    NewProcess(sender).Run(func(p *Process) {
+        setter = p.Name()
+        p.Set(func(attr *Attributes) {
+            attr.Set("state", "ready")
+        })
+        p.Set(func(attr *Attributes) {}) // no change, not recorded
+        p.Spawn(func(q *Process) {
+            sendingProc = q.Name()
+            q.SendUpd(NewTuple("build"), True(), func(attr *Attributes) {
+                attr.Set("state", "busy")
+                attr.Set("sent", 1)
+            })
+            close(sent)
+        })
+    })
+    waitAll(t, 2000, received, sent)
+    
+    history := sender.History()
+    if len(history) != 2 || setter == sendingProc {
+        t.Fatalf("history %+v of %s and %s", history, setter, sendingProc)
+    }
+    set, send := history[0], history[1]
+    if set.Action != CommitSet || set.Process != setter || set.Changes["state"] != (AttributeChange{"idle", "ready", true}) {
+        t.Errorf("set %+v", set)
+    }
+    if send.Action != CommitSend || send.Process != sendingProc || send.Tx != set.Tx + 1 || send.Mid <= set.Mid || send.Time.Before(set.Time) {
+        t.Errorf("send %+v after %+v", send, set)
+    }
+    if h := sender.History("sent"); len(h) != 1 || h[0].Tx != send.Tx || len(h[0].Changes) != 2 {
+        t.Errorf("the history of sent is %+v", h)
+    }
+    if h := receiver.History("job"); len(h) != 1 || h[0].Action != CommitReceive || h[0].Mid != send.Mid {
+        t.Errorf("the history of the receiver is %+v", h)
+    }
+    
+    sender.KeepHistory(1)
+    if h := sender.History(); len(h) != 1 || h[0].Tx != send.Tx {
+        t.Errorf("the history was not shortened: %+v", h)
+    }
+    sender.KeepHistory(0)
+    if len(sender.History()) != 0 {
+        t.Errorf("the history was not dropped")
+    }
+    sender.Close()
+    receiver.Close()
+}
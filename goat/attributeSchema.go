@@ -0,0 +1,313 @@
+package goat
+
+import (
+    "fmt"
+    "math"
+    "time"
+)
+
+// AttributeType is the type of the values of an attribute in an AttributeSchema
+type AttributeType int
+
+const (
+    AnyAttribute AttributeType = iota
+    IntAttribute // int
+    FloatAttribute // float64
+    StringAttribute // string
+    BoolAttribute // bool
+    TupleAttribute // Tuple
+    TimeAttribute // time.Time
+    DurationAttribute // time.Duration
+)
+
+func (at AttributeType) String() string {
+    switch at {
+        case IntAttribute:
+            return "int"
+        case FloatAttribute:
+            return "float64"
+        case StringAttribute:
+            return "string"
+        case BoolAttribute:
+            return "bool"
+        case TupleAttribute:
+            return "Tuple"
+        case TimeAttribute:
+            return "time.Time"
+        case DurationAttribute:
+            return "time.Duration"
+    }
+    return "any"
+}
+
+// has tells whether val is of type at
+func (at AttributeType) has(val interface{}) bool {
+    switch val.(type) {
+        case int:
+            return at == IntAttribute || at == AnyAttribute
+        case float64:
+            return at == FloatAttribute || at == AnyAttribute
+        case string:
+            return at == StringAttribute || at == AnyAttribute
+        case bool:
+            return at == BoolAttribute || at == AnyAttribute
+        case Tuple:
+            return at == TupleAttribute || at == AnyAttribute
+        case time.Time:
+            return at == TimeAttribute || at == AnyAttribute
+        case time.Duration:
+            return at == DurationAttribute || at == AnyAttribute
+    }
+    return at == AnyAttribute
+}
+
+/*
+AttributeSpec describes an attribute: the type of its values, the value it gets
+when the component is created without it (none if Default is nil), the smallest
+and the largest value it can have (no bound if Min or Max are nil), and whether
+it can be changed after the creation of the component.
+*/
+type AttributeSpec struct {
+    Name string
+    Type AttributeType
+    Default interface{}
+    Min interface{}
+    Max interface{}
+    ReadOnly bool
+}
+
+/*
+AttributeError tells why an attribute or its value does not follow a schema, or
+why a typed getter of Attributes could not return it.
+*/
+type AttributeError struct {
+    Name string
+    Msg string
+}
+
+func (e *AttributeError) Error() string {
+    return fmt.Sprintf("goat: attribute %q %s", e.Name, e.Msg)
+}
+
+/*
+AttributeSchema lists the attributes that a component can have. The attributes of
+a component created with a schema (see NewComponentWithSchema) are checked when
+they are initialized, set and committed: an attribute that is not in the schema,
+like a misspelled one, or a value of the wrong type or out of its range is an
+error.
+*/
+type AttributeSchema struct {
+    specs map[string]AttributeSpec
+}
+
+// NewAttributeSchema fails if an attribute is listed twice or has an invalid default
+func NewAttributeSchema(specs ...AttributeSpec) (*AttributeSchema, error) {
+    schema := AttributeSchema{map[string]AttributeSpec{}}
+    for _, spec := range specs {
+        if _, has := schema.specs[spec.Name]; has {
+            return nil, &AttributeError{spec.Name, "is listed twice"}
+        }
+        schema.specs[spec.Name] = spec
+        if spec.Default != nil {
+            if err := schema.Check(spec.Name, spec.Default); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return &schema, nil
+}
+
+// Spec returns the description of the attribute name, if it is in the schema
+func (s *AttributeSchema) Spec(name string) (AttributeSpec, bool) {
+    spec, has := s.specs[name]
+    return spec, has
+}
+
+// Check tells whether val is a valid value for the attribute name
+func (s *AttributeSchema) Check(name string, val interface{}) error {
+    spec, has := s.specs[name]
+    if !has {
+        return &AttributeError{name, "is not in the schema"}
+    } else if !spec.Type.has(val) {
+        return &AttributeError{name, fmt.Sprintf("has type %s, not %T", spec.Type, val)}
+    }
+    if spec.Min != nil {
+        if less, comparable := compareValues(val, "<", spec.Min); !comparable || less {
+            return &AttributeError{name, fmt.Sprintf("is %v, less than %v", val, spec.Min)}
+        }
+    }
+    if spec.Max != nil {
+        if greater, comparable := compareValues(val, ">", spec.Max); !comparable || greater {
+            return &AttributeError{name, fmt.Sprintf("is %v, greater than %v", val, spec.Max)}
+        }
+    }
+    return nil
+}
+
+/*
+initial checks the values a component is created with, and returns them together
+with the defaults of the attributes they do not have.
+*/
+func (s *AttributeSchema) initial(attrInit map[string]interface{}) (map[string]interface{}, error) {
+    values := map[string]interface{}{}
+    for name, val := range attrInit {
+        if err := s.Check(name, val); err != nil {
+            return nil, err
+        }
+        values[name] = val
+    }
+    for name, spec := range s.specs {
+        if _, has := values[name]; !has && spec.Default != nil {
+            values[name] = spec.Default
+        }
+    }
+    return values, nil
+}
+
+func (s *AttributeSchema) readOnly() []string {
+    names := []string{}
+    for name, spec := range s.specs {
+        if spec.ReadOnly {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+/*
+CheckPredicate reports the first attribute that p refers to, of the sender or of
+the receiver, that is not in the schema. It is meant for the components that
+share a schema, to find the misspelled names in their predicates.
+*/
+func (s *AttributeSchema) CheckPredicate(p Predicate) error {
+    names := map[string]struct{}{}
+    predicateRefs(p, names)
+    receiverRefs(p, names)
+    for name := range names {
+        if _, isMsg := messageField(name); !isMsg {
+            if _, has := s.specs[name]; !has {
+                return &AttributeError{name, "is not in the schema"}
+            }
+        }
+    }
+    return nil
+}
+
+// receiverRefs adds to names the attributes of the receiver that p refers to
+func receiverRefs(p Predicate, names map[string]struct{}) {
+    var operand func(x interface{})
+    operand = func(x interface{}) {
+        switch v := x.(type) {
+            case recattr:
+                names[v.name] = struct{}{}
+            case expr:
+                for _, arg := range v.args {
+                    operand(arg)
+                }
+            case evalattr:
+                for _, param := range v.params {
+                    operand(param)
+                }
+            case Tuple:
+                for _, elem := range v.Elems {
+                    operand(elem)
+                }
+        }
+    }
+    switch pp := p.(type) {
+        case and:
+            receiverRefs(pp.p1, names)
+            receiverRefs(pp.p2, names)
+        case or:
+            receiverRefs(pp.p1, names)
+            receiverRefs(pp.p2, names)
+        case not:
+            receiverRefs(pp.p, names)
+        case comp:
+            operand(pp.arg1)
+            operand(pp.arg2)
+        case isin:
+            operand(pp.arg1)
+            operand(pp.arg2)
+    }
+}
+
+//////////// typed getters
+
+// typed returns the value of the attribute x, checking that it is in the schema
+func (attr *Attributes) typed(x string) (interface{}, error) {
+    if attr.schema != nil {
+        if _, has := attr.schema.specs[x]; !has {
+            return nil, &AttributeError{x, "is not in the schema"}
+        }
+    }
+    val, has := attr.Get(x)
+    if !has {
+        return nil, &AttributeError{x, "is not set"}
+    }
+    return val, nil
+}
+
+// GetInt returns the value of the attribute x, that must be an integer that fits an int
+func (attr *Attributes) GetInt(x string) (int, error) {
+    val, err := attr.typed(x)
+    if err != nil {
+        return 0, err
+    }
+    switch v := val.(type) {
+        case int:
+            return v, nil
+        case int64:
+            if v >= math.MinInt && v <= math.MaxInt {
+                return int(v), nil
+            }
+        case uint64:
+            if v <= math.MaxInt {
+                return int(v), nil
+            }
+    }
+    return 0, &AttributeError{x, fmt.Sprintf("is %v, not an int", val)}
+}
+
+// GetFloat returns the value of the attribute x, that must be a number
+func (attr *Attributes) GetFloat(x string) (float64, error) {
+    val, err := attr.typed(x)
+    if err != nil {
+        return 0, err
+    }
+    switch v := val.(type) {
+        case float64:
+            return v, nil
+        case int:
+            return float64(v), nil
+        case int64:
+            return float64(v), nil
+        case uint64:
+            return float64(v), nil
+    }
+    return 0, &AttributeError{x, fmt.Sprintf("is %v, not a number", val)}
+}
+
+// GetString returns the value of the attribute x, that must be a string
+func (attr *Attributes) GetString(x string) (string, error) {
+    val, err := attr.typed(x)
+    if err != nil {
+        return "", err
+    }
+    if s, isString := val.(string); isString {
+        return s, nil
+    }
+    return "", &AttributeError{x, fmt.Sprintf("is %v, not a string", val)}
+}
+
+// GetTuple returns the value of the attribute x, that must be a Tuple
+func (attr *Attributes) GetTuple(x string) (Tuple, error) {
+    val, err := attr.typed(x)
+    if err != nil {
+        return Tuple{}, err
+    }
+    if t, isTuple := val.(Tuple); isTuple {
+        return t, nil
+    }
+    return Tuple{}, &AttributeError{x, fmt.Sprintf("is %v, not a Tuple", val)}
+}
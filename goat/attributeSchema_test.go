@@ -0,0 +1,151 @@
+package goat
+
+import (
+    "errors"
+    "testing"
+)
+
+func testSchema(t *testing.T) *AttributeSchema {
+    schema, err := NewAttributeSchema(
+        AttributeSpec{Name: "load", Type: IntAttribute, Default: 0, Min: 0, Max: 100},
+        AttributeSpec{Name: "role", Type: StringAttribute, ReadOnly: true},
+        AttributeSpec{Name: "weight", Type: FloatAttribute, Default: 1.0},
+        AttributeSpec{Name: "pos", Type: TupleAttribute},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    return schema
+}
+
+func TestAttributeSchema(t *testing.T) {
+    if _, err := NewAttributeSchema(AttributeSpec{Name: "x", Type: IntAttribute, Default: "1"}); err == nil {
+        t.Errorf("a default of the wrong type was accepted")
+    }
+    if _, err := NewAttributeSchema(AttributeSpec{Name: "x"}, AttributeSpec{Name: "x"}); err == nil {
+        t.Errorf("an attribute was listed twice")
+    }
+    schema := testSchema(t)
+    for _, init := range []map[string]interface{}{
+        {"Load": 3},
+        {"load": "3"},
+        {"load": 101},
+        {"load": -1},
+        {"role": 1},
+    } {
+        var attrErr *AttributeError
+        if err := NewAttributes().initWithSchema(init, schema); !errors.As(err, &attrErr) {
+            t.Errorf("%v: got %v", init, err)
+        }
+    }
+    attr := NewAttributes()
+    if err := attr.initWithSchema(map[string]interface{}{"role": "worker", "pos": NewTuple(1, 2)}, schema); err != nil {
+        t.Fatal(err)
+    }
+    if load, err := attr.GetInt("load"); err != nil || load != 0 {
+        t.Errorf("load is %v, %v", load, err)
+    }
+    attr.Set("load", 50)
+    attr.Set("weight", 2.5)
+    if !attr.commit() || attr.GetValue("load") != 50 {
+        t.Errorf("the changes were not committed")
+    }
+    for _, change := range []struct{
+        name string
+        val interface{}
+    }{{"Load", 1}, {"load", 1000}, {"weight", "heavy"}, {"role", "coordinator"}} {
+        func() {
+            defer func() {
+                if recover() == nil {
+                    t.Errorf("%s was set to %v", change.name, change.val)
+                }
+            }()
+            attr.Set(change.name, change.val)
+        }()
+        var attrErr *AttributeError
+        if err := attr.SetErr(change.name, change.val); !errors.As(err, &attrErr) {
+            t.Errorf("%s set to %v: got %v", change.name, change.val, err)
+        }
+    }
+    if len(attr.changes) > 0 {
+        t.Errorf("the rejected values were kept: %v", attr.changes)
+    }
+    attr.changes = map[string]interface{}{"load": 10, "weight": 3}
+    if attr.commit() || attr.GetValue("load") != 50 {
+        t.Errorf("invalid changes were committed")
+    }
+}
+
+func TestTypedGetters(t *testing.T) {
+    attr := NewAttributes()
+    if err := attr.initWithSchema(map[string]interface{}{"role": "worker", "load": 7, "pos": NewTuple(1, 2)}, testSchema(t)); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := attr.GetInt("load"); err != nil || v != 7 {
+        t.Errorf("GetInt: %v, %v", v, err)
+    }
+    if v, err := attr.GetFloat("load"); err != nil || v != 7 {
+        t.Errorf("GetFloat: %v, %v", v, err)
+    }
+    if v, err := attr.GetString("role"); err != nil || v != "worker" {
+        t.Errorf("GetString: %v, %v", v, err)
+    }
+    if v, err := attr.GetTuple("pos"); err != nil || v.Get(1) != 2 {
+        t.Errorf("GetTuple: %v, %v", v, err)
+    }
+    if _, err := attr.GetInt("role"); err == nil {
+        t.Errorf("a string was returned as an int")
+    }
+    if _, err := attr.GetString("Role"); err == nil {
+        t.Errorf("an attribute out of the schema was returned")
+    }
+    noSchema := NewAttributes()
+    noSchema.init(map[string]interface{}{"x": 1})
+    if _, err := noSchema.GetInt("y"); err == nil {
+        t.Errorf("a missing attribute was returned")
+    }
+    if v, err := noSchema.GetInt("x"); err != nil || v != 1 {
+        t.Errorf("GetInt: %v, %v", v, err)
+    }
+}
+
+func TestSchemaCheckPredicate(t *testing.T) {
+    schema := testSchema(t)
+    p, err := ParsePredicate(`receiver.load < this.load && msg[0] == "x"`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := schema.CheckPredicate(p); err != nil {
+        t.Errorf("got %v", err)
+    }
+    p, _ = ParsePredicate(`receiver.Load < 10`)
+    if err := schema.CheckPredicate(p); err == nil {
+        t.Errorf("receiver.Load is not in the schema")
+    }
+    double := func(args ...interface{}) interface{} { return 2 * args[0].(int) }
+    for _, p := range []Predicate{
+        LessThan(Evaluate(double, Receiver("Load")), 10),
+        Equals(NewTuple(1, Receiver("Pos")), Receiver("pos")),
+    } {
+        if err := schema.CheckPredicate(p); err == nil {
+            t.Errorf("%v: the misspelled receiver attribute was not found", p)
+        }
+    }
+}
+
+func TestComponentWithSchema(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+    schema := testSchema(t)
+    if _, err := NewComponentWithSchema(tst.agents[0], map[string]interface{}{"Load": 1}, schema); err == nil {
+        t.Errorf("a component was created with a misspelled attribute")
+    }
+    comp, err := NewComponentWithSchema(tst.agents[1], map[string]interface{}{"role": "worker"}, schema)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer comp.Close()
+    if load, err := comp.attributes.GetInt("load"); err != nil || load != 0 {
+        t.Errorf("load is %v, %v", load, err)
+    }
+}
@@ -0,0 +1,184 @@
+package goat
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+/*
+AttributeSnapshot holds the committed attributes of a component. Tx and Mid are
+the transaction and the mid of the last change it includes (see AttributeChanges).
+Note that a component restored from a snapshot still joins the infrastructure as
+a new agent, with a new id and a new first mid.
+*/
+type AttributeSnapshot struct {
+    Values map[string]interface{}
+    Tx int
+    Mid int
+}
+
+// Encode serializes s with gob; the values must be of the types registered by InitSend, or basic ones
+func (s AttributeSnapshot) Encode() ([]byte, error) {
+    registerTypes()
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+        return nil, fmt.Errorf("goat: invalid snapshot: %v", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// DecodeAttributeSnapshot reads a snapshot serialized by Encode
+func DecodeAttributeSnapshot(data []byte) (AttributeSnapshot, error) {
+    registerTypes()
+    var s AttributeSnapshot
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+        return AttributeSnapshot{}, fmt.Errorf("goat: invalid snapshot: %v", err)
+    }
+    if s.Values == nil {
+        s.Values = map[string]interface{}{}
+    }
+    return s, nil
+}
+
+// LoadAttributeSnapshot reads the snapshot saved in the file path
+func LoadAttributeSnapshot(path string) (AttributeSnapshot, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return AttributeSnapshot{}, err
+    }
+    return DecodeAttributeSnapshot(data)
+}
+
+// save writes s to the file path, replacing it only when s is completely written
+func (s AttributeSnapshot) save(path string) error {
+    data, err := s.Encode()
+    if err != nil {
+        return err
+    }
+    return writeFileSync(path, data)
+}
+
+// apply adds changes to s
+func (s *AttributeSnapshot) apply(changes AttributeChanges) {
+    for name, change := range changes.Changes {
+        s.Values[name] = change.New
+    }
+    s.Tx = changes.Tx
+    s.Mid = changes.Mid
+}
+
+/*
+Snapshot returns the committed attributes. The values are not copied: a Tuple
+in the snapshot shares its elements with the attribute.
+*/
+func (attr *Attributes) Snapshot() AttributeSnapshot {
+    s := AttributeSnapshot{Values: map[string]interface{}{}, Mid: attr.mid}
+    for name, val := range attr.actual {
+        s.Values[name] = val
+    }
+    if attr.watchers != nil {
+        attr.watchers.lock.Lock()
+        s.Tx = attr.watchers.tx
+        attr.watchers.lock.Unlock()
+    }
+    return s
+}
+
+/*
+Restore replaces the committed attributes with the ones of s, and discards the
+uncommitted changes. It fails, changing nothing, if the attributes have a schema
+that s does not follow; the attributes of the schema that s does not have get
+their defaults. The read-only attributes are restored too.
+*/
+func (attr *Attributes) Restore(s AttributeSnapshot) error {
+    values := map[string]interface{}{}
+    if attr.schema != nil {
+        var err error
+        if values, err = attr.schema.initial(s.Values); err != nil {
+            return err
+        }
+    } else {
+        for name, val := range s.Values {
+            values[name] = val
+        }
+    }
+    attr.actual = values
+    attr.changes = nil
+    return nil
+}
+
+/*
+RestoreAttributes replaces the attributes of c with the ones of s (see
+Attributes.Restore). It must be called before the processes of c start.
+*/
+func (c *Component) RestoreAttributes(s AttributeSnapshot) error {
+    return c.attributes.Restore(s)
+}
+
+/*
+PersistAttributes saves the committed attributes of c to the file path: after
+every transaction if interval is 0, otherwise every interval if they changed, and
+when c is closed. If the file already exists, the attributes are first restored
+from it (see RestoreAttributes), so that a component that is created again after
+a crash or a restart, and persists its attributes to the same file, gets back the
+state it had. It must be called before the processes of c start. The errors met
+while saving are logged, and the next change retries.
+*/
+func (c *Component) PersistAttributes(path string, interval time.Duration) error {
+    if saved, err := LoadAttributeSnapshot(path); err == nil {
+        if err := c.RestoreAttributes(saved); err != nil {
+            return err
+        }
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    changes, stop := c.WatchAttributes()
+    snapshot := c.attributes.Snapshot()
+    if err := snapshot.save(path); err != nil {
+        stop()
+        return err
+    }
+    c.persisters.Add(1)
+    go func(){
+        defer c.persisters.Done()
+        var tick <-chan time.Time
+        if interval > 0 {
+            ticker := time.NewTicker(interval)
+            defer ticker.Stop()
+            tick = ticker.C
+        }
+        dirty := false
+        save := func() {
+            if err := snapshot.save(path); err != nil {
+                log.Printf("goat: can not save the attributes to %s: %v", path, err)
+            } else {
+                dirty = false
+            }
+        }
+        for {
+            select {
+                case change, ok := <- changes:
+                    if !ok {
+                        if dirty {
+                            save()
+                        }
+                        return
+                    }
+                    snapshot.apply(change)
+                    dirty = true
+                    if interval <= 0 {
+                        save()
+                    }
+                case <- tick:
+                    if dirty {
+                        save()
+                    }
+            }
+        }
+    }()
+    return nil
+}
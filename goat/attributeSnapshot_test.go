@@ -0,0 +1,83 @@
+package goat
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestAttributeSnapshot(t *testing.T) {
+    attr := NewAttributes()
+    attr.init(map[string]interface{}{
+        "tasks": NewTuple("a", 2),
+        "count": 3,
+        "since": time.Unix(100, 0).UTC(),
+        "every": time.Second,
+    })
+    attr.Set("count", 4)
+    snap := attr.Snapshot()
+    if snap.Values["count"] != 3 {
+        t.Errorf("the snapshot has uncommitted changes: %v", snap.Values)
+    }
+    data, err := snap.Encode()
+    if err != nil {
+        t.Fatal(err)
+    }
+    back, err := DecodeAttributeSnapshot(data)
+    if err != nil || !reflect.DeepEqual(back, snap) {
+        t.Errorf("decoded %v, %v", back, err)
+    }
+    if _, err := DecodeAttributeSnapshot(data[:len(data)/2]); err == nil {
+        t.Errorf("a truncated snapshot was decoded")
+    }
+    
+    restored := NewAttributes()
+    restored.Set("count", 10)
+    if err := restored.Restore(back); err != nil || restored.GetValue("count") != 3 || restored.Has("x") {
+        t.Errorf("restored %v, %v", restored.actual, err)
+    }
+    schema, _ := NewAttributeSchema(AttributeSpec{Name: "count", Type: StringAttribute})
+    strict := NewAttributes()
+    strict.initWithSchema(nil, schema)
+    if err := strict.Restore(back); err == nil || len(strict.actual) != 0 {
+        t.Errorf("a snapshot that breaks the schema was restored")
+    }
+}
+
+func TestPersistAttributes(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "attributes")
+    // the second round starts from the tasks saved by the first one
+    for round, interval := range []time.Duration{0, time.Hour} {
+        tst := testLocalInfrastructure{}
+        tst.initTest(2)
+        comp := NewComponent(tst.agents[0], map[string]interface{}{"tasks": 0})
+        if err := comp.PersistAttributes(path, interval); err != nil {
+            t.Fatal(err)
+        }
+        if saved, err := LoadAttributeSnapshot(path); err != nil || saved.Values["tasks"] == nil {
+            t.Errorf("saved %v, %v", saved, err)
+        }
+        done := make(chan struct{})
+        NewProcess(comp).Run(func(p *Process) {
+            for i := 0; i < 3; i++ {
+                p.Set(func(attr *Attributes) {
+                    attr.Set("tasks", attr.GetValue("tasks").(int) + 1)
+                })
+            }
+            close(done)
+        })
+        waitAll(t, 2000, done)
+        comp.Close()
+        
+        // the component created again gets back its tasks
+        again := NewComponent(tst.agents[1], map[string]interface{}{"tasks": 0})
+        if err := again.PersistAttributes(path, interval); err != nil {
+            t.Fatal(err)
+        }
+        if tasks, err := again.attributes.GetInt("tasks"); err != nil || tasks != 3 * (round + 1) {
+            t.Errorf("interval %v: restored %d tasks, %v", interval, tasks, err)
+        }
+        again.Close()
+    }
+}
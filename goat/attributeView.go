@@ -0,0 +1,400 @@
+package goat
+
+import (
+    "fmt"
+    "sync"
+)
+
+/*
+AttributePublisher is implemented by the agents that can tell their infrastructure
+the value of some attributes of their component. The infrastructure uses them to
+evaluate the predicate of a message before forwarding it: if the predicate is
+false whatever the other attributes are, the agent gets a short notice that the
+mid was used instead of the whole message. A nil value means that the attribute
+is not set.
+
+The view holds from the mid from on: the infrastructure sends again, in full, the
+messages from that mid on that it filtered with an older view. The channel
+returned is closed once the infrastructure has the view, or the agent is closed.
+*/
+type AttributePublisher interface {
+    PublishAttributes(from int, view map[string]interface{}) <-chan struct{}
+}
+
+/*
+skipped is the predicate of the empty message that takes the place of a message
+filtered with the view published for the mid from: it behaves as False.
+*/
+type skipped struct {
+    from int
+}
+func (s skipped) Satisfy(*Attributes) bool {
+    return false
+}
+func (s skipped) String() string {
+    return "FF"
+}
+
+// skippedPred is the predicate of a message filtered with the view from, or False if no view was used
+func skippedPred(from int) ClosedPredicate {
+    if from < 0 {
+        return False()
+    }
+    return skipped{from}
+}
+
+// skipParams returns "SKIP mid from", or "SKIP mid" if no view was used
+func skipParams(mid int, from int) []string {
+    if from < 0 {
+        return []string{"SKIP", itoa(mid)}
+    }
+    return []string{"SKIP", itoa(mid), itoa(from)}
+}
+
+/*
+publishedView is the view an agent published last: its channel is closed when
+the infrastructure tells that it has the view, or when the agent is closed.
+*/
+type publishedView struct {
+    lock *sync.Mutex
+    from int
+    tokens []string
+    chnKnown chan struct{}
+    closed bool
+}
+
+func newPublishedView() *publishedView {
+    return &publishedView{lock: &sync.Mutex{}, from: -1}
+}
+
+// publish records the view from the mid from, encoded as "from name value ...", and returns its channel
+func (pv *publishedView) publish(from int, view map[string]interface{}) ([]string, <-chan struct{}) {
+    pv.lock.Lock()
+    defer pv.lock.Unlock()
+    pv.from = from
+    pv.tokens = append([]string{itoa(from)}, encodeAttributeView(view)...)
+    if pv.chnKnown != nil && !pv.closed {
+        close(pv.chnKnown)
+    }
+    pv.chnKnown = make(chan struct{})
+    if pv.closed {
+        close(pv.chnKnown)
+    }
+    return pv.tokens, pv.chnKnown
+}
+
+// last returns the tokens of the last view published, or nil
+func (pv *publishedView) last() []string {
+    pv.lock.Lock()
+    defer pv.lock.Unlock()
+    return pv.tokens
+}
+
+// pending returns the mid of the last view published, if the infrastructure did not tell it has it, or -1
+func (pv *publishedView) pending() int {
+    pv.lock.Lock()
+    defer pv.lock.Unlock()
+    if pv.chnKnown == nil || pv.closed {
+        return -1
+    }
+    return pv.from
+}
+
+// known reads "VIEW from" from the infrastructure
+func (pv *publishedView) known(params []string) {
+    from, err := paramInt(params, 0)
+    if err != nil {
+        return
+    }
+    pv.lock.Lock()
+    if from == pv.from && pv.chnKnown != nil && !pv.closed {
+        close(pv.chnKnown)
+        pv.chnKnown = nil
+    }
+    pv.lock.Unlock()
+}
+
+// close releases the component waiting for the view, since the infrastructure will not tell anymore
+func (pv *publishedView) close() {
+    pv.lock.Lock()
+    if pv.chnKnown != nil && !pv.closed {
+        close(pv.chnKnown)
+    }
+    pv.closed = true
+    pv.lock.Unlock()
+}
+
+// knownView returns a channel already closed, for the infrastructures that get the view at once
+func knownView() <-chan struct{} {
+    chn := make(chan struct{})
+    close(chn)
+    return chn
+}
+
+/*
+attributeView is what an infrastructure knows about the attributes of an agent:
+the attributes in known have the values in attr, or are not set if attr does not
+have them. The other attributes are unknown. The view holds from the mid from on.
+*/
+type attributeView struct {
+    attr Attributes
+    known map[string]struct{}
+    from int
+}
+
+func newAttributeView(from int, view map[string]interface{}) attributeView {
+    av := attributeView{known: map[string]struct{}{}, from: from}
+    values := map[string]interface{}{}
+    for name, val := range view {
+        av.known[name] = struct{}{}
+        if val != nil {
+            values[name] = val
+        }
+    }
+    av.attr.init(values)
+    return av
+}
+
+// encodes the view as "name value name value ..."
+func encodeAttributeView(view map[string]interface{}) []string {
+    tokens := make([]string, 0, 2*len(view))
+    for name, val := range view {
+        tokens = append(tokens, name, escapeWithType(val, false))
+    }
+    return tokens
+}
+
+// decodes "from name value ..."
+func decodeAttributeView(tokens []string) (attributeView, error) {
+    from, err := paramInt(tokens, 0)
+    if err != nil {
+        return attributeView{}, err
+    }
+    tokens = tokens[1:]
+    if len(tokens) % 2 != 0 {
+        return attributeView{}, fmt.Errorf("goat: attribute %q has no value", tokens[len(tokens)-1])
+    }
+    view := map[string]interface{}{}
+    for i := 0; i < len(tokens); i += 2 {
+        val, isAttr, next, err := unescapeWithType(tokens[i+1], 0)
+        if err != nil {
+            return attributeView{}, fmt.Errorf("goat: attribute %q: %w", tokens[i], err)
+        }
+        if isAttr || next != len(tokens[i+1]) {
+            return attributeView{}, fmt.Errorf("goat: attribute %q: invalid value %q", tokens[i], tokens[i+1])
+        }
+        view[tokens[i]] = val
+    }
+    return newAttributeView(from, view), nil
+}
+
+// an operand is known if it does not depend on unknown attributes
+func (av *attributeView) knows(x interface{}, isAttr bool) bool {
+    if isAttr {
+        _, has := av.known[x.(string)]
+        return has
+    }
+    if e, isExpr := x.(cexpr); isExpr {
+        for _, arg := range e.args {
+            if ra, isRecAttr := arg.(recattr); isRecAttr {
+                if !av.knows(ra.name, true) {
+                    return false
+                }
+            } else if !av.knows(arg, false) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+/*
+satisfy evaluates p on the view. The second result is false if the value of p
+depends on the attributes that are not in the view.
+*/
+func (av *attributeView) satisfy(p ClosedPredicate) (bool, bool) {
+    switch pp := p.(type) {
+        case _true:
+            return true, true
+        case _false:
+            return false, true
+        case ccomp:
+            if av.knows(pp.Par1, pp.IsAttr1) && av.knows(pp.Par2, pp.IsAttr2) {
+                return pp.Satisfy(&av.attr), true
+            }
+        case cisin:
+            if av.knows(pp.Par1, pp.IsAttr1) && av.knows(pp.Par2, pp.IsAttr2) {
+                return pp.Satisfy(&av.attr), true
+            }
+        case cnot:
+            val, known := av.satisfy(pp.p)
+            return !val, known
+        case cand:
+            val1, known1 := av.satisfy(pp.p1)
+            val2, known2 := av.satisfy(pp.p2)
+            if (known1 && !val1) || (known2 && !val2) {
+                return false, true
+            }
+            return true, known1 && known2
+        case cor:
+            val1, known1 := av.satisfy(pp.p1)
+            val2, known2 := av.satisfy(pp.p2)
+            if (known1 && val1) || (known2 && val2) {
+                return true, true
+            }
+            return false, known1 && known2
+    }
+    return false, false
+}
+
+// skippedHistory is how many of the last messages filtered for an agent a node keeps
+const skippedHistory = 4096
+
+/*
+skippedMessage is a message of sender that an agent got only the mid of: a DATA
+message as sent to the agents in params, or msg in a LocalInfrastructure.
+*/
+type skippedMessage struct {
+    mid int
+    sender int
+    from int
+    params []string
+    msg Message
+}
+
+/*
+predicateFilter holds the views published by the agents of a node, and tells
+which agents do not need a message, or must not get it according to the policy.
+The last predicate decoded and the last rules closed are kept, since the same
+message is checked for every agent.
+
+A view arrives after the messages the agent got before publishing it: the filter
+keeps the messages it skipped for each agent, and a new view returns those from
+its mid on, filtered with an older view, to send them again.
+*/
+type predicateFilter struct {
+    views map[int]attributeView
+    skipped map[int][]skippedMessage
+    lastSource string
+    lastPred ClosedPredicate
+    policy *Policy
+    lastRulesKey string
+    lastRules []ClosedPredicate
+}
+
+func newPredicateFilter() *predicateFilter {
+    return &predicateFilter{views: map[int]attributeView{}, skipped: map[int][]skippedMessage{}}
+}
+
+/*
+publish reads the "from name value ..." tokens of an ATTR message from the agent
+id. It returns the mid of the view and the messages skipped for the agent from
+that mid on with an older view: the caller sends them again, or skips them with
+the new view. A view older than the one known is ignored.
+*/
+func (pf *predicateFilter) publish(id int, tokens []string) (int, []skippedMessage, error) {
+    view, err := decodeAttributeView(tokens)
+    if err != nil {
+        return 0, nil, err
+    }
+    return view.from, pf.setView(id, view), nil
+}
+
+// setView is publish with the view decoded
+func (pf *predicateFilter) setView(id int, view attributeView) []skippedMessage {
+    if old, has := pf.views[id]; has && old.from > view.from {
+        return nil
+    }
+    pf.views[id] = view
+    pf.lastRulesKey = ""
+    // the agent publishes a view once the infrastructure has the previous one: the older messages are settled
+    var stale []skippedMessage
+    for _, sm := range pf.skipped[id] {
+        if sm.mid >= view.from && sm.from < view.from {
+            stale = append(stale, sm)
+        }
+    }
+    delete(pf.skipped, id)
+    return stale
+}
+
+func (pf *predicateFilter) forget(id int) {
+    delete(pf.views, id)
+    delete(pf.skipped, id)
+    pf.lastRulesKey = ""
+}
+
+/*
+skip records that the agent id gets only the mid of sm, and returns the mid of
+the view used, or -1 if the agent has no view: the message is then excluded by
+the policy whatever the view.
+*/
+func (pf *predicateFilter) skip(id int, sm skippedMessage) int {
+    view, has := pf.views[id]
+    if !has {
+        return -1
+    }
+    if sm.params != nil {
+        sm.params = append([]string{}, sm.params...)
+    }
+    sm.from = view.from
+    kept := pf.skipped[id]
+    if len(kept) >= skippedHistory {
+        kept = kept[1:]
+    }
+    pf.skipped[id] = append(kept, sm)
+    return view.from
+}
+
+// stillExcludes checks again with the current view a message skipped for the agent id
+func (pf *predicateFilter) stillExcludes(id int, sm skippedMessage) bool {
+    if sm.params == nil {
+        return pf.excludes(id, sm.msg.Pred) || pf.breaksRules(id, pf.rulesFor(sm.sender, sm.msg.Message))
+    }
+    return pf.excludesData(sm.sender, id, sm.params[3], sm.params[4])
+}
+
+/*
+resend sends again to the agent id the messages returned by publish: send gets
+the SKIP stamped with the new view, or the DATA message.
+*/
+func (pf *predicateFilter) resend(id int, stale []skippedMessage, send func(params []string)) {
+    for _, sm := range stale {
+        if pf.stillExcludes(id, sm) {
+            send(skipParams(sm.mid, pf.skip(id, sm)))
+        } else {
+            send(sm.params)
+        }
+    }
+}
+
+func (pf *predicateFilter) setPolicy(policy *Policy) {
+    pf.policy = policy
+    pf.lastRulesKey = ""
+}
+
+// excludes is true if the agent id surely does not satisfy the predicate p
+func (pf *predicateFilter) excludes(id int, p ClosedPredicate) bool {
+    view, has := pf.views[id]
+    if !has {
+        return false
+    }
+    val, known := view.satisfy(p)
+    return known && !val
+}
+
+// excludesEncoded behaves like excludes, with the predicate as found in a DATA message
+func (pf *predicateFilter) excludesEncoded(id int, pred string) bool {
+    if _, has := pf.views[id]; !has {
+        return false
+    }
+    if pf.lastPred == nil || pf.lastSource != pred {
+        p, err := ToPredicate(pred)
+        if err != nil {
+            // let the agent deal with it
+            return false
+        }
+        pf.lastSource, pf.lastPred = pred, p
+    }
+    return pf.excludes(id, pf.lastPred)
+}
@@ -0,0 +1,212 @@
+package goat
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestAttributeViewSatisfy(t *testing.T) {
+    InitSend()
+    view, err := decodeAttributeView(append([]string{"0"}, encodeAttributeView(map[string]interface{}{"role": "worker", "zone": NewTuple(1, 2), "gone": nil})...))
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct{
+        pred Predicate
+        val bool
+        known bool
+    }{
+        {Equals(Receiver("role"), "worker"), true, true},
+        {Equals(Receiver("role"), "idle"), false, true},
+        {Equals(Receiver("load"), 3), false, false},
+        {Equals(Receiver("gone"), 3), false, true},
+        {Belong(2, Receiver("zone")), true, true},
+        {Equals(Len(Receiver("zone")), 3), false, true},
+        {Equals(Plus(Receiver("load"), Len(Receiver("zone"))), 3), false, false},
+        {And(Equals(Receiver("role"), "idle"), Equals(Receiver("load"), 3)), false, true},
+        {And(Equals(Receiver("role"), "worker"), Equals(Receiver("load"), 3)), false, false},
+        {Or(Equals(Receiver("role"), "worker"), Equals(Receiver("load"), 3)), true, true},
+        {Or(Equals(Receiver("role"), "idle"), Equals(Receiver("load"), 3)), false, false},
+        {Not(Equals(Receiver("role"), "idle")), true, true},
+        {Not(Equals(Receiver("load"), 3)), false, false},
+        {True(), true, true},
+    }
+    for _, c := range cases {
+        p := c.pred.CloseUnder(nil)
+        val, known := view.satisfy(p)
+        if known != c.known || (known && val != c.val) {
+            t.Errorf("%s: got %v, %v", p, val, known)
+        }
+    }
+    if _, err := decodeAttributeView([]string{"0", "role"}); err == nil {
+        t.Errorf("an attribute without value should be refused")
+    }
+    if _, err := decodeAttributeView([]string{"0", "role", "S|a,b"}); err == nil {
+        t.Errorf("a value with trailing garbage should be refused")
+    }
+}
+
+/*
+a view returns the messages skipped from its mid on with an older view, that are
+sent again in full or skipped with the new view
+*/
+func TestFilterSendsAgainStaleSkips(t *testing.T) {
+    InitSend()
+    pf := newPredicateFilter()
+    view := func(from int, role string) []string {
+        return append([]string{itoa(from)}, encodeAttributeView(map[string]interface{}{"role": role})...)
+    }
+    data := func(mid int, role string) skippedMessage {
+        pred := Equals(Receiver("role"), role).CloseUnder(nil).String()
+        job := NewTuple("job")
+        return skippedMessage{mid: mid, sender: 2, params: []string{"DATA", itoa(mid), "0", pred, job.encode()}}
+    }
+    if from := pf.skip(1, data(1, "worker")); from != -1 {
+        t.Errorf("a message skipped without view has the view %d", from)
+    }
+    pf.publish(1, view(0, "idle"))
+    for _, mid := range []int{2, 5, 6} {
+        if from := pf.skip(1, data(mid, "worker")); from != 0 {
+            t.Errorf("message %d was skipped with the view %d", mid, from)
+        }
+    }
+    pf.skip(1, data(7, "boss"))
+    from, stale, err := pf.publish(1, view(5, "worker"))
+    if err != nil || from != 5 || len(stale) != 3 {
+        t.Fatalf("the view from 5 returned %d, %v, %v", from, stale, err)
+    }
+    sent := [][]string{}
+    pf.resend(1, stale, func(msg []string) {
+        sent = append(sent, msg)
+    })
+    expected := [][]string{data(5, "worker").params, data(6, "worker").params, {"SKIP", "7", "5"}}
+    if len(sent) != len(expected) {
+        t.Fatalf("sent again %v", sent)
+    }
+    for i := range sent {
+        if strings.Join(sent[i], " ") != strings.Join(expected[i], " ") {
+            t.Errorf("sent again %v instead of %v", sent[i], expected[i])
+        }
+    }
+    if _, stale, _ := pf.publish(1, view(3, "idle")); len(stale) != 0 || pf.views[1].from != 5 {
+        t.Errorf("an older view replaced the one from 5")
+    }
+}
+
+/*
+the component waits for the message of a mid skipped with a view older than the
+one published for the mid, and serves each mid once
+*/
+func TestComponentWaitsForStaleSkip(t *testing.T) {
+    InitSend()
+    chnRply, chnData := newUnboundChanInt(), newUnboundChanMessage()
+    ip := newInProcess(chnRply, chnData)
+    defer ip.Stop()
+    ip.chnFirstMid <- 0
+    ip.viewFrom(0)
+    chnData.In <- Message{0, NewTuple(), skipped{0}}
+    if msg := <- ip.chnMessage.Out; msg.Id != 0 || msg.Pred != False() {
+        t.Errorf("served %v", msg)
+    }
+    // the commit at mid 0 publishes a view from mid 1
+    ip.viewFrom(1)
+    chnData.In <- Message{1, NewTuple(), skipped{0}}
+    ip.chnNext <- struct{}{}
+    chnData.In <- Message{1, NewTuple("job"), True()}
+    if msg := <- ip.chnMessage.Out; msg.Id != 1 || msg.Message.Get(0) != "job" {
+        t.Errorf("served %v instead of the message sent again", msg)
+    }
+    chnData.In <- Message{1, NewTuple("job"), True()}
+    chnData.In <- Message{2, NewTuple(), skipped{1}}
+    ip.chnNext <- struct{}{}
+    if msg := <- ip.chnMessage.Out; msg.Id != 2 {
+        t.Errorf("served %v instead of mid 2", msg)
+    }
+}
+
+/*
+the idle component gets only the mid of the message for the workers, and still
+receives the next one; once it becomes a worker, it gets the messages for them
+*/
+func publishedAttributesTest(t *testing.T, sender *Component, worker *Component, idle *Component) {
+    worker.PublishAttributes("role")
+    idle.PublishAttributes("role", "missing")
+    received := make(chan struct{}, 4)
+    promoted := make(chan struct{})
+    NewProcess(worker).Run(func(p *Process) {
+        for _, job := range []string{"job", "job2"} {
+            p.Receive(func(attr *Attributes, msg Tuple) bool {
+                return msg.Get(0) == job
+            })
+            received <- struct{}{}
+        }
+    })
+    NewProcess(idle).Run(func(p *Process) {
+        msg := p.Receive(func(attr *Attributes, msg Tuple) bool {
+            return true
+        })
+        if msg.Get(0) != "all" {
+            t.Errorf("the idle component received %v", msg)
+        }
+        received <- struct{}{}
+        p.Set(func(attr *Attributes) {
+            attr.Set("role", "worker")
+        })
+        close(promoted)
+        msg = p.Receive(func(attr *Attributes, msg Tuple) bool {
+            return true
+        })
+        if msg.Get(0) != "job2" {
+            t.Errorf("the promoted component received %v", msg)
+        }
+        received <- struct{}{}
+    })
+    NewProcess(sender).Run(func(p *Process) {
+        p.Send(NewTuple("job"), Equals(Receiver("role"), "worker"))
+        p.Send(NewTuple("all"), True())
+        <- promoted
+        // job2 takes a mid after the promotion: if the infrastructure filters it
+        // with the old view, it sends it again once it gets the new one
+        p.Send(NewTuple("job2"), Equals(Receiver("role"), "worker"))
+    })
+    waitAll(t, 4000, received, received, received, received)
+}
+
+func TestPublishAttributes(t *testing.T) {
+    InitSend()
+    attrs := func(role string) map[string]interface{} {
+        return map[string]interface{}{"role": role}
+    }
+    run := func(name string, agents ...Agent) {
+        comps := []*Component{NewComponent(agents[0], attrs("boss")), NewComponent(agents[1], attrs("worker")), NewComponent(agents[2], attrs("idle"))}
+        t.Run(name, func(t *testing.T) {
+            publishedAttributesTest(t, comps[0], comps[1], comps[2])
+        })
+        for _, comp := range comps {
+            comp.Close()
+        }
+    }
+    
+    local := testLocalInfrastructure{}
+    local.initTest(3)
+    run("local", local.agents[0], local.agents[1], local.agents[2])
+    
+    term, srv := initTestCS(300)
+    run("server", NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"))
+    teardownTestCS(term, srv)
+    
+    ring := testRingInfrastructure{}
+    ring.initTest(300, 2, 3)
+    run("ring", ring.agents[0], ring.agents[1], ring.agents[2])
+    ring.teardownTest()
+    
+    tree := testTreeInfrastructure{}
+    tree.initTest(300, 2, 2, 3)
+    run("tree", tree.agents[0], tree.agents[1], tree.agents[2])
+    tree.teardownTest()
+    
+    cluster := testClusterInfrastructure{}
+    cluster.initTest(300, 2, 3)
+    run("cluster", cluster.agents[0], cluster.agents[1], cluster.agents[2])
+    cluster.teardownTest()
+}
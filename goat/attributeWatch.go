@@ -0,0 +1,188 @@
+package goat
+
+import (
+    "reflect"
+    "sync"
+    "time"
+)
+
+// AttributeChange is the change of the value of an attribute, that had no value before if Had is false
+type AttributeChange struct {
+    Old interface{}
+    New interface{}
+    Had bool
+}
+
+/*
+AttributeChanges is a set of changes to the attributes of a component, committed
+together. Tx numbers the transactions committed by the component, starting from 1,
+and Mid is the mid of the message that was sent or received by the transaction.
+*/
+type AttributeChanges struct {
+    Tx int
+    Mid int
+    Changes map[string]AttributeChange
+}
+
+type attributeWatcher struct {
+    keys map[string]struct{}
+    in chan AttributeChanges
+    out chan AttributeChanges
+    cls chan struct{}
+    stopOnce sync.Once
+}
+
+func (w *attributeWatcher) start() {
+    defer close(w.out)
+    buffer := []AttributeChanges{}
+    for {
+        var out chan AttributeChanges
+        var first AttributeChanges
+        if len(buffer) > 0 {
+            out = w.out
+            first = buffer[0]
+        }
+        select {
+            case out <- first:
+                buffer = buffer[1:]
+            case changes, ok := <- w.in:
+                if !ok {
+                    w.flush(buffer)
+                    return
+                }
+                buffer = append(buffer, changes)
+            case <- w.cls:
+                return
+        }
+    }
+}
+
+// flush delivers the changes still queued, unless w is stopped
+func (w *attributeWatcher) flush(buffer []AttributeChanges) {
+    for _, changes := range buffer {
+        select {
+            case w.out <- changes:
+            case <- w.cls:
+                return
+        }
+    }
+}
+
+func (w *attributeWatcher) stop() {
+    w.stopOnce.Do(func(){
+        close(w.cls)
+    })
+}
+
+// filter returns the changes that w watches, if any
+func (w *attributeWatcher) filter(changes AttributeChanges) (AttributeChanges, bool) {
+    if len(w.keys) == 0 {
+        return changes, true
+    }
+    watched := AttributeChanges{changes.Tx, changes.Mid, map[string]AttributeChange{}}
+    for key, change := range changes.Changes {
+        if _, has := w.keys[key]; has {
+            watched.Changes[key] = change
+        }
+    }
+    return watched, len(watched.Changes) > 0
+}
+
+// attributeWatchers are the watchers of a set of Attributes, and their history
+type attributeWatchers struct {
+    lock sync.Mutex
+    watchers map[*attributeWatcher]struct{}
+    tx int
+    closed bool
+    history []AttributeCommit
+    historySize int
+}
+
+func (aw *attributeWatchers) add(keys []string) *attributeWatcher {
+    w := attributeWatcher{
+        keys: map[string]struct{}{},
+        in: make(chan AttributeChanges),
+        out: make(chan AttributeChanges),
+        cls: make(chan struct{}),
+    }
+    for _, key := range keys {
+        w.keys[key] = struct{}{}
+    }
+    go w.start()
+    aw.lock.Lock()
+    defer aw.lock.Unlock()
+    if aw.closed {
+        w.stop()
+    } else {
+        if aw.watchers == nil {
+            aw.watchers = map[*attributeWatcher]struct{}{}
+        }
+        aw.watchers[&w] = struct{}{}
+    }
+    return &w
+}
+
+func (aw *attributeWatchers) remove(w *attributeWatcher) {
+    aw.lock.Lock()
+    delete(aw.watchers, w)
+    aw.lock.Unlock()
+    w.stop()
+}
+
+/*
+notify numbers the transaction that made the changes, records it in the history
+and sends the changes to the watchers.
+*/
+func (aw *attributeWatchers) notify(mid int, action CommitAction, process string, changes map[string]AttributeChange) {
+    aw.lock.Lock()
+    defer aw.lock.Unlock()
+    aw.tx++
+    all := AttributeChanges{aw.tx, mid, changes}
+    aw.record(AttributeCommit{all, action, process, time.Now()})
+    for w := range aw.watchers {
+        if watched, any := w.filter(all); any {
+            select {
+                case w.in <- watched:
+                case <- w.cls:
+            }
+        }
+    }
+}
+
+// close ends all the watchers, once they deliver the changes queued, and stops the ones added later
+func (aw *attributeWatchers) close() {
+    aw.lock.Lock()
+    defer aw.lock.Unlock()
+    aw.closed = true
+    for w := range aw.watchers {
+        close(w.in)
+    }
+    aw.watchers = nil
+}
+
+// changesOf returns the values that changes actually change in actual
+func changesOf(actual map[string]interface{}, changes map[string]interface{}) map[string]AttributeChange {
+    diff := map[string]AttributeChange{}
+    for key, val := range changes {
+        old, had := actual[key]
+        if !had || !reflect.DeepEqual(old, val) {
+            diff[key] = AttributeChange{old, val, had}
+        }
+    }
+    return diff
+}
+
+/*
+WatchAttributes returns a channel where c sends the changes to the attributes keys
+(to every attribute if no key is given), once they are committed, in the order of
+the transactions. The changes are queued until they are read, so that the processes
+of c are never slowed down by a watcher. The channel is closed by the function
+returned, that drops the changes still queued, or when c is closed, after they
+are delivered.
+*/
+func (c *Component) WatchAttributes(keys ...string) (<-chan AttributeChanges, func()) {
+    w := c.attributes.watchers.add(keys)
+    return w.out, func(){
+        c.attributes.watchers.remove(w)
+    }
+}
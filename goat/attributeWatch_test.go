@@ -0,0 +1,71 @@
+package goat
+
+import (
+    "testing"
+    "time"
+)
+
+func nextChanges(t *testing.T, changes <-chan AttributeChanges) AttributeChanges {
+    select {
+        case c, ok := <- changes:
+            if !ok {
+                t.Fatal("the watch was closed")
+            }
+            return c
+        case <- time.After(2 * time.Second):
+            t.Fatal("no changes were notified")
+    }
+    return AttributeChanges{}
+}
+
+func TestWatchAttributes(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+    sender := NewComponent(tst.agents[0], map[string]interface{}{"load": 0})
+    receiver := NewComponent(tst.agents[1], map[string]interface{}{"load": 0})
+    senderAll, stopAll := sender.WatchAttributes()
+    receiverLoad, _ := receiver.WatchAttributes("load")
+    
+    received := make(chan struct{})
+    NewProcess(receiver).Run(func(p *Process) {
+        p.Receive(func(attr *Attributes, msg Tuple) bool {
+            attr.Set("last", msg.Get(0))
+            attr.Set("load", attr.GetValue("load").(int) + 1)
+            return true
+        })
+        close(received)
+    })
+    NewProcess(sender).Run(func(p *Process) {
+        p.SendUpd(NewTuple("job"), True(), func(attr *Attributes) {
+            attr.Set("load", 5)
+        })
+        p.Set(func(attr *Attributes) {
+            attr.Set("load", 5) // no change
+            attr.Set("state", "idle")
+        })
+    })
+    waitAll(t, 2000, received)
+    
+    sent := nextChanges(t, senderAll)
+    if sent.Tx != 1 || len(sent.Changes) != 1 || sent.Changes["load"] != (AttributeChange{0, 5, true}) {
+        t.Errorf("the send changed %+v", sent)
+    }
+    set := nextChanges(t, senderAll)
+    if set.Tx != 2 || set.Mid <= sent.Mid || len(set.Changes) != 1 || set.Changes["state"] != (AttributeChange{nil, "idle", false}) {
+        t.Errorf("the set changed %+v", set)
+    }
+    got := nextChanges(t, receiverLoad)
+    if got.Mid != sent.Mid || len(got.Changes) != 1 || got.Changes["load"] != (AttributeChange{0, 1, true}) {
+        t.Errorf("the receive changed %+v after the send %+v", got, sent)
+    }
+    
+    stopAll()
+    if _, ok := <- senderAll; ok {
+        t.Errorf("the stopped watch was not closed")
+    }
+    sender.Close()
+    receiver.Close()
+    if _, ok := <- receiverLoad; ok {
+        t.Errorf("the watch of a closed component was not closed")
+    }
+}
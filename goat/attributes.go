@@ -1,5 +1,9 @@
 package goat
 
+import (
+	"log"
+)
+
 /*
 Attributes holds the set of attributes defined for a component. It should not be 
 instantiated by the user. It is designed to allow transactions, but the completion
@@ -9,12 +13,24 @@ type Attributes struct {
 	actual map[string]interface{}
 	changes map[string]interface{}
 	onUpdate *signaling
+	readOnly map[string]struct{}
+	schema *AttributeSchema
+	watchers *attributeWatchers
+	// the attributes told to the infrastructure, how to tell it their new values from a mid, and whether it has them
+	published []string
+	publish func(from int, view map[string]interface{}) <-chan struct{}
+	viewKnown <-chan struct{}
+	// the transaction being committed
+	mid int
+	action CommitAction
+	process string
 }
 
 func NewAttributes() *Attributes{
     at := Attributes{actual: nil,
 	    changes: nil,
-	    onUpdate: newSignaling()}
+	    onUpdate: newSignaling(),
+	    watchers: &attributeWatchers{}}
     return &at
 }
 
@@ -26,6 +42,22 @@ func (attr *Attributes) init(attrM map[string]interface{}){
 	}
 }
 
+/*
+initWithSchema initializes the attributes with attrM and the defaults of schema,
+failing if attrM does not follow it. From then on, the attributes that are not in
+the schema or the values that do not follow it can not be set.
+*/
+func (attr *Attributes) initWithSchema(attrM map[string]interface{}, schema *AttributeSchema) error{
+	values, err := schema.initial(attrM)
+	if err != nil {
+		return err
+	}
+	attr.actual = values
+	attr.schema = schema
+	attr.makeReadOnly(schema.readOnly()...)
+	return nil
+}
+
 /*
 Get returns the value of the attribute x in the component. If the attribute x
 has the value v associated, Get(x) returns v, True; otherwise if the attribute x
@@ -76,23 +108,107 @@ Set sets the value of attribute key to val. Note that, since Attributes uses
 transactions, GetValue(key) == val until one of the following happens:
 * the last committed value of attribute was val1 (where val1 != val), and rollback() is called;
 * a call to Set(key, val2) is performed (where val2 != val).
+Set panics with the error of SetErr.
 */
 func (attr *Attributes) Set(key string, val interface{}){
+	if err := attr.SetErr(key, val); err != nil {
+		panic(err)
+	}
+}
+
+/*
+SetErr is Set returning an *AttributeError, and leaving the attributes unchanged,
+if the attribute is read-only or if the component has a schema that val does not
+follow.
+*/
+func (attr *Attributes) SetErr(key string, val interface{}) error{
+	if _, isReadOnly := attr.readOnly[key]; isReadOnly {
+		return &AttributeError{key, "is read-only and can not be changed"}
+	}
+	if attr.schema != nil {
+		if err := attr.schema.Check(key, val); err != nil {
+			return err
+		}
+	}
 	if attr.changes == nil{
 		attr.changes = map[string]interface{}{key: val}
 	} else {
 		attr.changes[key] = val
 	}
+	return nil
+}
+
+// makeReadOnly makes Set panic for the attributes keys
+func (attr *Attributes) makeReadOnly(keys ...string){
+	if attr.readOnly == nil {
+		attr.readOnly = map[string]struct{}{}
+	}
+	for _, key := range keys {
+		attr.readOnly[key] = struct{}{}
+	}
+}
+
+/*
+publishTo tells publish the values of the attributes names now, and again every
+time a commit changes one of them, with the mid they hold from.
+*/
+func (attr *Attributes) publishTo(names []string, publish func(from int, view map[string]interface{}) <-chan struct{}){
+	attr.published = names
+	attr.publish = publish
+	attr.publishView(attr.mid)
+}
+
+func (attr *Attributes) publishView(from int){
+	view := map[string]interface{}{}
+	for _, name := range attr.published {
+		view[name], _ = attr.Get(name)
+	}
+	attr.viewKnown = attr.publish(from, view)
+}
+
+// changesPublished is true if the uncommitted changes touch a published attribute
+func (attr *Attributes) changesPublished() bool{
+	for _, name := range attr.published {
+		if _, changed := attr.changes[name]; changed {
+			return true
+		}
+	}
+	return false
 }
 
 /*
 commit completes the transaction with success. The new values of the attributes
 are permanently saved. Returns True whether there was any change to the attribute values.
+If the attributes have a schema that the changes do not follow (for instance the
+attributes were changed directly by the library), the transaction is rolled back.
 */
 func (attr *Attributes) commit() bool{
+	if attr.schema != nil {
+		for k, v := range attr.changes{
+			if err := attr.schema.Check(k, v); err != nil {
+				log.Printf("%v: the changes are discarded", err)
+				attr.changes = nil
+				return false
+			}
+		}
+	}
+	// the infrastructure gets the new values once they are committed, and has the
+	// previous ones before: the published attributes are read-only until then
+	if attr.publish != nil && attr.changesPublished() {
+		<- attr.viewKnown
+		defer attr.publishView(attr.mid + 1)
+	}
+	var diff map[string]AttributeChange
+	if attr.watchers != nil && len(attr.changes) > 0 {
+		diff = changesOf(attr.actual, attr.changes)
+	}
 	if attr.actual == nil{
 		attr.actual = attr.changes
-		return attr.changes != nil && len(attr.changes) > 0
+		attr.changes = nil
+		if len(diff) > 0 {
+			attr.watchers.notify(attr.mid, attr.action, attr.process, diff)
+		}
+		return attr.actual != nil && len(attr.actual) > 0
 	} else {
 		anyChange := len(attr.changes)>0
 		_ = anyChange
@@ -102,7 +218,12 @@ func (attr *Attributes) commit() bool{
 		attr.changes = nil
 		if anyChange{
 		    dprintln("attrchange")
-		    attr.onUpdate.Signal()
+		    if len(diff) > 0 {
+		        attr.watchers.notify(attr.mid, attr.action, attr.process, diff)
+		    }
+		    if attr.onUpdate != nil {
+		        attr.onUpdate.Signal()
+		    }
 		    return true//anyChange
 	    } else {
 	        return false
@@ -0,0 +1,81 @@
+package goat
+
+import (
+    "crypto/subtle"
+    "errors"
+)
+
+/*
+Authenticator decides whether an agent can join the infrastructure, given the
+credential it sent with its registration (empty if it sent none) and the host it
+connected from. An agent is rejected if Authenticate returns an error, whose text
+is sent back to it. It checks only the agents that join: the links between the
+processes of an infrastructure (nodes, counters, message queues) must be reachable
+only by them, or use TLS with a MutualTLSConfig.
+*/
+type Authenticator interface {
+    Authenticate(credential string, host string) error
+}
+
+// ErrInvalidCredential is returned by a TokenAuthenticator for an unknown credential
+var ErrInvalidCredential = errors.New("invalid credential")
+
+/*
+TokenAuthenticator accepts the agents whose credential is one of a set of shared
+tokens.
+*/
+type TokenAuthenticator struct {
+    tokens [][]byte
+}
+
+func NewTokenAuthenticator(tokens ...string) *TokenAuthenticator {
+    ta := TokenAuthenticator{}
+    for _, token := range tokens {
+        ta.tokens = append(ta.tokens, []byte(token))
+    }
+    return &ta
+}
+
+func (ta *TokenAuthenticator) Authenticate(credential string, host string) error {
+    valid := 0
+    // every token is compared, in constant time, not to tell how close credential is
+    for _, token := range ta.tokens {
+        valid |= subtle.ConstantTimeCompare(token, []byte(credential))
+    }
+    if valid == 0 {
+        return ErrInvalidCredential
+    }
+    return nil
+}
+
+/*
+RejectedError is returned by the Start method of an agent when the registration
+did not let it join the infrastructure.
+*/
+type RejectedError struct {
+    Reason string
+}
+
+func (re *RejectedError) Error() string {
+    return "goat: registration rejected: " + re.Reason
+}
+
+// registerParams are the parameters of the Register message of an agent
+func registerParams(listeningPort int, credential string) []string {
+    if credential == "" {
+        return []string{"Register", itoa(listeningPort)}
+    }
+    return []string{"Register", itoa(listeningPort), credential}
+}
+
+// authenticate checks the parameters of a Register message with auth, if any
+func authenticate(auth Authenticator, params []string, host string) error {
+    if auth == nil {
+        return nil
+    }
+    credential := ""
+    if len(params) > 1 {
+        credential = params[1]
+    }
+    return auth.Authenticate(credential, host)
+}
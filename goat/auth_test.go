@@ -0,0 +1,125 @@
+package goat
+
+import (
+	"bufio"
+	"errors"
+	"testing"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+    ta := NewTokenAuthenticator("one", "two")
+    for _, cred := range []string{"one", "two"} {
+        if err := ta.Authenticate(cred, "127.0.0.1"); err != nil {
+            t.Errorf("%q was rejected: %v", cred, err)
+        }
+    }
+    for _, cred := range []string{"", "on", "one ", "three"} {
+        if err := ta.Authenticate(cred, "127.0.0.1"); err != ErrInvalidCredential {
+            t.Errorf("%q: got %v", cred, err)
+        }
+    }
+    if err := NewTokenAuthenticator().Authenticate("", "127.0.0.1"); err == nil {
+        t.Errorf("an authenticator without tokens accepted an agent")
+    }
+}
+
+// credentialAgent is an agent that can present a credential
+type credentialAgent interface {
+    Agent
+    SetCredential(credential string)
+}
+
+func TestRegistrationAuthentication(t *testing.T) {
+    InitSend()
+    auth := NewTokenAuthenticator("secret")
+    run := func(name string, agents []credentialAgent, newAgent func() credentialAgent) {
+        t.Run(name, func(t *testing.T) {
+            agents[0].SetCredential("secret")
+            agents[1].SetCredential("secret")
+            comp1, comp2 := NewComponent(agents[0], nil), NewComponent(agents[1], nil)
+            defer comp1.Close()
+            defer comp2.Close()
+            sendAndReceive(t, comp1, comp2)
+            for _, cred := range []string{"wrong", ""} {
+                agent := newAgent()
+                agent.SetCredential(cred)
+                comp, err := NewComponentErr(agent, nil)
+                var rejected *RejectedError
+                if !errors.As(err, &rejected) || rejected.Reason != ErrInvalidCredential.Error() {
+                    t.Errorf("credential %q: got %v", cred, err)
+                }
+                if comp != nil {
+                    comp.Close()
+                }
+            }
+            sendAndReceive(t, comp2, comp1)
+        })
+    }
+
+    ring := testRingInfrastructure{authenticator: auth}
+    ring.initTest(300, 2, 2)
+    run("ring", []credentialAgent{ring.agents[0], ring.agents[1]}, func() credentialAgent {
+        return NewRingAgent("127.0.0.1:17997")
+    })
+    // the connections of the rejected agents are closed too
+    ring.registration.lock.Lock()
+    if n := len(ring.registration.conns); n > 2 + 2 {
+        t.Errorf("the registration keeps %d connections", n)
+    }
+    ring.registration.lock.Unlock()
+    ring.teardownTest()
+
+    tree := testTreeInfrastructure{authenticator: auth}
+    tree.initTest(300, 2, 2, 2)
+    run("tree", []credentialAgent{tree.agents[0], tree.agents[1]}, func() credentialAgent {
+        return NewTreeAgent("127.0.0.1:17997")
+    })
+    tree.teardownTest()
+
+    cluster := testClusterInfrastructure{authenticator: auth}
+    cluster.initTest(300, 2, 2)
+    run("cluster", []credentialAgent{cluster.agents[0], cluster.agents[1]}, func() credentialAgent {
+        return NewClusterAgent("127.0.0.1:17999", "127.0.0.1:17997")
+    })
+    cluster.teardownTest()
+}
+
+// only the connection an agent registered from can make it leave or publish its attributes
+func TestClusterRegistrationChecksSender(t *testing.T) {
+    InitSend()
+    cluster := testClusterInfrastructure{}
+    cluster.initTest(300, 2, 2)
+    comp1, comp2 := NewComponent(cluster.agents[0], nil), NewComponent(cluster.agents[1], nil)
+    listener, port := listenToRandomPort()
+    defer listener.Close()
+    stranger, err := connect("127.0.0.1:17997", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    victim := itoa(cluster.agents[1].componentId)
+    stranger.Send("ATTR", victim, "0", "role", "S|stolen")
+    stranger.Send("Leave", victim)
+    // the registration reads the messages of a connection in order: once the
+    // stranger is registered, the forged messages were handled
+    stranger.Send("Register", itoa(port))
+    conn, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    reader := bufio.NewReader(conn)
+    for {
+        tokens, _, err := readMessage(reader)
+        if err != nil {
+            t.Fatal(err)
+        } else if tokens[0] == "Registered" {
+            stranger.Send("Leave", tokens[1])
+            break
+        }
+    }
+    sendAndReceive(t, comp1, comp2)
+    conn.Close()
+    stranger.Close()
+    comp1.Close()
+    comp2.Close()
+    cluster.teardownTest()
+}
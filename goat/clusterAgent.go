@@ -1,7 +1,11 @@
 package goat
 
 import(
+    "crypto/tls"
+    "errors"
+    "log"
     "net"
+    "strings"
     "time"
     "sync"
     //"fmt"
@@ -13,27 +17,48 @@ type ClusterAgent struct{
     componentId int
     firstMessageId int
     chnGetMid *unboundChanUnit
+    chnGetMids *unboundChanInt
     chnMids *unboundChanInt
     chnMessagesIn *unboundChanMessage
     chnMessagesOut chan Message
+    expired *expiredMessages
+    view *publishedView
     listeningPort int
-    listener net.Listener
+    inbox *connInbox
+    pool *connPool
     maxMid int
     chnReceiveTime *unboundChanMT
     chnSendTime *unboundChanMT
     lockST *sync.Mutex
     receiveTime map[int]int64
     sendTime map[int]int64
+    chnQuit chan struct{}
+    chnStopped chan struct{}
+    chnInStopped chan struct{}
+    tlsConfig *tls.Config
+    credential string
 }
 
 func NewClusterAgent(messageQueueAddress string, registrationAddress string) *ClusterAgent{
+    return NewClusterAgentTLS(nil, messageQueueAddress, registrationAddress)
+}
+
+/*
+NewClusterAgentTLS returns an agent whose connections use TLS with tlsConfig (see
+MutualTLSConfig); with a nil tlsConfig it is the same as NewClusterAgent.
+*/
+func NewClusterAgentTLS(tlsConfig *tls.Config, messageQueueAddress string, registrationAddress string) *ClusterAgent{
     ca := ClusterAgent{
+        tlsConfig: tlsConfig,
         messageQueueAddress: messageQueueAddress, 
         registrationAddress: registrationAddress,
         chnGetMid: newUnboundChanUnit(),
+        chnGetMids: newUnboundChanInt(),
         chnMids: newUnboundChanInt(),
         chnMessagesIn: newUnboundChanMessage(),
         chnMessagesOut: make(chan Message),
+        expired: newExpiredMessages(),
+        view: newPublishedView(),
         maxMid: -1,
         firstMessageId: -1,
         chnReceiveTime: newUnboundChanMT(),
@@ -41,20 +66,56 @@ func NewClusterAgent(messageQueueAddress string, registrationAddress string) *Cl
         lockST: &sync.Mutex{},
         receiveTime: map[int]int64{},
         sendTime: map[int]int64{},
+        chnQuit: make(chan struct{}),
+        chnStopped: make(chan struct{}),
+        chnInStopped: make(chan struct{}),
     }
     return &ca
 }
 
-func (ca *ClusterAgent) Start(){
-    ca.listener, ca.listeningPort = listenToRandomPort()
+/*
+SetCredential sets the credential the agent presents to the registration (see
+Authenticator). It must be called before the agent starts.
+*/
+func (ca *ClusterAgent) SetCredential(credential string) {
+    ca.credential = credential
+}
+
+/*
+Start registers the agent. It returns a *RejectedError if the registration does
+not accept the agent.
+*/
+func (ca *ClusterAgent) Start() error {
+    var listener net.Listener
+    listener, ca.listeningPort = ltp(0, ca.tlsConfig)
+    ca.inbox = newConnInbox(listener)
+    ca.pool = newConnPool(ca.tlsConfig)
     
-    chnRegistered := make(chan struct{}, 1) // TODO remove 1
+    chnRegistered := make(chan error, 1)
     
     //Register
-    sendTo(ca.registrationAddress, "Register", itoa(ca.listeningPort))
     go ca.doIncomingProcess(chnRegistered)
-    <- chnRegistered
+    err := ca.pool.send(ca.registrationAddress, registerParams(ca.listeningPort, ca.credential)...)
+    if err == nil {
+        err = <- chnRegistered
+    }
+    if err != nil {
+        ca.pool.Close()
+        ca.inbox.Close()
+        <- ca.chnInStopped
+        ca.release()
+        return err
+    }
     go ca.doOutcomingProcess()
+    return nil
+}
+
+// release frees the channels of the agent
+func (ca *ClusterAgent) release() {
+    ca.chnGetMid.Close()
+    ca.chnGetMids.Close()
+    ca.chnMids.Close()
+    ca.chnMessagesIn.Close()
 }
 
 func (ca *ClusterAgent) GetComponentId() int{
@@ -65,30 +126,76 @@ func (ca *ClusterAgent) GetFirstMessageId() int{
     return ca.firstMessageId
 }
 
-func (ca *ClusterAgent) doIncomingProcess(chnRegistered chan<- struct{}) {
+func (ca *ClusterAgent) doIncomingProcess(chnRegistered chan<- error) {
+    var to bool
     for {
-        cmd, params := receive(ca.listener)
+        cmd, params, _, err := ca.inbox.receive(0, &to)
+        if errors.Is(err, net.ErrClosed) {
+            ca.view.close()
+            close(ca.chnInStopped)
+            return
+        } else if err != nil {
+            continue
+        }
         switch cmd {
             case "Registered":
-                ca.componentId = atoi(params[0])
-                ca.firstMessageId = atoi(params[1])
-                close(chnRegistered)
+                compId, err1 := paramInt(params, 0)
+                firstMid, err2 := paramInt(params, 1)
+                if chnRegistered == nil || err1 != nil || err2 != nil {
+                    log.Printf("goat: agent %d: unexpected Registered %v", ca.componentId, params)
+                    break
+                }
+                ca.componentId = compId
+                ca.firstMessageId = firstMid
+                chnRegistered <- nil
+                chnRegistered = nil
+            case "Rejected":
+                if chnRegistered == nil {
+                    log.Printf("goat: agent %d: unexpected Rejected %v", ca.componentId, params)
+                    break
+                }
+                chnRegistered <- &RejectedError{strings.Join(params, " ")}
+                chnRegistered = nil
             case "RPLY":
                 //fmt.Println("Got RPLY", params[0])
-                mid := atoi(params[0])
+                mid, err := paramInt(params, 0)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLY: %v", ca.componentId, err)
+                    break
+                }
                 ca.chnMids.In <- mid
                 
-            case "DATA":
-                pred, _ := ToPredicate(params[2])
-                mid := atoi(params[0])
-                if ca.firstMessageId >= 0 && mid >= ca.firstMessageId {
-                    //cid := atoi(params[1])
-                    inMsg := Message {
-                        Id: mid,
-                        //componentId: cid,
-                        Pred: pred,
-                        Message: decodeTuple(params[3]),
+            case "RPLYN":
+                first, n, err := decodeMidRange(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLYN: %v", ca.componentId, err)
+                    break
+                }
+                for mid := first; mid < first + n; mid++ {
+                    ca.chnMids.In <- mid
+                }
+                
+            case "EXPIRED":
+                msg, err := decodeDataMessage(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid EXPIRED: %v", ca.componentId, err)
+                    break
+                }
+                ca.expired.drop(ca.componentId, msg)
+                
+            case "VIEW": // every node has the view from the mid in params
+                ca.view.known(params)
+                
+            case "DATA", "SKIP":
+                inMsg, err := decodeIncomingMessage(cmd, params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid %s: %v", ca.componentId, cmd, err)
+                    if inMsg.Id < 0 {
+                        break
                     }
+                }
+                mid := inMsg.Id
+                if ca.firstMessageId >= 0 && mid >= ca.firstMessageId {
                     rtime := time.Now().UnixNano()
                     ca.lockST.Lock()
                     if mid > ca.maxMid{
@@ -109,7 +216,8 @@ func (ca *ClusterAgent) doOutcomingProcess() {
         select {
             case msgToSend := <- ca.chnMessagesOut:
                 stime := time.Now().UnixNano()
-                sendTo(ca.messageQueueAddress, "add", "DATA", itoa(msgToSend.Id), itoa(ca.componentId), msgToSend.Pred.String(), msgToSend.Message.encode() )
+                // the raw tuple goes as base64 if the connection to the queue uses the text protocol
+                ca.pool.send(ca.messageQueueAddress, "add", "DATA", itoa(msgToSend.Id), itoa(ca.componentId), msgToSend.Pred.String(), msgToSend.Message.encodeFor(true) )
                 ca.lockST.Lock()
                 if msgToSend.Id >= ca.maxMid {
                     ca.maxMid = msgToSend.Id
@@ -117,11 +225,30 @@ func (ca *ClusterAgent) doOutcomingProcess() {
                 ca.lockST.Unlock()
                 ca.chnSendTime.In <- msgTime{msgToSend.Id, stime}
             case <- ca.chnGetMid.Out:
-                sendTo(ca.messageQueueAddress, "add", "REQ", itoa(ca.componentId))
+                ca.pool.send(ca.messageQueueAddress, "add", "REQ", itoa(ca.componentId))
+            case n := <- ca.chnGetMids.Out:
+                ca.pool.send(ca.messageQueueAddress, "add", "REQN", itoa(ca.componentId), itoa(n))
+            case <- ca.chnQuit:
+                close(ca.chnStopped)
+                return
         }
     }
 }
 
+/*
+Close tells the registration that the agent is leaving, so that the nodes stop
+forwarding messages to it, then stops the goroutines of the agent.
+*/
+func (ca *ClusterAgent) Close(){
+    close(ca.chnQuit)
+    <- ca.chnStopped
+    ca.pool.send(ca.registrationAddress, "Leave", itoa(ca.componentId))
+    ca.pool.Close()
+    ca.inbox.Close()
+    <- ca.chnInStopped
+    ca.release()
+}
+
 func (ca *ClusterAgent) GetReceiveTime() map[int]int64{
     ca.chnReceiveTime.Close()
     return toMapIntInt64(&ca.receiveTime, ca.chnReceiveTime)
@@ -139,12 +266,30 @@ func (ca *ClusterAgent) GetMaxMid() int {
     return out 
 }
 
+/*
+PublishAttributes sends the view to the registration, that forwards it to the
+nodes: they will not send the messages the component surely does not accept.
+The registration tells the agent once every node has the view.
+*/
+func (ca *ClusterAgent) PublishAttributes(from int, view map[string]interface{}) <-chan struct{} {
+    tokens, chnKnown := ca.view.publish(from, view)
+    ca.pool.send(ca.registrationAddress, append([]string{"ATTR", itoa(ca.componentId)}, tokens...)...)
+    return chnKnown
+}
+
 func (ca *ClusterAgent) SendMessage(msg Message){
     ca.chnMessagesOut <- msg
 }
 func (ca *ClusterAgent) AskMid(){
     ca.chnGetMid.In <- struct{}{}
 }
+func (ca *ClusterAgent) AskMids(n int){
+    ca.chnGetMids.In <- n
+}
+
+func (ca *ClusterAgent) OnExpired(handler func(Message)) {
+    ca.expired.setHandler(handler)
+}
 func (ca *ClusterAgent) GetRplyChan() *unboundChanInt {
     return ca.chnMids
 }
@@ -1,24 +1,40 @@
 package goat
 
 import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
     "net"
+    "sync"
     "sync/atomic"
-    //"fmt"
+    "time"
 )
 
+// an agent waiting for its component id
+type queuedClusterAgent struct {
+    address netAddress // where the agent listens
+    source netAddress // the connection it registered from
+}
+
 // Contains the set of registered agents, and informs the nodes about their arrival
 type ClusterAgentRegistration struct {
-    listener net.Listener
+    inbox *connInbox
+    pool *connPool
     counterAddress string
     nodesAddresses []string
-    agentAddresses map[netAddress]struct{}
-    queuedAgents []netAddress
+    agentSources map[string]netAddress // the address each registered agent sends from, by component id
+    agentAddresses map[string]netAddress // the address each registered agent listens at, by component id
+    viewsKnown map[string]int // how many nodes have each view published, by "compId from"
+    queuedAgents []queuedClusterAgent
     port string
     compId int
     messagesExchanged int
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
+    authenticator Authenticator
+    sequencer *SequencerClient
 }
 
 func NewClusterAgentRegistration(port int, counterAddress string, nodesAddresses []string) *ClusterAgentRegistration {
@@ -26,12 +42,27 @@ func NewClusterAgentRegistration(port int, counterAddress string, nodesAddresses
 }
 
 func NewClusterAgentRegistrationPerf(perfTest bool, port int, counterAddress string, nodesAddresses []string) *ClusterAgentRegistration{
+    return newClusterAgentRegistration(perfTest, nil, port, counterAddress, nodesAddresses)
+}
+
+/*
+NewClusterAgentRegistrationTLS returns a registration whose connections use TLS
+with tlsConfig (see MutualTLSConfig).
+*/
+func NewClusterAgentRegistrationTLS(tlsConfig *tls.Config, port int, counterAddress string, nodesAddresses []string) *ClusterAgentRegistration{
+    return newClusterAgentRegistration(false, tlsConfig, port, counterAddress, nodesAddresses)
+}
+
+func newClusterAgentRegistration(perfTest bool, tlsConfig *tls.Config, port int, counterAddress string, nodesAddresses []string) *ClusterAgentRegistration{
     return &ClusterAgentRegistration{
-        listener: listenToPort(port),
+        inbox: newConnInbox(listenToPortTLS(port, tlsConfig)),
+        pool: newConnPool(tlsConfig),
         counterAddress: counterAddress,
         nodesAddresses: nodesAddresses,
-        agentAddresses: map[netAddress]struct{}{},
-        queuedAgents: make([]netAddress, 0),
+        agentSources: map[string]netAddress{},
+        agentAddresses: map[string]netAddress{},
+        viewsKnown: map[string]int{},
+        queuedAgents: make([]queuedClusterAgent, 0),
         messagesExchanged: 0,
         port: itoa(port),
         perfTest: perfTest,
@@ -76,68 +107,103 @@ func (car *ClusterAgentRegistration) Work(timeout int64, timedOut chan<- struct{
     hasTimedOut := false
     for {
         if len(car.queuedAgents) == 0 {
-            cmd, params, srcAddr, err := receiveWithAddressTimeoutErr(car.listener, timeout, &hasTimedOut)
+            cmd, params, srcAddr, err := car.inbox.receive(timeout, &hasTimedOut)
             if hasTimedOut {
                 close(timedOut)
                 return
+            } else if errors.Is(err, net.ErrClosed) {
+                return
             }
             if err == nil {
                 switch cmd {
                     case "Register":
                         car.onInfrMsgAgent()
-                        agPort := params[0]
-                        agAddr := netAddress{srcAddr.Host, agPort}
-                        car.queuedAgents = append(car.queuedAgents, agAddr)
+                        car.register(params, srcAddr)
+                    case "Leave":
+                        car.leave(params, srcAddr)
+                    case "ATTR":
+                        car.publish(params, srcAddr)
+                    case "VIEW":
+                        car.viewKnown(params)
                     case "newAgentKnown":
                         panic("no agent is being announced!")
                 }
             }
         } else {
-            agAddr := car.queuedAgents[0]
+            agAddr := car.queuedAgents[0].address
             agCompId := itoa(car.compId)
             car.compId++
             dprintln("Registering component", agCompId)
             for _, ndAddr := range car.nodesAddresses {
                 car.onInfrMsgSent()
-                sendTo(ndAddr, "newAgent", agCompId, agAddr.String())
+                car.pool.send(ndAddr, "newAgent", agCompId, agAddr.String())
             }
             
             for nodesToReply := len(car.nodesAddresses); nodesToReply > 0; {
-                cmd, params, srcAddr, err := receiveWithAddressTimeoutErr(car.listener, timeout, &hasTimedOut)
+                cmd, params, srcAddr, err := car.inbox.receive(timeout, &hasTimedOut)
                 if hasTimedOut {
                     close(timedOut)
                     return
+                } else if errors.Is(err, net.ErrClosed) {
+                    return
                 }
                 if err == nil {
                     switch cmd {
                         case "Register":
                             car.onInfrMsgAgent()
-                            nagPort := params[0]
-                            nagAddr := netAddress{srcAddr.Host, nagPort}
-                            car.queuedAgents = append(car.queuedAgents, nagAddr)
+                            car.register(params, srcAddr)
+                        case "Leave":
+                            car.leave(params, srcAddr)
+                        case "ATTR":
+                            car.publish(params, srcAddr)
+                        case "VIEW":
+                            car.viewKnown(params)
                         case "newAgentKnown":
                             nodesToReply--
                     }
                 }
             }
             
-            car.onInfrMsgSent()
-            sendTo(car.counterAddress, "read", car.port)
             // get current count
             msgCnt := ""
+            if car.sequencer != nil {
+                next, err := car.sequencer.Read()
+                if err != nil {
+                    // the agent can not get its first mid: the nodes forget it, and it is rejected
+                    log.Printf("goat: cluster registration: can not register agent %s: %v", agCompId, err)
+                    for _, ndAddr := range car.nodesAddresses {
+                        car.onInfrMsgSent()
+                        car.pool.send(ndAddr, "Leave", agCompId)
+                    }
+                    car.onInfrMsgSent()
+                    car.pool.sendToAddress(agAddr, "Rejected", err.Error())
+                    car.queuedAgents = car.queuedAgents[1:]
+                    continue
+                }
+                msgCnt = itoa(next)
+            } else {
+                car.onInfrMsgSent()
+                car.pool.send(car.counterAddress, "read", car.port)
+            }
             for msgCnt == "" {
-                cmd, params, srcAddr, err := receiveWithAddressTimeoutErr(car.listener, timeout, &hasTimedOut)
+                cmd, params, srcAddr, err := car.inbox.receive(timeout, &hasTimedOut)
                 if hasTimedOut {
                     close(timedOut)
                     return
+                } else if errors.Is(err, net.ErrClosed) {
+                    return
                 }
                 if err == nil {
                     switch cmd {
                         case "Register":
                             car.onInfrMsgAgent()
-                            nagPort := params[0]
-                            nagAddr := netAddress{srcAddr.Host, nagPort}
-                            car.queuedAgents = append(car.queuedAgents, nagAddr)
+                            car.register(params, srcAddr)
+                        case "Leave":
+                            car.leave(params, srcAddr)
+                        case "ATTR":
+                            car.publish(params, srcAddr)
+                        case "VIEW":
+                            car.viewKnown(params)
                         case "newAgentKnown":
                             panic("no agent is being announced!")
                         case "count":
@@ -146,23 +212,133 @@ func (car *ClusterAgentRegistration) Work(timeout int64, timedOut chan<- struct{
                 }
             }
             
+            car.agentSources[agCompId] = car.queuedAgents[0].source
+            car.agentAddresses[agCompId] = agAddr
             car.onInfrMsgSent()
-            sendToAddress(agAddr, "Registered", agCompId, msgCnt)
+            car.pool.sendToAddress(agAddr, "Registered", agCompId, msgCnt)
             car.queuedAgents = car.queuedAgents[1:]
         }
     }
 }
 
+/*
+SetAuthenticator makes the registration accept only the agents that auth lets in;
+the others receive a Rejected reply. It must be called before Work.
+*/
+func (car *ClusterAgentRegistration) SetAuthenticator(auth Authenticator) {
+    car.authenticator = auth
+}
+
+/*
+SetSequencer makes the registration read the next mid from a replicated sequencer
+through sc, instead of the counter (see SequencerReplica). It must be called
+before Work.
+*/
+func (car *ClusterAgentRegistration) SetSequencer(sc *SequencerClient) {
+    car.sequencer = sc
+}
+
+// queues the agent that sent Register from srcAddr, or rejects it
+func (car *ClusterAgentRegistration) register(params []string, srcAddr netAddress) {
+    if len(params) < 1 {
+        return
+    }
+    agAddr := netAddress{srcAddr.Host, params[0]}
+    if err := authenticate(car.authenticator, params, srcAddr.Host); err != nil {
+        log.Printf("goat: registration: rejected agent from %v: %v", agAddr.String(), err)
+        car.onInfrMsgSent()
+        car.pool.sendToAddress(agAddr, "Rejected", err.Error())
+        car.pool.forget(agAddr.String())
+        return
+    }
+    car.queuedAgents = append(car.queuedAgents, queuedClusterAgent{agAddr, srcAddr})
+}
+
+/*
+fromAgent tells whether a message about the agent in params[0] arrived from srcAddr,
+the connection that agent registered from: another process can not make it leave
+or publish its attributes.
+*/
+func (car *ClusterAgentRegistration) fromAgent(cmd string, params []string, srcAddr netAddress) bool {
+    if len(params) > 0 {
+        if source, has := car.agentSources[params[0]]; has && source == srcAddr {
+            return true
+        }
+    }
+    log.Printf("goat: registration: rejected %s %v from %v", cmd, params, srcAddr.String())
+    return false
+}
+
+// tells every node to stop forwarding messages to the agent that sent Leave
+func (car *ClusterAgentRegistration) leave(params []string, srcAddr netAddress) {
+    if !car.fromAgent("Leave", params, srcAddr) {
+        return
+    }
+    agCompId := params[0]
+    delete(car.agentSources, agCompId)
+    delete(car.agentAddresses, agCompId)
+    car.onInfrMsgAgent()
+    dprintln("Component", agCompId, "is leaving")
+    for _, ndAddr := range car.nodesAddresses {
+        car.onInfrMsgSent()
+        car.pool.send(ndAddr, "Leave", agCompId)
+    }
+}
+
+// forwards the attributes published by an agent to every node
+func (car *ClusterAgentRegistration) publish(params []string, srcAddr netAddress) {
+    if !car.fromAgent("ATTR", params, srcAddr) {
+        return
+    }
+    car.onInfrMsgAgent()
+    for _, ndAddr := range car.nodesAddresses {
+        car.onInfrMsgSent()
+        car.pool.send(ndAddr, append([]string{"ATTR"}, params...)...)
+    }
+}
+
+/*
+viewKnown reads "VIEW compId from" from a node that has the view published by the
+agent: the agent is told once every node has it.
+*/
+func (car *ClusterAgentRegistration) viewKnown(params []string) {
+    if len(params) < 2 {
+        return
+    }
+    key := params[0] + " " + params[1]
+    car.viewsKnown[key]++
+    if car.viewsKnown[key] < len(car.nodesAddresses) {
+        return
+    }
+    delete(car.viewsKnown, key)
+    if agAddr, has := car.agentAddresses[params[0]]; has {
+        car.onInfrMsgSent()
+        car.pool.sendToAddress(agAddr, "VIEW", params[1])
+    }
+}
+
 func (car *ClusterAgentRegistration) Terminate(){
-    car.listener.Close()
+    car.inbox.Close()
+    car.pool.Close()
 }
 
 ///////////
 
+/*
+ClusterMessageQueue holds the messages of the agents until a node takes them. It
+accepts "add" and "get" from any process that reaches its port, without the
+checks of the registration (see Authenticator): a process could add messages or
+take those of the nodes. It must be reachable only by the nodes of the cluster,
+or use TLS with a MutualTLSConfig whose certificates only they hold (see
+NewClusterMessageQueueTLS).
+*/
 type ClusterMessageQueue struct{
-    listener net.Listener
+    inbox *connInbox
+    pool *connPool
+    lock *sync.Mutex
     messages [][]string
     queued []netAddress
+    leases *midLeases
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
@@ -173,10 +349,22 @@ func NewClusterMessageQueue(port int) *ClusterMessageQueue {
 }
 
 func NewClusterMessageQueuePerf(perfTest bool, port int) *ClusterMessageQueue {
+    return newClusterMessageQueue(perfTest, nil, port)
+}
+
+// NewClusterMessageQueueTLS returns a message queue whose connections use TLS with tlsConfig
+func NewClusterMessageQueueTLS(tlsConfig *tls.Config, port int) *ClusterMessageQueue {
+    return newClusterMessageQueue(false, tlsConfig, port)
+}
+
+func newClusterMessageQueue(perfTest bool, tlsConfig *tls.Config, port int) *ClusterMessageQueue {
     return &ClusterMessageQueue{
-        listener: listenToPort(port),
+        inbox: newConnInbox(listenToPortTLS(port, tlsConfig)),
+        pool: newConnPool(tlsConfig),
+        lock: &sync.Mutex{},
         messages: make([][]string, 0),
         queued: make([]netAddress, 0),
+        leases: newMidLeases(),
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
         perfTest: perfTest,
@@ -187,31 +375,95 @@ func (tn *ClusterMessageQueue) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
 
+/*
+SetMidLease sets how long the queue waits for the message of a mid given to an
+agent, once every previous mid is settled, before filling it with an empty
+message; a message that arrives later is dropped (see Component.OnExpired).
+With d <= 0, the default, the queue waits forever. It must be called before Work.
+*/
+func (cmq *ClusterMessageQueue) SetMidLease(d time.Duration) {
+    cmq.leases.duration = d
+}
+
 func (cmq *ClusterMessageQueue) Work(timeout int64, timedOut chan<- struct{}){
+    chnStop := make(chan struct{})
+    defer close(chnStop)
+    go cmq.expireLeases(chnStop)
     hasTimedOut := false
-    var err error = nil
     for{
-        cmd, params, srcAddr := receiveWithAddressTimeout(cmq.listener, timeout, &hasTimedOut)
+        cmd, params, srcAddr, err := cmq.inbox.receive(timeout, &hasTimedOut)
         if hasTimedOut {
             close(timedOut)
             return
+        } else if errors.Is(err, net.ErrClosed) {
+            return
         }
         if err == nil {
+            cmq.lock.Lock()
             switch cmd {
                 case "add":
                     dprintln("New Message:", params)
+                    if len(params) > 1 && params[0] == "DATA" && !cmq.leases.settle(atoi(params[1])) {
+                        // a node tells the sender, that drops it
+                        log.Printf("goat: message queue: message %s arrived after its lease expired", params[1])
+                        params[0] = "EXPIRED"
+                    }
                     cmq.messages = append(cmq.messages, params)
                 case "get":
                     srcPort := params[0]
                     cmq.queued = append(cmq.queued, netAddress{srcAddr.Host, srcPort})
+                case "lease": // lease owner first n, sent by the node that gave the mids
+                    owner, errOwner := paramInt(params, 0)
+                    first, errFirst := paramInt(params, 1)
+                    n, errN := paramInt(params, 2)
+                    if errOwner != nil || errFirst != nil || errN != nil {
+                        log.Printf("goat: message queue: invalid lease %v", params)
+                        break
+                    }
+                    cmq.leases.grant(owner, first, n)
             }
-            if len(cmq.messages) > 0 && len(cmq.queued) > 0 {
-                dprintln("Message to be served:", cmq.messages[0])
-                cmq.onInfrMsgSent()
-                sendToAddress(cmq.queued[0], append([]string{"msg"}, cmq.messages[0]...)...)
-                cmq.messages = cmq.messages[1:]
-                cmq.queued = cmq.queued[1:]
-            }
+            cmq.serve()
+            cmq.lock.Unlock()
+        }
+    }
+}
+
+// serve gives the first message to the first node waiting for one; the caller must hold cmq.lock
+func (cmq *ClusterMessageQueue) serve() {
+    if len(cmq.messages) > 0 && len(cmq.queued) > 0 {
+        dprintln("Message to be served:", cmq.messages[0])
+        cmq.onInfrMsgSent()
+        cmq.pool.sendToAddress(cmq.queued[0], append([]string{"msg"}, cmq.messages[0]...)...)
+        cmq.messages = cmq.messages[1:]
+        cmq.queued = cmq.queued[1:]
+    }
+}
+
+// expireLeases queues the empty messages of the mids whose lease expired, until chnStop is closed
+func (cmq *ClusterMessageQueue) expireLeases(chnStop chan struct{}) {
+    ticker := time.NewTicker(leaseTick)
+    defer ticker.Stop()
+    for {
+        select {
+            case <- chnStop:
+                return
+            case now := <- ticker.C:
+                cmq.lock.Lock()
+                for {
+                    mid := cmq.leases.lowest()
+                    if len(cmq.messages) > 0 {
+                        // the agent may still wait for the messages before its mid
+                        mid = -1
+                    }
+                    owner, expired := cmq.leases.expire(mid, now)
+                    if !expired {
+                        break
+                    }
+                    dprintln("Filling mid", mid, "of agent", owner)
+                    cmq.messages = append(cmq.messages, emptyDataMessage(mid, owner))
+                    cmq.serve()
+                }
+                cmq.lock.Unlock()
         }
     }
 }
@@ -245,7 +497,8 @@ func (tn *ClusterMessageQueue) GetInfrMsgSent() uint64 {
 }
 
 func (cmq *ClusterMessageQueue) Terminate(){
-    cmq.listener.Close()
+    cmq.inbox.Close()
+    cmq.pool.Close()
 }
 
 ///////////
@@ -254,8 +507,11 @@ type ClusterNode struct{
     messageQueueAddress string
     counterAddress string
     registrationAddress string
-    listener net.Listener
+    inbox *connInbox
+    pool *connPool
     agents map[int]string
+    filter *predicateFilter
+    sequencer *SequencerClient
     port string
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
@@ -267,12 +523,23 @@ func NewClusterNode(port int, messageQueueAddress string, counterAddress string,
 }
 
 func NewClusterNodePerf(perfTest bool, port int, messageQueueAddress string, counterAddress string, registrationAddress string) *ClusterNode {
+    return newClusterNode(perfTest, nil, port, messageQueueAddress, counterAddress, registrationAddress)
+}
+
+// NewClusterNodeTLS returns a node whose connections use TLS with tlsConfig
+func NewClusterNodeTLS(tlsConfig *tls.Config, port int, messageQueueAddress string, counterAddress string, registrationAddress string) *ClusterNode {
+    return newClusterNode(false, tlsConfig, port, messageQueueAddress, counterAddress, registrationAddress)
+}
+
+func newClusterNode(perfTest bool, tlsConfig *tls.Config, port int, messageQueueAddress string, counterAddress string, registrationAddress string) *ClusterNode {
     return &ClusterNode{
         messageQueueAddress: messageQueueAddress,
         counterAddress: counterAddress,
         registrationAddress: registrationAddress,
-        listener: listenToPort(port),
+        inbox: newConnInbox(listenToPortTLS(port, tlsConfig)),
+        pool: newConnPool(tlsConfig),
         agents: map[int]string{},
+        filter: newPredicateFilter(),
         port: itoa(port),
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
@@ -280,6 +547,14 @@ func NewClusterNodePerf(perfTest bool, port int, messageQueueAddress string, cou
     }
 }
 
+/*
+SetPolicy makes the node check the rules of policy before delivering a message to
+its agents (see Policy). It must be called before Work.
+*/
+func (cn *ClusterNode) SetPolicy(policy *Policy) {
+    cn.filter.setPolicy(policy)
+}
+
 func (tn *ClusterNode) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
@@ -288,31 +563,65 @@ func (cn *ClusterNode) Work(timeout int64, timedOut chan<- struct{}){
     hasTimedOut := false
     for{
         cn.onInfrMsgSent()
-        sendTo(cn.messageQueueAddress, "get", cn.port)
+        cn.pool.send(cn.messageQueueAddress, "get", cn.port)
         var reqFrom int //contains the agent id that sent the req
+        var reqN int //the mids it asked with REQN, 0 for a REQ
         for deliveredMessage := false; !deliveredMessage; {
-            cmd, params := receiveWithTimeout(cn.listener, timeout, &hasTimedOut)
+            cmd, params, _, err := cn.inbox.receive(timeout, &hasTimedOut)
             if hasTimedOut {
                 close(timedOut)
                 return
+            } else if errors.Is(err, net.ErrClosed) {
+                return
             }
             switch cmd {
                 case "msg": // a new message arrived
                     // "msg" cmd [params]
+                    if err := checkQueuedParams(params); err != nil {
+                        log.Printf("goat: cluster node %s: invalid message from the queue: %v", cn.port, err)
+                        cn.onInfrMsgSent()
+                        cn.pool.send(cn.messageQueueAddress, "get", cn.port)
+                        break
+                    }
                     msgCmd := params[0]
                     msgParams := params[1:]
-                    if msgCmd == "REQ" {
+                    if msgCmd == "REQ" || msgCmd == "REQN" {
                         cn.onInfrMsgAgent()
                         reqFrom = atoi(msgParams[0])
-                        cn.onInfrMsgSent()
-                        sendTo(cn.counterAddress, "inc", cn.port)
+                        reqN = 0
+                        if msgCmd == "REQN" {
+                            // checked by checkQueuedParams
+                            reqN, _ = decodeMidCount(msgParams)
+                        }
+                        if cn.sequencer != nil {
+                            // the node goes on serving the other messages meanwhile
+                            go cn.askSequencer(reqFrom, cn.agents[reqFrom], reqN)
+                            deliveredMessage = true
+                        } else if reqN > 0 {
+                            cn.onInfrMsgSent()
+                            cn.pool.send(cn.counterAddress, "inc", cn.port, itoa(reqN))
+                        } else {
+                            cn.onInfrMsgSent()
+                            cn.pool.send(cn.counterAddress, "inc", cn.port)
+                        }
+                    } else if msgCmd == "EXPIRED" {
+                        if agentAddr, has := cn.agents[atoi(msgParams[1])]; has {
+                            cn.onInfrMsgSent()
+                            cn.pool.send(agentAddr, params...)
+                        }
+                        deliveredMessage = true
                     } else {
                         sender := atoi(msgParams[1])
                         msgParams[1] = "0"
                         for agentId, agentAddr := range cn.agents {
-                            if agentId != sender{
+                            if agentId != sender && cn.filter.excludesData(sender, agentId, msgParams[2], msgParams[3]) {
+                                mid := atoi(msgParams[0])
+                                from := cn.filter.skip(agentId, skippedMessage{mid: mid, sender: sender, params: params})
                                 cn.onInfrMsgSent()
-                                sendTo(agentAddr, params...)
+                                cn.pool.send(agentAddr, skipParams(mid, from)...)
+                            } else if agentId != sender{
+                                cn.onInfrMsgSent()
+                                cn.pool.send(agentAddr, params...)
                             }
                         }
                         deliveredMessage = true
@@ -323,18 +632,106 @@ func (cn *ClusterNode) Work(timeout int64, timedOut chan<- struct{}){
                     agAddr := params[1]
                     cn.agents[atoi(agCompId)] = agAddr
                     cn.onInfrMsgSent()
-                    sendTo(cn.registrationAddress, "newAgentKnown")
+                    cn.pool.send(cn.registrationAddress, "newAgentKnown")
                     
-                case "count": // a message count => a REQ was filed and I must reply with this mid
-                    mid := params[0]
+                case "Leave": // an agent left
+                    cn.pool.forget(cn.agents[atoi(params[0])])
+                    delete(cn.agents, atoi(params[0]))
+                    cn.filter.forget(atoi(params[0]))
+                    
+                case "ATTR": // an agent published some attributes
+                    agCompId, err := paramInt(params, 0)
+                    var from int
+                    var stale []skippedMessage
+                    if err == nil {
+                        from, stale, err = cn.filter.publish(agCompId, params[1:])
+                    }
+                    if err != nil {
+                        log.Printf("goat: cluster node %s: invalid ATTR: %v", cn.port, err)
+                        break
+                    }
+                    // the messages filtered with an older view, then the registration knows the node has the view
+                    if agentAddr, has := cn.agents[agCompId]; has {
+                        cn.filter.resend(agCompId, stale, func(msg []string) {
+                            cn.onInfrMsgSent()
+                            cn.pool.send(agentAddr, msg...)
+                        })
+                    }
                     cn.onInfrMsgSent()
-                    sendTo(cn.agents[reqFrom], "RPLY", mid)
-                    dprintln("RPLY", mid, "to", reqFrom)
+                    cn.pool.send(cn.registrationAddress, "VIEW", params[0], itoa(from))
+                    
+                case "count": // a message count => a REQ was filed and I must reply with this mid
+                    cn.reply(reqFrom, reqN, params[0])
                     deliveredMessage = true
             }    
         }
     }
 }
+// askSequencer asks the mids of a request of the agent reqFrom, at agentAddr, and replies
+func (cn *ClusterNode) askSequencer(reqFrom int, agentAddr string, reqN int) {
+    first, err := cn.sequencer.Next(reqN)
+    if err != nil {
+        log.Printf("goat: cluster node %s: no mid for agent %d: %v", cn.port, reqFrom, err)
+        return
+    }
+    cn.replyTo(reqFrom, agentAddr, reqN, itoa(first))
+}
+
+/*
+reply sends the mid to the agent reqFrom, that asked reqN mids with a REQN or one
+with a REQ (reqN == 0), after telling the message queue who holds them.
+*/
+func (cn *ClusterNode) reply(reqFrom int, reqN int, mid string) {
+    cn.replyTo(reqFrom, cn.agents[reqFrom], reqN, mid)
+}
+
+// replyTo is reply to the agent at agentAddr; it does not read the state of the node
+func (cn *ClusterNode) replyTo(reqFrom int, agentAddr string, reqN int, mid string) {
+    n := reqN
+    if n == 0 {
+        n = 1
+    }
+    cn.onInfrMsgSent()
+    cn.pool.send(cn.messageQueueAddress, "lease", itoa(reqFrom), mid, itoa(n))
+    cn.onInfrMsgSent()
+    if reqN > 0 {
+        cn.pool.send(agentAddr, "RPLYN", mid, itoa(reqN))
+    } else {
+        cn.pool.send(agentAddr, "RPLY", mid)
+    }
+    dprintln("RPLY", mid, "to", reqFrom)
+}
+
+/*
+SetSequencer makes the node ask the mids to a replicated sequencer through sc,
+instead of the counter (see SequencerReplica). It must be called before Work.
+*/
+func (cn *ClusterNode) SetSequencer(sc *SequencerClient) {
+    cn.sequencer = sc
+}
+
+// checks the "cmd [params]" that agents put in the message queue
+func checkQueuedParams(params []string) error {
+    if len(params) == 0 {
+        return fmt.Errorf("goat: empty message")
+    }
+    switch params[0] {
+        case "REQ":
+            _, err := paramInt(params, 1)
+            return err
+        case "REQN":
+            if _, err := paramInt(params, 1); err != nil {
+                return err
+            }
+            _, err := decodeMidCount(params[1:])
+            return err
+        case "DATA", "EXPIRED":
+            return checkDataParams(params[1:])
+        default:
+            return fmt.Errorf("goat: unknown message %q", params[0])
+    }
+}
+
 func (tn *ClusterNode) onInfrMsgAgent() {
     if tn.perfTest {
         atomic.AddUint64(&tn.infrMessagesFromAgents, 1)
@@ -364,5 +761,6 @@ func (tn *ClusterNode) GetInfrMsgSent() uint64 {
 }
 
 func (cn *ClusterNode) Terminate(){
-    cn.listener.Close()
+    cn.inbox.Close()
+    cn.pool.Close()
 }
@@ -1,6 +1,19 @@
 package goat
 
+import (
+    "context"
+    "errors"
+    "sync"
+)
+
+/*
+ErrComponentClosed is returned by the context-aware actions of a process when its
+component is being shut down.
+*/
+var ErrComponentClosed = errors.New("goat: component closed")
+
 type Component struct {
+    lastProcessId int64 // first, to be aligned for atomic
     agent Agent
     midHandler *midHandler
     attributes *Attributes
@@ -8,6 +21,16 @@ type Component struct {
     inProcess *inProcess
     chnSubscribe chan []*Process
     chnUnsubscribe chan *Process
+    
+    lock *sync.Mutex
+    closing bool
+    processes *sync.WaitGroup
+    chnCancel chan struct{}
+    closeOnce *sync.Once
+    chnClosed chan struct{}
+    closeErr error
+    policy *Policy
+    persisters *sync.WaitGroup
 }
 
 /*
@@ -15,6 +38,32 @@ NewComponentWithAttributes defines a new component that interacts with the infra
 access point is the server URI. The environment is initialized according to attrInit.
 */
 func NewComponentWithAttributes(agent Agent, attrInit map[string]interface{}) *Component {
+    c, err := NewComponentErr(agent, attrInit)
+    if err != nil {
+        panic(err)
+    }
+    return c
+}
+
+/*
+NewComponentErr is NewComponentWithAttributes returning the error of the agent
+when it can not join the infrastructure, for instance a *RejectedError.
+*/
+func NewComponentErr(agent Agent, attrInit map[string]interface{}) (*Component, error) {
+    return newComponent(agent, attrInit, nil)
+}
+
+/*
+NewComponentWithSchema is NewComponentErr for a component whose attributes follow
+schema (see AttributeSchema): attrInit must follow it, or the *AttributeError is
+returned, the attributes it does not set get their defaults, and every change is
+checked.
+*/
+func NewComponentWithSchema(agent Agent, attrInit map[string]interface{}, schema *AttributeSchema) (*Component, error) {
+    return newComponent(agent, attrInit, schema)
+}
+
+func newComponent(agent Agent, attrInit map[string]interface{}, schema *AttributeSchema) (*Component, error) {
     chnSubscribe := make(chan []*Process)
     chnUnsubscribe := make(chan *Process)
     attributes := NewAttributes()
@@ -30,20 +79,39 @@ func NewComponentWithAttributes(agent Agent, attrInit map[string]interface{}) *C
         inProcess: inProcess,
         chnSubscribe: chnSubscribe,
         chnUnsubscribe: chnUnsubscribe,
+        lock: &sync.Mutex{},
+        processes: &sync.WaitGroup{},
+        chnCancel: make(chan struct{}),
+        closeOnce: &sync.Once{},
+        chnClosed: make(chan struct{}),
+        persisters: &sync.WaitGroup{},
 	}
-	if attrInit != nil {
+	var err error
+	if schema != nil {
+		err = c.attributes.initWithSchema(attrInit, schema)
+	} else if attrInit != nil {
 		c.attributes.init(attrInit)
 	}
 	//c.ncomm = netCommunicationInitAndRun(server)
 	//c.agent = NewSingleServerAgent(server)
-	c.agent.Start()
+	if err == nil {
+		err = c.agent.Start()
+	}
+	if err != nil {
+		c.midHandler.Close()
+		c.inProcess.Stop()
+		c.messageDispatcher.Stop()
+		c.attributes.onUpdate.Stop()
+		c.attributes.watchers.close()
+		return nil, err
+	}
 	dprintln(c.agent.GetComponentId(),"started")
 	//c.nid = c.ncomm.firstMessageId
 	fMid := c.agent.GetFirstMessageId()
 	inProcess.chnFirstMid <- fMid
 	dprintln(c.agent.GetComponentId(),"'s first mid is",fMid)
 
-	return &c
+	return &c, nil
 }
 
 func NewComponent(agent Agent, attrInit map[string]interface{}) *Component {
@@ -61,6 +129,128 @@ func (c *Component) OnMid(mid int) chan struct{} {
     return chnEvt
 }
 
+/*
+PublishAttributes tells the infrastructure the current value of the attributes
+names (or that they are not set), so that it can send only the mid of the
+messages whose predicate is false for those values, instead of the whole message.
+Every commit that changes one of them publishes them again, as the values from
+the next mid on: the infrastructure sends again in full the messages it filtered
+with the old ones, and c waits for them. A commit that changes them waits until
+the infrastructure has the values committed before. It has effect only if the
+agent of c is an AttributePublisher, and it should be called before the processes
+of c start.
+*/
+func (c *Component) PublishAttributes(names ...string) {
+    if publisher, canPublish := c.agent.(AttributePublisher); canPublish {
+        c.attributes.publishTo(names, func(from int, view map[string]interface{}) <-chan struct{} {
+            c.inProcess.viewFrom(from)
+            return publisher.PublishAttributes(from, view)
+        })
+    }
+}
+
+/*
+OnExpired makes c call handler with every message of its processes that was
+dropped because it arrived after the lease of its mid expired: the others got an
+empty message in its place. The message is not sent again by itself, since with a
+new mid it would come after the ones that c sent later; handler can send it again,
+for instance from a new process, if that order is fine. It has effect only if the
+agent of c is an ExpiryNotifier; handler must not block.
+*/
+func (c *Component) OnExpired(handler func(msg Tuple, pred ClosedPredicate)) {
+    if notifier, canNotify := c.agent.(ExpiryNotifier); canNotify {
+        notifier.OnExpired(func(msg Message) {
+            handler(msg.Message, msg.Pred)
+        })
+    }
+}
+
+/*
+SetMidReservation makes c reserve n mids at a time when a process wants to send,
+if its agent is a MidReserver; the mids are then used by the following sends
+without asking the infrastructure, while those that are not needed are released
+with an empty message. With n <= 1 each send asks its own mid; n is at most
+maxMidReservation.
+*/
+func (c *Component) SetMidReservation(n int) {
+    if n > maxMidReservation {
+        n = maxMidReservation
+    }
+    c.midHandler.SetReservation(n)
+}
+
+/*
+SetPolicy makes c follow the rules of policy when it sends a message (see Policy).
+It should be called before the processes of c start.
+*/
+func (c *Component) SetPolicy(policy *Policy) {
+    c.policy = policy
+}
+
 func (c *Component) GetAgent() Agent {
     return c.agent
 }
+
+// addProcesses accounts for n new processes; it fails if c is shutting down.
+func (c *Component) addProcesses(n int, spawned bool) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.closing && !spawned {
+        return false
+    }
+    c.processes.Add(n)
+    return true
+}
+
+/*
+Shutdown stops the component. It waits for the running processes to end; if ctx
+is done before they do, they are cancelled: any action they are blocked on (or
+will perform) makes them terminate, while the context-aware actions return
+ErrComponentClosed. Then the mids still owed by the component are released, the
+agent leaves the infrastructure and every goroutine of the component is stopped.
+Shutdown returns the error of ctx if the processes had to be cancelled. It must
+not be called by a process of c.
+*/
+func (c *Component) Shutdown(ctx context.Context) error {
+    c.closeOnce.Do(func(){
+        c.lock.Lock()
+        c.closing = true
+        c.lock.Unlock()
+        
+        chnProcsDone := make(chan struct{})
+        go func(){
+            c.processes.Wait()
+            close(chnProcsDone)
+        }()
+        select {
+            case <- chnProcsDone:
+                close(c.chnCancel)
+            case <- ctx.Done():
+                c.closeErr = ctx.Err()
+                close(c.chnCancel)
+                <- chnProcsDone
+        }
+        
+        c.midHandler.Close()
+        c.inProcess.Stop()
+        c.messageDispatcher.Stop()
+        c.agent.Close()
+        c.attributes.onUpdate.Stop()
+        c.attributes.watchers.close()
+        c.persisters.Wait()
+        dprintln(c.agent.GetComponentId(), "closed")
+        close(c.chnClosed)
+    })
+    <- c.chnClosed
+    return c.closeErr
+}
+
+/*
+Close stops the component immediately, cancelling its running processes. See
+Shutdown for details.
+*/
+func (c *Component) Close() {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    c.Shutdown(ctx)
+}
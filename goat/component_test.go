@@ -2,10 +2,13 @@
 package goat
 
 import (
+	"crypto/tls"
 	"testing"
 	"fmt"
 	"math/rand"
 	"encoding/gob"
+	"context"
+	"time"
 )
 
 func initTestCS(timeout int64) (chan struct{}, *CentralServer) {
@@ -30,6 +33,11 @@ type testClusterInfrastructure struct{
     msgQ *ClusterMessageQueue
     counter *ClusterCounter
     terms []chan struct{}
+    tlsConfig *tls.Config
+    authenticator Authenticator
+    sequencerAddresses []string // the replicas of a sequencer to use instead of the counter
+    sequencers []*SequencerClient
+    midLease time.Duration // if not 0
 }
 
 func (tci *testClusterInfrastructure) initTest(timeout int64, clusterSize int, componentNbr int) {
@@ -48,12 +56,25 @@ func (tci *testClusterInfrastructure) initTest(timeout int64, clusterSize int, c
 	tci.terms[1] = make(chan struct{})
 	tci.terms[2] = make(chan struct{})
 	
-	tci.msgQ = NewClusterMessageQueue(17999)
-	tci.counter = NewClusterCounter(17998)
-	tci.registration = NewClusterAgentRegistration(17997, counterAddr, nodesAddr)
+	tci.msgQ = NewClusterMessageQueueTLS(tci.tlsConfig, 17999)
+	if tci.midLease != 0 {
+	    tci.msgQ.SetMidLease(tci.midLease)
+	}
+	tci.counter = NewClusterCounterTLS(tci.tlsConfig, 17998)
+	tci.registration = NewClusterAgentRegistrationTLS(tci.tlsConfig, 17997, counterAddr, nodesAddr)
+	tci.registration.SetAuthenticator(tci.authenticator)
 	tci.nodes = make([]*ClusterNode, clusterSize)
 	for i:=0; i<clusterSize; i++{
-	    tci.nodes[i] = NewClusterNode(18000+i, msgQAddr, counterAddr, registrationAddr)
+	    tci.nodes[i] = NewClusterNodeTLS(tci.tlsConfig, 18000+i, msgQAddr, counterAddr, registrationAddr)
+	}
+	if tci.sequencerAddresses != nil {
+	    tci.sequencers = []*SequencerClient{NewSequencerClientTLS(tci.tlsConfig, tci.sequencerAddresses)}
+	    tci.registration.SetSequencer(tci.sequencers[0])
+	    for _, node := range tci.nodes {
+	        sc := NewSequencerClientTLS(tci.tlsConfig, tci.sequencerAddresses)
+	        tci.sequencers = append(tci.sequencers, sc)
+	        node.SetSequencer(sc)
+	    }
 	}
     
     go tci.counter.Work(timeout, tci.terms[1])
@@ -66,7 +87,7 @@ func (tci *testClusterInfrastructure) initTest(timeout int64, clusterSize int, c
     
     tci.agents = make([]*ClusterAgent, componentNbr)
     for i:=0; i<componentNbr; i++{
-        tci.agents[i] = NewClusterAgent(msgQAddr, registrationAddr)
+        tci.agents[i] = NewClusterAgentTLS(tci.tlsConfig, msgQAddr, registrationAddr)
 	}
 }
 
@@ -74,6 +95,9 @@ func (tci *testClusterInfrastructure) teardownTest(){
     for _, chnTO := range tci.terms{
         <- chnTO
     }
+    for _, sc := range tci.sequencers {
+        sc.Close()
+    }
     tci.counter.Terminate()
     tci.msgQ.Terminate()
     tci.registration.Terminate()
@@ -87,8 +111,11 @@ type testRingInfrastructure struct{
     nodes []*RingNode
     agents []*RingAgent
     registration *RingAgentRegistration
-    counter *ClusterCounter
+    counter *RingCounter
     terms []chan struct{}
+    tlsConfig *tls.Config
+    authenticator Authenticator
+    midLease time.Duration // if not 0
 }
 
 func (tri *testRingInfrastructure) initTest(timeout int64, ringSize int, componentNbr int) {
@@ -105,11 +132,15 @@ func (tri *testRingInfrastructure) initTest(timeout int64, ringSize int, compone
 	tri.terms[0] = make(chan struct{})
 	tri.terms[1] = make(chan struct{})
 	
-	tri.counter = NewClusterCounter(17998)
-	tri.registration = NewRingAgentRegistration(17997, nodesAddr)
+	tri.counter = NewRingCounterTLS(tri.tlsConfig, 17998)
+	tri.registration = NewRingAgentRegistrationTLS(tri.tlsConfig, 17997, nodesAddr)
+	tri.registration.SetAuthenticator(tri.authenticator)
 	tri.nodes = make([]*RingNode, ringSize)
 	for i:=0; i<ringSize; i++{
-	    tri.nodes[i] = NewRingNode(18000+i, counterAddr, nodesAddr[(i+1)%ringSize])
+	    tri.nodes[i] = NewRingNodeTLS(tri.tlsConfig, 18000+i, counterAddr, nodesAddr[(i+1)%ringSize], registrationAddr)
+	    if tri.midLease != 0 {
+	        tri.nodes[i].SetMidLease(tri.midLease)
+	    }
 	}
     
     go tri.counter.Work(timeout, tri.terms[0])
@@ -121,7 +152,7 @@ func (tri *testRingInfrastructure) initTest(timeout int64, ringSize int, compone
     
     tri.agents = make([]*RingAgent, componentNbr)
     for i:=0; i<componentNbr; i++{
-        tri.agents[i] = NewRingAgent(registrationAddr)
+        tri.agents[i] = NewRingAgentTLS(tri.tlsConfig, registrationAddr)
 	}
 }
 
@@ -141,6 +172,9 @@ type testTreeInfrastructure struct{
     agents []*TreeAgent
     registration *TreeAgentRegistration
     terms []chan struct{}
+    tlsConfig *tls.Config
+    authenticator Authenticator
+    midLease time.Duration // if not 0
 }
 
 type treeInfrBuilder struct {
@@ -190,7 +224,8 @@ func (tti *testTreeInfrastructure) initTest(timeout int64, treeDepth int, maxChi
 	}
 	tti.terms[0] = make(chan struct{})
 	
-	tti.registration = NewTreeAgentRegistration(17997, nodesAddr)
+	tti.registration = NewTreeAgentRegistrationTLS(tti.tlsConfig, 17997, nodesAddr)
+	tti.registration.SetAuthenticator(tti.authenticator)
 	tti.nodes = make([]*TreeNode, treeSize)
 
     parents := map[string]string{}
@@ -198,7 +233,10 @@ func (tti *testTreeInfrastructure) initTest(timeout int64, treeDepth int, maxChi
     tree.getParentsChild(&parents, &childs)
     
 	for i:=0; i<treeSize; i++{
-	    tti.nodes[i] = NewTreeNode(18000+i, parents[nodesAddr[i]], childs[nodesAddr[i]])
+	    tti.nodes[i] = NewTreeNodeTLS(tti.tlsConfig, 18000+i, parents[nodesAddr[i]], registrationAddr, childs[nodesAddr[i]])
+	    if tti.midLease != 0 && parents[nodesAddr[i]] == "" {
+	        tti.nodes[i].SetMidLease(tti.midLease)
+	    }
 	}
     
     go tti.registration.Work(timeout, tti.terms[0])
@@ -209,14 +247,13 @@ func (tti *testTreeInfrastructure) initTest(timeout int64, treeDepth int, maxChi
     
     tti.agents = make([]*TreeAgent, componentNbr)
     for i:=0; i<componentNbr; i++{
-        tti.agents[i] = NewTreeAgent(registrationAddr)
+        tti.agents[i] = NewTreeAgentTLS(tti.tlsConfig, registrationAddr)
 	}
 }
 
 func (tti *testTreeInfrastructure) teardownTest(){
     for _, chnTO := range tti.terms{
         <- chnTO
-        fmt.Println("X", len(tti.terms))
     }
     tti.registration.Terminate()
     for _, nd := range tti.nodes{
@@ -224,42 +261,58 @@ func (tti *testTreeInfrastructure) teardownTest(){
     }
 } 
 
-func TestComponentEmpty(t *testing.T) {
-    tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 1)
-	defer tst.teardownTest()
-	comp := NewComponent(tst.agents[0])
-	run := false
+type testLocalInfrastructure struct{
+    infrastructure *LocalInfrastructure
+    agents []*LocalAgent
+}
+
+func (tli *testLocalInfrastructure) initTest(componentNbr int) {
+    tli.infrastructure = NewLocalInfrastructure()
+    tli.agents = make([]*LocalAgent, componentNbr)
+    for i:=0; i<componentNbr; i++{
+        tli.agents[i] = tli.infrastructure.NewLocalAgent()
+    }
+}
+
+// waitAll fails the test if any of chns is not closed within msec milliseconds
+func waitAll(t *testing.T, msec int64, chns ...chan struct{}) {
+    chnTimeout := timeout(msec)
+    for i, chn := range chns {
+        select {
+            case <- chn:
+            case <- chnTimeout:
+                t.Errorf("event %d did not happen within %d msec", i, msec)
+                return
+        }
+    }
+}
+
+func TestEmptyComponent(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(1)
+	comp := NewComponent(tst.agents[0], nil)
+	run := make(chan struct{})
 	NewProcess(comp).Run(func(*Process) {
-		run = true
+		close(run)
 	})
-	defer func() {
-		if !run {
-			t.Fail()
-		}
-	}()
+	waitAll(t, 2000, run)
 }
 
 func TestTwoComponentEmpty(t *testing.T) {
-    tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 2)
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
 	
-	run1 := false
-	comp1 := NewComponent(tst.agents[0])
-	comp2 := NewComponent(tst.agents[1])
+	run1 := make(chan struct{})
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
 	NewProcess(comp1).Run(func(*Process) {
-		run1 = true
+		close(run1)
 	})
-	run2 := false
+	run2 := make(chan struct{})
 	NewProcess(comp2).Run(func(*Process) {
-		run2 = true
+		close(run2)
 	})
-	defer func() {
-		tst.teardownTest()
-		if !run1 || !run2 {
-			t.Fail()
-		}
-	}()
+	waitAll(t, 2000, run1, run2)
 }
 
 type Foo struct {
@@ -271,8 +324,8 @@ type Foo struct {
 };
 
 func TestSendReceiveObject(t *testing.T) {
-	tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 2)
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
 	sendOb := Foo{
 	    Dog : "bark",
 	    Cat : "meoww",
@@ -281,13 +334,13 @@ func TestSendReceiveObject(t *testing.T) {
 	    Monkey: 5,
 	}
 	gob.Register(sendOb) //Needed to exchange non-standard objects
-	sent := false
-	received := false
-	comp1 := NewComponent(tst.agents[0])
-	comp2 := NewComponent(tst.agents[1])
+	sent := make(chan struct{})
+	received := make(chan struct{})
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
 	NewProcess(comp1).Run(func(p *Process) {
 		p.Send(NewTuple(sendOb), True())
-		sent = true
+		close(sent)
 	})
 	NewProcess(comp2).Run(func(p *Process) {
 		p.Receive(func(attr *Attributes, t Tuple) bool {
@@ -299,27 +352,22 @@ func TestSendReceiveObject(t *testing.T) {
 			    recOb.Fish == sendOb.Fish && recOb.Monkey == sendOb.Monkey &&
 			    len(recOb.Rat) == 1 && recOb.Rat[0] == sendOb.Rat[0]  
 		})
-		received = true
+		close(received)
 	})
-	defer func() {
-		tst.teardownTest()
-		if !sent || !received {
-			t.Fail()
-		}
-	}()
+	waitAll(t, 2000, sent, received)
 }
 
 func TestSendReceive(t *testing.T) {
-	tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 2)
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
     
-	sent := false
-	received := false
-	comp1 := NewComponent(tst.agents[0])
-	comp2 := NewComponent(tst.agents[1])
+	sent := make(chan struct{})
+	received := make(chan struct{})
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
 	NewProcess(comp1).Run(func(p *Process) {
 		p.Send(NewTuple("Ciao"), True())
-		sent = true
+		close(sent)
 	})
 	NewProcess(comp2).Run(func(p *Process) {
 		p.Receive(func(attr *Attributes, msg Tuple) bool {
@@ -328,28 +376,23 @@ func TestSendReceive(t *testing.T) {
 		    }
 			return msg.Get(0) == "Ciao"
 		})
-		received = true
+		close(received)
 	})
-	defer func() {
-		tst.teardownTest()
-		if !sent || !received {
-			t.Fail()
-		}
-	}()
+	waitAll(t, 2000, sent, received)
 }
 
 func TestSendTwoReceive(t *testing.T) {
-	tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 3)
-	sent := false
-	received2 := false
-	received3 := false
-	comp1 := NewComponent(tst.agents[0])
-	comp2 := NewComponent(tst.agents[1])
-	comp3 := NewComponent(tst.agents[2])
+    tst := testLocalInfrastructure{}
+    tst.initTest(3)
+	sent := make(chan struct{})
+	received2 := make(chan struct{})
+	received3 := make(chan struct{})
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	comp3 := NewComponent(tst.agents[2], nil)
 	NewProcess(comp1).Run(func(p *Process) {
 		p.Send(NewTuple("Ciao"), True())
-		sent = true
+		close(sent)
 	})
 	NewProcess(comp2).Run(func(p *Process) {
 		p.Receive(func(attr *Attributes, msg Tuple) bool {
@@ -358,7 +401,7 @@ func TestSendTwoReceive(t *testing.T) {
 		    }
 			return msg.Get(0) == "Ciao"
 		})
-		received2 = true
+		close(received2)
 	})
 	NewProcess(comp3).Run(func(p *Process) {
 		p.Receive(func(attr *Attributes, msg Tuple) bool {
@@ -367,29 +410,23 @@ func TestSendTwoReceive(t *testing.T) {
 		    }
 			return msg.Get(0) == "Ciao"
 		})
-		received3 = true
+		close(received3)
 	})
-	defer func() {
-		tst.teardownTest()
-		if !sent || !received2 || !received3 {
-			t.Fail()
-		}
-	}()
+	waitAll(t, 2000, sent, received2, received3)
 }
 
 func TestSendTwoReceiveOneAcceptThenTheOther(t *testing.T) {
-    fmt.Println("---")
-	tst := testTreeInfrastructure{}
-    tst.initTest(2000, 2, 4, 3)
-	sent := false
-	received2 := false
-	received3 := false
-	comp1 := NewComponent(tst.agents[0])
-	comp2 := NewComponent(tst.agents[1])
-	comp3 := NewComponent(tst.agents[2])
+    tst := testLocalInfrastructure{}
+    tst.initTest(3)
+	sent := make(chan struct{})
+	received2 := make(chan struct{})
+	received3 := make(chan struct{})
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	comp3 := NewComponent(tst.agents[2], nil)
 	NewProcess(comp1).Run(func(p *Process) {
 		p.Send(NewTuple("Ciao"), True())
-		sent = true
+		close(sent)
 	})
 	NewProcess(comp2).Run(func(p *Process) {
 		p.Receive(func(attr *Attributes, t Tuple) bool {
@@ -398,7 +435,7 @@ func TestSendTwoReceiveOneAcceptThenTheOther(t *testing.T) {
 		    }
 			return t.Get(0) == "Ciao"
 		})
-		received2 = true
+		close(received2)
 		p.Send(NewTuple("Ciaone"), True())
 	})
 	NewProcess(comp3).Run(func(p *Process) {
@@ -408,16 +445,348 @@ func TestSendTwoReceiveOneAcceptThenTheOther(t *testing.T) {
 		    }
 			return msg.Get(0) == "Ciaone"
 		})
-		if !received2 {
-			t.Error("comp2 must have received before me!")
+		select {
+		    case <- received2:
+		    default:
+			    t.Error("comp2 must have received before me!")
 		}
-		received3 = true
+		close(received3)
 	})
-	defer func() {
-		tst.teardownTest()
-		fmt.Println(sent, received2, received3)
-		if !sent || !received2 || !received3 {
-			t.Fail()
+	waitAll(t, 2000, sent, received2, received3)
+}
+
+func TestLocalAgentsShareTheMidSequence(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+	comp1 := NewComponent(tst.agents[0], map[string]interface{}{"n": 0})
+	comp2 := NewComponent(tst.agents[1], nil)
+	done := make(chan struct{})
+	received := make(chan struct{})
+	NewProcess(comp1).Run(func(p *Process) {
+	    for i := 0; i < 10; i++ {
+		    p.Send(NewTuple(i), True())
 		}
+		close(done)
+	})
+	NewProcess(comp2).Run(func(p *Process) {
+	    for i := 0; i < 10; i++ {
+		    j := i
+		    p.Receive(func(attr *Attributes, msg Tuple) bool {
+			    return msg.IsLong(1) && msg.Get(0) == j
+		    })
+		}
+		close(received)
+	})
+	waitAll(t, 2000, done, received)
+	if tst.agents[0].GetMaxMid() != 9 || tst.agents[1].GetMaxMid() != 9 {
+	    t.Errorf("expected max mid 9, got %d and %d", tst.agents[0].GetMaxMid(), tst.agents[1].GetMaxMid())
+	}
+}
+
+// the sender reserves 4 mids and sends 6 messages: the 2 mids left must be released
+func reservedMidsTest(t *testing.T, sender *Component, receiver *Component) {
+	sender.SetMidReservation(4)
+	received := make(chan struct{})
+	acked := make(chan struct{})
+	NewProcess(receiver).Run(func(p *Process) {
+	    for i := 0; i < 6; i++ {
+		    j := i
+		    p.Receive(func(attr *Attributes, msg Tuple) bool {
+			    return msg.IsLong(1) && msg.Get(0) == j
+		    })
+		}
+		close(received)
+		p.Send(NewTuple("ack"), True())
+	})
+	NewProcess(sender).Run(func(p *Process) {
+	    for i := 0; i < 6; i++ {
+		    p.Send(NewTuple(i), True())
+		}
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return msg.IsLong(1) && msg.Get(0) == "ack"
+		})
+		close(acked)
+	})
+	waitAll(t, 3000, received, acked)
+}
+
+func TestMidReservation(t *testing.T) {
+	run := func(name string, sender Agent, receiver Agent) {
+		comps := []*Component{NewComponent(sender, nil), NewComponent(receiver, nil)}
+		t.Run(name, func(t *testing.T) {
+			reservedMidsTest(t, comps[0], comps[1])
+		})
+		for _, comp := range comps {
+			comp.Close()
+		}
+	}
+	
+	local := testLocalInfrastructure{}
+	local.initTest(2)
+	run("local", local.agents[0], local.agents[1])
+	
+	term, srv := initTestCS(300)
+	run("server", NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"))
+	teardownTestCS(term, srv)
+	
+	ring := testRingInfrastructure{}
+	ring.initTest(300, 2, 2)
+	run("ring", ring.agents[0], ring.agents[1])
+	ring.teardownTest()
+	
+	tree := testTreeInfrastructure{}
+	tree.initTest(300, 2, 2, 2)
+	run("tree", tree.agents[0], tree.agents[1])
+	tree.teardownTest()
+	
+	cluster := testClusterInfrastructure{}
+	cluster.initTest(300, 2, 2)
+	run("cluster", cluster.agents[0], cluster.agents[1])
+	cluster.teardownTest()
+}
+
+func TestReceiveCtxTimeout(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	gaveUp := make(chan struct{})
+	received := make(chan struct{})
+	NewProcess(comp2).Run(func(p *Process) {
+	    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	    defer cancel()
+	    _, err := p.ReceiveCtx(ctx, func(attr *Attributes, msg Tuple) bool {
+	        return true
+	    })
+	    if err != context.DeadlineExceeded {
+	        t.Errorf("expected a deadline error, got %v", err)
+	    }
+	    close(gaveUp)
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return msg.IsLong(1) && msg.Get(0) == "Ciao"
+		})
+		close(received)
+	})
+	NewProcess(comp1).Run(func(p *Process) {
+	    <- gaveUp
+		p.Send(NewTuple("Ciao"), True())
+	})
+	waitAll(t, 2000, gaveUp, received)
+}
+
+func TestSendCtxCancelDoesNotLoseMids(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	received := make(chan struct{})
+	sent := make(chan struct{})
+	NewProcess(comp1).Run(func(p *Process) {
+	    ctx, cancel := context.WithCancel(context.Background())
+	    time.AfterFunc(100 * time.Millisecond, cancel)
+	    err := p.GSendUpdCtx(ctx, False(), NewTuple("Never"), True(), func(*Attributes){})
+	    if err != context.Canceled {
+	        t.Errorf("expected a cancellation error, got %v", err)
+	    }
+		p.Send(NewTuple("Ciao"), True())
+		close(sent)
+	})
+	NewProcess(comp2).Run(func(p *Process) {
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return msg.IsLong(1) && msg.Get(0) == "Ciao"
+		})
+		close(received)
+	})
+	waitAll(t, 2000, sent, received)
+}
+
+func TestSelectCtxTimeout(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(1)
+	comp := NewComponent(tst.agents[0], nil)
+	done := make(chan struct{})
+	NewProcess(comp).Run(func(p *Process) {
+	    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	    defer cancel()
+	    err := p.SelectCtx(ctx,
+	        Case(False(), Send(NewTuple("Never"), True()), func(*Process){
+	            t.Error("a disabled case was entered")
+	        }),
+	        Case(True(), Receive(func(*Attributes, Tuple) bool { return true }), func(*Process){
+	            t.Error("no message was sent")
+	        }),
+	    )
+	    if err != context.DeadlineExceeded {
+	        t.Errorf("expected a deadline error, got %v", err)
+	    }
+	    close(done)
+	})
+	waitAll(t, 2000, done)
+}
+
+func TestCloseCancelsBlockedProcesses(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	NewProcess(comp2).Run(func(p *Process) {
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return false
+		})
+		t.Error("a cancelled process went on")
+	})
+	closed := make(chan struct{})
+	go func(){
+	    comp2.Close()
+	    close(closed)
 	}()
+	waitAll(t, 2000, closed)
+	if len(tst.infrastructure.agents) != 1 {
+	    t.Errorf("the closed component did not leave the infrastructure")
+	}
+	sent := make(chan struct{})
+	NewProcess(comp1).Run(func(p *Process) {
+		p.Send(NewTuple("Ciao"), True())
+		close(sent)
+	})
+	waitAll(t, 2000, sent)
+	comp1.Close()
+}
+
+func TestShutdownWaitsForProcesses(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	received := make(chan struct{})
+	NewProcess(comp2).Run(func(p *Process) {
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return msg.IsLong(1) && msg.Get(0) == "Ciao"
+		})
+		close(received)
+	})
+	NewProcess(comp1).Run(func(p *Process) {
+	    p.Sleep(100)
+		p.Send(NewTuple("Ciao"), True())
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	if err := comp2.Shutdown(ctx); err != nil {
+	    t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	waitAll(t, 2000, received)
+	if err := comp1.Shutdown(ctx); err != nil {
+	    t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(1)
+	comp := NewComponent(tst.agents[0], nil)
+	cancelled := make(chan struct{})
+	NewProcess(comp).Run(func(p *Process) {
+	    _, err := p.ReceiveCtx(context.Background(), func(attr *Attributes, msg Tuple) bool {
+	        return true
+	    })
+	    if err != ErrComponentClosed {
+	        t.Errorf("expected ErrComponentClosed, got %v", err)
+	    }
+	    close(cancelled)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	if err := comp.Shutdown(ctx); err != context.DeadlineExceeded {
+	    t.Errorf("expected a deadline error, got %v", err)
+	}
+	waitAll(t, 2000, cancelled)
+	// a closed component does not start new processes
+	NewProcess(comp).Run(func(p *Process) {
+	    t.Error("a process started on a closed component")
+	})
+}
+
+func TestClusterAgentLeaves(t *testing.T) {
+    tst := testClusterInfrastructure{}
+    tst.initTest(1000, 2, 2)
+	comp1 := NewComponent(tst.agents[0], nil)
+	comp2 := NewComponent(tst.agents[1], nil)
+	comp2.Close()
+	sent := make(chan struct{})
+	NewProcess(comp1).Run(func(p *Process) {
+		p.Send(NewTuple("Ciao"), True())
+		close(sent)
+	})
+	waitAll(t, 2000, sent)
+	comp1.Close()
+	tst.teardownTest()
+}
+
+// sendAndReceive makes the first component send a message that the second one receives
+func sendAndReceive(t *testing.T, sender *Component, receiver *Component) {
+	sendAndReceiveWithin(t, sender, receiver, 2000)
+}
+
+// sendAndReceiveWithin fails the test if the message of sender does not reach receiver within msec milliseconds
+func sendAndReceiveWithin(t *testing.T, sender *Component, receiver *Component, msec int64) {
+	received := make(chan struct{})
+	NewProcess(receiver).Run(func(p *Process) {
+		p.Receive(func(attr *Attributes, msg Tuple) bool {
+			return msg.IsLong(1) && msg.Get(0) == "Ciao"
+		})
+		close(received)
+	})
+	NewProcess(sender).Run(func(p *Process) {
+		p.Send(NewTuple("Ciao"), True())
+	})
+	waitAll(t, msec, received)
+}
+
+func TestRingRestart(t *testing.T) {
+    for i := 0; i < 3; i++ {
+        tst := testRingInfrastructure{}
+        tst.initTest(300, 3, 2)
+        comp1 := NewComponent(tst.agents[0], nil)
+        comp2 := NewComponent(tst.agents[1], nil)
+        sendAndReceive(t, comp1, comp2)
+        comp1.Close()
+        comp2.Close()
+        tst.teardownTest()
+    }
+}
+
+func TestRegistrationForgetsAgents(t *testing.T) {
+    tst := testRingInfrastructure{}
+    tst.initTest(1000, 2, 2)
+    comp1 := NewComponent(tst.agents[0], nil)
+    comp2 := NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    open := func() int {
+        tst.registration.lock.Lock()
+        defer tst.registration.lock.Unlock()
+        return len(tst.registration.conns)
+    }
+    // only the connections of the nodes are left
+    for deadline := time.Now().Add(2 * time.Second); open() > 2 && time.Now().Before(deadline); {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if n := open(); n != 2 {
+        t.Errorf("the registration keeps %d connections", n)
+    }
+    tst.teardownTest()
+}
+
+func TestTreeRestart(t *testing.T) {
+    for i := 0; i < 3; i++ {
+        tst := testTreeInfrastructure{}
+        tst.initTest(300, 2, 2, 2)
+        comp1 := NewComponent(tst.agents[0], nil)
+        comp2 := NewComponent(tst.agents[1], nil)
+        sendAndReceive(t, comp1, comp2)
+        comp1.Close()
+        comp2.Close()
+        tst.teardownTest()
+    }
 }
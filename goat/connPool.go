@@ -0,0 +1,280 @@
+package goat
+
+import (
+    "bufio"
+    "crypto/tls"
+    "errors"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+/*
+connPool keeps a connection open to each address a cluster process sends to, so
+that a message does not cost a new TCP connection. A connection is dialled at the
+first message to its address and dropped when it fails or the other side closes
+it: the next message to that address dials it again.
+*/
+type connPool struct {
+    lock *sync.Mutex
+    conns map[string]*duplexConn
+    closed bool
+    tlsConfig *tls.Config
+}
+
+// with a nil tlsConfig the connections are plain TCP
+func newConnPool(tlsConfig *tls.Config) *connPool {
+    return &connPool{
+        lock: &sync.Mutex{},
+        conns: map[string]*duplexConn{},
+        tlsConfig: tlsConfig,
+    }
+}
+
+// conn returns the connection to address, dialling it if needed
+func (cp *connPool) conn(address string) (*duplexConn, error) {
+    cp.lock.Lock()
+    dc, has := cp.conns[address]
+    closed := cp.closed
+    cp.lock.Unlock()
+    if closed {
+        return nil, net.ErrClosed
+    } else if has {
+        return dc, nil
+    }
+    conn, err := dialTCP(address, cp.tlsConfig)
+    if err != nil {
+        return nil, err
+    }
+    if dc, err = dialedConn(conn); err != nil {
+        return nil, err
+    }
+    cp.lock.Lock()
+    if cp.closed {
+        cp.lock.Unlock()
+        conn.Close()
+        return nil, net.ErrClosed
+    } else if other, has := cp.conns[address]; has {
+        // someone else dialled meanwhile
+        cp.lock.Unlock()
+        conn.Close()
+        return other, nil
+    }
+    cp.conns[address] = dc
+    cp.lock.Unlock()
+    go cp.watch(address, dc)
+    return dc, nil
+}
+
+// watch drops dc from the pool when the other side closes it; nothing is expected on it
+func (cp *connPool) watch(address string, dc *duplexConn) {
+    for {
+        if _, _, err := dc.ReceiveErr(); err != nil {
+            cp.drop(address, dc)
+            return
+        }
+    }
+}
+
+func (cp *connPool) drop(address string, dc *duplexConn) {
+    cp.lock.Lock()
+    if cp.conns[address] == dc {
+        delete(cp.conns, address)
+    }
+    cp.lock.Unlock()
+    dc.Close()
+}
+
+/*
+send sends the tokens to address. If the pooled connection fails, it is dialled
+again and the message is sent once more.
+*/
+func (cp *connPool) send(address string, tokens ...string) error {
+    var err error
+    for attempt := 0; attempt < 2; attempt++ {
+        var dc *duplexConn
+        if dc, err = cp.conn(address); err != nil {
+            return err
+        }
+        if err = dc.Send(tokens...); err == nil {
+            return nil
+        }
+        dprintln("Connection to", address, "failed:", err)
+        cp.drop(address, dc)
+    }
+    return err
+}
+
+func (cp *connPool) sendToAddress(address netAddress, tokens ...string) error {
+    return cp.send(address.String(), tokens...)
+}
+
+// forget closes the connection to address, if any
+func (cp *connPool) forget(address string) {
+    cp.lock.Lock()
+    dc, has := cp.conns[address]
+    cp.lock.Unlock()
+    if has {
+        cp.drop(address, dc)
+    }
+}
+
+func (cp *connPool) Close() {
+    cp.lock.Lock()
+    cp.closed = true
+    conns := cp.conns
+    cp.conns = map[string]*duplexConn{}
+    cp.lock.Unlock()
+    for _, dc := range conns {
+        dc.Close()
+    }
+}
+
+type inboxMessage struct {
+    cmd string
+    params []string
+    srcAddr netAddress
+}
+
+/*
+connInbox accepts the connections of the other processes and queues the messages
+read from all of them, in the order they arrive. It replaces the cluster's
+receive functions that accepted a new connection for each message.
+*/
+type connInbox struct {
+    listener net.Listener
+    lock *sync.Mutex
+    messages []inboxMessage
+    conns map[net.Conn]struct{}
+    closed bool
+    chnArrived chan struct{}
+    chnClosed chan struct{}
+}
+
+func newConnInbox(listener net.Listener) *connInbox {
+    ci := &connInbox{
+        listener: listener,
+        lock: &sync.Mutex{},
+        conns: map[net.Conn]struct{}{},
+        chnArrived: make(chan struct{}, 1),
+        chnClosed: make(chan struct{}),
+    }
+    go ci.accept()
+    return ci
+}
+
+func (ci *connInbox) accept() {
+    var delay time.Duration // before accepting again, after an error
+    for {
+        conn, err := ci.listener.Accept()
+        if err != nil {
+            select {
+                case <- ci.chnClosed:
+                    return
+                default:
+            }
+            if errors.Is(err, net.ErrClosed) {
+                ci.Close()
+                return
+            }
+            delay = acceptDelay(delay)
+            log.Printf("goat: accept error: %v; retrying in %v", err, delay)
+            select {
+                case <- time.After(delay):
+                case <- ci.chnClosed:
+                    return
+            }
+            continue
+        }
+        delay = 0
+        ci.lock.Lock()
+        if ci.closed {
+            ci.lock.Unlock()
+            conn.Close()
+            return
+        }
+        ci.conns[conn] = struct{}{}
+        ci.lock.Unlock()
+        go ci.read(conn)
+    }
+}
+
+func (ci *connInbox) read(conn net.Conn) {
+    srcAddr := newNetAddress(conn.RemoteAddr().String())
+    reader := bufio.NewReader(conn)
+    for {
+        tokens, _, err := readMessage(reader)
+        if err == nil && tokens[0] == "HELLO" {
+            // nothing else is written on conn: the protocol is only read
+            _, err = answerHello(conn, tokens[1:])
+            if err == nil {
+                continue
+            }
+        }
+        if err != nil {
+            ci.lock.Lock()
+            delete(ci.conns, conn)
+            ci.lock.Unlock()
+            conn.Close()
+            return
+        }
+        ci.lock.Lock()
+        ci.messages = append(ci.messages, inboxMessage{tokens[0], tokens[1:], srcAddr})
+        ci.lock.Unlock()
+        signalActivity(ci.chnArrived)
+    }
+}
+
+/*
+receive returns the next message, waiting at most msec milliseconds (forever if
+msec <= 0): on timeout it sets timedOut. It returns net.ErrClosed once the inbox
+is closed.
+*/
+func (ci *connInbox) receive(msec int64, timedOut *bool) (string, []string, netAddress, error) {
+    chnTimeout := timeout(msec)
+    *timedOut = false
+    for {
+        ci.lock.Lock()
+        if ci.closed {
+            ci.lock.Unlock()
+            return "", []string{}, netAddress{}, net.ErrClosed
+        }
+        if len(ci.messages) > 0 {
+            msg := ci.messages[0]
+            ci.messages[0] = inboxMessage{} // free the message, the array stays until the queue is empty
+            ci.messages = ci.messages[1:]
+            if len(ci.messages) == 0 {
+                ci.messages = nil
+            }
+            ci.lock.Unlock()
+            return msg.cmd, msg.params, msg.srcAddr, nil
+        }
+        ci.lock.Unlock()
+        select {
+            case <- ci.chnArrived:
+            case <- chnTimeout:
+                *timedOut = true
+                return "", []string{}, netAddress{}, nil
+            case <- ci.chnClosed:
+        }
+    }
+}
+
+// Close closes the listener and the connections accepted so far
+func (ci *connInbox) Close() {
+    ci.lock.Lock()
+    if ci.closed {
+        ci.lock.Unlock()
+        return
+    }
+    ci.closed = true
+    close(ci.chnClosed)
+    conns := ci.conns
+    ci.conns = map[net.Conn]struct{}{}
+    ci.lock.Unlock()
+    ci.listener.Close()
+    for conn := range conns {
+        conn.Close()
+    }
+}
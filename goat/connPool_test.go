@@ -0,0 +1,141 @@
+package goat
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func receiveAll(t *testing.T, ci *connInbox, n int) {
+    for i := 0; i < n; i++ {
+        var to bool
+        cmd, params, _, err := ci.receive(2000, &to)
+        if err != nil || to {
+            t.Fatalf("message %d: timed out %v, %v", i, to, err)
+        }
+        if cmd != "msg" || len(params) != 1 || params[0] != itoa(i) {
+            t.Fatalf("message %d: got %s %v", i, cmd, params)
+        }
+    }
+}
+
+func TestConnPoolReusesConnections(t *testing.T) {
+    listener, port := listenToRandomPort()
+    inbox := newConnInbox(listener)
+    defer inbox.Close()
+    pool := newConnPool(nil)
+    defer pool.Close()
+    address := "127.0.0.1:" + itoa(port)
+    for i := 0; i < 100; i++ {
+        if err := pool.send(address, "msg", itoa(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    receiveAll(t, inbox, 100)
+    inbox.lock.Lock()
+    accepted := len(inbox.conns)
+    inbox.lock.Unlock()
+    if accepted != 1 {
+        t.Errorf("%d connections were accepted instead of 1", accepted)
+    }
+}
+
+func TestConnPoolReconnects(t *testing.T) {
+    listener, port := listenToRandomPort()
+    inbox := newConnInbox(listener)
+    pool := newConnPool(nil)
+    defer pool.Close()
+    address := "127.0.0.1:" + itoa(port)
+    pool.send(address, "msg", "0")
+    receiveAll(t, inbox, 1)
+    // the other side restarts: the pool drops the connection and dials again
+    inbox.Close()
+    for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+        pool.lock.Lock()
+        pooled := len(pool.conns)
+        pool.lock.Unlock()
+        if pooled == 0 {
+            break
+        } else if time.Now().After(deadline) {
+            t.Fatal("the closed connection is still in the pool")
+        }
+    }
+    inbox = newConnInbox(listenToPort(port))
+    defer inbox.Close()
+    if err := pool.send(address, "msg", "0"); err != nil {
+        t.Fatal(err)
+    }
+    receiveAll(t, inbox, 1)
+}
+
+func TestConnInboxTimeoutAndClose(t *testing.T) {
+    listener, _ := listenToRandomPort()
+    inbox := newConnInbox(listener)
+    var to bool
+    if _, _, _, err := inbox.receive(50, &to); err != nil || !to {
+        t.Errorf("expected a timeout, got %v, %v", to, err)
+    }
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        inbox.Close()
+    }()
+    if _, _, _, err := inbox.receive(0, &to); err == nil {
+        t.Errorf("a closed inbox returned a message")
+    }
+}
+
+// failingListener fails every Accept, like a process out of file descriptors
+type failingListener struct {
+    net.Listener
+    lock sync.Mutex
+    accepts int
+    closed bool
+}
+
+func (fl *failingListener) Accept() (net.Conn, error) {
+    fl.lock.Lock()
+    defer fl.lock.Unlock()
+    fl.accepts++
+    if fl.closed {
+        return nil, net.ErrClosed
+    }
+    return nil, errors.New("too many open files")
+}
+
+func (fl *failingListener) Close() error {
+    fl.lock.Lock()
+    fl.closed = true
+    fl.lock.Unlock()
+    return nil
+}
+
+func TestConnInboxBacksOff(t *testing.T) {
+    fl := &failingListener{}
+    inbox := newConnInbox(fl)
+    time.Sleep(200 * time.Millisecond)
+    inbox.Close()
+    fl.lock.Lock()
+    accepts := fl.accepts
+    fl.lock.Unlock()
+    // 5, 10, 20, 40, 80 msec between the attempts
+    if accepts > 10 {
+        t.Errorf("%d Accept in 200 msec", accepts)
+    }
+}
+
+func TestListenerBacksOff(t *testing.T) {
+    fl := &failingListener{}
+    uc := newUnboundChanConn()
+    uc.listener = fl
+    go acceptDuplexConns(uc, fl)
+    time.Sleep(200 * time.Millisecond)
+    uc.Close()
+    fl.lock.Lock()
+    accepts := fl.accepts
+    fl.lock.Unlock()
+    if accepts > 10 {
+        t.Errorf("%d Accept in 200 msec", accepts)
+    }
+}
@@ -0,0 +1,110 @@
+package goat
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultStateBatch is the number of mids a counter issues between two writes of its state file
+const defaultStateBatch = 1024
+
+var errCounterStateClosed = errors.New("goat: counter state file closed")
+
+/*
+counterState keeps in a file a bound to the mids issued by a counter: no mid
+greater or equal to it has been issued. The bound is written ahead of the mids it
+covers, batch mids at a time, so the file is synced once every batch mids. When
+the counter is terminated the exact next mid is written instead.
+*/
+type counterState struct {
+    path string
+    batch int
+    lock *sync.Mutex
+    next int
+    bound int
+    closed bool
+}
+
+/*
+openCounterState reads the state file path, if any, and returns the state and the
+mid the counter must resume from.
+*/
+func openCounterState(path string, batch int) (*counterState, int, error) {
+    if batch < 1 {
+        batch = defaultStateBatch
+    }
+    cs := &counterState{path: path, batch: batch, lock: &sync.Mutex{}}
+    data, err := os.ReadFile(path)
+    if err == nil {
+        cs.bound, err = strconv.Atoi(strings.TrimSpace(string(data)))
+        if err != nil || cs.bound < 0 {
+            return nil, 0, fmt.Errorf("goat: invalid counter state file %s", path)
+        }
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return nil, 0, err
+    }
+    cs.next = cs.bound
+    return cs, cs.next, nil
+}
+
+func (cs *counterState) write(bound int) error {
+    return writeFileSync(cs.path, []byte(itoa(bound) + "\n"))
+}
+
+/*
+reserve records that the mids up to next (excluded) are being issued; they must
+not be before it returns nil.
+*/
+func (cs *counterState) reserve(next int) error {
+    cs.lock.Lock()
+    defer cs.lock.Unlock()
+    if cs.closed {
+        return errCounterStateClosed
+    }
+    if next > cs.bound {
+        if err := cs.write(next + cs.batch); err != nil {
+            return err
+        }
+        cs.bound = next + cs.batch
+    }
+    if next > cs.next {
+        cs.next = next
+    }
+    return nil
+}
+
+/*
+reserveWait retries reserve until it succeeds, backing off after each error (such
+as a full disk), or until the state is closed.
+*/
+func (cs *counterState) reserveWait(next int, who string) error {
+    delay := 5 * time.Millisecond
+    for {
+        err := cs.reserve(next)
+        if err == nil || err == errCounterStateClosed {
+            return err
+        }
+        log.Printf("goat: %s: %v; retrying in %v", who, err, delay)
+        time.Sleep(delay)
+        if delay *= 2; delay > time.Second {
+            delay = time.Second
+        }
+    }
+}
+
+// close writes the next mid, so that a restarted counter does not skip any mid
+func (cs *counterState) close() error {
+    cs.lock.Lock()
+    defer cs.lock.Unlock()
+    if cs.closed {
+        return nil
+    }
+    cs.closed = true
+    return cs.write(cs.next)
+}
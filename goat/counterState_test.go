@@ -0,0 +1,96 @@
+package goat
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestCounterStateResume(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "counter")
+    cs, next, err := openCounterState(path, 10)
+    if err != nil || next != 0 {
+        t.Fatalf("fresh state resumes from %d (%v)", next, err)
+    }
+    for _, n := range []int{1, 4, 11, 12} {
+        if err := cs.reserve(n); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // a counter that stops abruptly resumes above every mid it issued
+    _, next, err = openCounterState(path, 10)
+    if err != nil || next < 12 {
+        t.Fatalf("state resumes from %d (%v), some mids would be issued again", next, err)
+    }
+    if err := cs.close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := cs.reserve(13); err != errCounterStateClosed {
+        t.Errorf("reserved after close: %v", err)
+    }
+    _, next, err = openCounterState(path, 10)
+    if err != nil || next != 12 {
+        t.Errorf("terminated counter resumes from %d (%v), not 12", next, err)
+    }
+    os.WriteFile(path, []byte("garbage"), 0644)
+    if _, _, err := openCounterState(path, 10); err == nil {
+        t.Error("invalid state file accepted")
+    }
+}
+
+func TestRingCounterRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "counter")
+    inc := func(n string) int {
+        rc := NewRingCounter(18200)
+        if err := rc.UseStateFile(path, 4); err != nil {
+            t.Fatal(err)
+        }
+        go rc.WorkLoop()
+        defer rc.Terminate()
+        conn, err := connect("127.0.0.1:18200", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.Send("inc", n)
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil || cmd != "counter" || len(params) != 1 {
+            t.Fatalf("counter replied %s %v (%v)", cmd, params, err)
+        }
+        return atoi(params[0])
+    }
+    if mid := inc("3"); mid != 0 {
+        t.Errorf("first mid is %d", mid)
+    }
+    if mid := inc("1"); mid != 3 {
+        t.Errorf("restarted counter issued %d, not 3", mid)
+    }
+    if mid := inc("1"); mid != 4 {
+        t.Errorf("restarted counter issued %d, not 4", mid)
+    }
+}
+
+func TestCounterStateReserveWait(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "later")
+    cs, _, err := openCounterState(filepath.Join(dir, "counter"), 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the reservation fails until the directory exists
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        os.Mkdir(dir, 0755)
+    }()
+    if err := cs.reserveWait(1, "test counter"); err != nil {
+        t.Fatalf("reservation failed: %v", err)
+    }
+    os.RemoveAll(dir)
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        cs.close()
+    }()
+    if err := cs.reserveWait(20, "test counter"); err != errCounterStateClosed {
+        t.Errorf("reservation on a closed state: %v", err)
+    }
+}
@@ -0,0 +1,418 @@
+package goat
+
+import (
+    "math"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+/*
+expr is an arithmetic or string expression that can be used as an argument of a
+comparison. Its arguments are values, attributes of the sender (Comp), attributes
+of the receiver (Receiver), Evaluate and other expressions. When the predicate is
+closed, the attributes of the sender are read; if no attribute of the receiver is
+left, the expression is computed at once, otherwise it is sent to the receivers
+that compute it on their attributes.
+*/
+type expr struct {
+    op string
+    args []interface{}
+}
+
+/*
+cexpr is an expression closed under the attributes of the sender: its arguments
+are values, recattr and other cexpr.
+*/
+type cexpr struct {
+    op string
+    args []interface{}
+}
+
+/*
+Plus is the sum of its arguments. Numbers of different types are summed as the
+widest one (int, int64, uint64, float64); a time.Duration can be added to a
+time.Time or to another time.Duration.
+*/
+func Plus(args ...interface{}) expr {
+    return expr{"add", args}
+}
+
+/*
+Minus is a-b. The difference of two time.Time is a time.Duration.
+*/
+func Minus(a interface{}, b interface{}) expr {
+    return expr{"sub", []interface{}{a, b}}
+}
+
+/*
+Times is the product of its arguments; a time.Duration can be multiplied by a
+number.
+*/
+func Times(args ...interface{}) expr {
+    return expr{"mul", args}
+}
+
+/*
+Div is a/b. The division of integers is truncated, and it is undefined if b is 0.
+*/
+func Div(a interface{}, b interface{}) expr {
+    return expr{"div", []interface{}{a, b}}
+}
+
+/*
+Mod is the remainder of a/b.
+*/
+func Mod(a interface{}, b interface{}) expr {
+    return expr{"mod", []interface{}{a, b}}
+}
+
+/*
+Abs is the absolute value of a number or of a time.Duration.
+*/
+func Abs(a interface{}) expr {
+    return expr{"abs", []interface{}{a}}
+}
+
+/*
+Min is the least of its arguments, that must be comparable with each other.
+*/
+func Min(args ...interface{}) expr {
+    return expr{"min", args}
+}
+
+/*
+Max is the greatest of its arguments, that must be comparable with each other.
+*/
+func Max(args ...interface{}) expr {
+    return expr{"max", args}
+}
+
+/*
+Len is the number of characters of a string or of elements of a tuple.
+*/
+func Len(a interface{}) expr {
+    return expr{"len", []interface{}{a}}
+}
+
+/*
+Concat joins its arguments, that must be all strings or all tuples.
+*/
+func Concat(args ...interface{}) expr {
+    return expr{"concat", args}
+}
+
+func (e expr) closeUnder(attr *Attributes) interface{} {
+    args := make([]interface{}, len(e.args))
+    constant := true
+    for i, arg := range e.args {
+        val, isAttr := closure(arg, attr)
+        if isAttr {
+            val = recattr{val.(string)}
+        }
+        switch val.(type) {
+            case recattr, cexpr:
+                constant = false
+        }
+        args[i] = val
+    }
+    ce := cexpr{e.op, args}
+    if constant {
+        if val, ok := ce.eval(nil); ok {
+            return val
+        }
+    }
+    return ce
+}
+
+/*
+eval computes the expression on the attributes of the receiver. The second
+result is false if an attribute is missing or the operation is undefined for the
+values found; a comparison with such an expression is false.
+*/
+func (e cexpr) eval(attr *Attributes) (interface{}, bool) {
+    vals := make([]interface{}, len(e.args))
+    for i, arg := range e.args {
+        switch a := arg.(type) {
+            case recattr:
+                if attr == nil {
+                    return nil, false
+                }
+                val, has := attr.Get(a.name)
+                if !has {
+                    return nil, false
+                }
+                vals[i] = val
+            case cexpr:
+                val, ok := a.eval(attr)
+                if !ok {
+                    return nil, false
+                }
+                vals[i] = val
+            default:
+                vals[i] = a
+        }
+    }
+    if len(vals) == 0 {
+        return nil, false
+    }
+    switch e.op {
+        case "add", "mul", "sub", "div", "mod":
+            if (e.op == "sub" || e.op == "div" || e.op == "mod") && len(vals) != 2 {
+                return nil, false
+            }
+            res := vals[0]
+            for _, val := range vals[1:] {
+                var ok bool
+                if res, ok = arith(e.op, res, val); !ok {
+                    return nil, false
+                }
+            }
+            return res, true
+        case "abs":
+            if len(vals) != 1 {
+                return nil, false
+            }
+            return abs(vals[0])
+        case "min", "max":
+            best, op := vals[0], "<"
+            if e.op == "max" {
+                op = ">"
+            }
+            for _, val := range vals[1:] {
+                better, ok := compareValues(val, op, best)
+                if !ok {
+                    return nil, false
+                }
+                if better {
+                    best = val
+                }
+            }
+            if _, ok := compareValues(best, "==", best); !ok {
+                return nil, false
+            }
+            return best, true
+        case "len":
+            if len(vals) != 1 {
+                return nil, false
+            }
+            switch v := vals[0].(type) {
+                case string:
+                    return utf8.RuneCountInString(v), true
+                case Tuple:
+                    return len(v.Elems), true
+            }
+        case "concat":
+            switch vals[0].(type) {
+                case string:
+                    var sb strings.Builder
+                    for _, val := range vals {
+                        str, isString := val.(string)
+                        if !isString {
+                            return nil, false
+                        }
+                        sb.WriteString(str)
+                    }
+                    return sb.String(), true
+                case Tuple:
+                    elems := []interface{}{}
+                    for _, val := range vals {
+                        tpl, isTuple := val.(Tuple)
+                        if !isTuple {
+                            return nil, false
+                        }
+                        elems = append(elems, tpl.Elems...)
+                    }
+                    return NewTuple(elems...), true
+            }
+    }
+    return nil, false
+}
+
+// numberRank orders the numeric types from the narrowest to the widest; 0 if x is not a number
+func numberRank(x interface{}) int {
+    switch x.(type) {
+        case int:
+            return 1
+        case int64:
+            return 2
+        case uint64:
+            return 3
+        case float64:
+            return 4
+    }
+    return 0
+}
+
+func arith(op string, a interface{}, b interface{}) (interface{}, bool) {
+    switch va := a.(type) {
+        case time.Time:
+            switch vb := b.(type) {
+                case time.Duration:
+                    if op == "add" {
+                        return va.Add(vb), true
+                    } else if op == "sub" {
+                        return va.Add(-vb), true
+                    }
+                case time.Time:
+                    if op == "sub" {
+                        return va.Sub(vb), true
+                    }
+            }
+            return nil, false
+        case time.Duration:
+            switch vb := b.(type) {
+                case time.Duration:
+                    switch op {
+                        case "add":
+                            return va + vb, true
+                        case "sub":
+                            return va - vb, true
+                        case "mod":
+                            if vb != 0 {
+                                return va % vb, true
+                            }
+                    }
+                    return nil, false
+                case time.Time:
+                    if op == "add" {
+                        return vb.Add(va), true
+                    }
+                    return nil, false
+            }
+            if op != "mul" && op != "div" {
+                return nil, false
+            }
+            n, ok := arith(op, int64(va), b)
+            switch vn := n.(type) {
+                case int64:
+                    return time.Duration(vn), ok
+                case float64:
+                    return time.Duration(vn), ok
+            }
+            return nil, false
+    }
+    if vb, isDuration := b.(time.Duration); isDuration && op == "mul" {
+        return arith(op, vb, a)
+    }
+    rankA, rankB := numberRank(a), numberRank(b)
+    if rankA == 0 || rankB == 0 {
+        return nil, false
+    }
+    ia, ua, fa, _ := splitNumber(a)
+    ib, ub, fb, _ := splitNumber(b)
+    rank := rankA
+    if rankB > rank {
+        rank = rankB
+    }
+    switch rank {
+        case 4:
+            switch op {
+                case "add":
+                    return fa + fb, true
+                case "sub":
+                    return fa - fb, true
+                case "mul":
+                    return fa * fb, true
+                case "div":
+                    return fa / fb, true
+                case "mod":
+                    return math.Mod(fa, fb), true
+            }
+        case 3:
+            // the signed operands are converted, unless they are negative
+            if rankA != 3 {
+                if ia < 0 {
+                    return nil, false
+                }
+                ua = uint64(ia)
+            }
+            if rankB != 3 {
+                if ib < 0 {
+                    return nil, false
+                }
+                ub = uint64(ib)
+            }
+            if (op == "div" || op == "mod") && ub == 0 {
+                return nil, false
+            }
+            switch op {
+                case "add":
+                    return ua + ub, true
+                case "sub":
+                    return ua - ub, true
+                case "mul":
+                    return ua * ub, true
+                case "div":
+                    return ua / ub, true
+                case "mod":
+                    return ua % ub, true
+            }
+        default:
+            if (op == "div" || op == "mod") && ib == 0 {
+                return nil, false
+            }
+            var res int64
+            switch op {
+                case "add":
+                    res = ia + ib
+                case "sub":
+                    res = ia - ib
+                case "mul":
+                    res = ia * ib
+                case "div":
+                    res = ia / ib
+                case "mod":
+                    res = ia % ib
+                default:
+                    return nil, false
+            }
+            if rank == 1 {
+                return int(res), true
+            }
+            return res, true
+    }
+    return nil, false
+}
+
+func abs(x interface{}) (interface{}, bool) {
+    switch v := x.(type) {
+        case int:
+            if v < 0 {
+                return -v, true
+            }
+            return v, true
+        case int64:
+            if v < 0 {
+                return -v, true
+            }
+            return v, true
+        case uint64:
+            return v, true
+        case float64:
+            return math.Abs(v), true
+        case time.Duration:
+            return v.Abs(), true
+    }
+    return nil, false
+}
+
+func (e cexpr) String() string {
+    args := make([]string, len(e.args))
+    for i, arg := range e.args {
+        if ra, isAttr := arg.(recattr); isAttr {
+            args[i] = escapeWithType(ra.name, true)
+        } else {
+            args[i] = escapeWithType(arg, false)
+        }
+    }
+    return "E|" + e.op + "(" + strings.Join(args, ",") + ")"
+}
+
+func isExpressionOp(op string) bool {
+    switch op {
+        case "add", "sub", "mul", "div", "mod", "abs", "min", "max", "len", "concat":
+            return true
+    }
+    return false
+}
@@ -0,0 +1,85 @@
+package goat
+
+import (
+    "testing"
+    "time"
+)
+
+func TestExpressionEvaluation(t *testing.T) {
+    InitSend()
+    start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    attr := Attributes{}
+    attr.init(map[string]interface{}{"x": 12, "f": 0.5, "big": uint64(1) << 63, "name": "città", "tags": NewTuple("a", "b"), "start": start, "step": time.Minute})
+    cases := []struct{
+        e expr
+        want interface{}
+    }{
+        {Plus(Receiver("x"), 3, 4), 19},
+        {Plus(Receiver("x"), Receiver("f")), 12.5},
+        {Plus(Receiver("x"), int64(1)), int64(13)},
+        {Minus(Receiver("big"), 1), uint64(1) << 63 - 1},
+        {Times(Receiver("x"), -2), -24},
+        {Div(Receiver("x"), 5), 2},
+        {Div(Receiver("x"), 8.0), 1.5},
+        {Mod(Receiver("x"), 5), 2},
+        {Abs(Minus(3, Receiver("x"))), 9},
+        {Min(Receiver("x"), 3.5, 7), 3.5},
+        {Max("a", Receiver("name"), "b"), "città"},
+        {Len(Receiver("name")), 5},
+        {Len(Receiver("tags")), 2},
+        {Concat(Receiver("name"), "!", ""), "città!"},
+        {Plus(Receiver("start"), Times(Receiver("step"), 90)), start.Add(90 * time.Minute)},
+        {Minus(Receiver("start"), start.Add(-time.Hour)), time.Hour},
+        {Minus(Times(Plus(Receiver("x"), 1), 2), Div(Receiver("x"), 4)), 23},
+    }
+    for _, c := range cases {
+        ce, isExpr := c.e.closeUnder(&attr).(cexpr)
+        if !isExpr {
+            t.Errorf("%v should depend on the receiver", c.e)
+            continue
+        }
+        got, ok := ce.eval(&attr)
+        if eq, _ := compareValues(got, "==", c.want); !ok || !eq {
+            t.Errorf("%s = %v (%T), want %v (%T)", ce, got, got, c.want, c.want)
+        }
+        back, _, _, err := unescapeWithType(ce.String(), 0)
+        if err != nil || back.(cexpr).String() != ce.String() {
+            t.Errorf("%s decoded as %v (%v)", ce, back, err)
+        }
+    }
+    for _, e := range []expr{Div(Receiver("x"), 0), Plus(Receiver("x"), "a"), Len(Receiver("x")), Concat(Receiver("name"), Receiver("tags")),
+        Minus(-1, Receiver("big")), Plus(Receiver("missing"), 1), Min(Receiver("x"), "a")} {
+        if val, ok := e.closeUnder(&attr).(cexpr).eval(&attr); ok {
+            t.Errorf("%v should be undefined, got %v", e, val)
+        }
+    }
+}
+
+func TestExpressionConstantFolding(t *testing.T) {
+    sender := Attributes{}
+    sender.init(map[string]interface{}{"x": 100})
+    if val := Plus(Comp("x"), Times(2, 3)).closeUnder(&sender); val != 106 {
+        t.Errorf("expected 106, got %v", val)
+    }
+    neighbour := And(LessThan(Minus(Receiver("x"), 10), Comp("x")), LessThan(Comp("x"), Plus(Receiver("x"), 10)))
+    closed := neighbour.CloseUnder(&sender)
+    if closed.String() != "&(<(E|sub(A|x,I|10),I|100),<(I|100,E|add(A|x,I|10)))" {
+        t.Errorf("unexpected encoding %s", closed)
+    }
+    wire, err := ToPredicate(closed.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    for x, want := range map[int]bool{89: false, 91: true, 100: true, 109: true, 110: false} {
+        receiver := Attributes{}
+        receiver.init(map[string]interface{}{"x": x})
+        if wire.Satisfy(&receiver) != want {
+            t.Errorf("%s with x = %d should be %v", wire, x, want)
+        }
+    }
+    receiver := Attributes{}
+    receiver.init(map[string]interface{}{"x": "a"})
+    if wire.Satisfy(&receiver) {
+        t.Errorf("an undefined expression should not satisfy the predicate")
+    }
+}
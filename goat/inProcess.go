@@ -1,5 +1,7 @@
 package goat
 
+import "sort"
+
 type inProcess struct {
     chnRply *unboundChanInt
     chnData *unboundChanMessage
@@ -8,9 +10,14 @@ type inProcess struct {
     nid int
     inMessages map[int]Message
     inMids map[int]struct{}
+    served bool
+    // the mids the views published hold from: the last one up to nid, and the next ones
+    views []int
+    chnView chan int
     
     chnFreshMid *unboundChanInt
     chnMessage *unboundChanMessage
+    chnQuit chan struct{}
 }
 
 func newInProcess(chnRply *unboundChanInt, chnData *unboundChanMessage) *inProcess {
@@ -21,8 +28,10 @@ func newInProcess(chnRply *unboundChanInt, chnData *unboundChanMessage) *inProce
         nid: -1,
         inMessages: map[int]Message{},
         inMids: map[int]struct{}{},
+        chnView: make(chan int),
         chnFreshMid: newUnboundChanInt(),
-        chnMessage: newUnboundChanMessage()}
+        chnMessage: newUnboundChanMessage(),
+        chnQuit: make(chan struct{})}
     go func(){ip.goroutine()}()
     return &ip
 }
@@ -34,25 +43,79 @@ func (ip *inProcess) goroutine() {
                 ip.inMids[mid] = struct{}{}
             
             case msg := <- ip.chnData.Out:
-                ip.inMessages[msg.Id] = msg
+                // a message sent again after a new view replaces the empty one, if not served yet
+                if msg.Id > ip.nid || (msg.Id == ip.nid && !ip.served) {
+                    ip.inMessages[msg.Id] = msg
+                }
                 
             case ip.nid = <- ip.chnFirstMid:
             
+            case from := <- ip.chnView:
+                ip.views = append(ip.views, from)
+                sort.Ints(ip.views)
+            
             case <- ip.chnNext:
                 dprintln("N!", ip.nid+1)
                 delete(ip.inMids, ip.nid)
                 delete(ip.inMessages, ip.nid)
                 ip.nid++
+                ip.served = false
+                for len(ip.views) > 1 && ip.views[1] <= ip.nid {
+                    ip.views = ip.views[1:]
+                }
+                
+            case <- ip.chnQuit:
+                ip.chnFreshMid.Close()
+                ip.chnMessage.Close()
+                return
         }
         
-        if msg, has := ip.inMessages[ip.nid]; has {
+        if ip.served {
+            continue
+        }
+        if msg, has := ip.inMessages[ip.nid]; has && !ip.stale(msg) {
                 delete(ip.inMessages, ip.nid)
+            if _, isSkipped := msg.Pred.(skipped); isSkipped {
+                msg.Pred = False()
+            }
+            ip.served = true
             dprintln("Serving <-",ip.nid)
             ip.chnMessage.In <- msg
         } else if _, has = ip.inMids[ip.nid]; has {
                 delete(ip.inMids, ip.nid)
+            ip.served = true
             dprintln("Serving ->",ip.nid)
             ip.chnFreshMid.In <- ip.nid
         }
     }
 }
+
+/*
+stale is true if msg is the empty message of a mid filtered with a view older than
+the one published for the mid: the infrastructure sends the message again.
+*/
+func (ip *inProcess) stale(msg Message) bool {
+    s, isSkipped := msg.Pred.(skipped)
+    if !isSkipped {
+        return false
+    }
+    for _, from := range ip.views {
+        if from > s.from && from <= msg.Id {
+            return true
+        }
+    }
+    return false
+}
+
+// viewFrom tells ip that a view holds from the mid from on; it must be called before ip serves that mid
+func (ip *inProcess) viewFrom(from int) {
+    select {
+        case ip.chnView <- from:
+        case <- ip.chnQuit:
+    }
+}
+
+// Stop terminates the goroutine of ip. Mids and messages still queued are dropped.
+func (ip *inProcess) Stop() {
+    close(ip.chnQuit)
+}
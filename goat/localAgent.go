@@ -0,0 +1,232 @@
+package goat
+
+import (
+    "sync"
+    "time"
+)
+
+/*
+LocalInfrastructure connects components that live in the same Go process. It
+plays the role of the counter, of the registration and of the nodes: it hands out
+totally ordered mids and delivers each message to every other local agent, using
+Go channels instead of network connections.
+*/
+type LocalInfrastructure struct {
+    lock *sync.Mutex
+    nextMid int
+    nextCompId int
+    agents map[int]*LocalAgent
+    filter *predicateFilter
+}
+
+func NewLocalInfrastructure() *LocalInfrastructure {
+    return &LocalInfrastructure{
+        lock: &sync.Mutex{},
+        nextMid: 0,
+        nextCompId: 0,
+        agents: map[int]*LocalAgent{},
+        filter: newPredicateFilter(),
+    }
+}
+
+/*
+SetPolicy makes li check the rules of policy before delivering a message to the
+agents (see Policy).
+*/
+func (li *LocalInfrastructure) SetPolicy(policy *Policy) {
+    li.lock.Lock()
+    li.filter.setPolicy(policy)
+    li.lock.Unlock()
+}
+
+/*
+NewLocalAgent returns a new agent attached to the infrastructure li. The agent
+joins the infrastructure when it is started.
+*/
+func (li *LocalInfrastructure) NewLocalAgent() *LocalAgent {
+    return &LocalAgent{
+        infrastructure: li,
+        componentId: -1,
+        firstMessageId: -1,
+        maxMid: -1,
+        chnMids: newUnboundChanInt(),
+        chnMessagesIn: newUnboundChanMessage(),
+        receiveTime: map[int]int64{},
+        sendTime: map[int]int64{},
+        chnReceiveTime: newUnboundChanMT(),
+        chnSendTime: newUnboundChanMT(),
+        lockST: &sync.Mutex{},
+    }
+}
+
+func (li *LocalInfrastructure) register(la *LocalAgent) {
+    li.lock.Lock()
+    la.componentId = li.nextCompId
+    li.nextCompId++
+    // every mid from now on is assigned after la joined, so la will get it
+    la.firstMessageId = li.nextMid
+    la.maxMid = la.firstMessageId
+    li.agents[la.componentId] = la
+    li.lock.Unlock()
+}
+
+func (li *LocalInfrastructure) leave(la *LocalAgent) {
+    li.lock.Lock()
+    delete(li.agents, la.componentId)
+    li.filter.forget(la.componentId)
+    li.lock.Unlock()
+}
+
+func (li *LocalInfrastructure) askMid(la *LocalAgent) {
+    li.lock.Lock()
+    mid := li.nextMid
+    li.nextMid++
+    li.lock.Unlock()
+    la.chnMids.In <- mid
+}
+
+func (li *LocalInfrastructure) askMids(la *LocalAgent, n int) {
+    li.lock.Lock()
+    first := li.nextMid
+    li.nextMid += n
+    li.lock.Unlock()
+    for mid := first; mid < first + n; mid++ {
+        la.chnMids.In <- mid
+    }
+}
+
+func (li *LocalInfrastructure) dispatch(sender int, msg Message) {
+    li.lock.Lock()
+    rules := li.filter.rulesFor(sender, msg.Message)
+    for agentId, agent := range li.agents {
+        if agentId != sender && msg.Id >= agent.firstMessageId {
+            if li.filter.excludes(agentId, msg.Pred) || li.filter.breaksRules(agentId, rules) {
+                from := li.filter.skip(agentId, skippedMessage{mid: msg.Id, sender: sender, msg: msg})
+                agent.deliver(Message{msg.Id, NewTuple(), skippedPred(from)})
+            } else {
+                agent.deliver(msg)
+            }
+        }
+    }
+    li.lock.Unlock()
+}
+
+/*
+LocalAgent is the Agent of a component attached to a LocalInfrastructure.
+*/
+type LocalAgent struct {
+    infrastructure *LocalInfrastructure
+    componentId int
+    firstMessageId int
+    maxMid int
+    chnMids *unboundChanInt
+    chnMessagesIn *unboundChanMessage
+    receiveTime map[int]int64
+    sendTime map[int]int64
+    chnReceiveTime *unboundChanMT
+    chnSendTime *unboundChanMT
+    lockST *sync.Mutex
+}
+
+func (la *LocalAgent) Start() error {
+    la.infrastructure.register(la)
+    dprintln("Local agent", la.componentId, "starting at mid", la.firstMessageId)
+    return nil
+}
+
+func (la *LocalAgent) Close() {
+    la.infrastructure.leave(la)
+    la.chnMids.Close()
+    la.chnMessagesIn.Close()
+    dprintln("Local agent", la.componentId, "left")
+}
+
+func (la *LocalAgent) deliver(msg Message) {
+    // each receiver gets its own copy of the tuple, as if it was decoded from the network
+    elems := make([]interface{}, len(msg.Message.Elems))
+    copy(elems, msg.Message.Elems)
+    inMsg := Message{
+        Id: msg.Id,
+        Pred: msg.Pred,
+        Message: Tuple{elems},
+    }
+    rtime := time.Now().UnixNano()
+    la.lockST.Lock()
+    if msg.Id > la.maxMid {
+        la.maxMid = msg.Id
+    }
+    la.lockST.Unlock()
+    la.chnReceiveTime.In <- msgTime{msg.Id, rtime}
+    la.chnMessagesIn.In <- inMsg
+}
+
+func (la *LocalAgent) SendMessage(msg Message) {
+    stime := time.Now().UnixNano()
+    la.infrastructure.dispatch(la.componentId, msg)
+    la.lockST.Lock()
+    if msg.Id > la.maxMid {
+        la.maxMid = msg.Id
+    }
+    la.lockST.Unlock()
+    la.chnSendTime.In <- msgTime{msg.Id, stime}
+}
+
+/*
+PublishAttributes tells the infrastructure the value of some attributes: it will
+not deliver the messages the component surely does not accept, but only their mid.
+The infrastructure has the view at once.
+*/
+func (la *LocalAgent) PublishAttributes(from int, view map[string]interface{}) <-chan struct{} {
+    li := la.infrastructure
+    li.lock.Lock()
+    for _, sm := range li.filter.setView(la.componentId, newAttributeView(from, view)) {
+        if li.filter.stillExcludes(la.componentId, sm) {
+            la.deliver(Message{sm.mid, NewTuple(), skippedPred(li.filter.skip(la.componentId, sm))})
+        } else {
+            la.deliver(sm.msg)
+        }
+    }
+    li.lock.Unlock()
+    return knownView()
+}
+
+func (la *LocalAgent) AskMid() {
+    la.infrastructure.askMid(la)
+}
+
+func (la *LocalAgent) AskMids(n int) {
+    la.infrastructure.askMids(la, n)
+}
+
+func (la *LocalAgent) GetRplyChan() *unboundChanInt {
+    return la.chnMids
+}
+
+func (la *LocalAgent) GetDataChan() *unboundChanMessage {
+    return la.chnMessagesIn
+}
+
+func (la *LocalAgent) GetComponentId() int {
+    return la.componentId
+}
+
+func (la *LocalAgent) GetFirstMessageId() int {
+    return la.firstMessageId
+}
+
+func (la *LocalAgent) GetReceiveTime() map[int]int64 {
+    la.chnReceiveTime.Close()
+    return toMapIntInt64(&la.receiveTime, la.chnReceiveTime)
+}
+
+func (la *LocalAgent) GetSendTime() map[int]int64 {
+    la.chnSendTime.Close()
+    return toMapIntInt64(&la.sendTime, la.chnSendTime)
+}
+
+func (la *LocalAgent) GetMaxMid() int {
+    la.lockST.Lock()
+    out := la.maxMid
+    la.lockST.Unlock()
+    return out
+}
@@ -11,6 +11,7 @@ type messageDispatcher struct {
     attributes *Attributes
     evtMid int
     chnEvtMid chan struct{}
+    chnQuit chan struct{}
 }
 
 func newMessageDispatcher(chnMessageIn *unboundChanMessage, chnSubscribe chan []*Process, chnUnsubscribe chan *Process, chnNext chan struct{}, attributes *Attributes)  *messageDispatcher {
@@ -20,7 +21,8 @@ func newMessageDispatcher(chnMessageIn *unboundChanMessage, chnSubscribe chan []
         chnNext: chnNext,
         chnAcceptMessage: make(chan bool),
         attributes: attributes,
-        evtMid: -1}
+        evtMid: -1,
+        chnQuit: make(chan struct{})}
     go func(){md.goroutine()}()
     return &md
 }
@@ -107,6 +109,8 @@ func (md *messageDispatcher) goroutine() {
                         }
                     case pr := <- md.chnUnsubscribe:
                         delete(subscribedProcs, pr)
+                    case <- md.chnQuit:
+                        return
                     }
                 }
                         
@@ -116,6 +120,16 @@ func (md *messageDispatcher) goroutine() {
                 }
             case pr := <- md.chnUnsubscribe:
                 delete(subscribedProcs, pr) 
+            case <- md.chnQuit:
+                return
         }
     }
 }
+
+/*
+Stop terminates the goroutine of md. It must be called only when no process is
+subscribed anymore.
+*/
+func (md *messageDispatcher) Stop() {
+    close(md.chnQuit)
+}
@@ -1,5 +1,10 @@
 package goat
 
+import (
+    "fmt"
+    "strconv"
+)
+
 type messagePredicate struct {
 	message   string
 	predicate ClosedPredicate
@@ -12,7 +17,18 @@ type Message struct {
     Pred ClosedPredicate
 }
 
+/*
+makeMessage prepares the message with the mid it takes. The predicate is
+simplified first; if no component can satisfy it, the message is sent empty, as
+the mid must reach everyone anyway but the payload is useless.
+*/
 func makeMessage(messageToSend messagePredicate, mid int) Message{
+    if !messageToSend.invalid {
+        messageToSend.predicate = Simplify(messageToSend.predicate)
+        if _, isFalse := messageToSend.predicate.(_false); isFalse {
+            messageToSend.invalid = true
+        }
+    }
     if messageToSend.invalid {
 		return Message{
 			Message:   NewTuple(),
@@ -20,10 +36,131 @@ func makeMessage(messageToSend messagePredicate, mid int) Message{
 			Id:        mid,
 		}
 	} else {
+		msg, err := decodeTuple(messageToSend.message)
+		if err != nil {
+			panic(err)
+		}
 		return Message{
-			Message:   decodeTuple(messageToSend.message),
+			Message:   msg,
 			Pred: messageToSend.predicate,
 			Id:        mid,
 		}
 	}
 }
+
+// paramInt reads params[i] as an integer
+func paramInt(params []string, i int) (int, error) {
+    if i >= len(params) {
+        return 0, fmt.Errorf("goat: missing parameter %d", i)
+    }
+    n, err := strconv.Atoi(params[i])
+    if err != nil {
+        return 0, fmt.Errorf("goat: parameter %d: %q is not an integer", i, params[i])
+    }
+    return n, nil
+}
+
+/*
+decodeDataMessage reads the parameters of "DATA mid sender predicate tuple". If
+the mid is valid but the rest of the message is not, it returns the error with
+an empty message that no component satisfies, which still takes the mid: the
+receivers would wait for it forever otherwise. If the mid is invalid too, the Id
+of the message returned is -1.
+*/
+func decodeDataMessage(params []string) (Message, error) {
+    mid, err := paramInt(params, 0)
+    if err != nil {
+        return Message{Id: -1}, err
+    }
+    if len(params) < 4 {
+        return Message{mid, NewTuple(), False()}, fmt.Errorf("message %d has %d parameters instead of 4", mid, len(params))
+    }
+    pred, err := ToPredicate(params[2])
+    if err != nil {
+        return Message{mid, NewTuple(), False()}, fmt.Errorf("message %d: %w", mid, err)
+    }
+    tuple, err := decodeTuple(params[3])
+    if err != nil {
+        return Message{mid, NewTuple(), False()}, fmt.Errorf("message %d: %w", mid, err)
+    }
+    return Message{mid, tuple, pred}, nil
+}
+
+/*
+decodeIncomingMessage reads a DATA message, or a "SKIP mid [from]" sent by a node
+that knows the component would not accept the message, with the view published
+for the mid from if any: it becomes the empty message that takes the mid.
+*/
+func decodeIncomingMessage(cmd string, params []string) (Message, error) {
+    if cmd == "SKIP" {
+        mid, err := paramInt(params, 0)
+        if err != nil {
+            return Message{Id: -1}, err
+        }
+        if len(params) < 2 {
+            return Message{mid, NewTuple(), False()}, nil
+        }
+        from, err := paramInt(params, 1)
+        if err != nil {
+            // taken as filtered with the oldest view
+            return Message{mid, NewTuple(), skipped{-1}}, err
+        }
+        return Message{mid, NewTuple(), skippedPred(from)}, nil
+    }
+    return decodeDataMessage(params)
+}
+
+/*
+checkDataParams checks the parameters of a DATA message that a node has to
+forward: the node does not read the predicate and the tuple, but it needs the
+mid and the sender.
+*/
+func checkDataParams(params []string) error {
+    if len(params) != 4 {
+        return fmt.Errorf("goat: DATA has %d parameters instead of 4", len(params))
+    }
+    if _, err := paramInt(params, 0); err != nil {
+        return err
+    }
+    _, err := paramInt(params, 1)
+    return err
+}
+
+/*
+decodeMidRange reads the parameters of "RPLYN first n", the reply to "REQN compId n":
+the mids from first to first+n-1 are all reserved for the agent.
+*/
+func decodeMidRange(params []string) (int, int, error) {
+    first, err := paramInt(params, 0)
+    if err != nil {
+        return 0, 0, err
+    }
+    n, err := paramInt(params, 1)
+    if err != nil {
+        return 0, 0, err
+    }
+    if first < 0 || checkMidCount(n) != nil {
+        return 0, 0, fmt.Errorf("goat: invalid mid range %d+%d", first, n)
+    }
+    return first, n, nil
+}
+
+// maxMidReservation is the most mids that a single request can reserve
+const maxMidReservation = 1 << 16
+
+// checkMidCount fails if n mids can not be asked at once
+func checkMidCount(n int) error {
+    if n < 1 || n > maxMidReservation {
+        return fmt.Errorf("goat: asked %d mids", n)
+    }
+    return nil
+}
+
+// reads the number of mids asked by "REQN compId n"
+func decodeMidCount(params []string) (int, error) {
+    n, err := paramInt(params, 1)
+    if err == nil {
+        err = checkMidCount(n)
+    }
+    return n, err
+}
@@ -15,6 +15,8 @@ type midHandler struct {
     chnNext chan struct{}
     evtMid int
     chnEvtMid chan struct{}
+    chnClose chan chan struct{}
+    chnReservation chan int
 }
 
 type askMidPol int
@@ -36,7 +38,9 @@ func NewMidHandler(chnFreshMid *unboundChanInt, agent Agent, attributes *Attribu
         agent: agent,
         attributes: attributes,
         chnNext: chnNext,
-        evtMid: -1}
+        evtMid: -1,
+        chnClose: make(chan chan struct{}),
+        chnReservation: make(chan int)}
     go func(){mh.start()}()
     return &mh
 }
@@ -59,20 +63,61 @@ func (mh *midHandler) RetryLater(incomingMids chan struct{}) {
     mh.chnRetry <- struct{}{}
 }
 
+// SetReservation makes mh ask n mids at a time, if the agent is a MidReserver.
+func (mh *midHandler) SetReservation(n int) {
+    mh.chnReservation <- n
+}
+
+/*
+Close stops mh once every mid it asked for has been received and released (as an
+empty message, since no process can send anymore). Close must be called only when
+no process is sending, and blocks until mh has stopped.
+*/
+func (mh *midHandler) Close() {
+    chnClosed := make(chan struct{})
+    mh.chnClose <- chnClosed
+    <- chnClosed
+}
+
 func (mh *midHandler) start() {
     sendingChans := map[chan struct{}]struct{}{}
     mh.chnTimeToAskMid = make(chan struct{})
     mh.askMidPolicy = ampNone
+    pendingMids := 0
+    reservation := 1
+    var chnClosed chan struct{}
     for{
+        if chnClosed != nil && pendingMids == 0 && len(sendingChans) == 0 {
+            close(chnClosed)
+            return
+        }
         select {
             case <- mh.chnTimeToAskMid:
                 dprintln("askmid")
                 mh.chnTimeToAskMid = make(chan struct{})
                 mh.askMidPolicy = ampNone
-                mh.agent.AskMid()
+                if chnClosed == nil || len(sendingChans) > 0 {
+                    reserver, canReserve := mh.agent.(MidReserver)
+                    if canReserve && reservation > 1 {
+                        // the mids still to come will serve the processes
+                        if pendingMids == 0 {
+                            pendingMids += reservation
+                            reserver.AskMids(reservation)
+                        }
+                    } else {
+                        pendingMids++
+                        mh.agent.AskMid()
+                    }
+                }
+                
+            case reservation = <- mh.chnReservation:
+                
+            case chnClosed = <- mh.chnClose:
                 
             case mid := <- mh.chnFreshMid.Out:
+                pendingMids--
                 //fmt.Println("Prepare a send", mid)
+                mh.attributes.mid = mid
                 stoppedChans := map[chan struct{}]struct{}{}
                 toBeAddedChans := map[chan struct{}]struct{}{}
                 midConsumed := false
@@ -0,0 +1,169 @@
+package goat
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+const (
+    // leaseTick is how often the infrastructure looks for expired leases
+    leaseTick = 100 * time.Millisecond
+)
+
+/*
+midLeases tracks the mids given to the agents whose message has not arrived yet.
+The lease of a mid starts when it is the next one the infrastructure waits for,
+and lasts duration (forever if duration <= 0, the default): when it expires, or
+as soon as the agent holding the mid is known to be gone, the mid is filled with
+an empty message, so the other components do not wait for it forever. A message
+that arrives later for a filled mid must be dropped, and the agent told with
+"EXPIRED mid sender pred tuple" (the parameters of the DATA), so that it tells its
+component (see expiredMessages).
+*/
+type midLeases struct {
+    duration time.Duration
+    owners map[int]int // the agent holding each mid
+    revoked map[int]struct{} // mids of the agents that are gone
+    filled map[int]struct{}
+    early map[int]struct{} // mids whose message arrived before their lease
+    waiting int
+    since time.Time
+}
+
+func newMidLeases() *midLeases {
+    return &midLeases{
+        owners: map[int]int{},
+        revoked: map[int]struct{}{},
+        filled: map[int]struct{}{},
+        early: map[int]struct{}{},
+        waiting: -1,
+    }
+}
+
+// grant records that the mids from first to first+n-1 are held by owner
+func (ml *midLeases) grant(owner int, first int, n int) {
+    for mid := first; mid < first + n; mid++ {
+        if _, has := ml.early[mid]; has {
+            delete(ml.early, mid)
+        } else {
+            ml.owners[mid] = owner
+        }
+    }
+}
+
+// settle records that the message of mid arrived; it fails if mid was filled meanwhile
+func (ml *midLeases) settle(mid int) bool {
+    if ml.dropFilled(mid) {
+        return false
+    }
+    if _, has := ml.owners[mid]; has {
+        delete(ml.owners, mid)
+        delete(ml.revoked, mid)
+    } else {
+        ml.early[mid] = struct{}{}
+    }
+    return true
+}
+
+// dropFilled tells whether mid was filled, and forgets it: its message arrived late, or again
+func (ml *midLeases) dropFilled(mid int) bool {
+    _, has := ml.filled[mid]
+    delete(ml.filled, mid)
+    return has
+}
+
+// revoke ends the leases of owner, that will send no message
+func (ml *midLeases) revoke(owner int) {
+    for mid, o := range ml.owners {
+        if o == owner {
+            ml.revoked[mid] = struct{}{}
+        }
+    }
+}
+
+// holds tells whether mid is held by an agent
+func (ml *midLeases) holds(mid int) bool {
+    _, held := ml.owners[mid]
+    return held
+}
+
+// lowest returns the smallest mid still held, or -1
+func (ml *midLeases) lowest() int {
+    lowest := -1
+    for mid := range ml.owners {
+        if lowest < 0 || mid < lowest {
+            lowest = mid
+        }
+    }
+    return lowest
+}
+
+/*
+expire tells whether next, the mid the infrastructure waits for, must be filled
+now, and by which agent it was held. The mid is then considered filled.
+*/
+func (ml *midLeases) expire(next int, now time.Time) (int, bool) {
+    owner, held := ml.owners[next]
+    if !held {
+        ml.waiting = -1
+        return 0, false
+    }
+    if next != ml.waiting {
+        ml.waiting = next
+        ml.since = now
+    }
+    _, isRevoked := ml.revoked[next]
+    if !isRevoked && (ml.duration <= 0 || now.Sub(ml.since) < ml.duration) {
+        return 0, false
+    }
+    delete(ml.owners, next)
+    delete(ml.revoked, next)
+    ml.filled[next] = struct{}{}
+    ml.waiting = -1
+    return owner, true
+}
+
+// isEmptyData tells whether the DATA params fill a mid, as those of emptyDataMessage
+func isEmptyData(params []string) bool {
+    tuple := NewTuple()
+    return len(params) == 4 && params[2] == False().String() && params[3] == tuple.encode()
+}
+
+// emptyDataMessage is the DATA that fills mid, as if sent by sender
+func emptyDataMessage(mid int, sender int) []string {
+    tuple := NewTuple()
+    return []string{"DATA", itoa(mid), itoa(sender), False().String(), tuple.encode()}
+}
+
+/*
+expiredMessages gets the messages of an agent that arrived after the lease of
+their mid expired, and were dropped. They are not sent again with a new mid, that
+would put them after the messages that the component sent later, but given to the
+handler of the component, if any (see ExpiryNotifier).
+*/
+type expiredMessages struct {
+    lock *sync.Mutex
+    handler func(Message)
+}
+
+func newExpiredMessages() *expiredMessages {
+    return &expiredMessages{lock: &sync.Mutex{}}
+}
+
+func (em *expiredMessages) setHandler(handler func(Message)) {
+    em.lock.Lock()
+    em.handler = handler
+    em.lock.Unlock()
+}
+
+// drop tells the handler that msg, sent by the agent componentId, was dropped
+func (em *expiredMessages) drop(componentId int, msg Message) {
+    log.Printf("goat: agent %d: message %d arrived after its lease expired and was dropped", componentId, msg.Id)
+    em.lock.Lock()
+    handler := em.handler
+    em.lock.Unlock()
+    if handler != nil {
+        handler(msg)
+    }
+}
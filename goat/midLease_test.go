@@ -0,0 +1,184 @@
+package goat
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMidLeases(t *testing.T) {
+    ml := newMidLeases()
+    ml.duration = time.Second
+    start := time.Now()
+    ml.grant(1, 0, 2)
+    ml.grant(2, 2, 1)
+    if ml.settle(3); ml.lowest() != 0 {
+        t.Errorf("lowest mid held is %d, not 0", ml.lowest())
+    }
+    ml.grant(2, 3, 1) // its message arrived first
+    if !ml.settle(0) {
+        t.Error("mid 0 was filled")
+    }
+    // the lease of 1 starts when it is the next mid
+    if _, expired := ml.expire(1, start); expired {
+        t.Error("mid 1 expired at once")
+    }
+    if _, expired := ml.expire(1, start.Add(time.Second / 2)); expired {
+        t.Error("mid 1 expired before its lease")
+    }
+    if owner, expired := ml.expire(1, start.Add(time.Second)); !expired || owner != 1 {
+        t.Errorf("mid 1 did not expire (%v, %d)", expired, owner)
+    }
+    if ml.settle(1) {
+        t.Error("the message of the filled mid 1 was accepted")
+    }
+    // the mids of a gone agent are filled as soon as they are next
+    ml.revoke(2)
+    if owner, expired := ml.expire(2, start.Add(time.Second)); !expired || owner != 2 {
+        t.Errorf("revoked mid 2 did not expire (%v, %d)", expired, owner)
+    }
+    if lowest := ml.lowest(); lowest != -1 {
+        t.Errorf("mid %d is still held", lowest)
+    }
+}
+
+// holdMid makes agent join and take a mid, then sends nothing, like a crashed agent
+func holdMid(t *testing.T, agent Agent) {
+    if err := agent.Start(); err != nil {
+        t.Fatal(err)
+    }
+    agent.AskMid()
+    select {
+        case <- agent.GetRplyChan().Out:
+        case <- time.After(2 * time.Second):
+            t.Fatal("no mid for the crashed agent")
+    }
+}
+
+func TestMidLeaseFill(t *testing.T) {
+    lease := 300 * time.Millisecond
+    run := func(name string, crashed Agent, agent1 Agent, agent2 Agent) {
+        comp1, comp2 := NewComponent(agent1, nil), NewComponent(agent2, nil)
+        holdMid(t, crashed)
+        sendAndReceive(t, comp1, comp2)
+        if t.Failed() {
+            t.Fatalf("%s: the mid of the crashed agent was not filled", name)
+        }
+        comp1.Close()
+        comp2.Close()
+        crashed.Close()
+    }
+
+    term, srv := initTestCS(1000)
+    srv.SetMidLease(lease)
+    run("server", NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"))
+    teardownTestCS(term, srv)
+
+    ring := testRingInfrastructure{midLease: lease}
+    ring.initTest(1000, 2, 3)
+    run("ring", ring.agents[0], ring.agents[1], ring.agents[2])
+    ring.teardownTest()
+
+    tree := testTreeInfrastructure{midLease: lease}
+    tree.initTest(1000, 2, 2, 3)
+    run("tree", tree.agents[0], tree.agents[1], tree.agents[2])
+    tree.teardownTest()
+
+    cluster := testClusterInfrastructure{midLease: lease}
+    cluster.initTest(1000, 2, 3)
+    run("cluster", cluster.agents[0], cluster.agents[1], cluster.agents[2])
+    cluster.teardownTest()
+}
+
+func TestMidLeaseAgentGone(t *testing.T) {
+    // without deadline (the default), the mids are filled only because the agent leaves
+    term, srv := initTestCS(1000)
+    comp1 := NewComponent(NewSingleServerAgent("127.0.0.1:17654"), nil)
+    comp2 := NewComponent(NewSingleServerAgent("127.0.0.1:17654"), nil)
+    crashed := NewSingleServerAgent("127.0.0.1:17654")
+    holdMid(t, crashed)
+    crashed.Close()
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    teardownTestCS(term, srv)
+
+    ring := testRingInfrastructure{}
+    ring.initTest(1000, 2, 3)
+    comp1, comp2 = NewComponent(ring.agents[1], nil), NewComponent(ring.agents[2], nil)
+    holdMid(t, ring.agents[0])
+    ring.agents[0].Close()
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    ring.teardownTest()
+}
+
+// the message of an agent that sends after its lease expired is dropped, and given back to it
+func TestMidLeaseLateMessage(t *testing.T) {
+    lease := 300 * time.Millisecond
+    run := func(name string, slow Agent, agent Agent) {
+        t.Run(name, func(t *testing.T) {
+            comp := NewComponent(agent, nil)
+            ctx, cancel := context.WithCancel(context.Background())
+            stopped := make(chan struct{})
+            NewProcess(comp).Run(func(p *Process) {
+                if msg, err := p.ReceiveCtx(ctx, func(attr *Attributes, msg Tuple) bool {
+                    return true
+                }); err == nil {
+                    t.Errorf("received %v", msg)
+                }
+                close(stopped)
+            })
+            expired := make(chan Message, 1)
+            slow.(ExpiryNotifier).OnExpired(func(msg Message) {
+                expired <- msg
+            })
+            if err := slow.Start(); err != nil {
+                t.Fatal(err)
+            }
+            slow.AskMid()
+            var mid int
+            select {
+                case mid = <- slow.GetRplyChan().Out:
+                case <- time.After(2 * time.Second):
+                    t.Fatal("no mid for the slow agent")
+            }
+            time.Sleep(3 * lease)
+            slow.SendMessage(Message{mid, NewTuple("late"), True()})
+            select {
+                case msg := <- expired:
+                    if msg.Id != mid || msg.Message.Get(0) != "late" {
+                        t.Errorf("%v expired", msg)
+                    }
+                case <- time.After(3 * time.Second):
+                    t.Error("the late message was not given back")
+            }
+            // the message was dropped before it was given back
+            cancel()
+            waitAll(t, 2000, stopped)
+            comp.Close()
+            slow.Close()
+        })
+    }
+
+    term, srv := initTestCS(1000)
+    srv.SetMidLease(lease)
+    run("server", NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"))
+    teardownTestCS(term, srv)
+
+    ring := testRingInfrastructure{midLease: lease}
+    ring.initTest(1000, 2, 2)
+    run("ring", ring.agents[0], ring.agents[1])
+    ring.teardownTest()
+
+    tree := testTreeInfrastructure{midLease: lease}
+    tree.initTest(1000, 2, 2, 2)
+    run("tree", tree.agents[0], tree.agents[1])
+    tree.teardownTest()
+
+    cluster := testClusterInfrastructure{midLease: lease}
+    cluster.initTest(1000, 2, 2)
+    run("cluster", cluster.agents[0], cluster.agents[1])
+    cluster.teardownTest()
+}
@@ -1,13 +1,18 @@
 package goat
 
 import (
+    "crypto/tls"
+    "errors"
+    "log"
     "net"
     "sync/atomic"
 )
 
 type ClusterCounter struct {
-    listener net.Listener
+    inbox *connInbox
+    pool *connPool
     count int
+    state *counterState
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
@@ -18,14 +23,41 @@ func NewClusterCounter(port int) *ClusterCounter{
 }
 
 func NewClusterCounterPerf(perfTest bool, port int) *ClusterCounter{
+    return newClusterCounter(perfTest, nil, port)
+}
+
+// NewClusterCounterTLS returns a counter whose connections use TLS with tlsConfig
+func NewClusterCounterTLS(tlsConfig *tls.Config, port int) *ClusterCounter{
+    return newClusterCounter(false, tlsConfig, port)
+}
+
+func newClusterCounter(perfTest bool, tlsConfig *tls.Config, port int) *ClusterCounter{
     return &ClusterCounter{
-        listener: listenToPort(port),
+        inbox: newConnInbox(listenToPortTLS(port, tlsConfig)),
+        pool: newConnPool(tlsConfig),
         perfTest: perfTest,
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
     }
 }
 
+/*
+UseStateFile makes the counter resume from the state saved in the file path, if
+any, and save its state there, so that once restarted it does not issue again the
+mids it issued before. The state is synced once every batch mids (a default
+amount if batch < 1): a counter that stops without Terminate may skip up to batch
+mids when restarted. It must be called before Work.
+*/
+func (cc *ClusterCounter) UseStateFile(path string, batch int) error {
+    state, count, err := openCounterState(path, batch)
+    if err != nil {
+        return err
+    }
+    cc.state = state
+    cc.count = count
+    return nil
+}
+
 func (tn *ClusterCounter) onInfrMsgAgent() {
     if tn.perfTest {
         atomic.AddUint64(&tn.infrMessagesFromAgents, 1)
@@ -57,27 +89,48 @@ func (tn *ClusterCounter) GetInfrMsgSent() uint64 {
 func (cc *ClusterCounter) Work(timeout int64, timedOut chan<- struct{}){
     hasTimedOut := false
     for {
-        cmd, params, srcAddr := receiveWithAddressTimeout(cc.listener, timeout, &hasTimedOut)
+        cmd, params, srcAddr, err := cc.inbox.receive(timeout, &hasTimedOut)
         if hasTimedOut {
             close(timedOut)
             return
+        } else if errors.Is(err, net.ErrClosed) {
+            return
+        } else if err != nil {
+            continue
         }
         switch cmd {
             case "read": // ask, it will not be used
                 rplPort := params[0]
                 rplAddress := netAddress{srcAddr.Host, rplPort}
                 cc.onInfrMsgSent()
-                sendToAddress(rplAddress, "count", itoa(cc.count))
-            case "inc": // it will be assigned to a message
+                cc.pool.sendToAddress(rplAddress, "count", itoa(cc.count))
+            case "inc": // it will be assigned to a message; "inc port n" reserves n mids
                 rplPort := params[0]
                 rplAddress := netAddress{srcAddr.Host, rplPort}
+                n := 1
+                if len(params) > 1 {
+                    if n, err = paramInt(params, 1); err != nil || checkMidCount(n) != nil {
+                        log.Printf("goat: cluster counter: invalid inc %v", params)
+                        break
+                    }
+                }
+                // the requester waits for the count: the reservation is retried until the counter stops
+                if cc.state != nil && cc.state.reserveWait(cc.count + n, "cluster counter") != nil {
+                    break
+                }
                 cc.onInfrMsgSent()
-                sendToAddress(rplAddress, "count", itoa(cc.count))
-                cc.count++
+                cc.pool.sendToAddress(rplAddress, "count", itoa(cc.count))
+                cc.count += n
         }    
     }
 }
 
 func (cc *ClusterCounter) Terminate(){
-    cc.listener.Close()
+    if cc.state != nil {
+        if err := cc.state.close(); err != nil {
+            log.Printf("goat: cluster counter: %v", err)
+        }
+    }
+    cc.inbox.Close()
+    cc.pool.Close()
 }
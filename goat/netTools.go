@@ -1,30 +1,40 @@
 package goat
 
 import (
+    "errors"
     "net"
     "bufio"
+    "crypto/tls"
+    "crypto/x509"
+    "log"
     "sync"
-    "fmt"
-    "strings"
+    "time"
 )
 
 type duplexConn struct {
     conn net.Conn
     reader *bufio.Reader
     lock *sync.Mutex
+    binary bool // send binary frames
+    chosen chan struct{} // closed once the first message, that chooses the protocol, was read
+    pending []string // the first message, if it did not choose the protocol
+    pendingErr error // the error that ended the read of the first message
 }
 
 func (dc *duplexConn) Send(tokens ...string) error{
-    escTokens := make([]string, len(tokens))
-    for i, tok:= range tokens {
-        escTokens[i] = escape(tok)
-    }
     dc.lock.Lock()
-    _, err := fmt.Fprintf(dc.conn, "%s\n", strings.Join(escTokens," "))
+    err := writeMessage(dc.conn, dc.binary, tokens)
     dc.lock.Unlock()
     return err
 }
 
+// usesBinary tells whether dc sends binary frames
+func (dc *duplexConn) usesBinary() bool {
+    dc.lock.Lock()
+    defer dc.lock.Unlock()
+    return dc.binary
+}
+
 func (dc *duplexConn) SrcAddr() netAddress{
     return newNetAddress(dc.conn.RemoteAddr().String())
 }
@@ -33,18 +43,67 @@ func (dc *duplexConn) RemoteAddr() net.Addr{
     return dc.conn.RemoteAddr()
 }
 
+/*
+negotiate reads the first message of dc, while the messages are sent with the text
+protocol, and switches to binary frames if it agrees on them: the answer to the
+hello when this side dialled (dialled true), the hello otherwise. Any other message
+is kept for ReceiveErr. The read has no deadline of its own, so it never delays a
+peer that does not negotiate; a deadline set on dc.conn ends it as it would end
+ReceiveErr.
+*/
+func (dc *duplexConn) negotiate(dialled bool) {
+    defer close(dc.chosen)
+    tokens, _, err := readMessage(dc.reader)
+    switch {
+        case err != nil:
+            dc.pendingErr = err
+        case dialled && tokens[0] == "PROTOCOL":
+            dc.lock.Lock()
+            dc.binary = acceptsBinary(tokens[1:])
+            dc.lock.Unlock()
+        case !dialled && tokens[0] == "HELLO":
+            dc.lock.Lock()
+            dc.binary, dc.pendingErr = answerHello(dc.conn, tokens[1:])
+            dc.lock.Unlock()
+        default:
+            dc.pending = tokens
+    }
+}
+
 func (dc *duplexConn) ReceiveErr() (string, []string, error) {
-    serverMsg, err := dc.reader.ReadString('\n')
-    if err == nil {
-        escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-        tokens := make([]string, len(escTokens))
-        for i, escTok := range escTokens {
-            tokens[i], _ = unescape(escTok, 0)
-        }
-        return tokens[0], tokens[1:], nil
-    } else {
+    <- dc.chosen
+    if dc.pendingErr != nil {
+        err := dc.pendingErr
+        dc.pendingErr = nil
         return "", nil, err
     }
+    if dc.pending != nil {
+        tokens := dc.pending
+        dc.pending = nil
+        return tokens[0], tokens[1:], nil
+    }
+    for {
+        tokens, _, err := readMessage(dc.reader)
+        if err != nil {
+            return "", nil, err
+        }
+        switch tokens[0] {
+            case "HELLO":
+                dc.lock.Lock()
+                dc.binary, err = answerHello(dc.conn, tokens[1:])
+                dc.lock.Unlock()
+                if err != nil {
+                    return "", nil, err
+                }
+            case "PROTOCOL":
+                // an answer that arrived after another message
+                dc.lock.Lock()
+                dc.binary = acceptsBinary(tokens[1:])
+                dc.lock.Unlock()
+            default:
+                return tokens[0], tokens[1:], nil
+        }
+    }
 }
 
 func (dc *duplexConn) Receive() (string, []string) {
@@ -62,48 +121,211 @@ func (dc *duplexConn) Close() {
 }
 
 func connectWith(address string) *duplexConn {
-    conn, err := net.Dial("tcp", address)
+    return connectWithTLS(address, nil)
+}
+
+func connectWithTLS(address string, tlsConfig *tls.Config) *duplexConn {
+    dc, err := connect(address, tlsConfig)
     if err == nil{
-        return newDuplexConn(conn)
+        return dc
     } else {
         panic(err)
     }
 }
 
+// connect is connectWithTLS returning the error instead of panicking
+func connect(address string, tlsConfig *tls.Config) (*duplexConn, error) {
+    conn, err := dialTCP(address, tlsConfig)
+    if err != nil {
+        return nil, err
+    }
+    return dialedConn(conn)
+}
+
+// newDuplexConn wraps conn with the text protocol, without negotiating
 func newDuplexConn(conn net.Conn) *duplexConn {
-    return &duplexConn{conn, bufio.NewReader(conn), &sync.Mutex{}}
+    chosen := make(chan struct{})
+    close(chosen)
+    return &duplexConn{conn: conn, reader: bufio.NewReader(conn), lock: &sync.Mutex{}, chosen: chosen}
+}
+
+// dialedConn wraps conn, that this side dialled, and proposes the binary protocol on it
+func dialedConn(conn net.Conn) (*duplexConn, error) {
+    if err := writeMessage(conn, false, helloMessage()); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    dc := newDuplexConn(conn)
+    dc.chosen = make(chan struct{})
+    go dc.negotiate(true)
+    return dc, nil
+}
+
+// acceptedConn wraps conn, that the other side dialled, and answers its hello when it arrives
+func acceptedConn(conn net.Conn) *duplexConn {
+    dc := newDuplexConn(conn)
+    dc.chosen = make(chan struct{})
+    go dc.negotiate(false)
+    return dc
 }
 
 
 
 
 func listenerInt(port int) (*unboundChanConn, chan struct{}, int){
+    return listenerIntTLS(port, nil)
+}
+
+func listenerIntTLS(port int, tlsConfig *tls.Config) (*unboundChanConn, chan struct{}, int){
     uc := newUnboundChanConn()
     chnReady := make(chan struct{})
-    chnPort := make(chan int, 1)
+    listener, err := listenTCP(port, tlsConfig)
+    if err != nil{
+        panic(err)
+    }
+    uc.listener = listener
+    listeningPort := atoi(newNetAddress(listener.Addr().String()).Port)
     go func(){
-        listener, err := net.Listen("tcp", ":"+itoa(port))
-        if err != nil{
-            panic(err)
-        }
-        chnPort <- atoi(newNetAddress(listener.Addr().String()).Port)
         close(chnReady)
-        for{
-            conn, err := listener.Accept()
-            if err == nil {
-                uc.In <- newDuplexConn(conn)
+        acceptDuplexConns(uc, listener)
+    }()
+    return uc, chnReady, listeningPort
+}
+
+// acceptDuplexConns passes the connections accepted by listener to uc, until listener is closed
+func acceptDuplexConns(uc *unboundChanConn, listener net.Listener) {
+    var delay time.Duration // before accepting again, after an error
+    for{
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
             }
+            delay = acceptDelay(delay)
+            log.Printf("goat: accept error: %v; retrying in %v", err, delay)
+            select {
+                case <- time.After(delay):
+                case <- uc.cls:
+                    return
+            }
+            continue
         }
-    }()
-    return uc, chnReady, <-chnPort
+        delay = 0
+        go func(){
+            if err := handshake(conn); err != nil {
+                log.Printf("goat: rejected connection from %v: %v", conn.RemoteAddr(), err)
+                conn.Close()
+                return
+            }
+            select {
+                case uc.In <- acceptedConn(conn):
+                case <-uc.cls:
+                    conn.Close()
+            }
+        }()
+    }
+}
+
+// acceptDelay doubles delay, the wait before accepting again after an error, up to a second
+func acceptDelay(delay time.Duration) time.Duration {
+    // like net/http, back off on errors such as too many open files
+    if delay == 0 {
+        return 5 * time.Millisecond
+    } else if delay *= 2; delay > time.Second {
+        return time.Second
+    }
+    return delay
 }
 
 func listener(port int) (*unboundChanConn, chan struct{}) {
-    ucc, rd, _ := listenerInt(port)
+    return listenerTLS(port, nil)
+}
+
+func listenerTLS(port int, tlsConfig *tls.Config) (*unboundChanConn, chan struct{}) {
+    ucc, rd, _ := listenerIntTLS(port, tlsConfig)
     return ucc, rd
 }
 
+/*
+MutualTLSConfig returns a configuration for the agents and the nodes that use TLS
+in both directions: a process presents cert, and accepts only the processes whose
+certificate is signed by an authority in ca, both when it dials and when it
+accepts a connection.
+*/
+func MutualTLSConfig(cert tls.Certificate, ca *x509.CertPool) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        RootCAs: ca,
+        ClientCAs: ca,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+        MinVersion: tls.VersionTLS12,
+    }
+}
+
+// dialTCP opens a connection to address, with TLS if tlsConfig is not nil
+func dialTCP(address string, tlsConfig *tls.Config) (net.Conn, error) {
+    if tlsConfig == nil {
+        return net.Dial("tcp", address)
+    }
+    return tls.Dial("tcp", address, tlsConfig)
+}
+
+// listenTCP listens on port (0 for a random one), with TLS if tlsConfig is not nil
+func listenTCP(port int, tlsConfig *tls.Config) (net.Listener, error) {
+    if tlsConfig == nil {
+        return net.Listen("tcp", ":"+itoa(port))
+    }
+    return tls.Listen("tcp", ":"+itoa(port), tlsConfig)
+}
+
+// handshakeTimeout bounds the TLS handshake of an accepted connection
+const handshakeTimeout = 10 * time.Second
+
+/*
+handshake completes the TLS handshake of an accepted connection, so that a peer
+that is not trusted is rejected at once. Without it the handshake would wait for
+the first read, and two nodes that connect to each other before reading would
+wait for each other forever.
+*/
+func handshake(conn net.Conn) error {
+    tlsConn, isTLS := conn.(*tls.Conn)
+    if !isTLS {
+        return nil
+    }
+    tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+    defer tlsConn.SetDeadline(time.Time{})
+    return tlsConn.Handshake()
+}
+
 
 func listenerRandomPort() (*unboundChanConn, chan struct{}, int){
     return listenerInt(0)
 }
+
+/*
+signalActivity records that something happened on a node, without blocking: the
+channel has a buffer of one and a pending signal is enough.
+*/
+func signalActivity(chnActivity chan struct{}) {
+    select {
+        case chnActivity <- struct{}{}:
+        default:
+    }
+}
+
+/*
+waitIdle returns when no activity has been signalled for msec milliseconds, closing
+timedOut, or when chnQuit is closed. With msec <= 0 it only waits for chnQuit.
+*/
+func waitIdle(chnActivity chan struct{}, chnQuit chan struct{}, msec int64, timedOut chan<- struct{}) {
+    for {
+        select {
+            case <- chnActivity:
+            case <- timeout(msec):
+                close(timedOut)
+                return
+            case <- chnQuit:
+                return
+        }
+    }
+}
@@ -0,0 +1,146 @@
+package goat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCA returns a self-signed authority and its key
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        KeyUsage: x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cert, key
+}
+
+// newTestCert returns a certificate for 127.0.0.1 signed by ca, usable by clients and servers
+func newTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{CommonName: "goat"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testTLSConfigs returns a configuration and one whose certificate is signed by another authority
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+    ca, caKey := newTestCA(t, "goat test CA")
+    otherCA, otherKey := newTestCA(t, "another CA")
+    pool := x509.NewCertPool()
+    pool.AddCert(ca)
+    otherPool := x509.NewCertPool()
+    otherPool.AddCert(otherCA)
+    return MutualTLSConfig(newTestCert(t, ca, caKey), pool),
+        MutualTLSConfig(newTestCert(t, otherCA, otherKey), otherPool)
+}
+
+func TestMutualTLS(t *testing.T) {
+    InitSend()
+    cfg, _ := testTLSConfigs(t)
+    run := func(name string, sender Agent, receiver Agent) {
+        comp1, comp2 := NewComponent(sender, nil), NewComponent(receiver, nil)
+        t.Run(name, func(t *testing.T) {
+            sendAndReceive(t, comp1, comp2)
+            sendAndReceive(t, comp2, comp1)
+        })
+        comp1.Close()
+        comp2.Close()
+    }
+
+    term := make(chan struct{})
+    srv := RunCentralServerTLS(cfg, 17654, term, 300)
+    run("server", NewSingleServerAgentTLS(cfg, "127.0.0.1:17654"), NewSingleServerAgentTLS(cfg, "127.0.0.1:17654"))
+    teardownTestCS(term, srv)
+
+    ring := testRingInfrastructure{tlsConfig: cfg}
+    ring.initTest(300, 3, 2)
+    run("ring", ring.agents[0], ring.agents[1])
+    ring.teardownTest()
+
+    tree := testTreeInfrastructure{tlsConfig: cfg}
+    tree.initTest(300, 2, 2, 2)
+    run("tree", tree.agents[0], tree.agents[1])
+    tree.teardownTest()
+
+    cluster := testClusterInfrastructure{tlsConfig: cfg}
+    cluster.initTest(300, 2, 2)
+    run("cluster", cluster.agents[0], cluster.agents[1])
+    cluster.teardownTest()
+}
+
+// a listener with TLS delivers only the connections of trusted peers
+func TestTLSRejectsUntrusted(t *testing.T) {
+    cfg, untrusted := testTLSConfigs(t)
+    uc, ready, port := listenerIntTLS(0, cfg)
+    defer uc.Close()
+    <-ready
+    address := "127.0.0.1:" + itoa(port)
+
+    if conn, err := net.Dial("tcp", address); err == nil {
+        defer conn.Close()
+        conn.Write([]byte("hello plain\n"))
+    }
+    // the untrusted client may see its handshake succeed: the server checks it afterwards
+    if conn, err := tls.Dial("tcp", address, untrusted); err == nil {
+        defer conn.Close()
+        conn.Write([]byte("hello untrusted\n"))
+    }
+    trusted := connectWithTLS(address, cfg)
+    defer trusted.Close()
+    trusted.Send("hello", "trusted")
+
+    select {
+        case dc := <-uc.Out:
+            cmd, params := dc.Receive()
+            if cmd != "hello" || len(params) != 1 || params[0] != "trusted" {
+                t.Errorf("accepted a connection that sent %s %v", cmd, params)
+            }
+        case <-time.After(2 * time.Second):
+            t.Fatal("the trusted connection was not accepted")
+    }
+    select {
+        case dc := <-uc.Out:
+            cmd, params := dc.Receive()
+            t.Errorf("accepted a connection that sent %s %v", cmd, params)
+        case <-time.After(200 * time.Millisecond):
+    }
+}
@@ -0,0 +1,275 @@
+package goat
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// ErrForbiddenByPolicy is returned when a rule of the policy forbids a send, whoever the receiver is
+var ErrForbiddenByPolicy = errors.New("goat: forbidden by the policy")
+
+/*
+PolicyRule is a rule that every message must follow. Allow is a predicate where
+this.x is the attribute x of the sending component, receiver.x the attribute x of
+a receiving component and msg the tuple sent (msg[i] is its field i, len(msg) its
+length; see Msg and MsgField). For instance
+
+    !msg[0] == "assign" || this.role == "coordinator"
+
+lets only the coordinators send the tuples that start with "assign". As with the
+attributes of the receiver, a comparison with an attribute of the sender that is
+not set, or with a field that the message does not have, is false.
+*/
+type PolicyRule struct {
+    Name string
+    Allow Predicate
+}
+
+// ParsePolicyRule returns the rule name, whose Allow predicate is read by ParsePredicate from src
+func ParsePolicyRule(name string, src string) (PolicyRule, error) {
+    p, err := ParsePredicate(src)
+    if err != nil {
+        return PolicyRule{}, err
+    }
+    return PolicyRule{name, p}, nil
+}
+
+/*
+Policy is a set of rules (see PolicyRule). A component that has a policy (see
+Component.SetPolicy) sends a message only if the rules that do not depend on the
+receiver are true. Otherwise the send waits as if its guard were false (and the
+rule is logged), while SendCtx, GSendUpdCtx and SelectCtx give up with
+ErrForbiddenByPolicy; the rules that depend on the receiver are added to the predicate of the message, so
+that only the allowed components receive it. The infrastructures can check the
+rules again (see for instance RingNode.SetPolicy) with the attributes published
+by the agents (see Component.PublishAttributes): a message that surely breaks a
+rule for an agent is not delivered to it.
+*/
+type Policy struct {
+    rules []PolicyRule
+}
+
+func NewPolicy(rules ...PolicyRule) *Policy {
+    return &Policy{rules}
+}
+
+// the fields of the message are seen by the rules as attributes of the sender with these names
+const msgAttribute = "$msg"
+
+func msgFieldAttribute(i int) string {
+    return msgAttribute + "[" + itoa(i) + "]"
+}
+
+// Msg is the tuple sent, in the rules of a Policy
+func Msg() compattr {
+    return compattr{msgAttribute}
+}
+
+// MsgField is the field i of the tuple sent, in the rules of a Policy
+func MsgField(i int) compattr {
+    return compattr{msgFieldAttribute(i)}
+}
+
+// messageField tells whether name refers to the message: the index is -1 for the whole tuple
+func messageField(name string) (int, bool) {
+    if name == msgAttribute {
+        return -1, true
+    } else if !strings.HasPrefix(name, msgAttribute + "[") || !strings.HasSuffix(name, "]") {
+        return 0, false
+    }
+    i, err := strconv.Atoi(name[len(msgAttribute)+1:len(name)-1])
+    return i, err == nil && i >= 0
+}
+
+// messageEnvironment returns the attributes attr (if any) together with the fields of msg
+func messageEnvironment(attr *Attributes, msg Tuple) *Attributes {
+    env := Attributes{changes: map[string]interface{}{}}
+    if attr != nil {
+        env.actual = attr.actual
+        for name, val := range attr.changes {
+            env.changes[name] = val
+        }
+    }
+    env.changes[msgAttribute] = msg
+    for i, elem := range msg.Elems {
+        env.changes[msgFieldAttribute(i)] = elem
+    }
+    return &env
+}
+
+// operandRefs adds to names the attributes of the sender that x refers to
+func operandRefs(x interface{}, names map[string]struct{}) {
+    switch v := x.(type) {
+        case compattr:
+            names[v.name] = struct{}{}
+        case expr:
+            for _, arg := range v.args {
+                operandRefs(arg, names)
+            }
+        case evalattr:
+            for _, param := range v.params {
+                operandRefs(param, names)
+            }
+        case Tuple:
+            for _, elem := range v.Elems {
+                operandRefs(elem, names)
+            }
+    }
+}
+
+// predicateRefs adds to names the attributes of the sender that p refers to
+func predicateRefs(p Predicate, names map[string]struct{}) {
+    switch pp := p.(type) {
+        case and:
+            predicateRefs(pp.p1, names)
+            predicateRefs(pp.p2, names)
+        case or:
+            predicateRefs(pp.p1, names)
+            predicateRefs(pp.p2, names)
+        case not:
+            predicateRefs(pp.p, names)
+        case comp:
+            operandRefs(pp.arg1, names)
+            operandRefs(pp.arg2, names)
+        case isin:
+            operandRefs(pp.arg1, names)
+            operandRefs(pp.arg2, names)
+    }
+}
+
+/*
+closeRule closes p under env. Unlike CloseUnder, a comparison that refers to an
+attribute that env does not have becomes false.
+*/
+func closeRule(p Predicate, env *Attributes) ClosedPredicate {
+    switch pp := p.(type) {
+        case and:
+            return cand{closeRule(pp.p1, env), closeRule(pp.p2, env)}
+        case or:
+            return cor{closeRule(pp.p1, env), closeRule(pp.p2, env)}
+        case not:
+            return cnot{closeRule(pp.p, env)}
+        case comp, isin:
+            names := map[string]struct{}{}
+            predicateRefs(p, names)
+            for name := range names {
+                if !env.Has(name) {
+                    return False()
+                }
+            }
+    }
+    return p.CloseUnder(env)
+}
+
+/*
+restrict checks the rules for msg, sent with the predicate msgPred by a component
+with the attributes attr. It returns an ErrForbiddenByPolicy error naming the rule
+if a rule forbids the send, otherwise msgPred with the rules that depend on the
+receiver. A nil policy allows everything.
+*/
+func (pol *Policy) restrict(attr *Attributes, msg Tuple, msgPred ClosedPredicate) (ClosedPredicate, error) {
+    if pol == nil {
+        return msgPred, nil
+    }
+    env := messageEnvironment(attr, msg)
+    for _, rule := range pol.rules {
+        switch allowed := Simplify(closeRule(rule.Allow, env)).(type) {
+            case _true:
+            case _false:
+                dprintln("Rule", rule.Name, "forbids", msg)
+                return msgPred, fmt.Errorf("%w: rule %s forbids %v", ErrForbiddenByPolicy, rule.Name, msg)
+            default:
+                msgPred = cand{msgPred, allowed}
+        }
+    }
+    return msgPred, nil
+}
+
+/*
+closeFor closes the rules for msg, sent by a component whose attributes are known
+as in sender (nil if nothing is known). A rule that refers to an attribute of the
+sender that is not known can not be checked, and is nil.
+*/
+func (pol *Policy) closeFor(sender *attributeView, msg Tuple) []ClosedPredicate {
+    var attr *Attributes
+    if sender != nil {
+        attr = &sender.attr
+    }
+    env := messageEnvironment(attr, msg)
+    closed := make([]ClosedPredicate, len(pol.rules))
+    for i, rule := range pol.rules {
+        names := map[string]struct{}{}
+        predicateRefs(rule.Allow, names)
+        known := true
+        for name := range names {
+            if _, isMsg := messageField(name); !isMsg {
+                if sender == nil {
+                    known = false
+                } else if _, has := sender.known[name]; !has {
+                    known = false
+                }
+            }
+        }
+        if known {
+            closed[i] = Simplify(closeRule(rule.Allow, env))
+        }
+    }
+    return closed
+}
+
+// rulesFor returns the rules of the policy of pf closed for msg, sent by the agent sender
+func (pf *predicateFilter) rulesFor(sender int, msg Tuple) []ClosedPredicate {
+    if pf.policy == nil {
+        return nil
+    }
+    if view, has := pf.views[sender]; has {
+        return pf.policy.closeFor(&view, msg)
+    }
+    return pf.policy.closeFor(nil, msg)
+}
+
+// rulesForEncoded behaves like rulesFor with the tuple as found in a DATA message; the last result is kept
+func (pf *predicateFilter) rulesForEncoded(sender int, tuple string) []ClosedPredicate {
+    if pf.policy == nil {
+        return nil
+    }
+    key := itoa(sender) + " " + tuple
+    if pf.lastRulesKey != key {
+        msg, err := decodeTuple(tuple)
+        if err != nil {
+            // let the agent deal with it
+            pf.lastRules = nil
+        } else {
+            pf.lastRules = pf.rulesFor(sender, msg)
+        }
+        pf.lastRulesKey = key
+    }
+    return pf.lastRules
+}
+
+// breaksRules is true if the agent id surely does not satisfy one of the closed rules
+func (pf *predicateFilter) breaksRules(id int, rules []ClosedPredicate) bool {
+    view, hasView := pf.views[id]
+    for _, rule := range rules {
+        if rule == nil {
+            continue
+        } else if _, isFalse := rule.(_false); isFalse {
+            return true
+        } else if hasView {
+            if val, known := view.satisfy(rule); known && !val {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+/*
+excludesData behaves like excludesEncoded for a DATA message from the agent sender,
+and also excludes the agent id if the message surely breaks a rule of the policy.
+*/
+func (pf *predicateFilter) excludesData(sender int, id int, pred string, tuple string) bool {
+    return pf.excludesEncoded(id, pred) || pf.breaksRules(id, pf.rulesForEncoded(sender, tuple))
+}
@@ -0,0 +1,175 @@
+package goat
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+// only the coordinators send assignments, and only to the components cleared for their level
+func testPolicy(t *testing.T) *Policy {
+    assign, err := ParsePolicyRule("assign", `!msg[0] == "assign" || this.role == "coordinator"`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    clearance, err := ParsePolicyRule("clearance", `!msg[0] == "doc" || receiver.clearance >= msg[1]`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return NewPolicy(assign, clearance)
+}
+
+func TestPolicyRuleSyntax(t *testing.T) {
+    for _, src := range []string{
+        `!msg[0] == "assign" || this.role == "coordinator"`,
+        `len(msg) <= 3 && "x" in msg`,
+        `receiver.clearance >= msg[1] + 1`,
+    } {
+        rule, err := ParsePolicyRule("r", src)
+        if err != nil {
+            t.Errorf("%s: %v", src, err)
+            continue
+        }
+        if back, err := FormatPredicate(rule.Allow); err != nil || back != src {
+            t.Errorf("%s formatted as %s, %v", src, back, err)
+        }
+    }
+    if src, _ := FormatPredicate(Equals(MsgField(2), Len(Msg()))); src != "msg[2] == len(msg)" {
+        t.Errorf("got %s", src)
+    }
+    for _, src := range []string{`msg[x] == 1`, `msg["a"] == 1`, `msg[1 == 1`} {
+        if _, err := ParsePolicyRule("r", src); err == nil {
+            t.Errorf("%s was parsed", src)
+        }
+    }
+    if _, err := ParseClosedPredicate(`msg[0] == 1`); err == nil || !strings.Contains(err.Error(), "msg[0]") {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestPolicyRestrict(t *testing.T) {
+    pol := testPolicy(t)
+    worker, coordinator := NewAttributes(), NewAttributes()
+    worker.init(map[string]interface{}{"role": "worker"})
+    coordinator.init(map[string]interface{}{"role": "coordinator"})
+    cases := []struct{
+        attr *Attributes
+        msg Tuple
+        allowed bool
+    }{
+        {worker, NewTuple("assign", 1), false},
+        {coordinator, NewTuple("assign", 1), true},
+        {NewAttributes(), NewTuple("assign"), false},
+        {worker, NewTuple("hello"), true},
+        {worker, NewTuple(), true},
+    }
+    for _, c := range cases {
+        pred, err := pol.restrict(c.attr, c.msg, True())
+        allowed := err == nil
+        if !allowed && !errors.Is(err, ErrForbiddenByPolicy) {
+            t.Errorf("%v: %v", c.msg, err)
+        } else if allowed != c.allowed {
+            t.Errorf("%v: allowed is %v", c.msg, allowed)
+        } else if allowed && Simplify(pred).String() != "TT" {
+            t.Errorf("%v: restricted to %s", c.msg, pred)
+        }
+    }
+    pred, err := pol.restrict(worker, NewTuple("doc", 3), True())
+    allowed := err == nil
+    low, high := NewAttributes(), NewAttributes()
+    low.init(map[string]interface{}{"clearance": 1})
+    high.init(map[string]interface{}{"clearance": 5})
+    if !allowed || pred.Satisfy(low) || !pred.Satisfy(high) || pred.Satisfy(NewAttributes()) {
+        t.Errorf("the message was allowed %v, with %s", allowed, pred)
+    }
+}
+
+func TestPolicyOnComponents(t *testing.T) {
+    tst := testLocalInfrastructure{}
+    tst.initTest(3)
+    worker := NewComponent(tst.agents[0], map[string]interface{}{"role": "worker"})
+    low := NewComponent(tst.agents[1], map[string]interface{}{"clearance": 1})
+    high := NewComponent(tst.agents[2], map[string]interface{}{"clearance": 5})
+    worker.SetPolicy(testPolicy(t))
+    received := make(chan struct{}, 2)
+    for _, comp := range []*Component{low, high} {
+        comp := comp
+        NewProcess(comp).Run(func(p *Process) {
+            msg := p.Receive(func(attr *Attributes, msg Tuple) bool {
+                return true
+            })
+            if msg.Get(0) != "doc" || comp == low {
+                t.Errorf("the component with high clearance %v received %v", comp == high, msg)
+            }
+            received <- struct{}{}
+        })
+    }
+    NewProcess(worker).Run(func(p *Process) {
+        // the rule does not depend on the receiver: the send fails instead of waiting
+        if err := p.SendCtx(context.Background(), NewTuple("assign", 1), True()); !errors.Is(err, ErrForbiddenByPolicy) {
+            t.Errorf("a worker sent an assignment: %v", err)
+        }
+        p.Send(NewTuple("doc", 3), True())
+    })
+    waitAll(t, 2000, received)
+    select {
+        case <- received:
+        case <- time.After(200 * time.Millisecond):
+    }
+    worker.Close()
+    low.Close()
+    high.Close()
+}
+
+// the infrastructure drops the messages of a sender that does not follow the policy
+func TestPolicyAtInfrastructure(t *testing.T) {
+    InitSend()
+    tst := testLocalInfrastructure{}
+    tst.initTest(2)
+    tst.infrastructure.SetPolicy(testPolicy(t))
+    worker := NewComponent(tst.agents[0], map[string]interface{}{"role": "worker"})
+    receiver := NewComponent(tst.agents[1], nil)
+    worker.PublishAttributes("role")
+    received := make(chan struct{})
+    NewProcess(receiver).Run(func(p *Process) {
+        msg := p.Receive(func(attr *Attributes, msg Tuple) bool {
+            return true
+        })
+        if msg.Get(0) != "hello" {
+            t.Errorf("received %v", msg)
+        }
+        close(received)
+    })
+    NewProcess(worker).Run(func(p *Process) {
+        p.Send(NewTuple("assign", 1), True())
+        p.Send(NewTuple("hello"), True())
+    })
+    waitAll(t, 2000, received)
+    worker.Close()
+    receiver.Close()
+
+    pf := newPredicateFilter()
+    pf.setPolicy(testPolicy(t))
+    pf.publish(1, append([]string{"0"}, encodeAttributeView(map[string]interface{}{"role": "worker"})...))
+    pf.publish(3, append([]string{"0"}, encodeAttributeView(map[string]interface{}{"clearance": 1})...))
+    assign, doc := NewTuple("assign", 1), NewTuple("doc", 3)
+    cases := []struct{
+        sender int
+        id int
+        tuple string
+        excluded bool
+    }{
+        {1, 2, assign.encode(), true},
+        {2, 3, assign.encode(), false}, // the role of the sender is not known
+        {1, 3, doc.encodeFor(true), true},
+        {1, 2, doc.encode(), false}, // the clearance of the receiver is not known
+        {1, 2, "not a tuple", false},
+    }
+    for _, c := range cases {
+        if excluded := pf.excludesData(c.sender, c.id, "TT", c.tuple); excluded != c.excluded {
+            t.Errorf("%d to %d: excluded is %v", c.sender, c.id, excluded)
+        }
+    }
+}
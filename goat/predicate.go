@@ -2,6 +2,7 @@ package goat
 
 import (
     "fmt"
+    "strconv"
 )
 
 /*
@@ -37,58 +38,8 @@ func (eq ccomp) Satisfy(attr *Attributes) bool {
     if !a1Exists || !a2Exists {
         return false
     }
-    switch a1 := a1Val.(type){
-        case int:{
-            a2, isA2Int := a2Val.(int)
-            if isA2Int{
-                switch eq.Op {
-                    case "==":
-                        return a1 == a2
-                    case "!=":
-                        return a1 != a2
-                    case "<":
-                        return a1 < a2
-                    case "<=":
-                        return a1 <= a2
-                    case ">":
-                        return a1 > a2
-                    case ">=":
-                        return a1 >= a2
-                }
-            }
-        }
-        case string:{
-            a2, isA2String := a2Val.(string)
-            if isA2String{
-                switch eq.Op {
-                    case "==":
-                        return a1 == a2
-                    case "!=":
-                        return a1 != a2
-                    case "<":
-                        return a1 < a2
-                    case "<=":
-                        return a1 <= a2
-                    case ">":
-                        return a1 > a2
-                    case ">=":
-                        return a1 >= a2
-                }
-            }
-        }
-        case bool:{
-            a2, isA2Bool := a2Val.(bool)
-            if isA2Bool{
-                switch eq.Op {
-                    case "==":
-                        return a1 == a2
-                    case "!=":
-                        return a1 != a2
-                }
-            }
-        }
-    }
-    return false
+    res, _ := compareValues(a1Val, eq.Op, a2Val)
+    return res
 }
 /*func (eq ccomp) ImmediateSatisfy() (bool, bool) {
     return false, false
@@ -142,6 +93,9 @@ func closure(arg interface{}, attr *Attributes) (interface{}, bool){
         case recattr: {
             return _arg.name, true
         }
+        case expr: {
+            return _arg.closeUnder(attr), false
+        }
         default: {
             return _arg, false
         }
@@ -449,39 +403,88 @@ func (f _false) CloseUnder(attr *Attributes) ClosedPredicate {
 
 /////////////
 
+/*
+ToPredicate decodes a predicate in the format produced by ClosedPredicate.String.
+The error describes the position of the first problem and what was expected.
+*/
 func ToPredicate(s string) (ClosedPredicate, error){
-    p, _, err := toPredicateInt(s, 0)
-    return p, err
+    p, next, err := toPredicateInt(s, 0)
+    if err != nil {
+        return nil, err
+    }
+    if next != len(s) {
+        return nil, &PredicateSyntaxError{s, next, "expected end of input, found "+strconv.Quote(s[next:])}
+    }
+    return p, nil
+}
+
+// expectAt checks that s[at] is c, as needed after the arguments of a predicate
+func expectAt(s string, at int, c byte) error {
+    if at >= len(s) {
+        return &PredicateSyntaxError{s, at, "expected "+strconv.Quote(string(c))+", found end of input"}
+    } else if s[at] != c {
+        return &PredicateSyntaxError{s, at, "expected "+strconv.Quote(string(c))+", found "+strconv.Quote(s[at:at+1])}
+    }
+    return nil
 }
 
 func toPredicateInt(s string, from int) (ClosedPredicate, int, error) {
-    escapedS := (s)
+    if from+2 > len(s) {
+        return nil, from, &PredicateSyntaxError{s, from, "expected a predicate, found "+strconv.Quote(s[from:])}
+    }
     switch s[from: from+2] {
-        case "C(":
-            attr1, is1Attr, commaPos := unescapeWithType(escapedS, from+2)
-            attr2, is2Attr, bracketPos := unescapeWithType(escapedS, commaPos+1)
-            return cisin{attr1, is1Attr, attr2, is2Attr}, bracketPos+1, nil
-        case "=(", "N(", "l(", "<(", "g(", ">(":
-            attr1, is1Attr, commaPos := unescapeWithType(escapedS, from+2)
-            attr2, is2Attr, bracketPos := unescapeWithType(escapedS, commaPos+1)
+        case "C(", "=(", "N(", "l(", "<(", "g(", ">(":
+            attr1, is1Attr, commaPos, err := unescapeWithType(s, from+2)
+            if err != nil {
+                return nil, from, err
+            }
+            if err = expectAt(s, commaPos, ','); err != nil {
+                return nil, from, err
+            }
+            attr2, is2Attr, bracketPos, err := unescapeWithType(s, commaPos+1)
+            if err != nil {
+                return nil, from, err
+            }
+            if err = expectAt(s, bracketPos, ')'); err != nil {
+                return nil, from, err
+            }
+            if s[from] == 'C' {
+                return cisin{attr1, is1Attr, attr2, is2Attr}, bracketPos+1, nil
+            }
             return ccomp{attr1, is1Attr, GetLetterOp(s[from:from+1]), attr2, is2Attr}, bracketPos+1, nil
-        case "&(":
-            p1, commaPos, _ := toPredicateInt(s, from+2)
-            p2, bracketPos, _ := toPredicateInt(s, commaPos+1)
-            return cand{p1, p2}, bracketPos+1, nil
-        case "|(":
-            p1, commaPos, _ := toPredicateInt(s, from+2)
-            p2, bracketPos, _ := toPredicateInt(s, commaPos+1)
+        case "&(", "|(":
+            p1, commaPos, err := toPredicateInt(s, from+2)
+            if err != nil {
+                return nil, from, err
+            }
+            if err = expectAt(s, commaPos, ','); err != nil {
+                return nil, from, err
+            }
+            p2, bracketPos, err := toPredicateInt(s, commaPos+1)
+            if err != nil {
+                return nil, from, err
+            }
+            if err = expectAt(s, bracketPos, ')'); err != nil {
+                return nil, from, err
+            }
+            if s[from] == '&' {
+                return cand{p1, p2}, bracketPos+1, nil
+            }
             return cor{p1, p2}, bracketPos+1, nil
         case "!(":
-            p, bracketPos, _ := toPredicateInt(s, from+2)
+            p, bracketPos, err := toPredicateInt(s, from+2)
+            if err != nil {
+                return nil, from, err
+            }
+            if err = expectAt(s, bracketPos, ')'); err != nil {
+                return nil, from, err
+            }
             return cnot{p}, bracketPos+1, nil
         case "TT":
             return _true{}, from+2, nil
         case "FF":
             return _false{}, from+2, nil
         default:
-            //TODO Error!
-            return nil, from + 1, nil
+            return nil, from, &PredicateSyntaxError{s, from, "expected a predicate, found "+strconv.Quote(s[from:from+2])}
     }
 }
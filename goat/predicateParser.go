@@ -0,0 +1,939 @@
+package goat
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/*
+PredicateSyntaxError describes why a predicate could not be parsed. Pos is the
+byte offset in Source where the problem was found.
+*/
+type PredicateSyntaxError struct {
+    Source string
+    Pos int
+    Msg string
+}
+
+func (e *PredicateSyntaxError) Error() string {
+    return fmt.Sprintf("goat: invalid predicate at position %d: %s", e.Pos, e.Msg)
+}
+
+/*
+ParsePredicate reads a predicate written in the readable syntax, for instance
+
+    receiver.role == "worker" && receiver.load < this.maxLoad || "x" in receiver.tags
+
+receiver.x is the attribute x of the receiver, this.x is the attribute x of the
+sending component (read when the predicate is closed); an attribute whose name is
+not an identifier is written receiver["some name"]. Values are integers, floats
+like 0.2 or 1e-3, strings (with Go escapes), true, false, tuples like
+[1, "a", [2]] and the conversions int64(5), uint64(5), float64("Inf"),
+time("2006-01-02T15:04:05Z") and duration("1h30m"). The operands can be combined
+with +, -, *, / and % (see Plus, Minus, Times, Div and Mod) and the functions abs,
+min, max, len and concat. The predicate operators are ==, !=, <, <=, >, >=, in, !,
+&& and ||, from the tightest to the loosest; ! binds looser than the comparisons,
+so !receiver.x == 1 negates the comparison. A bare true or false is the predicate
+True() or False(). In the rules of a Policy, msg is the tuple sent and msg[i] its
+field i.
+*/
+func ParsePredicate(src string) (Predicate, error) {
+    node, err := parsePredicateSource(src)
+    if err != nil {
+        return nil, err
+    }
+    return node.toPredicate(src)
+}
+
+/*
+ParseClosedPredicate behaves like ParsePredicate, but returns a ClosedPredicate;
+hence the predicate can not refer to the attributes of the sender (this.x).
+*/
+func ParseClosedPredicate(src string) (ClosedPredicate, error) {
+    node, err := parsePredicateSource(src)
+    if err != nil {
+        return nil, err
+    }
+    if ref := node.findThis(); ref != nil {
+        var sb strings.Builder
+        formatThisAttribute(&sb, ref.name)
+        return nil, &PredicateSyntaxError{src, ref.pos, "a closed predicate can not refer to "+sb.String()}
+    }
+    p, err := node.toPredicate(src)
+    if err != nil {
+        return nil, err
+    }
+    return p.CloseUnder(nil), nil
+}
+
+/*
+FormatPredicate writes p in the syntax read by ParsePredicate. It fails if p
+contains something that has no readable form, like Evaluate.
+*/
+func FormatPredicate(p Predicate) (string, error) {
+    var sb strings.Builder
+    err := formatPredicate(&sb, p, precOr)
+    return sb.String(), err
+}
+
+/*
+FormatClosedPredicate writes p in the syntax read by ParseClosedPredicate.
+*/
+func FormatClosedPredicate(p ClosedPredicate) (string, error) {
+    var sb strings.Builder
+    err := formatClosedPredicate(&sb, p, precOr)
+    return sb.String(), err
+}
+
+//////////// lexer
+
+const (
+    tokEOF = iota
+    tokIdent
+    tokInt
+    tokFloat
+    tokString
+    tokOp
+)
+
+type predToken struct {
+    kind int
+    text string
+    pos int
+}
+
+func (t predToken) describe() string {
+    switch t.kind {
+        case tokEOF:
+            return "end of input"
+        case tokString:
+            return "string " + t.text
+        default:
+            return "\"" + t.text + "\""
+    }
+}
+
+func isIdentStart(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func isIdentifier(s string) bool {
+    if len(s) == 0 || !isIdentStart(s[0]) {
+        return false
+    }
+    for i := 1; i < len(s); i++ {
+        if !isIdentStart(s[i]) && !isDigit(s[i]) {
+            return false
+        }
+    }
+    return true
+}
+
+// two-characters operators must come before their prefixes
+var predicateOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", ".", "-", "+", "*", "/", "%"}
+
+func lexPredicate(src string) ([]predToken, error) {
+    toks := []predToken{}
+    for i := 0; i < len(src); {
+        c := src[i]
+        switch {
+            case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+                i++
+            case isIdentStart(c):
+                j := i+1
+                for j < len(src) && (isIdentStart(src[j]) || isDigit(src[j])) {
+                    j++
+                }
+                toks = append(toks, predToken{tokIdent, src[i:j], i})
+                i = j
+            case isDigit(c):
+                j := i+1
+                for j < len(src) && isDigit(src[j]) {
+                    j++
+                }
+                kind := tokInt
+                if j+1 < len(src) && src[j] == '.' && isDigit(src[j+1]) {
+                    kind = tokFloat
+                    for j = j+1; j < len(src) && isDigit(src[j]); j++ {
+                    }
+                }
+                if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+                    k := j+1
+                    if k < len(src) && (src[k] == '+' || src[k] == '-') {
+                        k++
+                    }
+                    if k < len(src) && isDigit(src[k]) {
+                        kind = tokFloat
+                        for j = k; j < len(src) && isDigit(src[j]); j++ {
+                        }
+                    }
+                }
+                toks = append(toks, predToken{kind, src[i:j], i})
+                i = j
+            case c == '"':
+                j := i+1
+                for j < len(src) && src[j] != '"' {
+                    if src[j] == '\\' {
+                        j++
+                    }
+                    j++
+                }
+                if j >= len(src) {
+                    return nil, &PredicateSyntaxError{src, i, "unterminated string"}
+                }
+                toks = append(toks, predToken{tokString, src[i:j+1], i})
+                i = j+1
+            default:
+                found := false
+                for _, op := range predicateOperators {
+                    if strings.HasPrefix(src[i:], op) {
+                        toks = append(toks, predToken{tokOp, op, i})
+                        i += len(op)
+                        found = true
+                        break
+                    }
+                }
+                if !found {
+                    return nil, &PredicateSyntaxError{src, i, fmt.Sprintf("unexpected character %q", c)}
+                }
+        }
+    }
+    return append(toks, predToken{tokEOF, "", len(src)}), nil
+}
+
+//////////// parser
+
+const (
+    nodeBinary = iota
+    nodeNot
+    nodeValue
+    nodeTuple
+    nodeReceiver
+    nodeThis
+    nodeExpr
+)
+
+/*
+predNode is the syntax tree of an expression: predicates and operands share it, so
+that operators with different precedences can be added without changing the
+shape of the parser. The kind of each subtree is checked when it is converted.
+*/
+type predNode struct {
+    kind int
+    op string
+    args []*predNode
+    value interface{}
+    name string
+    pos int
+}
+
+type predParser struct {
+    src string
+    toks []predToken
+    next int
+}
+
+func parsePredicateSource(src string) (*predNode, error) {
+    toks, err := lexPredicate(src)
+    if err != nil {
+        return nil, err
+    }
+    ps := &predParser{src, toks, 0}
+    node, err := ps.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    if tok := ps.peek(); tok.kind != tokEOF {
+        return nil, ps.expected("an operator or end of input", tok)
+    }
+    return node, nil
+}
+
+func (ps *predParser) peek() predToken {
+    return ps.toks[ps.next]
+}
+
+func (ps *predParser) pop() predToken {
+    tok := ps.toks[ps.next]
+    if tok.kind != tokEOF {
+        ps.next++
+    }
+    return tok
+}
+
+func (ps *predParser) isOp(ops ...string) bool {
+    tok := ps.peek()
+    if tok.kind == tokOp || tok.kind == tokIdent {
+        for _, op := range ops {
+            if tok.text == op {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func (ps *predParser) expected(what string, got predToken) error {
+    return &PredicateSyntaxError{ps.src, got.pos, "expected " + what + ", found " + got.describe()}
+}
+
+func (ps *predParser) expect(op string) error {
+    if !ps.isOp(op) {
+        return ps.expected("\""+op+"\"", ps.peek())
+    }
+    ps.pop()
+    return nil
+}
+
+func (ps *predParser) parseOr() (*predNode, error) {
+    return ps.parseLeftAssoc(ps.parseAnd, "||")
+}
+
+func (ps *predParser) parseAnd() (*predNode, error) {
+    return ps.parseLeftAssoc(ps.parseNot, "&&")
+}
+
+func (ps *predParser) parseLeftAssoc(operand func() (*predNode, error), ops ...string) (*predNode, error) {
+    left, err := operand()
+    if err != nil {
+        return nil, err
+    }
+    for ps.isOp(ops...) {
+        tok := ps.pop()
+        right, err := operand()
+        if err != nil {
+            return nil, err
+        }
+        left = &predNode{kind: nodeBinary, op: tok.text, args: []*predNode{left, right}, pos: tok.pos}
+    }
+    return left, nil
+}
+
+func (ps *predParser) parseNot() (*predNode, error) {
+    if ps.isOp("!") {
+        tok := ps.pop()
+        arg, err := ps.parseNot()
+        if err != nil {
+            return nil, err
+        }
+        return &predNode{kind: nodeNot, op: "!", args: []*predNode{arg}, pos: tok.pos}, nil
+    }
+    return ps.parseComparison()
+}
+
+func (ps *predParser) parseComparison() (*predNode, error) {
+    left, err := ps.parseSum()
+    if err != nil {
+        return nil, err
+    }
+    if ps.isOp("==", "!=", "<", "<=", ">", ">=", "in") {
+        tok := ps.pop()
+        right, err := ps.parseSum()
+        if err != nil {
+            return nil, err
+        }
+        left = &predNode{kind: nodeBinary, op: tok.text, args: []*predNode{left, right}, pos: tok.pos}
+        if ps.isOp("==", "!=", "<", "<=", ">", ">=", "in") {
+            return nil, &PredicateSyntaxError{ps.src, ps.peek().pos, "comparisons can not be chained, use parentheses"}
+        }
+    }
+    return left, nil
+}
+
+var arithmeticOps = map[string]string{"+": "add", "-": "sub", "*": "mul", "/": "div", "%": "mod"}
+
+func (ps *predParser) parseSum() (*predNode, error) {
+    return ps.parseArithmetic(ps.parseProduct, "+", "-")
+}
+
+func (ps *predParser) parseProduct() (*predNode, error) {
+    return ps.parseArithmetic(ps.parseOperand, "*", "/", "%")
+}
+
+func (ps *predParser) parseArithmetic(operand func() (*predNode, error), ops ...string) (*predNode, error) {
+    left, err := operand()
+    if err != nil {
+        return nil, err
+    }
+    for ps.isOp(ops...) {
+        tok := ps.pop()
+        right, err := operand()
+        if err != nil {
+            return nil, err
+        }
+        left = &predNode{kind: nodeExpr, op: arithmeticOps[tok.text], args: []*predNode{left, right}, pos: tok.pos}
+    }
+    return left, nil
+}
+
+// parses the arguments of abs, min, max, len and concat
+func (ps *predParser) parseFunction(name predToken) (*predNode, error) {
+    ps.pop()
+    node := &predNode{kind: nodeExpr, op: name.text, args: []*predNode{}, pos: name.pos}
+    for {
+        arg, err := ps.parseSum()
+        if err != nil {
+            return nil, err
+        }
+        node.args = append(node.args, arg)
+        if ps.isOp(")") {
+            ps.pop()
+            break
+        }
+        if err := ps.expect(","); err != nil {
+            return nil, ps.expected("\",\" or \")\"", ps.peek())
+        }
+    }
+    if (name.text == "abs" || name.text == "len") && len(node.args) != 1 {
+        return nil, &PredicateSyntaxError{ps.src, name.pos, name.text+" takes one argument"}
+    }
+    return node, nil
+}
+
+func (ps *predParser) parseOperand() (*predNode, error) {
+    tok := ps.pop()
+    switch tok.kind {
+        case tokInt, tokFloat:
+            return ps.numberValue(tok, "", tok.pos)
+        case tokString:
+            str, err := strconv.Unquote(tok.text)
+            if err != nil {
+                return nil, &PredicateSyntaxError{ps.src, tok.pos, "invalid string " + tok.text}
+            }
+            return &predNode{kind: nodeValue, value: str, pos: tok.pos}, nil
+        case tokIdent:
+            switch tok.text {
+                case "true":
+                    return &predNode{kind: nodeValue, value: true, pos: tok.pos}, nil
+                case "false":
+                    return &predNode{kind: nodeValue, value: false, pos: tok.pos}, nil
+                case "receiver", "this":
+                    name, err := ps.parseAttributeName()
+                    if err != nil {
+                        return nil, err
+                    }
+                    kind := nodeReceiver
+                    if tok.text == "this" {
+                        kind = nodeThis
+                    }
+                    return &predNode{kind: kind, name: name, pos: tok.pos}, nil
+                case "msg":
+                    name, err := ps.parseMessageField()
+                    if err != nil {
+                        return nil, err
+                    }
+                    return &predNode{kind: nodeThis, name: name, pos: tok.pos}, nil
+                case "int64", "uint64", "float64", "time", "duration":
+                    if ps.isOp("(") {
+                        return ps.parseConversion(tok)
+                    }
+                case "abs", "min", "max", "len", "concat":
+                    if ps.isOp("(") {
+                        return ps.parseFunction(tok)
+                    }
+            }
+        case tokOp:
+            switch tok.text {
+                case "(":
+                    node, err := ps.parseOr()
+                    if err != nil {
+                        return nil, err
+                    }
+                    if err := ps.expect(")"); err != nil {
+                        return nil, err
+                    }
+                    return node, nil
+                case "[":
+                    return ps.parseTuple(tok)
+                case "-":
+                    if num := ps.peek(); (num.kind == tokInt || num.kind == tokFloat) && num.pos == tok.pos+1 {
+                        ps.pop()
+                        return ps.numberValue(num, "-", tok.pos)
+                    }
+                    arg, err := ps.parseOperand()
+                    if err != nil {
+                        return nil, err
+                    }
+                    zero := &predNode{kind: nodeValue, value: 0, pos: tok.pos}
+                    return &predNode{kind: nodeExpr, op: "sub", args: []*predNode{zero, arg}, pos: tok.pos}, nil
+            }
+    }
+    return nil, ps.expected("a value, an attribute or \"(\"", tok)
+}
+
+// an integer literal is an int, a literal with a fraction or an exponent is a float64
+func (ps *predParser) numberValue(tok predToken, sign string, pos int) (*predNode, error) {
+    if tok.kind == tokFloat {
+        f, err := strconv.ParseFloat(sign + tok.text, 64)
+        if err != nil {
+            return nil, &PredicateSyntaxError{ps.src, pos, "number out of range"}
+        }
+        return &predNode{kind: nodeValue, value: f, pos: pos}, nil
+    }
+    n, err := strconv.Atoi(sign + tok.text)
+    if err != nil {
+        return nil, &PredicateSyntaxError{ps.src, pos, "integer out of range"}
+    }
+    return &predNode{kind: nodeValue, value: n, pos: pos}, nil
+}
+
+/*
+parseConversion reads the values that have no literal: int64(-5), uint64(5),
+float64("NaN"), time("2006-01-02T15:04:05Z") with a RFC 3339 time and
+duration("1h30m") with a duration read by time.ParseDuration.
+*/
+func (ps *predParser) parseConversion(name predToken) (*predNode, error) {
+    ps.pop()
+    neg := ps.isOp("-")
+    if neg {
+        ps.pop()
+    }
+    tok := ps.pop()
+    text := tok.text
+    if tok.kind == tokString {
+        var err error
+        if text, err = strconv.Unquote(tok.text); err != nil || neg {
+            return nil, &PredicateSyntaxError{ps.src, tok.pos, "invalid string " + tok.text}
+        }
+    } else if neg {
+        text = "-" + text
+    }
+    var value interface{}
+    var err error
+    switch {
+        case name.text == "int64" && tok.kind == tokInt:
+            value, err = strconv.ParseInt(text, 10, 64)
+        case name.text == "uint64" && tok.kind == tokInt:
+            value, err = strconv.ParseUint(text, 10, 64)
+        case name.text == "float64" && tok.kind != tokEOF && tok.kind != tokOp:
+            value, err = strconv.ParseFloat(text, 64)
+        case name.text == "time" && tok.kind == tokString:
+            value, err = time.Parse(time.RFC3339Nano, text)
+        case name.text == "duration" && tok.kind == tokString:
+            value, err = time.ParseDuration(text)
+        default:
+            return nil, ps.expected("the argument of " + name.text, tok)
+    }
+    if err != nil {
+        return nil, &PredicateSyntaxError{ps.src, tok.pos, fmt.Sprintf("invalid %s %s", name.text, tok.text)}
+    }
+    if err := ps.expect(")"); err != nil {
+        return nil, err
+    }
+    return &predNode{kind: nodeValue, value: value, pos: name.pos}, nil
+}
+
+// parses .name or ["name"] after receiver or this
+func (ps *predParser) parseAttributeName() (string, error) {
+    if ps.isOp(".") {
+        ps.pop()
+        tok := ps.pop()
+        if tok.kind != tokIdent {
+            return "", ps.expected("an attribute name", tok)
+        }
+        return tok.text, nil
+    } else if ps.isOp("[") {
+        ps.pop()
+        tok := ps.pop()
+        if tok.kind != tokString {
+            return "", ps.expected("a quoted attribute name", tok)
+        }
+        name, err := strconv.Unquote(tok.text)
+        if err != nil {
+            return "", &PredicateSyntaxError{ps.src, tok.pos, "invalid string " + tok.text}
+        }
+        if err := ps.expect("]"); err != nil {
+            return "", err
+        }
+        return name, nil
+    }
+    return "", ps.expected("\".\" or \"[\"", ps.peek())
+}
+
+// parses [i] after msg, if any: the name of the attribute that holds the field i of the message
+func (ps *predParser) parseMessageField() (string, error) {
+    if !ps.isOp("[") {
+        return msgAttribute, nil
+    }
+    ps.pop()
+    tok := ps.pop()
+    if tok.kind != tokInt {
+        return "", ps.expected("the index of a field", tok)
+    }
+    i, err := strconv.Atoi(tok.text)
+    if err != nil {
+        return "", &PredicateSyntaxError{ps.src, tok.pos, "index out of range"}
+    }
+    if err := ps.expect("]"); err != nil {
+        return "", err
+    }
+    return msgFieldAttribute(i), nil
+}
+
+func (ps *predParser) parseTuple(open predToken) (*predNode, error) {
+    node := &predNode{kind: nodeTuple, args: []*predNode{}, pos: open.pos}
+    if ps.isOp("]") {
+        ps.pop()
+        return node, nil
+    }
+    for {
+        elem, err := ps.parseOperand()
+        if err != nil {
+            return nil, err
+        }
+        node.args = append(node.args, elem)
+        if ps.isOp("]") {
+            ps.pop()
+            return node, nil
+        }
+        if err := ps.expect(","); err != nil {
+            return nil, ps.expected("\",\" or \"]\"", ps.peek())
+        }
+    }
+}
+
+//////////// conversion
+
+func (n *predNode) findThis() *predNode {
+    if n.kind == nodeThis {
+        return n
+    }
+    for _, arg := range n.args {
+        if ref := arg.findThis(); ref != nil {
+            return ref
+        }
+    }
+    return nil
+}
+
+func (n *predNode) toPredicate(src string) (Predicate, error) {
+    switch n.kind {
+        case nodeValue:
+            if b, isBool := n.value.(bool); isBool {
+                if b {
+                    return True(), nil
+                }
+                return False(), nil
+            }
+        case nodeNot:
+            p, err := n.args[0].toPredicate(src)
+            if err != nil {
+                return nil, err
+            }
+            return Not(p), nil
+        case nodeBinary:
+            switch n.op {
+                case "||", "&&":
+                    p1, err := n.args[0].toPredicate(src)
+                    if err != nil {
+                        return nil, err
+                    }
+                    p2, err := n.args[1].toPredicate(src)
+                    if err != nil {
+                        return nil, err
+                    }
+                    if n.op == "||" {
+                        return Or(p1, p2), nil
+                    }
+                    return And(p1, p2), nil
+                default:
+                    arg1, err := n.args[0].toOperand(src)
+                    if err != nil {
+                        return nil, err
+                    }
+                    arg2, err := n.args[1].toOperand(src)
+                    if err != nil {
+                        return nil, err
+                    }
+                    if n.op == "in" {
+                        return Belong(arg1, arg2), nil
+                    }
+                    return comp{arg1, n.op, arg2}, nil
+            }
+    }
+    return nil, &PredicateSyntaxError{src, n.pos, "expected a predicate, found a value"}
+}
+
+func (n *predNode) toOperand(src string) (interface{}, error) {
+    switch n.kind {
+        case nodeValue:
+            return n.value, nil
+        case nodeReceiver:
+            return Receiver(n.name), nil
+        case nodeThis:
+            return Comp(n.name), nil
+        case nodeExpr:
+            args := make([]interface{}, len(n.args))
+            for i, arg := range n.args {
+                var err error
+                if args[i], err = arg.toOperand(src); err != nil {
+                    return nil, err
+                }
+            }
+            return expr{n.op, args}, nil
+        case nodeTuple:
+            elems := make([]interface{}, len(n.args))
+            for i, arg := range n.args {
+                if arg.kind != nodeValue && arg.kind != nodeTuple {
+                    return nil, &PredicateSyntaxError{src, arg.pos, "tuples can only contain values"}
+                }
+                elems[i], _ = arg.toOperand(src)
+            }
+            return NewTuple(elems...), nil
+    }
+    return nil, &PredicateSyntaxError{src, n.pos, "expected a value, found a predicate"}
+}
+
+//////////// printer
+
+const (
+    precOr = iota+1
+    precAnd
+    precNot
+)
+
+func openParen(sb *strings.Builder, prec int, minPrec int) {
+    if prec < minPrec {
+        sb.WriteString("(")
+    }
+}
+
+func closeParen(sb *strings.Builder, prec int, minPrec int) {
+    if prec < minPrec {
+        sb.WriteString(")")
+    }
+}
+
+// the right operand is printed with a higher precedence, so that the shape of the tree is kept
+func formatPredicate(sb *strings.Builder, p Predicate, minPrec int) error {
+    var err error
+    switch pp := p.(type) {
+        case _true:
+            sb.WriteString("true")
+        case _false:
+            sb.WriteString("false")
+        case or:
+            openParen(sb, precOr, minPrec)
+            if err = formatPredicate(sb, pp.p1, precOr); err == nil {
+                sb.WriteString(" || ")
+                err = formatPredicate(sb, pp.p2, precAnd)
+            }
+            closeParen(sb, precOr, minPrec)
+        case and:
+            openParen(sb, precAnd, minPrec)
+            if err = formatPredicate(sb, pp.p1, precAnd); err == nil {
+                sb.WriteString(" && ")
+                err = formatPredicate(sb, pp.p2, precNot)
+            }
+            closeParen(sb, precAnd, minPrec)
+        case not:
+            openParen(sb, precNot, minPrec)
+            sb.WriteString("!")
+            err = formatPredicate(sb, pp.p, precNot)
+            closeParen(sb, precNot, minPrec)
+        case comp:
+            err = formatComparison(sb, pp.arg1, false, pp.op, pp.arg2, false)
+        case isin:
+            err = formatComparison(sb, pp.arg1, false, "in", pp.arg2, false)
+        default:
+            err = fmt.Errorf("goat: predicate %T has no readable form", p)
+    }
+    return err
+}
+
+func formatClosedPredicate(sb *strings.Builder, p ClosedPredicate, minPrec int) error {
+    var err error
+    switch pp := p.(type) {
+        case _true:
+            sb.WriteString("true")
+        case _false:
+            sb.WriteString("false")
+        case cor:
+            openParen(sb, precOr, minPrec)
+            if err = formatClosedPredicate(sb, pp.p1, precOr); err == nil {
+                sb.WriteString(" || ")
+                err = formatClosedPredicate(sb, pp.p2, precAnd)
+            }
+            closeParen(sb, precOr, minPrec)
+        case cand:
+            openParen(sb, precAnd, minPrec)
+            if err = formatClosedPredicate(sb, pp.p1, precAnd); err == nil {
+                sb.WriteString(" && ")
+                err = formatClosedPredicate(sb, pp.p2, precNot)
+            }
+            closeParen(sb, precAnd, minPrec)
+        case cnot:
+            openParen(sb, precNot, minPrec)
+            sb.WriteString("!")
+            err = formatClosedPredicate(sb, pp.p, precNot)
+            closeParen(sb, precNot, minPrec)
+        case ccomp:
+            err = formatComparison(sb, pp.Par1, pp.IsAttr1, pp.Op, pp.Par2, pp.IsAttr2)
+        case cisin:
+            err = formatComparison(sb, pp.Par1, pp.IsAttr1, "in", pp.Par2, pp.IsAttr2)
+        default:
+            err = fmt.Errorf("goat: predicate %T has no readable form", p)
+    }
+    return err
+}
+
+func formatComparison(sb *strings.Builder, arg1 interface{}, isAttr1 bool, op string, arg2 interface{}, isAttr2 bool) error {
+    if err := formatOperand(sb, arg1, isAttr1); err != nil {
+        return err
+    }
+    sb.WriteString(" " + op + " ")
+    return formatOperand(sb, arg2, isAttr2)
+}
+
+func formatAttribute(sb *strings.Builder, owner string, name string) {
+    sb.WriteString(owner)
+    if isIdentifier(name) {
+        sb.WriteString("." + name)
+    } else {
+        sb.WriteString("[" + strconv.Quote(name) + "]")
+    }
+}
+
+// writes an attribute of the sender, or the message of a Policy rule
+func formatThisAttribute(sb *strings.Builder, name string) {
+    if i, isMsg := messageField(name); isMsg {
+        sb.WriteString("msg")
+        if i >= 0 {
+            sb.WriteString("[" + itoa(i) + "]")
+        }
+        return
+    }
+    formatAttribute(sb, "this", name)
+}
+
+func formatOperand(sb *strings.Builder, x interface{}, isAttr bool) error {
+    if isAttr {
+        formatAttribute(sb, "receiver", x.(string))
+        return nil
+    }
+    switch val := x.(type) {
+        case expr:
+            return formatExpression(sb, val.op, val.args, 0)
+        case cexpr:
+            return formatExpression(sb, val.op, val.args, 0)
+        case recattr:
+            formatAttribute(sb, "receiver", val.name)
+        case compattr:
+            formatThisAttribute(sb, val.name)
+        case int:
+            sb.WriteString(itoa(val))
+        case int64:
+            sb.WriteString("int64(" + strconv.FormatInt(val, 10) + ")")
+        case uint64:
+            sb.WriteString("uint64(" + strconv.FormatUint(val, 10) + ")")
+        case float64:
+            sb.WriteString(formatFloat(val))
+        case time.Time:
+            sb.WriteString("time(" + strconv.Quote(val.Format(time.RFC3339Nano)) + ")")
+        case time.Duration:
+            sb.WriteString("duration(" + strconv.Quote(val.String()) + ")")
+        case string:
+            sb.WriteString(strconv.Quote(val))
+        case bool:
+            sb.WriteString(strconv.FormatBool(val))
+        case _true:
+            sb.WriteString("true")
+        case _false:
+            sb.WriteString("false")
+        case Tuple:
+            sb.WriteString("[")
+            for i, elem := range val.Elems {
+                if i > 0 {
+                    sb.WriteString(", ")
+                }
+                switch elem.(type) {
+                    case recattr, compattr:
+                        return fmt.Errorf("goat: tuples with attributes have no readable form")
+                }
+                if err := formatOperand(sb, elem, false); err != nil {
+                    return err
+                }
+            }
+            sb.WriteString("]")
+        default:
+            return fmt.Errorf("goat: value %v of type %T has no readable form", x, x)
+    }
+    return nil
+}
+
+const (
+    precSum = iota+1
+    precProduct
+    precTerm
+)
+
+var arithmeticSymbols = map[string]string{"add": " + ", "sub": " - ", "mul": " * ", "div": " / ", "mod": " % "}
+
+// + - * / % are written infix, the other operations as functions
+func formatExpression(sb *strings.Builder, op string, args []interface{}, minPrec int) error {
+    symbol, infix := arithmeticSymbols[op]
+    if infix && len(args) < 2 {
+        if len(args) == 1 && (op == "add" || op == "mul") {
+            return formatOperand(sb, args[0], false)
+        }
+        return fmt.Errorf("goat: %s with %d arguments has no readable form", op, len(args))
+    }
+    if !infix {
+        sb.WriteString(op + "(")
+        for i, arg := range args {
+            if i > 0 {
+                sb.WriteString(", ")
+            }
+            if err := formatOperand(sb, arg, false); err != nil {
+                return err
+            }
+        }
+        sb.WriteString(")")
+        return nil
+    }
+    prec := precSum
+    if op == "mul" || op == "div" || op == "mod" {
+        prec = precProduct
+    }
+    openParen(sb, prec, minPrec)
+    for i, arg := range args {
+        argPrec := prec
+        if i > 0 {
+            sb.WriteString(symbol)
+            argPrec = prec+1
+        }
+        var err error
+        switch val := arg.(type) {
+            case expr:
+                err = formatExpression(sb, val.op, val.args, argPrec)
+            case cexpr:
+                err = formatExpression(sb, val.op, val.args, argPrec)
+            default:
+                err = formatOperand(sb, arg, false)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    closeParen(sb, prec, minPrec)
+    return nil
+}
+
+// writes f so that it is read back as a float64, not as an int
+func formatFloat(f float64) string {
+    if math.IsInf(f, 0) || math.IsNaN(f) {
+        return "float64(" + strconv.Quote(strconv.FormatFloat(f, 'g', -1, 64)) + ")"
+    }
+    str := strconv.FormatFloat(f, 'g', -1, 64)
+    if !strings.ContainsAny(str, ".e") {
+        str += ".0"
+    }
+    return str
+}
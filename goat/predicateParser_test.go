@@ -0,0 +1,186 @@
+package goat
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+func TestParsePredicateMatchesConstructors(t *testing.T) {
+    InitSend()
+    attr := Attributes{}
+    attr.init(map[string]interface{}{"maxLoad": 10})
+    cases := []struct{
+        src string
+        pred Predicate
+    }{
+        {`true`, True()},
+        {`false`, False()},
+        {`receiver.role == "worker"`, Equals(Receiver("role"), "worker")},
+        {`receiver.load < this.maxLoad`, LessThan(Receiver("load"), Comp("maxLoad"))},
+        {`receiver["a b"] >= -3`, GreaterThanOrEqual(Receiver("a b"), -3)},
+        {`"x" in receiver.tags`, Belong("x", Receiver("tags"))},
+        {`receiver.n in [1, "a", [true]]`, Belong(Receiver("n"), NewTuple(1, "a", NewTuple(true)))},
+        {`receiver.role == "worker" && receiver.load < this.maxLoad || "x" in receiver.tags`,
+            Or(And(Equals(Receiver("role"), "worker"), LessThan(Receiver("load"), Comp("maxLoad"))), Belong("x", Receiver("tags")))},
+        {`!receiver.x == 1`, Not(Equals(Receiver("x"), 1))},
+        {`receiver.a != 1 && (receiver.b <= 2 || !(receiver.c > 3))`,
+            And(NotEquals(Receiver("a"), 1), Or(LessThanOrEqual(Receiver("b"), 2), Not(GreaterThan(Receiver("c"), 3))))},
+        {`receiver.a == 1 && receiver.b == 2 && receiver.c == 3`,
+            And(Equals(Receiver("a"), 1), Equals(Receiver("b"), 2), Equals(Receiver("c"), 3))},
+        {`receiver.x - 10 < this.maxLoad && this.maxLoad < receiver.x + 10`,
+            And(LessThan(Minus(Receiver("x"), 10), Comp("maxLoad")), LessThan(Comp("maxLoad"), Plus(Receiver("x"), 10)))},
+        {`receiver.a * 2 + -receiver.b % 3 >= (this.maxLoad - 1) / 2`,
+            GreaterThanOrEqual(Plus(Times(Receiver("a"), 2), Mod(Minus(0, Receiver("b")), 3)), 4)},
+        {`abs(receiver.a - receiver.b) <= max(1, min(receiver.c, 3)) && len(concat(receiver.s, "x")) > 2`,
+            And(LessThanOrEqual(Abs(Minus(Receiver("a"), Receiver("b"))), Max(1, Min(Receiver("c"), 3))), GreaterThan(Len(Concat(Receiver("s"), "x")), 2))},
+    }
+    for _, c := range cases {
+        p, err := ParsePredicate(c.src)
+        if err != nil {
+            t.Errorf("%s: %v", c.src, err)
+            continue
+        }
+        if got, want := p.CloseUnder(&attr).String(), c.pred.CloseUnder(&attr).String(); got != want {
+            t.Errorf("%s: got %s, want %s", c.src, got, want)
+        }
+    }
+}
+
+func TestFormatPredicateRoundTrip(t *testing.T) {
+    preds := []Predicate{
+        Or(And(Equals(Receiver("role"), "worker\n"), LessThan(Receiver("load"), Comp("maxLoad"))), Belong("x", Receiver("tags"))),
+        And(Equals(Receiver("a"), 1), Or(Equals(Receiver("b"), -2), Not(Not(True())))),
+        Or(Equals(Receiver("a"), 1), Or(Equals(Receiver("b"), 2), False())),
+        Belong(Receiver("weird name"), NewTuple(1, NewTuple("z"))),
+        LessThan(Minus(Receiver("a"), Minus(Receiver("b"), Receiver("c"))), Times(Plus(Comp("d"), 1), Div(Receiver("e"), -2))),
+        Equals(Concat(Receiver("s"), "x"), Min(Len(Receiver("t")), Abs(Receiver("u")))),
+    }
+    for _, pred := range preds {
+        src, err := FormatPredicate(pred)
+        if err != nil {
+            t.Errorf("%v: %v", pred, err)
+            continue
+        }
+        back, err := ParsePredicate(src)
+        if err != nil {
+            t.Errorf("%s: %v", src, err)
+            continue
+        }
+        again, _ := FormatPredicate(back)
+        if again != src {
+            t.Errorf("round trip changed %s into %s", src, again)
+        }
+    }
+    if src, _ := FormatPredicate(And(Not(Equals(Receiver("a"), 1)), Equals(Receiver("b"), "x"))); src != `!receiver.a == 1 && receiver.b == "x"` {
+        t.Errorf("unexpected format %s", src)
+    }
+    if _, err := FormatPredicate(Equals(Receiver("a"), Evaluate(func(...interface{})interface{}{ return 1 }))); err == nil {
+        t.Errorf("Evaluate should have no readable form")
+    }
+}
+
+func TestParseClosedPredicate(t *testing.T) {
+    attr := Attributes{}
+    attr.init(map[string]interface{}{"role": "worker", "tags": NewTuple("x", "y")})
+    p, err := ParseClosedPredicate(`receiver.role == "worker" && "y" in receiver.tags`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !p.Satisfy(&attr) {
+        t.Errorf("%s should be satisfied", p)
+    }
+    src, err := FormatClosedPredicate(p)
+    if err != nil || src != `receiver.role == "worker" && "y" in receiver.tags` {
+        t.Errorf("unexpected format %s (%v)", src, err)
+    }
+    if _, err := ParseClosedPredicate(`receiver.a == this.b`); err == nil {
+        t.Errorf("a closed predicate can not refer to this")
+    }
+}
+
+func TestParsePredicateErrors(t *testing.T) {
+    cases := []struct{
+        src string
+        pos int
+    }{
+        {``, 0},
+        {`receiver.a ==`, 13},
+        {`receiver.a == 1 receiver.b`, 16},
+        {`receiver.a == 1 == 2`, 16},
+        {`(receiver.a == 1`, 16},
+        {`receiver.a`, 0},
+        {`receiver.a == 1 && 3`, 19},
+        {`receiver == 1`, 9},
+        {`"abc`, 0},
+        {`receiver.a == 1 # 2`, 16},
+        {`receiver.a in [1, receiver.b]`, 18},
+        {`receiver.a == (true && false)`, 20},
+        {`receiver.a + == 1`, 13},
+        {`abs(receiver.a, 1) == 1`, 0},
+        {`receiver.a + 1`, 11},
+    }
+    for _, c := range cases {
+        _, err := ParsePredicate(c.src)
+        synErr, isSynErr := err.(*PredicateSyntaxError)
+        if !isSynErr {
+            t.Errorf("%q: expected a syntax error, got %v", c.src, err)
+        } else if synErr.Pos != c.pos {
+            t.Errorf("%q: error at %d, expected at %d (%v)", c.src, synErr.Pos, c.pos, err)
+        }
+    }
+}
+
+func TestParsePredicateNumbersAndTimes(t *testing.T) {
+    InitSend()
+    deadline := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+    attr := Attributes{}
+    attr.init(map[string]interface{}{"battery": 0.35, "deadline": deadline, "age": 90 * time.Minute, "id": int64(7), "mask": uint64(1) << 63})
+    cases := []struct{
+        src string
+        want bool
+    }{
+        {`receiver.battery > 0.2`, true},
+        {`receiver.battery > 1`, false},
+        {`receiver.battery >= 35e-2`, true},
+        {`receiver.battery < -1.5`, false},
+        {`receiver.deadline < time("2024-03-01T13:00:00+01:00")`, false},
+        {`receiver.deadline == time("2024-03-01T13:30:00+01:00")`, true},
+        {`receiver.age > duration("1h")`, true},
+        {`receiver.id == 7 && receiver.id == int64(7) && receiver.id > int64(-7)`, true},
+        {`receiver.mask > uint64(9223372036854775807)`, true},
+        {`receiver.battery < float64("Inf")`, true},
+    }
+    for _, c := range cases {
+        p, err := ParseClosedPredicate(c.src)
+        if err != nil {
+            t.Errorf("%s: %v", c.src, err)
+            continue
+        }
+        if p.Satisfy(&attr) != c.want {
+            t.Errorf("%s should be %v", c.src, c.want)
+        }
+        wire, err := ToPredicate(p.String())
+        if err != nil || wire.Satisfy(&attr) != c.want {
+            t.Errorf("%s changed on the wire into %s (%v)", c.src, wire, err)
+        }
+    }
+    pred := And(Equals(Receiver("a"), 2.0), LessThan(Receiver("b"), math.Inf(1)), Equals(Receiver("c"), int64(-3)),
+        Equals(Receiver("d"), uint64(3)), Equals(Receiver("e"), deadline), Equals(Receiver("f"), 1500*time.Millisecond))
+    src, err := FormatPredicate(pred)
+    if err != nil {
+        t.Fatal(err)
+    }
+    back, err := ParsePredicate(src)
+    if err != nil {
+        t.Fatalf("%s: %v", src, err)
+    }
+    if back.CloseUnder(nil).String() != pred.CloseUnder(nil).String() {
+        t.Errorf("%s read back as %s", src, back.CloseUnder(nil))
+    }
+    for _, bad := range []string{`receiver.a == int64("1")`, `receiver.a == time("tomorrow")`, `receiver.a == duration(5)`, `receiver.a == uint64(-1)`} {
+        if _, err := ParsePredicate(bad); err == nil {
+            t.Errorf("%s should not parse", bad)
+        }
+    }
+}
@@ -0,0 +1,132 @@
+package goat
+
+import (
+    "testing"
+)
+
+func TestToPredicateRoundTrip(t *testing.T) {
+    InitSend()
+    preds := []ClosedPredicate{
+        True(),
+        Not(False()).CloseUnder(nil),
+        And(Equals(Receiver("a b"), "x,y)"), Or(LessThan(Receiver("n"), -3), Belong(true, NewTuple(true, 1)))).CloseUnder(nil),
+    }
+    for _, p := range preds {
+        back, err := ToPredicate(p.String())
+        if err != nil {
+            t.Errorf("%s: %v", p, err)
+        } else if back.String() != p.String() {
+            t.Errorf("%s decoded as %s", p, back)
+        }
+    }
+}
+
+func TestToPredicateErrors(t *testing.T) {
+    cases := []struct{
+        src string
+        pos int
+    }{
+        {"", 0},
+        {"T", 0},
+        {"XX", 0},
+        {"TTFF", 2},
+        {"&(TT,FF)x", 8},
+        {"&(TT;FF)", 4},
+        {"&(TT,FF", 7},
+        {"!(TT", 4},
+        {"=(A|x,I|abc)", 8},
+        {"=(A|x,B|maybe)", 8},
+        {"=(A|x,T|notbase64)", 8},
+        {"=(A|x,Q|1)", 6},
+        {"=(A|x,S)", 7},
+        {"=(A|x", 5},
+        {"=(A|x,", 6},
+        {"|(TT,&(FF,Z))", 10},
+    }
+    for _, c := range cases {
+        _, err := ToPredicate(c.src)
+        synErr, isSynErr := err.(*PredicateSyntaxError)
+        if !isSynErr {
+            t.Errorf("%q: expected a syntax error, got %v", c.src, err)
+        } else if synErr.Pos != c.pos {
+            t.Errorf("%q: error at %d, expected at %d (%v)", c.src, synErr.Pos, c.pos, err)
+        }
+    }
+}
+
+func TestDecodeDataMessage(t *testing.T) {
+    InitSend()
+    tpl := NewTuple("Ciao")
+    msg, err := decodeDataMessage([]string{"7", "1", "TT", tpl.encode()})
+    if err != nil || msg.Id != 7 || msg.Message.Get(0) != "Ciao" {
+        t.Errorf("valid message decoded as %v (%v)", msg, err)
+    }
+    for _, params := range [][]string{
+        {"7", "1", "&(TT", tpl.encode()},
+        {"7", "1", "TT", "garbage"},
+        {"7", "1"},
+    } {
+        msg, err := decodeDataMessage(params)
+        if err == nil || msg.Id != 7 || !msg.Message.IsLong(0) || msg.Pred.String() != "FF" {
+            t.Errorf("%v decoded as %v (%v)", params, msg, err)
+        }
+    }
+    if msg, err := decodeDataMessage([]string{"x", "1", "TT", tpl.encode()}); err == nil || msg.Id != -1 {
+        t.Errorf("a message without mid decoded as %v", msg)
+    }
+}
+
+// a request can not reserve more than maxMidReservation mids, nor a reply grant them
+func TestMidCountLimit(t *testing.T) {
+    for _, c := range []struct{
+        n string
+        valid bool
+    }{
+        {"1", true},
+        {itoa(maxMidReservation), true},
+        {itoa(maxMidReservation + 1), false},
+        {"1000000000000", false},
+        {"0", false},
+    } {
+        if _, err := decodeMidCount([]string{"3", c.n}); (err == nil) != c.valid {
+            t.Errorf("REQN 3 %s: %v", c.n, err)
+        }
+        if _, _, err := decodeMidRange([]string{"10", c.n}); (err == nil) != c.valid {
+            t.Errorf("RPLYN 10 %s: %v", c.n, err)
+        }
+    }
+}
+
+func TestRingAgentSurvivesInvalidData(t *testing.T) {
+    InitSend()
+    regConns, regReady, regPort := listenerInt(0)
+    <- regReady
+    defer regConns.Close()
+    agent := NewRingAgent("127.0.0.1:" + itoa(regPort))
+    chnNode := make(chan *duplexConn)
+    go func(){
+        // plays both the registration and the node the agent is assigned to
+        regConn := <- regConns.Out
+        _, params := regConn.Receive()
+        nodeConn := connectWith("127.0.0.1:" + params[0])
+        nodeConn.Send("Registered", "0", "0")
+        chnNode <- nodeConn
+    }()
+    comp := NewComponent(agent, nil)
+    nodeConn := <- chnNode
+    defer nodeConn.Close()
+    received := make(chan struct{})
+    NewProcess(comp).Run(func(p *Process) {
+        p.Receive(func(attr *Attributes, msg Tuple) bool {
+            return msg.IsLong(1) && msg.Get(0) == "Ciao"
+        })
+        close(received)
+    })
+    ciao := NewTuple("Ciao")
+    nodeConn.Send("DATA", "zero", "1", "TT", ciao.encode())
+    nodeConn.Send("DATA", "0", "1", "&(TT", ciao.encode())
+    nodeConn.Send("DATA", "1", "1", "TT", "not a tuple")
+    nodeConn.Send("RPLY")
+    nodeConn.Send("DATA", "2", "1", "TT", ciao.encode())
+    waitAll(t, 2000, received)
+}
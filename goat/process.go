@@ -1,6 +1,10 @@
 package goat
 
 import (
+	"context"
+	"log"
+	"runtime"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +18,8 @@ type Process struct {
 	chnMessage       chan Message
 	
 	DBGSstatus int
+	id int
+	setting bool // SetIf is running
 }
 
 /*
@@ -26,6 +32,7 @@ func NewProcess(c *Component) *Process {
 
 		//chnAcceptMessage: make(chan bool),
 		chnMessage:       make(chan Message),
+		id:               int(atomic.AddInt64(&c.lastProcessId, 1)),
 	}
 	return &p
 }
@@ -37,6 +44,19 @@ func (p *Process) unsubscribe() {
 	dprintln("Unsubscribed")
 }
 
+// terminate is called when the goroutine of p ends, normally or because of a cancellation.
+func (p *Process) terminate() {
+	p.unsubscribe()
+	p.Comp.processes.Done()
+}
+
+// exitIfCancelled ends the goroutine of p if its component cancelled it.
+func (p *Process) exitIfCancelled(err error) {
+	if err == ErrComponentClosed {
+		runtime.Goexit()
+	}
+}
+
 /*
 Run defines that the wrapped component must behave like procFnc, and starts the
 component behaviour. Note that each component behaves as only one process (that
@@ -52,12 +72,15 @@ func (p *Process) Run(procFncs ...func(p *Process)) {
 	        procs[i] = NewProcess(p.Comp)
 	    }
 	}
+	if !p.Comp.addProcesses(len(procs), false) {
+	    return
+	}
 	p.Comp.chnSubscribe <- procs
 	for i, pr := range procs{
 	    go func(q *Process, procFnc func(p *Process), i int){
 	        //fmt.Println(i)
+	        defer q.terminate()
 	        q.Call(procFnc)
-		    q.unsubscribe()
 	    }(pr, procFncs[i], i)
 	}
 	/*go func() {
@@ -85,11 +108,12 @@ func (p *Process) Spawn(procFncs ...func(p *Process)) {
 	for i := range procs {
         procs[i] = NewProcess(p.Comp)
 	}
+	p.Comp.addProcesses(len(procs), true)
 	p.Comp.chnSubscribe <- procs
 	for i, pr := range procs{
 	    go func(q *Process, procFnc func(p *Process)){
+	        defer q.terminate()
 	        q.Call(procFnc)
-		    q.unsubscribe()
 	    }(pr, procFncs[i])
 	}
     /*
@@ -117,14 +141,24 @@ message satisfies the accept condition. aware and accept can alter the attribute
 (attr), but if the message is not accepted any change to them will be lost.
 */
 func (p *Process) Receive(accept func(attr *Attributes, msg Tuple) bool) Tuple {
-	return p.sendrec(
+	msg, err := p.ReceiveCtx(context.Background(), accept)
+	p.exitIfCancelled(err)
+	return msg
+}
+
+/*
+ReceiveCtx behaves like Receive, but gives up when ctx is done. In that case it
+returns an empty tuple and the error of ctx, and no message is consumed.
+*/
+func (p *Process) ReceiveCtx(ctx context.Context, accept func(attr *Attributes, msg Tuple) bool) (Tuple, error) {
+	return p.sendrecCtx(ctx,
 		func(attr *Attributes, receiving bool) SendReceive {
 			if receiving {
 				return ThenReceive(accept)
 			} else {
 				return ThenFail()
 			}
-		}, true)
+		}, true, false)
 }
 
 type srAction int
@@ -137,6 +171,7 @@ const (
 type SendReceive struct {
 	action  srAction
 	msg     string
+	tuple   Tuple // msg before encoding
 	msgPred ClosedPredicate
 	valid   bool
 	accept  func(*Attributes, Tuple) bool
@@ -163,6 +198,7 @@ func ThenSendUpdate(msg Tuple, msgPred ClosedPredicate, updFnc func(*Attributes)
 	return SendReceive{
 		action:  sendAction,
 		msg:     msg.encode(),
+		tuple:   msg,
 		msgPred: msgPred,
 		valid:   true,
 		updFnc:  updFnc,
@@ -211,17 +247,48 @@ func (p *Process) Sleep(msec int) {
 			p.Comp.messageDispatcher.chnAcceptMessage <- false
 		case <-timeout:
 			return
+		case <-p.Comp.chnCancel:
+			p.exitIfCancelled(ErrComponentClosed)
 		}
 	}
 }
 
 func (p *Process) sendrec(chooseFnc func(attr *Attributes, receiving bool) SendReceive, onlyReceive bool) Tuple {
+    msg, err := p.sendrecCtx(context.Background(), chooseFnc, onlyReceive, true)
+    p.exitIfCancelled(err)
+    return msg
+}
+
+/*
+sendrecCtx is the core of every send and receive. If ctx is done before a message
+is sent or received, the process withdraws from the midHandler and returns the
+error of ctx (or ErrComponentClosed if the component cancelled its processes).
+The withdrawal happens only between two offers: a mid or a message that was
+already given to the process is always answered, so nothing is lost.
+A send that the policy forbids whoever the receiver is returns ErrForbiddenByPolicy,
+unless waitForbidden: then it waits as if its guard were false, and is logged once.
+*/
+func (p *Process) sendrecCtx(ctx context.Context, chooseFnc func(attr *Attributes, receiving bool) SendReceive, onlyReceive bool, waitForbidden bool) (Tuple, error) {
+    if err := ctx.Err(); err != nil {
+        return NewTuple(), err
+    }
     incomingMids := make(chan struct{})
     if !onlyReceive {
         p.Comp.midHandler.AskMids(incomingMids)
     }
+    forbidden := false
     for {
         select {
+        case <- ctx.Done():
+            if !onlyReceive {
+                p.Comp.midHandler.StopMids(incomingMids)
+            }
+            return NewTuple(), ctx.Err()
+        case <- p.Comp.chnCancel:
+            if !onlyReceive {
+                p.Comp.midHandler.StopMids(incomingMids)
+            }
+            return NewTuple(), ErrComponentClosed
         case inMsg := <-p.chnMessage:
             attrs := p.Comp.attributes
 			nextAction := chooseFnc(attrs, true)
@@ -229,14 +296,14 @@ func (p *Process) sendrec(chooseFnc func(attr *Attributes, receiving bool) SendR
 				attrs.Satisfy(inMsg.Pred) &&
 				nextAction.accept(attrs, inMsg.Message) {
 	            p.DBGSstatus = 2
-	            p.Comp.attributes.commit()
+	            p.Comp.attributes.commitBy(CommitReceive, p.Name(), inMsg.Id)
 	            //fmt.Println("used", p.Comp.attributes.GetValue("used"))
 				p.Comp.messageDispatcher.chnAcceptMessage <- true
 				if !onlyReceive {
 				    p.Comp.midHandler.StopMids(incomingMids)
 				}
 	            p.DBGSstatus = 0
-				return inMsg.Message
+				return inMsg.Message, nil
 			} else {
 	            p.DBGSstatus = 3
 	            p.Comp.attributes.rollback()
@@ -251,10 +318,26 @@ func (p *Process) sendrec(chooseFnc func(attr *Attributes, receiving bool) SendR
 				msgPred := nextAction.msgPred
 				valid := nextAction.valid
 				if valid {
-				    nextAction.updFnc(p.Comp.attributes)
-				    p.Comp.attributes.commit()
-				    p.Comp.midHandler.SendMessage(messagePredicate{msg, msgPred, false}, incomingMids)
-		            return NewTuple()
+				    allowedPred, err := p.Comp.policy.restrict(p.Comp.attributes, nextAction.tuple, msgPred)
+				    if err == nil {
+				        nextAction.updFnc(p.Comp.attributes)
+				        action := CommitSend
+				        if p.setting {
+				            action = CommitSet
+				        }
+				        p.Comp.attributes.commitBy(action, p.Name(), p.Comp.attributes.mid)
+				        p.Comp.midHandler.SendMessage(messagePredicate{msg, allowedPred, false}, incomingMids)
+		                return NewTuple(), nil
+				    } else if !waitForbidden {
+				        // the mid handler withdraws the process and passes the mid on
+				        p.Comp.attributes.rollback()
+				        p.Comp.midHandler.StopMids(incomingMids)
+				        return NewTuple(), err
+				    } else if !forbidden {
+				        // the sender attributes can change: the send waits, as if its guard were false
+				        log.Printf("goat: process %s waits: %v", p.Name(), err)
+				        forbidden = true
+				    }
 				}
 			}
 			p.Comp.attributes.rollback()
@@ -408,6 +491,15 @@ func (p *Process) Send(msg Tuple, pr Predicate){
     p.GSendUpd(True(), msg, pr, func(*Attributes){})
 }
 
+/*
+SendCtx behaves like Send, but gives up when ctx is done. In that case it returns
+the error of ctx and the message is not sent. It also gives up with
+ErrForbiddenByPolicy if the policy of the component forbids the message.
+*/
+func (p *Process) SendCtx(ctx context.Context, msg Tuple, pr Predicate) error {
+    return p.GSendUpdCtx(ctx, True(), msg, pr, func(*Attributes){})
+}
+
 /*
 SendUpd sends a message to other components. msg contains the message to be sent,
 pr states the property a component must satisfy to receive msg. After sending the
@@ -432,7 +524,20 @@ func (p *Process) WaitSend(cond Predicate, msg Tuple, pr Predicate){
 }
 
 func (p *Process) GSendUpd(cond Predicate, msg Tuple, pr Predicate, upd func(*Attributes)){
-    p.sendrec(func(attr *Attributes, receiving bool) SendReceive {
+    p.exitIfCancelled(p.gsendUpd(context.Background(), true, cond, msg, pr, upd))
+}
+
+/*
+GSendUpdCtx behaves like GSendUpd, but gives up when ctx is done. In that case it
+returns the error of ctx, the message is not sent and upd is not applied. As
+SendCtx, it gives up with ErrForbiddenByPolicy if the policy forbids the message.
+*/
+func (p *Process) GSendUpdCtx(ctx context.Context, cond Predicate, msg Tuple, pr Predicate, upd func(*Attributes)) error {
+    return p.gsendUpd(ctx, false, cond, msg, pr, upd)
+}
+
+func (p *Process) gsendUpd(ctx context.Context, waitForbidden bool, cond Predicate, msg Tuple, pr Predicate, upd func(*Attributes)) error {
+    _, err := p.sendrecCtx(ctx, func(attr *Attributes, receiving bool) SendReceive {
 		if receiving || !cond.CloseUnder(attr).Satisfy(attr) {
 			return ThenFail()
 		} else {
@@ -440,7 +545,8 @@ func (p *Process) GSendUpd(cond Predicate, msg Tuple, pr Predicate, upd func(*At
 		    cpr := pr.CloseUnder(attr)
 		    return ThenSendUpdate(cmsg, cpr, upd)
 		}
-	}, false)
+	}, false, waitForbidden)
+	return err
 }
 
 type selectcase struct{
@@ -473,8 +579,21 @@ sequentially in the order they are given. If none of the case is satisfied, the
 statement is repeated as soon as the environment changes.
 */
 func (p *Process) Select(cases ...selectcase){
+    p.exitIfCancelled(p.selectCases(context.Background(), true, cases))
+}
+
+/*
+SelectCtx behaves like Select, but gives up when ctx is done. In that case it
+returns the error of ctx and no case is entered. It gives up with
+ErrForbiddenByPolicy if the policy forbids the message of the send case chosen.
+*/
+func (p *Process) SelectCtx(ctx context.Context, cases ...selectcase) error {
+    return p.selectCases(ctx, false, cases)
+}
+
+func (p *Process) selectCases(ctx context.Context, waitForbidden bool, cases []selectcase) error {
     var caseN int
-    p.sendrec(func(attr *Attributes, receiving bool) SendReceive {
+    _, err := p.sendrecCtx(ctx, func(attr *Attributes, receiving bool) SendReceive {
         for i, casei := range cases{
             if casei.pred.CloseUnder(attr).Satisfy(attr){
                 wantsToReceive := casei.action.action == sendAction
@@ -487,8 +606,12 @@ func (p *Process) Select(cases ...selectcase){
 		    }
 	    }
 	    return ThenFail()
-	}, false)
+	}, false, waitForbidden)
+	if err != nil {
+	    return err
+	}
 	p.Call(cases[caseN].then)
+	return nil
 }
 
 /*
@@ -515,6 +638,10 @@ SetIf waits for pred to be satisfied, then changes the environment according
 to setup. Any message received during this call is rejected.
 */
 func (p *Process) SetIf(pred Predicate, setup func(attr *Attributes)) {
+	p.setting = true
+	defer func(){
+	    p.setting = false
+	}()
 	p.SendFunc(func(attr *Attributes) (Tuple, Predicate, bool){
 	    if pred.CloseUnder(attr).Satisfy(attr) {
 	        setup(attr)
@@ -1,13 +1,24 @@
 package goat
 
+import "crypto/tls"
+import "sort"
+import "strconv"
+import "strings"
 import "time"
 import "sync"
+import "log"
 
 type msgTime struct {
     id int
     tm int64
 }
 
+// agentRequest is a request of mids without reply: n is 0 for REQ, id tells it from the others after a repair
+type agentRequest struct {
+    id int
+    n int
+}
+
 type RingAgent struct{
     registrationAddress string
     componentId int
@@ -24,10 +35,38 @@ type RingAgent struct{
     chnSendTime *unboundChanMT
     lockST *sync.Mutex
     chnGetMid *unboundChanUnit
+    chnGetMids *unboundChanInt
+    chnPublish chan []string
+    view *publishedView
+    connReg *duplexConn
+    connNode *duplexConn
+    lockNode *sync.Mutex // guards connNode and what a new node needs to resume the agent
+    nextIn int // the first mid not received yet
+    held map[int]struct{} // mids received and not used yet
+    pending []agentRequest
+    nextRequest int
+    sent map[int][]string
+    expired *expiredMessages
+    closing bool
+    connLost bool
+    chnQuit chan struct{}
+    chnStopped chan struct{}
+    chnInStopped chan struct{}
+    tlsConfig *tls.Config
+    credential string
 }
 
 func NewRingAgent(registrationAddress string) *RingAgent{
+    return NewRingAgentTLS(nil, registrationAddress)
+}
+
+/*
+NewRingAgentTLS returns an agent that uses TLS with tlsConfig (see MutualTLSConfig)
+to connect to the registration and to accept the connection of its node.
+*/
+func NewRingAgentTLS(tlsConfig *tls.Config, registrationAddress string) *RingAgent{
     ca := RingAgent{
+        tlsConfig: tlsConfig,
         registrationAddress: registrationAddress,
         chnMids: newUnboundChanInt(),
         chnMessagesIn: newUnboundChanMessage(),
@@ -39,64 +78,82 @@ func NewRingAgent(registrationAddress string) *RingAgent{
         chnSendTime: newUnboundChanMT(),
         lockST: &sync.Mutex{},
         chnGetMid: newUnboundChanUnit(),
+        chnGetMids: newUnboundChanInt(),
+        chnPublish: make(chan []string),
+        view: newPublishedView(),
+        lockNode: &sync.Mutex{},
+        held: map[int]struct{}{},
+        sent: map[int][]string{},
+        expired: newExpiredMessages(),
+        chnQuit: make(chan struct{}),
+        chnStopped: make(chan struct{}),
+        chnInStopped: make(chan struct{}),
     }
     return &ca
 }
 
-func (ca *RingAgent) Start(){
+/*
+SetCredential sets the credential the agent presents to the registration (see
+Authenticator). It must be called before the agent starts.
+*/
+func (ca *RingAgent) SetCredential(credential string) {
+    ca.credential = credential
+}
+
+/*
+Start registers the agent and waits for its node. It returns a *RejectedError if
+the registration does not accept the agent.
+*/
+func (ca *RingAgent) Start() error {
     var chnReady chan(struct{})
-    ca.listener, chnReady, ca.listeningPort = listenerRandomPort()
+    ca.listener, chnReady, ca.listeningPort = listenerIntTLS(0, ca.tlsConfig)
     <-chnReady 
     
-    connReg := connectWith(ca.registrationAddress)
-    connReg.Send("Register", itoa(ca.listeningPort))
+    connReg, err := connect(ca.registrationAddress, ca.tlsConfig)
+    if err != nil {
+        ca.release()
+        return err
+    }
+    ca.connReg = connReg
+    connReg.Send(registerParams(ca.listeningPort, ca.credential)...)
     
-    connNode := <- ca.listener.Out
+    // the registration writes on connReg only to reject the agent
+    chnRejected := make(chan error, 1)
+    go func() {
+        cmd, params, err := connReg.ReceiveErr()
+        if err == nil && cmd == "Rejected" {
+            chnRejected <- &RejectedError{strings.Join(params, " ")}
+        }
+    }()
+    var connNode *duplexConn
+    select {
+        case connNode = <- ca.listener.Out:
+        case err := <- chnRejected:
+            connReg.Close()
+            ca.release()
+            return err
+    }
+    ca.connNode = connNode
     _, params := connNode.Receive()
     ca.componentId = atoi(params[0])
     ca.firstMessageId = atoi(params[1])
     ca.maxMid = ca.firstMessageId
+    ca.nextIn = ca.firstMessageId
     dprintln("Starting at mid", ca.firstMessageId)
     
-    go func() {
-        for {
-            cmd, params := connNode.Receive()
-            switch(cmd) {
-                case "RPLY":
-                    mid := atoi(params[0])
-                    ca.chnMids.In <- mid
-                    dprintln("r",mid,ca.componentId)
-                    
-                case "DATA":
-                    pred, _ := ToPredicate(params[2])
-                    mid := atoi(params[0])
-                    if ca.firstMessageId >= 0 && mid >= ca.firstMessageId {
-                        //cid := atoi(params[1])
-                        inMsg := Message {
-                            Id: mid,
-                            //componentId: cid,
-                            Pred: pred,
-                            Message: decodeTuple(params[3]),
-                        }
-                        rtime := time.Now().UnixNano()
-                        ca.lockST.Lock()
-                        if mid > ca.maxMid{
-                            ca.maxMid = mid
-                        } 
-                        ca.lockST.Unlock()
-                        ca.chnReceiveTime.In <- msgTime{mid, rtime}
-                        ca.chnMessagesIn.In <- inMsg
-                        dprintln(inMsg, ca.componentId)
-                    }
-            }
-        }
-    }()
+    go ca.readNode(connNode)
+    go ca.awaitAdoption()
     go func(){
         for {
             select {
                 case msgToSend := <- ca.chnMessagesOut:
                     stime := time.Now().UnixNano()
-                    connNode.Send("DATA", itoa(msgToSend.Id), itoa(ca.componentId), msgToSend.Pred.String(), msgToSend.Message.encode() )
+                    ca.lockNode.Lock()
+                    msg := []string{"DATA", itoa(msgToSend.Id), itoa(ca.componentId), msgToSend.Pred.String(), msgToSend.Message.encodeFor(ca.connNode.usesBinary())}
+                    ca.connNode.Send(msg...)
+                    ca.sent[msgToSend.Id] = msg
+                    delete(ca.held, msgToSend.Id)
+                    ca.lockNode.Unlock()
                     dprintln("+", msgToSend)
                     ca.lockST.Lock()
                     if msgToSend.Id > ca.maxMid{
@@ -105,11 +162,277 @@ func (ca *RingAgent) Start(){
                     ca.lockST.Unlock()
                     ca.chnSendTime.In <- msgTime{msgToSend.Id, stime}
                 case <- ca.chnGetMid.Out:
-                    connNode.Send("REQ", itoa(ca.componentId))
+                    ca.request(0)
                     dprintln("R?")
+                case n := <- ca.chnGetMids.Out:
+                    ca.request(n)
+                case view := <- ca.chnPublish:
+                    ca.lockNode.Lock()
+                    ca.connNode.Send(append([]string{"ATTR", itoa(ca.componentId)}, view...)...)
+                    ca.lockNode.Unlock()
+                case <- ca.chnQuit:
+                    close(ca.chnStopped)
+                    return
             }
         }
     }()
+    return nil
+}
+
+// request asks the node one mid (n = 0) or n mids
+func (ca *RingAgent) request(n int) {
+    ca.lockNode.Lock()
+    defer ca.lockNode.Unlock()
+    req := agentRequest{ca.nextRequest, n}
+    ca.nextRequest++
+    ca.pending = append(ca.pending, req)
+    ca.sendRequest(req)
+}
+
+/*
+sendRequest sends req, with its id: a tree gives the same mids to a request sent
+again after a repair. The caller must hold ca.lockNode.
+*/
+func (ca *RingAgent) sendRequest(req agentRequest) {
+    if req.n == 0 {
+        ca.connNode.Send("REQ", itoa(ca.componentId), itoa(req.id))
+    } else {
+        ca.connNode.Send("REQN", itoa(ca.componentId), itoa(req.n), itoa(req.id))
+    }
+}
+
+/*
+received records the mids first to first+n-1 given by the node to the request id,
+or to the oldest one if id < 0. A reply to a request already answered is dropped.
+*/
+func (ca *RingAgent) received(first int, n int, id int) {
+    ca.lockNode.Lock()
+    found := false
+    for i, req := range ca.pending {
+        if id < 0 || req.id == id {
+            ca.pending = append(ca.pending[:i], ca.pending[i+1:]...)
+            found = true
+            break
+        }
+    }
+    if !found && id >= 0 {
+        ca.lockNode.Unlock()
+        dprintln("Agent", ca.componentId, "got again the mids of request", id)
+        return
+    }
+    for mid := first; mid < first + n; mid++ {
+        ca.held[mid] = struct{}{}
+    }
+    ca.lockNode.Unlock()
+    for mid := first; mid < first + n; mid++ {
+        ca.chnMids.In <- mid
+    }
+}
+
+// readNode reads what the node writes on conn until conn breaks
+func (ca *RingAgent) readNode(conn *duplexConn) {
+    for {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            dprintln("Agent", ca.componentId, "disconnected:", err)
+            ca.lockNode.Lock()
+            defer ca.lockNode.Unlock()
+            if conn != ca.connNode {
+                return // replaced by the connection of a new node
+            }
+            if ca.closing {
+                close(ca.chnInStopped)
+            } else {
+                ca.connLost = true // the node failed, another one will adopt the agent
+            }
+            return
+        }
+        switch(cmd) {
+            case "RPLY":
+                mid, err := paramInt(params, 0)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLY: %v", ca.componentId, err)
+                    break
+                }
+                ca.received(mid, 1, replyRequest(params, 1))
+                dprintln("r",mid,ca.componentId)
+                
+            case "RPLYN":
+                first, n, err := decodeMidRange(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLYN: %v", ca.componentId, err)
+                    break
+                }
+                ca.received(first, n, replyRequest(params, 2))
+                
+            case "EXPIRED": // in a tree, every agent below the node that got the message is told
+                msg, err := decodeDataMessage(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid EXPIRED: %v", ca.componentId, err)
+                    break
+                }
+                ca.lockNode.Lock()
+                _, own := ca.sent[msg.Id]
+                ca.lockNode.Unlock()
+                if own {
+                    ca.expired.drop(ca.componentId, msg)
+                }
+                
+            case "VIEW": // the node has the view from the mid in params
+                ca.view.known(params)
+                
+            case "DATA", "SKIP":
+                inMsg, err := decodeIncomingMessage(cmd, params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid %s: %v", ca.componentId, cmd, err)
+                    if inMsg.Id < 0 {
+                        break
+                    }
+                }
+                mid := inMsg.Id
+                ca.lockNode.Lock()
+                _, own := ca.sent[mid] // a node that adopted the agent may send them
+                _, held := ca.held[mid] // filled before the component sent its message
+                ca.lockNode.Unlock()
+                if ca.firstMessageId >= 0 && mid >= ca.firstMessageId && !own && !held {
+                    rtime := time.Now().UnixNano()
+                    ca.lockST.Lock()
+                    if mid > ca.maxMid{
+                        ca.maxMid = mid
+                    } 
+                    ca.lockST.Unlock()
+                    ca.lockNode.Lock()
+                    for ; ca.nextIn <= mid; ca.nextIn++ {
+                        delete(ca.sent, ca.nextIn - ringHistory)
+                    }
+                    ca.lockNode.Unlock()
+                    ca.chnReceiveTime.In <- msgTime{mid, rtime}
+                    ca.chnMessagesIn.In <- inMsg
+                    dprintln(inMsg, ca.componentId)
+                }
+        }
+    }
+}
+
+/*
+awaitAdoption serves the nodes that adopt the agent when its node fails: the
+agent tells the new node where it stopped, then sends again the messages, the
+requests and the view the failed node may have lost. If the failed node did not
+tell that it had the view, the agent resumes from the mid of the view, since the
+failed node may have filtered the messages from there with an older one.
+*/
+func (ca *RingAgent) awaitAdoption() {
+    for conn := range ca.listener.Out {
+        ca.lockNode.Lock()
+        held := []string{}
+        for mid := range ca.held {
+            held = append(held, itoa(mid))
+        }
+        heldCSV := "-"
+        if len(held) > 0 {
+            heldCSV = strings.Join(held, ",")
+        }
+        next := ca.nextIn
+        if from := ca.view.pending(); from >= 0 && from < next {
+            next = from
+        }
+        ca.lockNode.Unlock()
+        conn.Send("Resume", itoa(next), heldCSV)
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil || cmd != "Registered" || len(params) < 2 {
+            conn.Close()
+            continue
+        }
+        nid := atoi(params[1])
+        ca.lockNode.Lock()
+        if ca.closing {
+            ca.lockNode.Unlock()
+            conn.Close()
+            continue
+        }
+        old := ca.connNode
+        ca.connNode = conn
+        ca.connLost = false
+        mids := []int{}
+        for mid := range ca.sent {
+            if mid >= nid {
+                mids = append(mids, mid)
+            }
+        }
+        sort.Ints(mids)
+        for _, mid := range mids {
+            conn.Send(ca.sent[mid]...)
+        }
+        for _, req := range ca.pending {
+            ca.sendRequest(req)
+        }
+        if view := ca.view.last(); view != nil {
+            conn.Send(append([]string{"ATTR", itoa(ca.componentId)}, view...)...)
+        }
+        ca.lockNode.Unlock()
+        old.Close()
+        dprintln("Agent", ca.componentId, "adopted at mid", nid)
+        go ca.readNode(conn)
+    }
+}
+
+// replyRequest returns the id of the request in the reply params at i, "compId:id" in a tree, or -1
+func replyRequest(params []string, i int) int {
+    if len(params) <= i {
+        return -1
+    }
+    key := params[i]
+    if sep := strings.LastIndex(key, ":"); sep >= 0 {
+        key = key[sep+1:]
+    }
+    id, err := strconv.Atoi(key)
+    if err != nil {
+        return -1
+    }
+    return id
+}
+
+// release frees what the agent holds when it could not start
+func (ca *RingAgent) release() {
+    ca.listener.Close()
+    ca.chnMids.Close()
+    ca.chnMessagesIn.Close()
+    ca.chnGetMid.Close()
+    ca.chnGetMids.Close()
+}
+
+/*
+Close tells the node that the agent is leaving, then closes the connections of
+the agent and stops its goroutines.
+*/
+func (ca *RingAgent) Close(){
+    close(ca.chnQuit)
+    <- ca.chnStopped
+    ca.lockNode.Lock()
+    ca.closing = true
+    if ca.connLost {
+        close(ca.chnInStopped)
+    }
+    ca.connNode.Send("Leave", itoa(ca.componentId))
+    ca.connNode.Close()
+    ca.lockNode.Unlock()
+    <- ca.chnInStopped
+    ca.view.close()
+    ca.connReg.Close()
+    ca.release()
+}
+
+/*
+PublishAttributes sends the view to the node of the agent, that will not send the
+messages the component surely does not accept.
+*/
+func (ca *RingAgent) PublishAttributes(from int, view map[string]interface{}) <-chan struct{} {
+    tokens, chnKnown := ca.view.publish(from, view)
+    select {
+        case ca.chnPublish <- tokens:
+        case <- ca.chnQuit:
+    }
+    return chnKnown
 }
 
 func (ca *RingAgent) SendMessage(msg Message){
@@ -118,6 +441,13 @@ func (ca *RingAgent) SendMessage(msg Message){
 func (ca *RingAgent) AskMid(){
     ca.chnGetMid.In <- struct{}{}
 }
+func (ca *RingAgent) AskMids(n int){
+    ca.chnGetMids.In <- n
+}
+
+func (ca *RingAgent) OnExpired(handler func(Message)) {
+    ca.expired.setHandler(handler)
+}
 func (ca *RingAgent) GetRplyChan() *unboundChanInt {
     return ca.chnMids
 }
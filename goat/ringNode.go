@@ -1,6 +1,8 @@
 package goat
 
 import (
+    "crypto/tls"
+    "log"
     "math/rand"
     "time"
     "sync"
@@ -15,10 +17,18 @@ type RingAgentRegistration struct {
     compId int
     policy func(*RingAgentRegistration, []CandidateNode)int
     lock *sync.Mutex
+    members []*ringMember
+    agents map[int]*ringAgentEntry
+    orphanFiller int // the ring node that fills the mids lost with the failed nodes, or -1
     listenerConns *unboundChanConn
+    conns map[*duplexConn]struct{} // open, to close them on Terminate
+    chnActivity chan struct{}
+    chnQuit chan struct{}
+    terminated bool
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
+    authenticator Authenticator
 }
 
 type CandidateNode struct {
@@ -68,14 +78,35 @@ func NewRingAgentRegistration(port int, nodesAddresses []string) *RingAgentRegis
 }
 
 func NewRingAgentRegistrationPolicyPerf(perfTest bool, port int, nodesAddresses []string,policy func(*RingAgentRegistration, []CandidateNode)int) *RingAgentRegistration{
-    listenerConns, chnReady := listener(port)
+    return newRingAgentRegistration(perfTest, nil, port, nodesAddresses, policy)
+}
+
+/*
+NewRingAgentRegistrationTLS returns a registration that accepts only TLS
+connections, with tlsConfig (see MutualTLSConfig).
+*/
+func NewRingAgentRegistrationTLS(tlsConfig *tls.Config, port int, nodesAddresses []string) *RingAgentRegistration{
+    return newRingAgentRegistration(false, tlsConfig, port, nodesAddresses, RingSequentialPolicy())
+}
+
+func NewRingAgentRegistrationPolicyTLS(tlsConfig *tls.Config, port int, nodesAddresses []string, policy func(*RingAgentRegistration, []CandidateNode)int) *RingAgentRegistration{
+    return newRingAgentRegistration(false, tlsConfig, port, nodesAddresses, policy)
+}
+
+func newRingAgentRegistration(perfTest bool, tlsConfig *tls.Config, port int, nodesAddresses []string,policy func(*RingAgentRegistration, []CandidateNode)int) *RingAgentRegistration{
+    listenerConns, chnReady := listenerTLS(port, tlsConfig)
     <-chnReady
     return &RingAgentRegistration{
         nodesAddresses: nodesAddresses,
         port: port,
         policy: policy,
         lock: &sync.Mutex{},
+        agents: map[int]*ringAgentEntry{},
+        orphanFiller: -1,
         listenerConns: listenerConns,
+        conns: map[*duplexConn]struct{}{},
+        chnActivity: make(chan struct{}, 1),
+        chnQuit: make(chan struct{}),
         perfTest: perfTest,
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
@@ -110,50 +141,132 @@ func (tn *RingAgentRegistration) GetInfrMsgSent() uint64 {
     }
 }
 
+/*
+SetAuthenticator makes the registration accept only the agents that auth lets in;
+the others receive a Rejected reply. It must be called before Work.
+*/
+func (rar *RingAgentRegistration) SetAuthenticator(auth Authenticator) {
+    rar.lock.Lock()
+    rar.authenticator = auth
+    rar.lock.Unlock()
+}
+
 func (tn *RingAgentRegistration) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
 
+/*
+Work serves the nodes and the agents until Terminate is called. It returns when
+no message arrives for timeout msec, closing timedOut, or when the registration
+is terminated.
+*/
 func (rar *RingAgentRegistration) Work(timeout int64, timedOut chan<- struct{}){
-    conns := []*duplexConn{}
-    candNodes := []CandidateNode{}
+    go rar.serve()
+    waitIdle(rar.chnActivity, rar.chnQuit, timeout, timedOut)
+}
+
+func (rar *RingAgentRegistration) serve(){
     readyReceived := 0
     chnStartRegistrations := make(chan struct{})
     for {
-        conn := <- rar.listenerConns.Out
+        conn, ok := <- rar.listenerConns.Out
+        if !ok {
+            return
+        }
+        rar.lock.Lock()
+        if rar.terminated {
+            rar.lock.Unlock()
+            conn.Close()
+            return
+        }
+        rar.conns[conn] = struct{}{}
+        auth := rar.authenticator
+        rar.lock.Unlock()
         cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            rar.release(conn)
+            continue
+        }
+        signalActivity(rar.chnActivity)
         switch (cmd) {
             case "Register":
-                if err == nil {
-                    rar.onInfrMsgAgent()
-                    agPort := params[0]
-                    agAddr := netAddress{conn.SrcAddr().Host, agPort}
-                    go func(con *duplexConn, addr netAddress){
-                        <- chnStartRegistrations
-                        rar.lock.Lock()
-                        compId := rar.compId
-                        rar.compId++
-                        which := rar.policy(rar, candNodes)
-                        rar.lock.Unlock()
-                        conns[which].Send("newAgent", itoa(compId), addr.String())
-                        rar.onInfrMsgSent()
-                    }(conn, agAddr)
+                rar.onInfrMsgAgent()
+                if len(params) < 1 {
+                    log.Printf("goat: registration: Register without port from %v", conn.RemoteAddr())
+                    rar.release(conn)
+                    continue
                 }
-            case "ready":
-                if err != nil {
-                    panic(err)
+                if err := authenticate(auth, params, conn.SrcAddr().Host); err != nil {
+                    log.Printf("goat: registration: rejected agent from %v: %v", conn.RemoteAddr(), err)
+                    conn.Send("Rejected", err.Error())
+                    rar.onInfrMsgSent()
+                    rar.release(conn)
+                    continue
                 }
-                isALeaf := len(params) > 0 && params[0] == "leaf" 
-                conns = append(conns, conn)
-                candNodes = append(candNodes, CandidateNode{IsLeaf: isALeaf, Address: conn.RemoteAddr()})
+                agPort := params[0]
+                agAddr := netAddress{conn.SrcAddr().Host, agPort}
+                // the agent keeps the connection until it stops, to learn of a rejection
+                go rar.releaseOnClose(conn)
+                go func(con *duplexConn, addr netAddress){
+                    select {
+                        case <- chnStartRegistrations:
+                        case <- rar.chnQuit:
+                            return
+                    }
+                    rar.lock.Lock()
+                    compId := rar.compId
+                    rar.compId++
+                    which := rar.pickNode()
+                    if which < 0 {
+                        rar.lock.Unlock()
+                        return
+                    }
+                    rar.agents[compId] = &ringAgentEntry{addr.String(), which}
+                    nodeConn := rar.members[which].conn
+                    rar.lock.Unlock()
+                    nodeConn.Send("newAgent", itoa(compId), addr.String())
+                    rar.onInfrMsgSent()
+                }(conn, agAddr)
+            case "ready": // ready [leaf] from a tree node, ready ring nextAddress from a ring node
+                isALeaf := len(params) > 0 && params[0] == "leaf"
+                member := &ringMember{conn: conn, cand: CandidateNode{IsLeaf: isALeaf, Address: conn.RemoteAddr()}, prev: -1, alive: true}
+                if len(params) > 1 && params[0] == "ring" {
+                    member.next = params[1]
+                } else {
+                    member.tree = true
+                }
+                rar.lock.Lock()
+                rar.members = append(rar.members, member)
+                rar.lock.Unlock()
                 readyReceived++
                 if readyReceived == len(rar.nodesAddresses) {
-                    for _,con := range conns {
-                        con.Send("connNext")
+                    for id, m := range rar.members {
+                        m.conn.Send("connNext", itoa(id))
                         rar.onInfrMsgSent()
+                        go rar.watchNode(id, m.conn)
                     }
                     close(chnStartRegistrations)
                 }
+            default:
+                rar.release(conn)
+        }
+    }
+}
+
+// release closes conn and forgets it
+func (rar *RingAgentRegistration) release(conn *duplexConn) {
+    rar.lock.Lock()
+    delete(rar.conns, conn)
+    rar.lock.Unlock()
+    conn.Close()
+}
+
+// releaseOnClose releases conn when the other end closes it
+func (rar *RingAgentRegistration) releaseOnClose(conn *duplexConn) {
+    for {
+        if _, _, err := conn.ReceiveErr(); err != nil {
+            rar.release(conn)
+            return
         }
     }
 }
@@ -186,9 +299,22 @@ func (rar *RingAgentRegistration) Work(timeout int64, timedOut chan<- struct{}){
     }
 }*/
 
+/*
+Terminate closes the listener and every connection of the registration, and stops
+its goroutines.
+*/
 func (rar *RingAgentRegistration) Terminate(){
-    //rar.listener.Close()
-    //TODO
+    rar.lock.Lock()
+    defer rar.lock.Unlock()
+    if rar.terminated {
+        return
+    }
+    rar.terminated = true
+    close(rar.chnQuit)
+    rar.listenerConns.Close()
+    for conn := range rar.conns {
+        conn.Close()
+    }
 }
 
 ///////////
@@ -197,7 +323,7 @@ type RingNode struct{
     counterAddress string
     registrationAddress string
     agents map[int]*duplexConn
-    rplys map[int]int
+    leases *midLeases
     removedComps map[int]struct{}
     port int
     messages map[int][]string
@@ -205,8 +331,28 @@ type RingNode struct{
     nextNodeAddress string
     lock *sync.Mutex
     counterConn *duplexConn
-    chnMids *unboundChanInt
+    sequencer *SequencerClient
+    reqLock *sync.Mutex
+    pendingReqs []midRequest
     nextNodeConn *duplexConn
+    prevNodeConn *duplexConn
+    regConn *duplexConn
+    id int // given by the registration
+    prevId int
+    expectedPrev int // the node the registration told to link to rn after a repair, or -1
+    offeredPrev map[int]*duplexConn // links from nodes not expected (yet)
+    nextBroken bool
+    lastForward time.Time
+    history map[int][]string
+    orphans map[int]struct{} // the mids lost with a failed node, that the registration told rn to fill
+    stuckNid int
+    stuckSince time.Time
+    filter *predicateFilter
+    listenerConns *unboundChanConn
+    chnActivity chan struct{}
+    chnQuit chan struct{}
+    terminated bool
+    tlsConfig *tls.Config
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
@@ -217,10 +363,29 @@ func NewRingNode(port int, counterAddress string, nextNodeAddress string, regist
 }
 
 func NewRingNodePerf(perfTest bool, port int, counterAddress string, nextNodeAddress string, registrationAddress string) *RingNode {
+    return newRingNode(perfTest, nil, port, counterAddress, nextNodeAddress, registrationAddress)
+}
+
+/*
+NewRingNodeTLS returns a node that uses TLS with tlsConfig for every connection:
+to the agents, to the other nodes, to the counter and to the registration.
+*/
+func NewRingNodeTLS(tlsConfig *tls.Config, port int, counterAddress string, nextNodeAddress string, registrationAddress string) *RingNode {
+    return newRingNode(false, tlsConfig, port, counterAddress, nextNodeAddress, registrationAddress)
+}
+
+func newRingNode(perfTest bool, tlsConfig *tls.Config, port int, counterAddress string, nextNodeAddress string, registrationAddress string) *RingNode {
+    listenerConns, chnReady := listenerTLS(port, tlsConfig)
+    <-chnReady
     return &RingNode{
         counterAddress: counterAddress,
         agents: map[int]*duplexConn{},
-        rplys: map[int]int{},
+        leases: newMidLeases(),
+        prevId: -1,
+        expectedPrev: -1,
+        orphans: map[int]struct{}{},
+        offeredPrev: map[int]*duplexConn{},
+        history: map[int][]string{},
         removedComps: map[int]struct{}{},
         port: port,
         messages: map[int][]string{},
@@ -228,6 +393,12 @@ func NewRingNodePerf(perfTest bool, port int, counterAddress string, nextNodeAdd
         nextNodeAddress: nextNodeAddress,
         registrationAddress: registrationAddress,
         lock: &sync.Mutex{},
+        reqLock: &sync.Mutex{},
+        tlsConfig: tlsConfig,
+        filter: newPredicateFilter(),
+        listenerConns: listenerConns,
+        chnActivity: make(chan struct{}, 1),
+        chnQuit: make(chan struct{}),
         perfTest: perfTest,
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
@@ -262,15 +433,125 @@ func (tn *RingNode) GetInfrMsgSent() uint64 {
     }
 }
 
-func counterConnHandlerIn(counterConn *duplexConn, chnMids *unboundChanInt) {
+// a REQ (n == 0) or REQN of an agent, waiting for the counter
+type midRequest struct {
+    idx int
+    conn *duplexConn
+    n int
+}
+
+/*
+askCounter files the request; the counter answers the requests in order. With a
+sequencer, each request waits for its own answer.
+*/
+func (rn *RingNode) askCounter(req midRequest) {
+    if rn.sequencer != nil {
+        go func(){
+            first, err := rn.sequencer.Next(req.n)
+            if err != nil {
+                log.Printf("goat: ring node %d: no mid for agent %d: %v", rn.port, req.idx, err)
+                return
+            }
+            rn.grant(req, first)
+            if req.n == 0 {
+                req.conn.Send("RPLY", itoa(first))
+            } else {
+                req.conn.Send("RPLYN", itoa(first), itoa(req.n))
+            }
+            rn.onInfrMsgSent()
+        }()
+        return
+    }
+    rn.reqLock.Lock()
+    rn.pendingReqs = append(rn.pendingReqs, req)
+    if req.n == 0 {
+        rn.counterConn.Send("inc")
+    } else {
+        rn.counterConn.Send("inc", itoa(req.n))
+    }
+    rn.reqLock.Unlock()
+    rn.onInfrMsgSent()
+}
+
+func (rn *RingNode) counterConnHandlerIn(counterConn *duplexConn) {
+    for {
+        cmd, params, err := counterConn.ReceiveErr()
+        if err != nil {
+            return
+        }
+        if cmd != "counter" {
+            continue
+        }
+        first, err := paramInt(params, 0)
+        if err != nil {
+            log.Printf("goat: ring node %d: invalid counter reply: %v", rn.port, err)
+            continue
+        }
+        rn.reqLock.Lock()
+        if len(rn.pendingReqs) == 0 {
+            rn.reqLock.Unlock()
+            log.Printf("goat: ring node %d: unexpected mid %d from the counter", rn.port, first)
+            continue
+        }
+        req := rn.pendingReqs[0]
+        rn.pendingReqs = rn.pendingReqs[1:]
+        rn.reqLock.Unlock()
+        rn.grant(req, first)
+        if req.n == 0 {
+            req.conn.Send("RPLY", itoa(first))
+        } else {
+            req.conn.Send("RPLYN", itoa(first), itoa(req.n))
+        }
+        rn.onInfrMsgSent()
+    }
+}
+
+// grant leases the mids from first to the agent that asked them with req
+func (rn *RingNode) grant(req midRequest, first int) {
+    n := req.n
+    if n == 0 {
+        n = 1
+    }
+    rn.lock.Lock()
+    defer rn.lock.Unlock()
+    rn.leases.grant(req.idx, first, n)
+    if _, isRemoved := rn.removedComps[req.idx]; isRemoved {
+        rn.leases.revoke(req.idx)
+        rn.dispatch(-1)
+    }
+}
+
+/*
+expireLeases fills the mids of the agents of rn whose lease expired, until rn is
+terminated. The empty message goes around the ring like the others.
+*/
+func (rn *RingNode) expireLeases() {
+    ticker := time.NewTicker(leaseTick)
+    defer ticker.Stop()
     for {
-        cmd, params := counterConn.Receive()
-        if cmd == "counter" {
-            chnMids.In <- atoi(params[0])
+        select {
+            case <- rn.chnQuit:
+                return
+            case now := <- ticker.C:
+                rn.lock.Lock()
+                rn.dispatch(-1)
+                rn.fillOrphan(now)
+                rn.lock.Unlock()
         }
     }
 }
 
+/*
+SetMidLease sets how long the node waits for the message of a mid given to one of
+its agents, once it is the next mid of the node, before filling it with an empty
+message; a message that arrives later is dropped (see Component.OnExpired).
+With d <= 0, the default, the node waits forever, unless the agent is gone. It
+must be called before Work.
+*/
+func (rn *RingNode) SetMidLease(d time.Duration) {
+    rn.leases.duration = d
+}
+
 func (rn *RingNode) dispatch(idx int) bool {
     agentFailed := false
     for {
@@ -281,10 +562,17 @@ func (rn *RingNode) dispatch(idx int) bool {
             idxDead := false
             for agentId, agentConn := range rn.agents {
                 if agentId != sender{
-                    err := agentConn.Send(rn.messages[rn.nid]...)
+                    var err error
+                    if rn.filter.excludesData(sender, agentId, mParams[2], mParams[3]) {
+                        from := rn.filter.skip(agentId, skippedMessage{mid: rn.nid, sender: sender, params: rn.messages[rn.nid]})
+                        err = agentConn.Send(skipParams(rn.nid, from)...)
+                    } else {
+                        err = agentConn.Send(rn.messages[rn.nid]...)
+                    }
                     rn.onInfrMsgSent()
                     if err != nil {
                         delete(rn.agents, agentId)
+                        rn.filter.forget(agentId)
                         if idx == agentId {
                             idxDead = true
                         }
@@ -292,20 +580,19 @@ func (rn *RingNode) dispatch(idx int) bool {
                 }
             }
             mParams[1] = itoa(sender) // reset before forwarding
-            rn.nextNodeConn.Send(rn.messages[rn.nid]...)
+            rn.forward(rn.messages[rn.nid]...)
             rn.onInfrMsgSent()
+            rn.remember(rn.nid, rn.messages[rn.nid])
             delete(rn.messages, rn.nid)
             if idxDead {
-                rn.removedComps[idx] = struct{}{}
+                rn.removeAgent(idx)
                 dprintln("Agent", idx, "failed")
                 agentFailed = true
             }
         }
-        whoRply, hasRply := rn.rplys[rn.nid]
-        _, isRemoved := rn.removedComps[whoRply]
-        if hasRply && isRemoved {
-            delete(rn.rplys, rn.nid)
-            rn.nid++
+        if owner, expired := rn.leases.expire(rn.nid, time.Now()); expired {
+            dprintln("Filling mid", rn.nid, "of agent", owner)
+            rn.messages[rn.nid] = emptyDataMessage(rn.nid, owner)
         } else {
             break
         }
@@ -313,11 +600,34 @@ func (rn *RingNode) dispatch(idx int) bool {
     return agentFailed
 }
 
-func (rn *RingNode) handleAgent(idx int, conn *duplexConn) {
-    rn.lock.Lock()
-    conn.Send("Registered", itoa(idx), itoa(rn.nid))
-    rn.onInfrMsgSent()
-    dprintln("Agent", idx, "started at mid",rn.nid)
+// removeAgent records that the agent idx is gone, with the mids it holds; the caller must hold rn.lock
+func (rn *RingNode) removeAgent(idx int) {
+    rn.removedComps[idx] = struct{}{}
+    rn.leases.revoke(idx)
+}
+
+/*
+handleAgent serves the agent idx; an agent that comes from a failed node (resume)
+first tells where it stopped.
+*/
+func (rn *RingNode) handleAgent(idx int, conn *duplexConn, resume bool) {
+    if resume {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil || cmd != "Resume" {
+            log.Printf("goat: ring node %d: agent %d did not resume", rn.port, idx)
+            conn.Close()
+            return
+        }
+        rn.lock.Lock()
+        delete(rn.removedComps, idx)
+        rn.resumeAgent(idx, conn, params)
+        dprintln("Agent", idx, "resumed at mid", rn.nid)
+    } else {
+        rn.lock.Lock()
+        conn.Send("Registered", itoa(idx), itoa(rn.nid))
+        rn.onInfrMsgSent()
+        dprintln("Agent", idx, "started at mid",rn.nid)
+    }
     rn.lock.Unlock()
     for {
         cmd, params, err := conn.ReceiveErr()
@@ -325,33 +635,46 @@ func (rn *RingNode) handleAgent(idx int, conn *duplexConn) {
             //unsubscribe it
             rn.lock.Lock()
             delete(rn.agents, idx)
-            rn.removedComps[idx] = struct{}{}
+            rn.filter.forget(idx)
+            rn.removeAgent(idx)
+            rn.dispatch(-1)
             rn.lock.Unlock()
             dprintln("Agent", idx, "failed")
             return
         }
+        signalActivity(rn.chnActivity)
         rn.onInfrMsgAgent()
         switch(cmd) {
             case "REQ":
-                rn.counterConn.Send("inc")
-                rn.onInfrMsgSent()
-                go func(){
-                    mid := <- rn.chnMids.Out
-                    conn.Send("RPLY", itoa(mid))
-                    rn.onInfrMsgSent()
-                    rn.lock.Lock()
-                    rn.rplys[mid] = idx
-                    isFailed := rn.dispatch(idx)
-                    rn.lock.Unlock()
-                    if isFailed {
-                        rn.removedComps[idx] = struct{}{}
-                    }
-                }()
+                rn.askCounter(midRequest{idx, conn, 0})
+                
+            case "REQN":
+                n, err := decodeMidCount(params)
+                if err != nil {
+                    log.Printf("goat: ring node %d: invalid REQN from agent %d: %v", rn.port, idx, err)
+                    continue
+                }
+                rn.askCounter(midRequest{idx, conn, n})
 
             case "DATA":
+                if err := checkDataParams(params); err != nil {
+                    log.Printf("goat: ring node %d: invalid DATA from agent %d: %v", rn.port, idx, err)
+                    continue
+                }
                 msgId := atoi(params[0])
                 rn.lock.Lock()
-                delete(rn.rplys, msgId)
+                if rn.leases.dropFilled(msgId) {
+                    rn.lock.Unlock()
+                    log.Printf("goat: ring node %d: message %d of agent %d arrived after its lease expired", rn.port, msgId, idx)
+                    conn.Send(append([]string{"EXPIRED"}, params...)...)
+                    rn.onInfrMsgSent()
+                    continue
+                }
+                if msgId < rn.nid {
+                    rn.lock.Unlock()
+                    continue // sent again after a repair, already dispatched
+                }
+                rn.leases.settle(msgId)
                 if msgId >= rn.nid{
                     rn.messages[msgId] = append([]string{cmd}, params...)
                     
@@ -382,20 +705,63 @@ func (rn *RingNode) handleAgent(idx int, conn *duplexConn) {
                     }*/
                     isFailed := rn.dispatch(idx)
                     if isFailed {
-                        rn.removedComps[idx] = struct{}{}
                         rn.lock.Unlock()
                         return
                     }
                 }
                 rn.lock.Unlock()
+                
+            case "ATTR":
+                if len(params) == 0 {
+                    break
+                }
+                rn.lock.Lock()
+                from, stale, err := rn.filter.publish(idx, params[1:])
+                if err != nil {
+                    log.Printf("goat: ring node %d: invalid ATTR from agent %d: %v", rn.port, idx, err)
+                } else {
+                    // the messages filtered with an older view, then the agent knows the node has the view
+                    rn.filter.resend(idx, stale, func(msg []string) {
+                        conn.Send(msg...)
+                        rn.onInfrMsgSent()
+                    })
+                    conn.Send("VIEW", itoa(from))
+                    rn.onInfrMsgSent()
+                }
+                rn.lock.Unlock()
+                
+            case "Leave":
+                rn.lock.Lock()
+                delete(rn.agents, idx)
+                rn.filter.forget(idx)
+                rn.removeAgent(idx)
+                rn.dispatch(-1)
+                rn.lock.Unlock()
+                conn.Close()
+                dprintln("Agent", idx, "left")
+                return
         }
     }
 }
 func (rn *RingNode) handlePrevNode(conn *duplexConn) {
     for {
-        cmd, params := conn.Receive()
+        conn.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            rn.prevDown(conn)
+            return
+        }
         switch(cmd) {
+            case "prev": // prev id: the node that writes on conn
+                if id, err := paramInt(params, 0); err == nil {
+                    rn.lock.Lock()
+                    rn.prevId = id
+                    rn.lock.Unlock()
+                    rn.regConn.Send("linked", itoa(id))
+                    rn.onInfrMsgSent()
+                }
             case "DATA":
+                signalActivity(rn.chnActivity)
                 msgId := atoi(params[0])
                 rn.lock.Lock()
                 if msgId >= rn.nid{
@@ -425,60 +791,180 @@ func (rn *RingNode) handlePrevNode(conn *duplexConn) {
 
 func (rn *RingNode) regConnHandlerIn(regConn *duplexConn) {
     for {
-        cmd, params := regConn.Receive()
-        if cmd == "newAgent"{ // a new agent arrived
-            rn.lock.Lock()
-            agCompId := params[0]
-            agAddr := params[1]
-            agConn := connectWith(agAddr)
-            rn.agents[atoi(agCompId)] = agConn
-            go func(idx int, conn *duplexConn){rn.handleAgent(idx, conn)}(atoi(agCompId), agConn)
-            rn.lock.Unlock()
+        cmd, params, err := regConn.ReceiveErr()
+        if err != nil {
+            return
+        }
+        signalActivity(rn.chnActivity)
+        switch cmd {
+            case "newAgent": // newAgent compId address [resume]: a new agent arrived, or one of a failed node
+                if len(params) < 2 {
+                    continue
+                }
+                rn.lock.Lock()
+                if rn.terminated {
+                    rn.lock.Unlock()
+                    return
+                }
+                agCompId := atoi(params[0])
+                resume := len(params) > 2 && params[2] == "resume"
+                agConn, err := connect(params[1], rn.tlsConfig)
+                if err != nil {
+                    rn.lock.Unlock()
+                    log.Printf("goat: ring node %d: can not reach agent %d: %v", rn.port, agCompId, err)
+                    continue
+                }
+                if !resume {
+                    rn.agents[agCompId] = agConn
+                }
+                go rn.handleAgent(agCompId, agConn, resume)
+                rn.lock.Unlock()
+            case "repair": // repair address: the next node failed, the node at address replaces it
+                if len(params) > 0 {
+                    go rn.repair(params[0])
+                }
+            case "expectPrev": // expectPrev id: the previous node failed, the node id replaces it
+                if id, err := paramInt(params, 0); err == nil {
+                    rn.expectPrev(id)
+                }
+            case "fillOrphan": // fillOrphan mid: mid was lost with a failed node, rn fills it
+                if mid, err := paramInt(params, 0); err == nil {
+                    rn.lock.Lock()
+                    rn.orphans[mid] = struct{}{}
+                    rn.fillOrphan(time.Now())
+                    rn.lock.Unlock()
+                }
         }
     }
 }
 
+/*
+SetPolicy makes the node check the rules of policy before delivering a message to
+its agents (see Policy). It must be called before Work.
+*/
+func (rn *RingNode) SetPolicy(policy *Policy) {
+    rn.filter.setPolicy(policy)
+}
+
+/*
+SetSequencer makes the node ask the mids to a replicated sequencer through sc,
+instead of the counter (see SequencerReplica). It must be called before Work.
+*/
+func (rn *RingNode) SetSequencer(sc *SequencerClient) {
+    rn.sequencer = sc
+}
+
 func (tn *RingNode) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
 
+/*
+Work connects the node to the ring and serves it until Terminate is called. It
+returns when no message arrives for timeout msec, closing timedOut, or when the
+node is terminated.
+*/
 func (rn *RingNode) Work(timeout int64, timedOut chan<- struct{}){
-    listenerConns, chnReady := listener(rn.port)
-    regConn := connectWith(rn.registrationAddress)
-    rn.counterConn = connectWith(rn.counterAddress)
-    <-chnReady
-    regConn.Send("ready")
+    if rn.connect() {
+        waitIdle(rn.chnActivity, rn.chnQuit, timeout, timedOut)
+    }
+}
+
+// connect joins the ring and starts serving it; it fails if rn is terminated meanwhile
+func (rn *RingNode) connect() bool {
+    regConn := connectWithTLS(rn.registrationAddress, rn.tlsConfig)
+    var counterConn *duplexConn
+    if rn.sequencer == nil {
+        counterConn = connectWithTLS(rn.counterAddress, rn.tlsConfig)
+    }
+    rn.lock.Lock()
+    rn.regConn = regConn
+    rn.counterConn = counterConn
+    terminated := rn.terminated
+    rn.lock.Unlock()
+    if terminated {
+        regConn.Close()
+        if counterConn != nil {
+            counterConn.Close()
+        }
+        return false
+    }
+    regConn.Send("ready", "ring", rn.nextNodeAddress)
     rn.onInfrMsgSent()
     for canConnectNext := false; !canConnectNext;{
-        cmd, _ := regConn.Receive()
-        canConnectNext = cmd == "connNext"
+        cmd, params, err := regConn.ReceiveErr()
+        if err != nil {
+            return false
+        }
+        if canConnectNext = cmd == "connNext"; canConnectNext {
+            rn.id, _ = paramInt(params, 0)
+        }
     }
-    chnConnNext := make(chan struct{})
+    chnConnNext := make(chan *duplexConn)
     go func() {
-        rn.nextNodeConn = connectWith(rn.nextNodeAddress)
-        close(chnConnNext)
+        chnConnNext <- connectWithTLS(rn.nextNodeAddress, rn.tlsConfig)
     }()
-    prevNodeConn := <- listenerConns.Out
-    <-chnConnNext
-    rn.chnMids = newUnboundChanInt()
+    prevNodeConn, ok := <- rn.listenerConns.Out
+    nextNodeConn := <-chnConnNext
+    rn.lock.Lock()
+    rn.nextNodeConn = nextNodeConn
+    rn.prevNodeConn = prevNodeConn
+    if !ok || rn.terminated {
+        rn.lock.Unlock()
+        nextNodeConn.Close()
+        return false
+    }
+    rn.forward("prev", itoa(rn.id))
+    rn.lock.Unlock()
     
-    go func(){counterConnHandlerIn(rn.counterConn, rn.chnMids)}()
+    if counterConn != nil {
+        go func(){rn.counterConnHandlerIn(counterConn)}()
+    }
     go func(){rn.regConnHandlerIn(regConn)}()
     go func(){rn.handlePrevNode(prevNodeConn)}()
+    go rn.expireLeases()
+    go rn.heartbeat()
+    go rn.acceptPrevNodes()
+    return true
 }
 
+/*
+Terminate closes the listener and every connection of the node, and stops its
+goroutines.
+*/
 func (rn *RingNode) Terminate(){
-    //rn.listener.Close()
-    //TODO
+    rn.lock.Lock()
+    defer rn.lock.Unlock()
+    if rn.terminated {
+        return
+    }
+    rn.terminated = true
+    close(rn.chnQuit)
+    rn.listenerConns.Close()
+    for _, conn := range []*duplexConn{rn.regConn, rn.counterConn, rn.nextNodeConn, rn.prevNodeConn} {
+        if conn != nil {
+            conn.Close()
+        }
+    }
+    for _, agConn := range rn.agents {
+        agConn.Close()
+    }
+    for _, offered := range rn.offeredPrev {
+        offered.Close()
+    }
 }
 
 ////
 
 type RingCounter struct{
     mid int
+    state *counterState
     port int
     lock *sync.Mutex
     listenerConns *unboundChanConn
+    conns []*duplexConn
+    chnActivity chan struct{}
+    chnQuit chan struct{}
+    terminated bool
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
     perfTest bool
@@ -489,19 +975,46 @@ func NewRingCounter(port int) *RingCounter {
 }
 
 func NewRingCounterPerf(perfTest bool, port int) *RingCounter {
-    listenerConns, chnReady := listener(port)
+    return newRingCounter(perfTest, nil, port)
+}
+
+// NewRingCounterTLS returns a counter that accepts only TLS connections, with tlsConfig
+func NewRingCounterTLS(tlsConfig *tls.Config, port int) *RingCounter {
+    return newRingCounter(false, tlsConfig, port)
+}
+
+func newRingCounter(perfTest bool, tlsConfig *tls.Config, port int) *RingCounter {
+    listenerConns, chnReady := listenerTLS(port, tlsConfig)
     <-chnReady
     return &RingCounter{
         mid: 0,
         port: port,
         lock: &sync.Mutex{},
         listenerConns: listenerConns,
+        conns: []*duplexConn{},
+        chnActivity: make(chan struct{}, 1),
+        chnQuit: make(chan struct{}),
         perfTest: perfTest,
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
     }
 }
 
+/*
+UseStateFile makes the counter resume from the state saved in the file path, if
+any, and save its state there (see ClusterCounter.UseStateFile). It must be
+called before Work.
+*/
+func (rc *RingCounter) UseStateFile(path string, batch int) error {
+    state, mid, err := openCounterState(path, batch)
+    if err != nil {
+        return err
+    }
+    rc.state = state
+    rc.mid = mid
+    return nil
+}
+
 func (tn *RingCounter) onInfrMsgAgent() {
     if tn.perfTest {
         atomic.AddUint64(&tn.infrMessagesFromAgents, 1)
@@ -532,12 +1045,29 @@ func (tn *RingCounter) GetInfrMsgSent() uint64 {
 
 func (rc *RingCounter) handleConn(conn *duplexConn) {
     for {
-        cmd, _ := conn.Receive()
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            return
+        }
+        signalActivity(rc.chnActivity)
         if cmd == "inc"{
+            // "inc n" reserves n consecutive mids
+            n := 1
+            if len(params) > 0 {
+                if n, err = paramInt(params, 0); err != nil || checkMidCount(n) != nil {
+                    log.Printf("goat: ring counter: invalid inc %v", params)
+                    n = 1
+                }
+            }
             rc.lock.Lock()
             mid := rc.mid
-            rc.mid++
+            rc.mid += n
+            state := rc.state
             rc.lock.Unlock()
+            // the node waits for the mid: the reservation is retried until the counter stops
+            if state != nil && state.reserveWait(mid + n, "ring counter") != nil {
+                continue
+            }
             conn.Send("counter", itoa(mid))
             rc.onInfrMsgSent()
         }
@@ -548,11 +1078,52 @@ func (tn *RingCounter) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
 
+/*
+Work serves the nodes until Terminate is called. It returns when no message
+arrives for timeout msec, closing timedOut, or when the counter is terminated.
+*/
 func (rc *RingCounter) Work(timeout int64, timedOut chan<- struct{}){
-    
+    go rc.serve()
+    waitIdle(rc.chnActivity, rc.chnQuit, timeout, timedOut)
+}
+
+func (rc *RingCounter) serve(){
     for {
-        conn := <- rc.listenerConns.Out
+        conn, ok := <- rc.listenerConns.Out
+        if !ok {
+            return
+        }
+        rc.lock.Lock()
+        if rc.terminated {
+            rc.lock.Unlock()
+            conn.Close()
+            return
+        }
+        rc.conns = append(rc.conns, conn)
+        rc.lock.Unlock()
         go func(c *duplexConn){rc.handleConn(c)}(conn)
     }
 }
 
+/*
+Terminate closes the listener and every connection of the counter, and stops its
+goroutines.
+*/
+func (rc *RingCounter) Terminate(){
+    rc.lock.Lock()
+    defer rc.lock.Unlock()
+    if rc.terminated {
+        return
+    }
+    rc.terminated = true
+    if rc.state != nil {
+        if err := rc.state.close(); err != nil {
+            log.Printf("goat: ring counter: %v", err)
+        }
+    }
+    close(rc.chnQuit)
+    rc.listenerConns.Close()
+    for _, conn := range rc.conns {
+        conn.Close()
+    }
+}
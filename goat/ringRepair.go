@@ -0,0 +1,448 @@
+package goat
+
+import (
+    "log"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // ringHeartbeat is how often a node writes on the link to the next node when it has nothing to forward
+    ringHeartbeat = 100 * time.Millisecond
+    // ringLinkTimeout is how long a node waits on the link from the previous node before it declares it down
+    ringLinkTimeout = 2 * time.Second
+    // ringHistory is how many of the last messages a node keeps, to send them again after a repair
+    ringHistory = 4096
+)
+
+/*
+The ring repairs itself when a node fails. Each node writes at least every
+ringHeartbeat on the link to the next node, that declares the node down to the
+registration if the link breaks or stays silent for ringLinkTimeout. The
+registration then tells the live node before the failed one to connect to the
+node after it ("repair"), tells the node after it which node to accept the link
+from ("expectPrev"), and moves the agents of the failed node to the node after
+it. That node is also the only one that fills a mid lost with the failed node,
+when another node reports it ("orphan", see fillOrphan). A node keeps the last
+ringHistory messages it dispatched: it sends them again on the new link, since
+the failed node may not have forwarded them, and it sends an adopted agent those
+it missed. The agent sends again its messages and requests that the failed node
+may have lost (see RingAgent).
+
+Besides "ready" and "connNext", the nodes and the registration exchange:
+    node → registration: linked prevId | nodeDown prevId | unreachable address | orphan mid
+    registration → node: repair address | expectPrev prevId | newAgent compId address resume | fillOrphan mid
+and on a link the previous node writes "prev id" first, then "HB" when idle.
+*/
+
+// ringMember is a node known to the registration, in a ring or in a tree
+type ringMember struct {
+    conn *duplexConn
+    cand CandidateNode
+    address string // as the previous node (a child, in a tree) reaches it, once it is linked
+    next string
+    prev int // the parent in a tree; -1 until the node is linked
+    tree bool
+    alive bool
+}
+
+// ringAgentEntry is an agent known to the registration, with its node
+type ringAgentEntry struct {
+    address string
+    node int
+}
+
+// pickNode chooses a live node with the policy, or returns -1; the caller must hold rar.lock
+func (rar *RingAgentRegistration) pickNode() int {
+    cands := []CandidateNode{}
+    ids := []int{}
+    for id, m := range rar.members {
+        if m.alive {
+            cands = append(cands, m.cand)
+            ids = append(ids, id)
+        }
+    }
+    if len(ids) == 0 {
+        return -1
+    }
+    return ids[rar.policy(rar, cands)]
+}
+
+// watchNode reads the reports of the node id about the ring
+func (rar *RingAgentRegistration) watchNode(id int, conn *duplexConn) {
+    for {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            rar.release(conn)
+            return
+        }
+        signalActivity(rar.chnActivity)
+        rar.lock.Lock()
+        switch cmd {
+            case "linked": // linked prevId: the link from prevId to id is up
+                if prev, err := paramInt(params, 0); err == nil && prev >= 0 && prev < len(rar.members) {
+                    rar.members[id].prev = prev
+                    rar.members[id].address = rar.members[prev].next
+                }
+            case "attached": // attached parentId parentAddress: the tree node id is a child of parentId
+                if parent, err := paramInt(params, 0); err == nil && parent >= 0 && parent < len(rar.members) && len(params) > 1 {
+                    rar.members[id].prev = parent
+                    rar.members[parent].address = params[1]
+                }
+            case "nodeDown": // nodeDown otherId: the link between otherId and id broke
+                if prev, err := paramInt(params, 0); err == nil && prev >= 0 && prev < len(rar.members) && prev != id {
+                    rar.nodeDown(prev)
+                }
+            case "orphan": // orphan mid: id waits for mid, lost with a failed node
+                if mid, err := paramInt(params, 0); err == nil && rar.orphanFiller >= 0 && rar.members[rar.orphanFiller].alive {
+                    rar.members[rar.orphanFiller].conn.Send("fillOrphan", itoa(mid))
+                    rar.onInfrMsgSent()
+                }
+            case "unreachable": // unreachable address: id could not connect to the node at address
+                if len(params) > 0 {
+                    for other, m := range rar.members {
+                        if m.alive && m.address == params[0] && other != id {
+                            rar.nodeDown(other)
+                            break
+                        }
+                    }
+                }
+        }
+        rar.lock.Unlock()
+    }
+}
+
+/*
+nodeDown removes the node dead from the ring (or the tree, see reparent): the live
+node before it connects to the node after it, that adopts its agents and fills
+the mids lost with it. In a tree, the agents move to the other nodes. The caller
+must hold rar.lock.
+*/
+func (rar *RingAgentRegistration) nodeDown(dead int) {
+    m := rar.members[dead]
+    if !m.alive || rar.terminated {
+        return
+    }
+    m.alive = false
+    m.conn.Close()
+    if m.tree {
+        log.Printf("goat: registration: tree node %d is down", dead)
+        rar.reparent(dead)
+        rar.moveAgents(dead, -1)
+        return
+    }
+    log.Printf("goat: registration: ring node %d is down", dead)
+    prev := m.prev
+    for steps := 0; prev >= 0 && !rar.members[prev].alive && steps < len(rar.members); steps++ {
+        prev = rar.members[prev].prev
+    }
+    next := -1
+    for id, other := range rar.members {
+        if other.alive && other.address == m.next {
+            next = id
+        }
+    }
+    if prev >= 0 && rar.members[prev].alive {
+        if next >= 0 {
+            rar.members[next].conn.Send("expectPrev", itoa(prev))
+            rar.onInfrMsgSent()
+        }
+        rar.members[prev].next = m.next
+        rar.members[prev].conn.Send("repair", m.next)
+        rar.onInfrMsgSent()
+    } else {
+        log.Printf("goat: registration: no live node before ring node %d", dead)
+    }
+    if next >= 0 {
+        rar.orphanFiller = next
+    }
+    rar.moveAgents(dead, next)
+}
+
+/*
+moveAgents assigns the agents of the node dead to the node to, or to the live ones
+with the policy if to < 0. The caller must hold rar.lock.
+*/
+func (rar *RingAgentRegistration) moveAgents(dead int, to int) {
+    for compId, ag := range rar.agents {
+        if ag.node != dead {
+            continue
+        }
+        which := to
+        if which < 0 {
+            which = rar.pickNode()
+        }
+        if which < 0 {
+            return
+        }
+        ag.node = which
+        rar.members[which].conn.Send("newAgent", itoa(compId), ag.address, "resume")
+        rar.onInfrMsgSent()
+    }
+}
+
+////
+
+// forward writes tokens on the link to the next node; the caller must hold rn.lock
+func (rn *RingNode) forward(tokens ...string) {
+    if rn.nextBroken {
+        return // the messages are in the history, for the repair
+    }
+    rn.nextNodeConn.conn.SetWriteDeadline(time.Now().Add(ringLinkTimeout))
+    if err := rn.nextNodeConn.Send(tokens...); err != nil {
+        dprintln("Link to the next node of", rn.port, "broke:", err)
+        rn.nextBroken = true
+    }
+    rn.lastForward = time.Now()
+}
+
+// remember adds a dispatched message to the history; the caller must hold rn.lock
+func (rn *RingNode) remember(mid int, msg []string) {
+    rn.history[mid] = msg
+    delete(rn.history, mid - ringHistory)
+}
+
+// heartbeat keeps the link to the next node alive until rn is terminated
+func (rn *RingNode) heartbeat() {
+    ticker := time.NewTicker(ringHeartbeat)
+    defer ticker.Stop()
+    for {
+        select {
+            case <- rn.chnQuit:
+                return
+            case now := <- ticker.C:
+                rn.lock.Lock()
+                if now.Sub(rn.lastForward) >= ringHeartbeat {
+                    rn.forward("HB")
+                }
+                rn.lock.Unlock()
+        }
+    }
+}
+
+// acceptPrevNodes serves the links from the previous nodes opened after a repair
+func (rn *RingNode) acceptPrevNodes() {
+    for {
+        conn, ok := <- rn.listenerConns.Out
+        if !ok {
+            return
+        }
+        go rn.offerPrev(conn)
+    }
+}
+
+/*
+offerPrev reads "prev id" on a link opened after a repair. The link replaces the
+one from the previous node only if id is the node the registration told rn to
+expect; a link that comes before the registration does is kept for
+ringLinkTimeout, any other is closed.
+*/
+func (rn *RingNode) offerPrev(conn *duplexConn) {
+    conn.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+    cmd, params, err := conn.ReceiveErr()
+    id, errId := paramInt(params, 0)
+    if err != nil || cmd != "prev" || errId != nil {
+        conn.Close()
+        return
+    }
+    rn.lock.Lock()
+    defer rn.lock.Unlock()
+    if rn.terminated {
+        conn.Close()
+        return
+    }
+    if id == rn.expectedPrev {
+        rn.linkPrev(id, conn)
+        return
+    }
+    if other, has := rn.offeredPrev[id]; has {
+        other.Close()
+    }
+    rn.offeredPrev[id] = conn
+    time.AfterFunc(ringLinkTimeout, func() {
+        rn.lock.Lock()
+        if rn.offeredPrev[id] == conn {
+            log.Printf("goat: ring node %d: refused the link from node %d, that it does not expect", rn.port, id)
+            delete(rn.offeredPrev, id)
+            conn.Close()
+        }
+        rn.lock.Unlock()
+    })
+}
+
+// expectPrev makes rn accept the link from the node id, that replaces the previous node
+func (rn *RingNode) expectPrev(id int) {
+    rn.lock.Lock()
+    defer rn.lock.Unlock()
+    rn.expectedPrev = id
+    if conn, has := rn.offeredPrev[id]; has && !rn.terminated {
+        rn.linkPrev(id, conn)
+    }
+}
+
+/*
+linkPrev makes conn the link from the previous node id, and closes the other
+links offered. The caller must hold rn.lock.
+*/
+func (rn *RingNode) linkPrev(id int, conn *duplexConn) {
+    old := rn.prevNodeConn
+    rn.prevNodeConn = conn
+    rn.prevId = id
+    rn.expectedPrev = -1
+    for other, offered := range rn.offeredPrev {
+        if offered != conn {
+            offered.Close()
+        }
+        delete(rn.offeredPrev, other)
+    }
+    old.Close()
+    rn.regConn.Send("linked", itoa(id))
+    rn.onInfrMsgSent()
+    go rn.handlePrevNode(conn)
+}
+
+// prevDown reports that the link conn from the previous node broke, if it is still the current one
+func (rn *RingNode) prevDown(conn *duplexConn) {
+    rn.lock.Lock()
+    current := conn == rn.prevNodeConn && !rn.terminated
+    prevId := rn.prevId
+    rn.lock.Unlock()
+    conn.Close()
+    if current && prevId >= 0 {
+        dprintln("Ring node", rn.port, "lost the previous node", prevId)
+        rn.regConn.Send("nodeDown", itoa(prevId))
+        rn.onInfrMsgSent()
+    }
+}
+
+/*
+repair connects rn to the node at address, that replaces the next node, and sends
+it the messages of the history.
+*/
+func (rn *RingNode) repair(address string) {
+    conn, err := connect(address, rn.tlsConfig)
+    if err != nil {
+        log.Printf("goat: ring node %d: can not reach %s: %v", rn.port, address, err)
+        rn.regConn.Send("unreachable", address)
+        rn.onInfrMsgSent()
+        return
+    }
+    conn.Send("prev", itoa(rn.id))
+    rn.lock.Lock()
+    if rn.terminated {
+        rn.lock.Unlock()
+        conn.Close()
+        return
+    }
+    old := rn.nextNodeConn
+    rn.nextNodeConn = conn
+    rn.nextBroken = false
+    rn.nextNodeAddress = address
+    first := rn.nid - ringHistory
+    for mid := first; mid < rn.nid; mid++ {
+        if msg, has := rn.history[mid]; has {
+            rn.forward(msg...)
+        }
+    }
+    rn.lock.Unlock()
+    old.Close()
+    dprintln("Ring node", rn.port, "now forwards to", address)
+}
+
+/*
+resumeAgent serves an agent moved to rn from a failed node: the agent tells the
+next mid it waits for and the mids it holds, then rn sends it the messages from
+that mid on. The caller must hold rn.lock.
+*/
+func (rn *RingNode) resumeAgent(idx int, conn *duplexConn, params []string) {
+    next, held, err := decodeResume(params)
+    if err != nil {
+        log.Printf("goat: ring node %d: invalid Resume from agent %d: %v", rn.port, idx, err)
+        next = rn.nid
+    }
+    for _, mid := range held {
+        if mid >= rn.nid {
+            rn.leases.grant(idx, mid, 1)
+        }
+    }
+    conn.Send("Registered", itoa(idx), itoa(rn.nid))
+    rn.onInfrMsgSent()
+    if next < rn.nid - ringHistory {
+        log.Printf("goat: ring node %d: agent %d missed messages older than the history", rn.port, idx)
+    }
+    for mid := next; mid < rn.nid; mid++ {
+        msg, has := rn.history[mid]
+        if !has || atoi(msg[2]) == idx {
+            continue
+        }
+        fwd := append([]string{}, msg...)
+        fwd[2] = "0" //anonimity
+        if rn.filter.excludesData(atoi(msg[2]), idx, msg[3], msg[4]) {
+            conn.Send(skipParams(mid, rn.filter.skip(idx, skippedMessage{mid: mid, sender: atoi(msg[2]), params: fwd}))...)
+        } else {
+            conn.Send(fwd...)
+        }
+        rn.onInfrMsgSent()
+    }
+    rn.agents[idx] = conn
+}
+
+// decodeResume decodes "Resume next held" from an agent, where held lists its mids separated by commas, or is "-"
+func decodeResume(params []string) (int, []int, error) {
+    next, err := paramInt(params, 0)
+    if err != nil {
+        return 0, nil, err
+    }
+    held := []int{}
+    if len(params) > 1 && params[1] != "-" {
+        for _, s := range strings.Split(params[1], ",") {
+            mid, err := strconv.Atoi(s)
+            if err != nil {
+                return next, nil, err
+            }
+            held = append(held, mid)
+        }
+    }
+    return next, held, nil
+}
+
+/*
+fillOrphan fills the mid rn waits for if the registration told it to, and reports
+it if it is stuck for long, although later messages arrived or later mids were
+given: its lease was held by a node that failed. The registration tells only the node after the last failed
+one to fill a mid, so the fill goes round the ring like the other messages; an
+agent moved to that node that sends the message later is told EXPIRED. The caller
+must hold rn.lock.
+*/
+func (rn *RingNode) fillOrphan(now time.Time) {
+    for mid := range rn.orphans {
+        if mid < rn.nid {
+            delete(rn.orphans, mid)
+        }
+    }
+    if _, has := rn.orphans[rn.nid]; has && !rn.leases.holds(rn.nid) {
+        log.Printf("goat: ring node %d: filling mid %d, lost with a failed node", rn.port, rn.nid)
+        delete(rn.orphans, rn.nid)
+        rn.leases.filled[rn.nid] = struct{}{}
+        rn.messages[rn.nid] = emptyDataMessage(rn.nid, -1)
+        rn.dispatch(-1)
+    }
+    if rn.nid != rn.stuckNid {
+        rn.stuckNid = rn.nid
+        rn.stuckSince = now
+        return
+    }
+    if rn.leases.duration <= 0 || rn.leases.holds(rn.nid) || now.Sub(rn.stuckSince) < 2 * rn.leases.duration + ringLinkTimeout {
+        return
+    }
+    later := rn.leases.lowest() > rn.nid // a component waits for rn.nid before it sends its message
+    for mid := range rn.messages {
+        later = later || mid > rn.nid
+    }
+    if later {
+        rn.regConn.Send("orphan", itoa(rn.nid))
+        rn.onInfrMsgSent()
+        rn.stuckSince = now // asks again later, if the node to fill it failed too
+    }
+}
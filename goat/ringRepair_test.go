@@ -0,0 +1,254 @@
+package goat
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+)
+
+// nodeOf returns the index in tri.nodes of the node that serves agent
+func (tri *testRingInfrastructure) nodeOf(agent *RingAgent) int {
+    rar := tri.registration
+    rar.lock.Lock()
+    id := rar.agents[agent.GetComponentId()].node
+    rar.lock.Unlock()
+    for i, nd := range tri.nodes {
+        nd.lock.Lock()
+        ndId := nd.id
+        nd.lock.Unlock()
+        if ndId == id {
+            return i
+        }
+    }
+    return -1
+}
+
+// kill terminates the node i, as if it crashed
+func (tri *testRingInfrastructure) kill(i int) {
+    tri.nodes[i].Terminate()
+    close(tri.terms[2+i])
+}
+
+/*
+hang makes the node i silent without closing its links, as if it froze: it
+writes nothing, not even heartbeats. The returned function kills it.
+*/
+func (tri *testRingInfrastructure) hang(i int) func() {
+    tri.nodes[i].lock.Lock()
+    return func() {
+        tri.nodes[i].lock.Unlock()
+        tri.kill(i)
+    }
+}
+
+func TestRingRepair(t *testing.T) {
+    tst := testRingInfrastructure{}
+    tst.initTest(3000, 4, 2)
+    comp1 := NewComponent(tst.agents[0], nil)
+    comp2 := NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    // the node of the first agent fails: the agent moves to another node
+    tst.kill(tst.nodeOf(tst.agents[0]))
+    sendAndReceive(t, comp1, comp2)
+    sendAndReceive(t, comp2, comp1)
+    // a node without agents fails
+    for i := range tst.nodes {
+        tst.nodes[i].lock.Lock()
+        alive := !tst.nodes[i].terminated
+        tst.nodes[i].lock.Unlock()
+        if alive && i != tst.nodeOf(tst.agents[0]) && i != tst.nodeOf(tst.agents[1]) {
+            tst.kill(i)
+            break
+        }
+    }
+    sendAndReceive(t, comp1, comp2)
+    sendAndReceive(t, comp2, comp1)
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+}
+
+/*
+inFlightTest sends n messages from the first component to the others, and kills
+the node of the component victim while they are in flight: the receivers get
+each message once and in order, and the sender does not get its own messages
+back from the node that adopts it.
+*/
+func inFlightTest(t *testing.T, victim int) {
+    tst := testRingInfrastructure{}
+    tst.initTest(6000, 4, 3)
+    comps := []*Component{}
+    for _, agent := range tst.agents {
+        comps = append(comps, NewComponent(agent, nil))
+    }
+    const n = 60
+    chnKill := make(chan struct{})
+    done := []chan struct{}{}
+    for _, comp := range comps[1:] {
+        chnDone := make(chan struct{})
+        done = append(done, chnDone)
+        NewProcess(comp).Run(func(p *Process) {
+            defer close(chnDone)
+            for i := 0; i < n; i++ {
+                msg := p.Receive(func(attr *Attributes, msg Tuple) bool {
+                    return true
+                })
+                if got := msg.Get(0); got != i {
+                    t.Errorf("received %v instead of %d", got, i)
+                    return
+                }
+            }
+        })
+    }
+    echoed := make(chan struct{})
+    NewProcess(comps[0]).Run(func(p *Process) {
+        ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+        defer cancel()
+        if msg, err := p.ReceiveCtx(ctx, func(attr *Attributes, msg Tuple) bool {
+            return true
+        }); err == nil {
+            t.Errorf("the sender received its own message %v", msg)
+        }
+        close(echoed)
+    })
+    NewProcess(comps[0]).Run(func(p *Process) {
+        for i := 0; i < n; i++ {
+            if i == n / 4 {
+                close(chnKill)
+            }
+            p.Send(NewTuple(i), True())
+        }
+    })
+    <- chnKill
+    tst.kill(tst.nodeOf(tst.agents[victim]))
+    waitAll(t, 15000, append(done, echoed)...)
+    for _, comp := range comps {
+        comp.Close()
+    }
+    tst.teardownTest()
+}
+
+func TestRingRepairInFlight(t *testing.T) {
+    for _, victim := range []int{0, 1} {
+        t.Run(fmt.Sprintf("victim%d", victim), func(t *testing.T) {
+            inFlightTest(t, victim)
+        })
+    }
+}
+
+/*
+A node that freezes while an agent of it holds a mid is declared down by the next
+node when the link stays silent. The next node alone fills the mid, and the fill
+goes round the ring, so the other components get the later messages.
+*/
+func TestRingRepairSilentNode(t *testing.T) {
+    tst := testRingInfrastructure{midLease: 200 * time.Millisecond}
+    tst.initTest(6000, 4, 3)
+    holder := tst.agents[0]
+    if err := holder.Start(); err != nil {
+        t.Fatal(err)
+    }
+    comp1 := NewComponent(tst.agents[1], nil)
+    comp2 := NewComponent(tst.agents[2], nil)
+    sendAndReceive(t, comp1, comp2)
+    holder.AskMid()
+    orphan := <- holder.GetRplyChan().Out
+    silent := tst.nodeOf(holder)
+    if silent == tst.nodeOf(tst.agents[1]) || silent == tst.nodeOf(tst.agents[2]) {
+        t.Fatalf("the agents share node %d", silent)
+    }
+    kill := tst.hang(silent)
+    holder.Close() // its mid is lost with the node
+    sendAndReceiveWithin(t, comp1, comp2, 10000)
+    deadline := time.Now().Add(2 * time.Second)
+    for i, nd := range tst.nodes {
+        if i == silent {
+            continue
+        }
+        for {
+            nd.lock.Lock()
+            msg, has := nd.history[orphan]
+            nd.lock.Unlock()
+            if has {
+                if !isEmptyData(msg[1:]) || msg[2] != "-1" {
+                    t.Errorf("node %d has %v for the lost mid %d", i, msg, orphan)
+                }
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Errorf("node %d did not get the lost mid %d", i, orphan)
+                break
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+    sendAndReceive(t, comp2, comp1)
+    kill()
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+}
+
+// a link from a node that the registration did not announce does not replace the one from the previous node
+func TestRingRefusesUnexpectedPrev(t *testing.T) {
+    tst := testRingInfrastructure{}
+    tst.initTest(3000, 3, 2)
+    comp1 := NewComponent(tst.agents[0], nil)
+    comp2 := NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    nd := tst.nodes[0]
+    nd.lock.Lock()
+    prev := nd.prevNodeConn
+    nd.lock.Unlock()
+    stranger, err := connect(fmt.Sprintf("127.0.0.1:%d", nd.port), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stranger.Send("prev", "99")
+    stranger.conn.SetReadDeadline(time.Now().Add(2 * ringLinkTimeout))
+    var netErr net.Error
+    if _, _, err := stranger.ReceiveErr(); err == nil {
+        t.Errorf("the node wrote to the stranger")
+    } else if errors.As(err, &netErr) && netErr.Timeout() {
+        t.Errorf("the node did not close the link from the stranger")
+    }
+    nd.lock.Lock()
+    if nd.prevNodeConn != prev {
+        t.Errorf("the stranger replaced the link from the previous node")
+    }
+    nd.lock.Unlock()
+    stranger.Close()
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+}
+
+// the messages a node sends an agent that the agent sent itself, as after an adoption, do not reach its component
+func TestRingAgentDropsOwnMessages(t *testing.T) {
+    ca := NewRingAgent("127.0.0.1:17997")
+    ca.firstMessageId = 0
+    own := NewTuple("own")
+    ca.sent[1] = []string{"DATA", "1", "0", True().String(), own.encode()}
+    nodeSide, agentSide := net.Pipe()
+    go ca.readNode(newDuplexConn(agentSide))
+    node := newDuplexConn(nodeSide)
+    for mid, val := range []string{"other", "own", "next"} {
+        tuple := NewTuple(val)
+        node.Send("DATA", itoa(mid), "0", True().String(), tuple.encode())
+    }
+    for _, want := range []int{0, 2} {
+        select {
+            case msg := <- ca.chnMessagesIn.Out:
+                if msg.Id != want {
+                    t.Errorf("the component got message %d instead of %d", msg.Id, want)
+                }
+            case <- time.After(time.Second):
+                t.Fatalf("message %d did not reach the component", want)
+        }
+    }
+    node.Close()
+}
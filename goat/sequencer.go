@@ -0,0 +1,1057 @@
+package goat
+
+import (
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+A replicated sequencer is a set of SequencerReplica, usually three or five, that
+hand out the mids in place of a single counter (see SequencerClient). One replica
+is the leader: it allocates the mids that the nodes ask for, and answers only once
+a majority of the replicas accepted the allocation. When the leader is not heard
+for a while, the other replicas elect a new one, that starts from the allocations
+known to a majority: a mid that was handed out is never handed out again. Every
+request carries an id, so that a request retried after a failover gets the mids
+allocated to it, if any, and no mid is left unused.
+
+The replicas speak this protocol, on the connections opened by the clients and by
+the other replicas:
+
+    inc n req                       -> count first req | leader idx req
+    read req                        -> count next req | leader idx req
+    VOTE term idx                   -> VOTED term idx state | REJECT promised
+    SYNC term idx seq state         -> ACCEPTED term seq idx | REJECT promised
+    ACCEPT term idx seq start entries -> ACCEPTED term seq idx | REJECT promised
+
+where a state is a floor followed by entries, and an entry is "term first n req".
+*/
+
+const (
+    sequencerHeartbeat = 50 * time.Millisecond
+    sequencerElection = 400 * time.Millisecond // plus a random part as long
+    sequencerRetention = time.Minute // how long an allocation is remembered, for the retried requests
+    sequencerRequestTimeout = sequencerRetention / 2 // a client gives up a request after this
+    sequencerClientTimeout = time.Second
+    sequencerDialTimeout = time.Second
+)
+
+// ErrSequencerClosed is returned by a SequencerClient that was closed
+var ErrSequencerClosed = errors.New("goat: sequencer client closed")
+
+/*
+ErrSequencerTimeout is returned by a SequencerClient when no leader answered a
+request within sequencerRequestTimeout, for instance because a majority of the
+replicas is down: the request is not retried anymore, since the replicas forget
+its allocation after a while.
+*/
+var ErrSequencerTimeout = errors.New("goat: no sequencer leader answered")
+
+// seqEntry allocates the mids from first to first+n-1 to the request req
+type seqEntry struct {
+    term int
+    first int
+    n int
+    req string
+}
+
+func (e seqEntry) end() int {
+    return e.first + e.n
+}
+
+/*
+seqState holds the allocations known to a replica, sorted by first mid. The mids
+below floor were allocated by entries that are not remembered anymore.
+*/
+type seqState struct {
+    floor int
+    entries []seqEntry
+    learnt map[string]time.Time // when the replica learnt each entry, by request
+}
+
+func (s *seqState) next() int {
+    next := s.floor
+    for _, e := range s.entries {
+        if e.end() > next {
+            next = e.end()
+        }
+    }
+    return next
+}
+
+func (s *seqState) find(req string) (seqEntry, bool) {
+    for i := len(s.entries) - 1; i >= 0; i-- {
+        if s.entries[i].req == req {
+            return s.entries[i], true
+        }
+    }
+    return seqEntry{}, false
+}
+
+/*
+prune sorts the entries and forgets the first ones that the replica learnt more
+than sequencerRetention ago: their requests are not retried anymore (see
+SequencerClient.request). Only a prefix is forgotten, so that the entries left
+have no holes before them.
+*/
+func (s *seqState) prune() {
+    sort.Slice(s.entries, func(i, j int) bool {
+        return s.entries[i].first < s.entries[j].first
+    })
+    now := time.Now()
+    learnt := make(map[string]time.Time, len(s.entries))
+    drop := 0
+    for i, e := range s.entries {
+        at, has := s.learnt[e.req]
+        if !has {
+            at = now
+        }
+        if drop == i && now.Sub(at) > sequencerRetention {
+            if e.end() > s.floor {
+                s.floor = e.end()
+            }
+            drop++
+        } else {
+            learnt[e.req] = at
+        }
+    }
+    s.learnt = learnt
+    if drop > 0 {
+        s.entries = append([]seqEntry{}, s.entries[drop:]...)
+    }
+}
+
+/*
+accept adds the entries proposed at term by the leader, whose mids start from
+start. The entries of lower terms that reach start are dropped: they were never
+accepted by a majority, or the leader would have them.
+*/
+func (s *seqState) accept(term int, start int, entries []seqEntry) {
+    kept := []seqEntry{}
+    for _, e := range s.entries {
+        if e.term < term && e.end() > start {
+            continue
+        }
+        overlaps := false
+        for _, ne := range entries {
+            overlaps = overlaps || (e.first < ne.end() && ne.first < e.end())
+        }
+        if !overlaps {
+            kept = append(kept, e)
+        }
+    }
+    s.entries = append(kept, entries...)
+    s.prune()
+}
+
+func (s *seqState) copy() seqState {
+    learnt := make(map[string]time.Time, len(s.learnt))
+    for req, at := range s.learnt {
+        learnt[req] = at
+    }
+    return seqState{s.floor, append([]seqEntry{}, s.entries...), learnt}
+}
+
+func encodeSeqEntries(entries []seqEntry) []string {
+    tokens := make([]string, 0, 4*len(entries))
+    for _, e := range entries {
+        tokens = append(tokens, itoa(e.term), itoa(e.first), itoa(e.n), e.req)
+    }
+    return tokens
+}
+
+func decodeSeqEntries(tokens []string) ([]seqEntry, error) {
+    if len(tokens) % 4 != 0 {
+        return nil, fmt.Errorf("goat: invalid sequencer entries %v", tokens)
+    }
+    entries := make([]seqEntry, 0, len(tokens)/4)
+    for i := 0; i < len(tokens); i += 4 {
+        var e seqEntry
+        var err error
+        if e.term, err = paramInt(tokens, i); err != nil {
+            return nil, err
+        } else if e.first, err = paramInt(tokens, i+1); err != nil {
+            return nil, err
+        } else if e.n, err = paramInt(tokens, i+2); err != nil {
+            return nil, err
+        }
+        e.req = tokens[i+3]
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+func (s *seqState) encode() []string {
+    return append([]string{itoa(s.floor)}, encodeSeqEntries(s.entries)...)
+}
+
+func decodeSeqState(tokens []string) (seqState, error) {
+    floor, err := paramInt(tokens, 0)
+    if err != nil {
+        return seqState{}, err
+    }
+    entries, err := decodeSeqEntries(tokens[1:])
+    if err != nil {
+        return seqState{}, err
+    }
+    s := seqState{floor: floor, entries: entries}
+    s.prune()
+    return s, nil
+}
+
+/*
+mergeSeqStates returns the allocations that a new leader starts from, given the
+states of a majority of the replicas. Where two entries overlap, or are for the
+same request, the one of the higher term wins, as it was accepted later; the
+result is cut at the first hole, so that the mids are handed out with no gaps,
+and at the first entry of a term lower than the one before it.
+*/
+func mergeSeqStates(states []seqState) seqState {
+    floor := 0
+    all := []seqEntry{}
+    for _, s := range states {
+        if s.floor > floor {
+            floor = s.floor
+        }
+        all = append(all, s.entries...)
+    }
+    sort.SliceStable(all, func(i, j int) bool {
+        return all[i].term > all[j].term
+    })
+    kept := []seqEntry{}
+    reqs := map[string]struct{}{}
+    for _, e := range all {
+        if _, dup := reqs[e.req]; dup || e.end() <= floor {
+            continue
+        }
+        overlaps := false
+        for _, k := range kept {
+            overlaps = overlaps || (e.first < k.end() && k.first < e.end())
+        }
+        if !overlaps {
+            kept = append(kept, e)
+            reqs[e.req] = struct{}{}
+        }
+    }
+    sort.Slice(kept, func(i, j int) bool {
+        return kept[i].first < kept[j].first
+    })
+    merged := seqState{floor: floor, entries: []seqEntry{}}
+    next, term := floor, 0
+    for _, e := range kept {
+        if e.first < next {
+            continue
+        } else if e.first > next || e.term < term {
+            // a leader puts its entries after the ones accepted before it: these never were
+            break
+        }
+        merged.entries = append(merged.entries, e)
+        next, term = e.end(), e.term
+    }
+    return merged
+}
+
+// seqRequest is an inc (n > 0) or a read (n == 0) of a client, to answer on conn
+type seqRequest struct {
+    conn *duplexConn
+    req string
+    n int
+}
+
+// seqRound is a SYNC or an ACCEPT of the leader, waiting for a majority
+type seqRound struct {
+    seq int
+    tokens []string
+    acks map[int]struct{}
+    requests []seqRequest
+    sync bool
+    sent time.Time
+}
+
+type seqEvent struct {
+    conn *duplexConn
+    cmd string
+    params []string
+}
+
+// seqPeer sends the messages of a replica to another one, dialling it when needed
+type seqPeer struct {
+    address string
+    chnOut chan []string
+}
+
+type seqRole int
+
+const (
+    seqFollower seqRole = iota
+    seqCandidate
+    seqLeader
+)
+
+/*
+SequencerReplica is a replica of a replicated sequencer (see above). The replicas
+must be given the same addresses, in the same order; each one listens on the port
+of its own address. A replica keeps its promise and its allocations in memory
+only, unless UseStateFile is called: a replica that crashed must then never come
+back under the same index, as it would forget what it accepted and promised.
+*/
+type SequencerReplica struct {
+    index int
+    addresses []string
+    tlsConfig *tls.Config
+    statePath string
+    listenerConns *unboundChanConn
+    peers []*seqPeer
+    chnEvents chan seqEvent
+    chnActivity chan struct{}
+    chnQuit chan struct{}
+    lock *sync.Mutex
+    conns []*duplexConn
+    terminated bool
+    leading bool
+
+    // only used by the goroutine of the replica
+    role seqRole
+    promised int
+    leader int
+    state seqState
+    heard time.Time
+    electionTimeout time.Duration
+    votes map[int]seqState
+    round *seqRound
+    lastSeq int
+    pending []seqRequest
+    saved string
+}
+
+func NewSequencerReplica(index int, addresses []string) *SequencerReplica {
+    return newSequencerReplica(nil, index, addresses)
+}
+
+// NewSequencerReplicaTLS returns a replica that uses TLS with tlsConfig for every connection
+func NewSequencerReplicaTLS(tlsConfig *tls.Config, index int, addresses []string) *SequencerReplica {
+    return newSequencerReplica(tlsConfig, index, addresses)
+}
+
+func newSequencerReplica(tlsConfig *tls.Config, index int, addresses []string) *SequencerReplica {
+    listenerConns, chnReady := listenerTLS(atoi(newNetAddress(addresses[index]).Port), tlsConfig)
+    <-chnReady
+    sr := &SequencerReplica{
+        index: index,
+        addresses: addresses,
+        tlsConfig: tlsConfig,
+        listenerConns: listenerConns,
+        peers: make([]*seqPeer, len(addresses)),
+        chnEvents: make(chan seqEvent),
+        chnActivity: make(chan struct{}, 1),
+        chnQuit: make(chan struct{}),
+        lock: &sync.Mutex{},
+        leader: -1,
+        state: seqState{entries: []seqEntry{}},
+    }
+    for i, address := range addresses {
+        if i != index {
+            sr.peers[i] = &seqPeer{address, make(chan []string, 64)}
+        }
+    }
+    return sr
+}
+
+/*
+UseStateFile makes the replica resume from the promise and the allocations saved
+in the file path, if any, and save them there before it answers a vote or an
+allocation, so that it can be restarted under the same index. It must be called
+before Work.
+*/
+func (sr *SequencerReplica) UseStateFile(path string) error {
+    data, err := os.ReadFile(path)
+    if err == nil {
+        tokens := strings.Fields(string(data))
+        promised, err := paramInt(tokens, 0)
+        if err != nil {
+            return fmt.Errorf("goat: invalid sequencer state file %s", path)
+        }
+        state, err := decodeSeqState(tokens[1:])
+        if err != nil {
+            return fmt.Errorf("goat: invalid sequencer state file %s", path)
+        }
+        sr.promised = promised
+        sr.state = state
+        sr.saved = strings.Join(tokens, " ")
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    sr.statePath = path
+    return nil
+}
+
+// save writes the promise and the allocations to the state file, if any, when they changed
+func (sr *SequencerReplica) save() error {
+    if sr.statePath == "" {
+        return nil
+    }
+    data := strings.Join(append([]string{itoa(sr.promised)}, sr.state.encode()...), " ")
+    if data == sr.saved {
+        return nil
+    }
+    if err := writeFileSync(sr.statePath, []byte(data + "\n")); err != nil {
+        log.Printf("goat: sequencer %d: can not save the state: %v", sr.index, err)
+        return err
+    }
+    sr.saved = data
+    return nil
+}
+
+func (sr *SequencerReplica) WorkLoop() {
+    sr.Work(0, make(chan struct{}))
+}
+
+/*
+Work serves the clients and the other replicas until Terminate is called. It
+returns when no client request arrives for timeout msec, closing timedOut, or when
+the replica is terminated.
+*/
+func (sr *SequencerReplica) Work(timeout int64, timedOut chan<- struct{}) {
+    go sr.serve()
+    for _, peer := range sr.peers {
+        if peer != nil {
+            go sr.sendTo(peer)
+        }
+    }
+    go sr.run()
+    waitIdle(sr.chnActivity, sr.chnQuit, timeout, timedOut)
+}
+
+// IsLeader tells whether the replica is the leader, ready to hand out mids
+func (sr *SequencerReplica) IsLeader() bool {
+    sr.lock.Lock()
+    defer sr.lock.Unlock()
+    return sr.leading
+}
+
+/*
+Terminate closes the listener and every connection of the replica, and stops its
+goroutines. The other replicas see it as crashed.
+*/
+func (sr *SequencerReplica) Terminate() {
+    sr.lock.Lock()
+    defer sr.lock.Unlock()
+    if sr.terminated {
+        return
+    }
+    sr.terminated = true
+    sr.leading = false
+    close(sr.chnQuit)
+    sr.listenerConns.Close()
+    for _, conn := range sr.conns {
+        conn.Close()
+    }
+}
+
+// track keeps conn to close it on Terminate, and reads it; it fails if sr is terminated
+func (sr *SequencerReplica) track(conn *duplexConn) bool {
+    sr.lock.Lock()
+    defer sr.lock.Unlock()
+    if sr.terminated {
+        conn.Close()
+        return false
+    }
+    sr.conns = append(sr.conns, conn)
+    go sr.read(conn)
+    return true
+}
+
+func (sr *SequencerReplica) serve() {
+    for {
+        conn, ok := <- sr.listenerConns.Out
+        if !ok || !sr.track(conn) {
+            return
+        }
+    }
+}
+
+func (sr *SequencerReplica) read(conn *duplexConn) {
+    for {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            conn.Close()
+            return
+        }
+        select {
+            case sr.chnEvents <- seqEvent{conn, cmd, params}:
+            case <- sr.chnQuit:
+                return
+        }
+    }
+}
+
+// sendTo delivers the messages for peer; they are dropped while it can not be reached
+func (sr *SequencerReplica) sendTo(peer *seqPeer) {
+    var conn *duplexConn
+    for {
+        select {
+            case tokens := <- peer.chnOut:
+                if conn == nil {
+                    c, err := dialSequencer(peer.address, sr.tlsConfig)
+                    if err != nil || !sr.track(c) {
+                        continue
+                    }
+                    conn = c
+                }
+                if err := conn.Send(tokens...); err != nil {
+                    conn.Close()
+                    conn = nil
+                }
+            case <- sr.chnQuit:
+                return
+        }
+    }
+}
+
+// send queues tokens for the replica i, without waiting
+func (sr *SequencerReplica) send(i int, tokens ...string) {
+    select {
+        case sr.peers[i].chnOut <- tokens:
+        default:
+            // the peer is slow or down: the leader sends again at the next heartbeat
+    }
+}
+
+func (sr *SequencerReplica) broadcast(tokens ...string) {
+    for i, peer := range sr.peers {
+        if peer != nil {
+            sr.send(i, tokens...)
+        }
+    }
+}
+
+func (sr *SequencerReplica) majority() int {
+    return len(sr.addresses)/2 + 1
+}
+
+func (sr *SequencerReplica) setLeading(leading bool) {
+    sr.lock.Lock()
+    sr.leading = leading && !sr.terminated
+    sr.lock.Unlock()
+}
+
+func (sr *SequencerReplica) newElectionTimeout() time.Duration {
+    jitter, err := rand.Int(rand.Reader, big.NewInt(int64(sequencerElection)))
+    if err != nil {
+        return sequencerElection
+    }
+    return sequencerElection + time.Duration(jitter.Int64())
+}
+
+func (sr *SequencerReplica) run() {
+    ticker := time.NewTicker(sequencerHeartbeat)
+    defer ticker.Stop()
+    sr.heard = time.Now()
+    sr.electionTimeout = sr.newElectionTimeout()
+    for {
+        select {
+            case ev := <- sr.chnEvents:
+                sr.handle(ev)
+            case <- ticker.C:
+                sr.tick()
+            case <- sr.chnQuit:
+                return
+        }
+    }
+}
+
+func (sr *SequencerReplica) tick() {
+    now := time.Now()
+    if sr.role == seqLeader {
+        if sr.round != nil {
+            if now.Sub(sr.round.sent) >= sequencerHeartbeat {
+                for i, peer := range sr.peers {
+                    if _, acked := sr.round.acks[i]; peer != nil && !acked {
+                        sr.send(i, sr.round.tokens...)
+                    }
+                }
+                sr.round.sent = now
+            }
+        } else {
+            sr.broadcast("ACCEPT", itoa(sr.promised), itoa(sr.index), "0", itoa(sr.state.next()))
+        }
+    } else if now.Sub(sr.heard) > sr.electionTimeout {
+        sr.startElection()
+    }
+}
+
+func (sr *SequencerReplica) startElection() {
+    sr.stepDown(-1)
+    sr.promised++
+    sr.role = seqCandidate
+    sr.heard = time.Now()
+    sr.electionTimeout = sr.newElectionTimeout()
+    sr.votes = map[int]seqState{}
+    if sr.save() == nil {
+        sr.votes[sr.index] = sr.state.copy()
+    }
+    dprintln("Sequencer", sr.index, "runs for term", sr.promised)
+    sr.broadcast("VOTE", itoa(sr.promised), itoa(sr.index))
+    sr.countVotes()
+}
+
+func (sr *SequencerReplica) countVotes() {
+    if len(sr.votes) < sr.majority() {
+        return
+    }
+    states := []seqState{}
+    for _, s := range sr.votes {
+        states = append(states, s)
+    }
+    sr.votes = nil
+    sr.state = mergeSeqStates(states)
+    sr.role = seqLeader
+    sr.leader = sr.index
+    dprintln("Sequencer", sr.index, "leads term", sr.promised, "from mid", sr.state.next())
+    // the merged state must be accepted by a majority before any mid is handed out
+    sr.lastSeq++
+    tokens := append([]string{"SYNC", itoa(sr.promised), itoa(sr.index), itoa(sr.lastSeq)}, sr.state.encode()...)
+    sr.round = &seqRound{sr.lastSeq, tokens, map[int]struct{}{}, nil, true, time.Now()}
+    if sr.save() == nil {
+        sr.round.acks[sr.index] = struct{}{}
+    }
+    sr.broadcast(tokens...)
+    sr.checkRound()
+}
+
+// stepDown makes the replica a follower of leader (-1 if not known), and sends away the clients waiting
+func (sr *SequencerReplica) stepDown(leader int) {
+    if sr.role == seqLeader {
+        if sr.round != nil {
+            sr.pending = append(sr.round.requests, sr.pending...)
+        }
+        for _, r := range sr.pending {
+            r.conn.Send("leader", itoa(leader), r.req)
+        }
+        sr.pending = nil
+        sr.round = nil
+        sr.setLeading(false)
+    }
+    sr.role = seqFollower
+    sr.leader = leader
+    sr.votes = nil
+}
+
+// promise adopts term if it is newer; it tells whether a message of term can be accepted
+func (sr *SequencerReplica) promise(term int, leader int) bool {
+    if term < sr.promised {
+        return false
+    } else if term > sr.promised || sr.role != seqFollower || sr.leader != leader {
+        sr.stepDown(leader)
+        sr.promised = term
+    }
+    sr.heard = time.Now()
+    return true
+}
+
+func (sr *SequencerReplica) handle(ev seqEvent) {
+    params := ev.params
+    switch ev.cmd {
+        case "inc", "read":
+            signalActivity(sr.chnActivity)
+            r := seqRequest{conn: ev.conn}
+            if ev.cmd == "inc" {
+                n, err := paramInt(params, 0)
+                if err != nil || checkMidCount(n) != nil || len(params) < 2 {
+                    log.Printf("goat: sequencer %d: invalid inc %v", sr.index, params)
+                    return
+                }
+                r.n, r.req = n, params[1]
+            } else if len(params) > 0 {
+                r.req = params[0]
+            }
+            if sr.role != seqLeader {
+                ev.conn.Send("leader", itoa(sr.leader), r.req)
+                return
+            }
+            sr.pending = append(sr.pending, r)
+            if sr.round == nil {
+                sr.startRound()
+            }
+
+        case "VOTE":
+            term, err := paramInt(params, 0)
+            if err != nil {
+                return
+            }
+            if term > sr.promised {
+                sr.stepDown(-1)
+                sr.promised = term
+                sr.heard = time.Now()
+                if sr.save() != nil {
+                    return
+                }
+                ev.conn.Send(append([]string{"VOTED", itoa(term), itoa(sr.index)}, sr.state.encode()...)...)
+            } else {
+                ev.conn.Send("REJECT", itoa(sr.promised))
+            }
+
+        case "VOTED":
+            term, err1 := paramInt(params, 0)
+            idx, err2 := paramInt(params, 1)
+            if err1 != nil || err2 != nil || sr.role != seqCandidate || term != sr.promised {
+                return
+            }
+            state, err := decodeSeqState(params[2:])
+            if err != nil {
+                log.Printf("goat: sequencer %d: invalid vote: %v", sr.index, err)
+                return
+            }
+            sr.votes[idx] = state
+            sr.countVotes()
+
+        case "SYNC", "ACCEPT":
+            term, err1 := paramInt(params, 0)
+            idx, err2 := paramInt(params, 1)
+            seq, err3 := paramInt(params, 2)
+            if err1 != nil || err2 != nil || err3 != nil {
+                return
+            }
+            if !sr.promise(term, idx) {
+                ev.conn.Send("REJECT", itoa(sr.promised))
+                return
+            }
+            if ev.cmd == "SYNC" {
+                state, err := decodeSeqState(params[3:])
+                if err != nil {
+                    log.Printf("goat: sequencer %d: invalid SYNC: %v", sr.index, err)
+                    return
+                }
+                sr.state = state
+            } else {
+                start, err := paramInt(params, 3)
+                var entries []seqEntry
+                if err == nil {
+                    entries, err = decodeSeqEntries(params[4:])
+                }
+                if err != nil {
+                    log.Printf("goat: sequencer %d: invalid ACCEPT: %v", sr.index, err)
+                    return
+                }
+                sr.state.accept(term, start, entries)
+            }
+            if sr.save() == nil && seq > 0 {
+                ev.conn.Send("ACCEPTED", itoa(term), itoa(seq), itoa(sr.index))
+            }
+
+        case "ACCEPTED":
+            term, err1 := paramInt(params, 0)
+            seq, err2 := paramInt(params, 1)
+            idx, err3 := paramInt(params, 2)
+            if err1 != nil || err2 != nil || err3 != nil {
+                return
+            }
+            if sr.role == seqLeader && term == sr.promised && sr.round != nil && sr.round.seq == seq {
+                sr.round.acks[idx] = struct{}{}
+                sr.checkRound()
+            }
+
+        case "REJECT":
+            if term, err := paramInt(params, 0); err == nil && term > sr.promised {
+                sr.stepDown(-1)
+                sr.promised = term
+            }
+    }
+}
+
+/*
+startRound allocates the mids to the pending requests and proposes them. The
+requests already allocated are answered at once, and the reads wait for the round
+to be accepted, so that the replica is surely still the leader.
+*/
+func (sr *SequencerReplica) startRound() {
+    requests := []seqRequest{}
+    entries := []seqEntry{}
+    start := sr.state.next()
+    next := start
+    for _, r := range sr.pending {
+        if r.n == 0 {
+            requests = append(requests, r)
+        } else if e, has := sr.state.find(r.req); has {
+            r.conn.Send("count", itoa(e.first), r.req)
+        } else {
+            dup := false
+            for _, e := range entries {
+                dup = dup || e.req == r.req
+            }
+            if !dup {
+                entries = append(entries, seqEntry{sr.promised, next, r.n, r.req})
+                next += r.n
+            }
+            requests = append(requests, r)
+        }
+    }
+    sr.pending = nil
+    if len(requests) == 0 {
+        return
+    }
+    sr.state.accept(sr.promised, start, entries)
+    sr.lastSeq++
+    tokens := append([]string{"ACCEPT", itoa(sr.promised), itoa(sr.index), itoa(sr.lastSeq), itoa(start)}, encodeSeqEntries(entries)...)
+    sr.round = &seqRound{sr.lastSeq, tokens, map[int]struct{}{}, requests, false, time.Now()}
+    if sr.save() == nil {
+        sr.round.acks[sr.index] = struct{}{}
+    }
+    sr.broadcast(tokens...)
+    sr.checkRound()
+}
+
+// checkRound answers the requests of the round once a majority accepted it
+func (sr *SequencerReplica) checkRound() {
+    if sr.round == nil || len(sr.round.acks) < sr.majority() {
+        return
+    }
+    round := sr.round
+    sr.round = nil
+    if round.sync {
+        sr.setLeading(true)
+    }
+    for _, r := range round.requests {
+        if r.n == 0 {
+            r.conn.Send("count", itoa(sr.state.next()), r.req)
+        } else if e, has := sr.state.find(r.req); has {
+            r.conn.Send("count", itoa(e.first), r.req)
+        }
+    }
+    if len(sr.pending) > 0 {
+        sr.startRound()
+    }
+}
+
+// dialSequencer opens a connection to a replica, giving up after sequencerDialTimeout
+func dialSequencer(address string, tlsConfig *tls.Config) (*duplexConn, error) {
+    dialer := &net.Dialer{Timeout: sequencerDialTimeout}
+    var conn net.Conn
+    var err error
+    if tlsConfig == nil {
+        conn, err = dialer.Dial("tcp", address)
+    } else {
+        conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return dialedConn(conn)
+}
+
+/*
+SequencerClient asks the mids to the replicas of a replicated sequencer (see
+SequencerReplica): it finds the leader, and retries with another replica when the
+one it asked fails. It can be used by several goroutines at once: each request
+has a connection of its own while it waits for the answer.
+*/
+type SequencerClient struct {
+    addresses []string
+    tlsConfig *tls.Config
+    lock *sync.Mutex // guards the fields below
+    idle map[int][]*duplexConn // the connections to each replica that no request uses
+    busy map[*duplexConn]struct{}
+    closed bool
+    chnClosed chan struct{}
+    id string
+    lastReq int
+    target int
+}
+
+func NewSequencerClient(addresses []string) *SequencerClient {
+    return NewSequencerClientTLS(nil, addresses)
+}
+
+// NewSequencerClientTLS returns a client that connects to the replicas with TLS, with tlsConfig
+func NewSequencerClientTLS(tlsConfig *tls.Config, addresses []string) *SequencerClient {
+    id := make([]byte, 8)
+    rand.Read(id)
+    return &SequencerClient{
+        addresses: addresses,
+        tlsConfig: tlsConfig,
+        lock: &sync.Mutex{},
+        idle: map[int][]*duplexConn{},
+        busy: map[*duplexConn]struct{}{},
+        chnClosed: make(chan struct{}),
+        id: hex.EncodeToString(id),
+    }
+}
+
+/*
+Next reserves n consecutive mids and returns the first one. It waits until a
+leader answers, and fails if the client is closed or with ErrSequencerTimeout.
+*/
+func (sc *SequencerClient) Next(n int) (int, error) {
+    if n < 1 {
+        n = 1
+    } else if n > maxMidReservation {
+        return 0, checkMidCount(n)
+    }
+    return sc.request("inc", itoa(n))
+}
+
+// Read returns the next mid that will be handed out
+func (sc *SequencerClient) Read() (int, error) {
+    return sc.request("read")
+}
+
+// Close makes the pending and the next requests fail with ErrSequencerClosed
+func (sc *SequencerClient) Close() {
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    if sc.closed {
+        return
+    }
+    sc.closed = true
+    close(sc.chnClosed)
+    for _, conns := range sc.idle {
+        for _, conn := range conns {
+            conn.Close()
+        }
+    }
+    for conn := range sc.busy {
+        conn.Close()
+    }
+}
+
+// conn takes a connection to the replica i, that no other request uses until release
+func (sc *SequencerClient) conn(i int) (*duplexConn, error) {
+    sc.lock.Lock()
+    if sc.closed {
+        sc.lock.Unlock()
+        return nil, ErrSequencerClosed
+    } else if idle := sc.idle[i]; len(idle) > 0 {
+        conn := idle[len(idle)-1]
+        sc.idle[i] = idle[:len(idle)-1]
+        sc.busy[conn] = struct{}{}
+        sc.lock.Unlock()
+        return conn, nil
+    }
+    sc.lock.Unlock()
+    conn, err := dialSequencer(sc.addresses[i], sc.tlsConfig)
+    if err != nil {
+        return nil, err
+    }
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    if sc.closed {
+        conn.Close()
+        return nil, ErrSequencerClosed
+    }
+    sc.busy[conn] = struct{}{}
+    return conn, nil
+}
+
+// release gives back the connection to the replica i, or closes it if it failed
+func (sc *SequencerClient) release(i int, conn *duplexConn, failed bool) {
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    delete(sc.busy, conn)
+    if failed || sc.closed {
+        conn.Close()
+    } else {
+        sc.idle[i] = append(sc.idle[i], conn)
+    }
+}
+
+/*
+request sends "cmd params req" until a replica answers "count mid req". It gives
+up after sequencerRequestTimeout, before the replicas can forget the allocation
+of req (see sequencerRetention): a later retry could be given other mids.
+*/
+func (sc *SequencerClient) request(cmd string, params ...string) (int, error) {
+    sc.lock.Lock()
+    sc.lastReq++
+    req := sc.id + "-" + itoa(sc.lastReq)
+    target := sc.target
+    sc.lock.Unlock()
+    tokens := append(append([]string{cmd}, params...), req)
+    deadline := time.Now().Add(sequencerRequestTimeout)
+    for failures := 0; ; {
+        select {
+            case <- sc.chnClosed:
+                return 0, ErrSequencerClosed
+            default:
+        }
+        if time.Now().After(deadline) {
+            return 0, ErrSequencerTimeout
+        }
+        mid, answered, leader, err := sc.ask(target, tokens, req)
+        if answered {
+            return mid, nil
+        } else if err == ErrSequencerClosed {
+            return 0, err
+        }
+        if leader >= 0 && leader < len(sc.addresses) && leader != target {
+            target = leader
+        } else {
+            // no leader is known: try the next replica, after a while if all were tried
+            target = (target + 1) % len(sc.addresses)
+            failures++
+            if failures % len(sc.addresses) == 0 {
+                select {
+                    case <- time.After(sequencerHeartbeat):
+                    case <- sc.chnClosed:
+                }
+            }
+        }
+        // the next requests start from the replica that looks like the leader
+        sc.lock.Lock()
+        sc.target = target
+        sc.lock.Unlock()
+    }
+}
+
+/*
+ask sends tokens to the replica i. It returns the mid if the replica answered,
+otherwise the leader the replica points to (-1 if it does not know it).
+*/
+func (sc *SequencerClient) ask(i int, tokens []string, req string) (int, bool, int, error) {
+    conn, err := sc.conn(i)
+    if err != nil {
+        return 0, false, -1, err
+    }
+    mid, answered, leader, err := askOn(conn, tokens, req)
+    sc.release(i, conn, err != nil)
+    return mid, answered, leader, err
+}
+
+// askOn is ask on the connection conn
+func askOn(conn *duplexConn, tokens []string, req string) (int, bool, int, error) {
+    if err := conn.Send(tokens...); err != nil {
+        return 0, false, -1, err
+    }
+    conn.conn.SetReadDeadline(time.Now().Add(sequencerClientTimeout))
+    defer conn.conn.SetReadDeadline(time.Time{})
+    for {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            return 0, false, -1, err
+        }
+        if len(params) < 2 || params[len(params)-1] != req {
+            continue // the answer to a request given up
+        }
+        switch cmd {
+            case "count":
+                mid, err := paramInt(params, 0)
+                return mid, err == nil, -1, err
+            case "leader":
+                leader, err := paramInt(params, 0)
+                if err != nil {
+                    leader = -1
+                }
+                return 0, false, leader, nil
+        }
+    }
+}
@@ -0,0 +1,276 @@
+package goat
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSequencerMerge(t *testing.T) {
+    a := seqState{floor: 0, entries: []seqEntry{{1, 0, 2, "a"}, {1, 2, 3, "b"}, {1, 5, 1, "c"}}}
+    // b was not accepted by a majority: the leader of term 2 gave its mids to d, then b was retried
+    b := seqState{floor: 0, entries: []seqEntry{{1, 0, 2, "a"}, {2, 2, 1, "d"}, {2, 3, 2, "b"}}}
+    c := seqState{floor: 0, entries: []seqEntry{{1, 0, 2, "a"}}}
+    merged := mergeSeqStates([]seqState{a, b, c})
+    want := []seqEntry{{1, 0, 2, "a"}, {2, 2, 1, "d"}, {2, 3, 2, "b"}}
+    if fmt.Sprint(merged.entries) != fmt.Sprint(want) || merged.next() != 5 {
+        t.Errorf("merged %v", merged)
+    }
+    // c starts after a hole, and is dropped
+    holed := mergeSeqStates([]seqState{{floor: 0, entries: []seqEntry{{1, 0, 2, "a"}, {1, 4, 1, "c"}}}})
+    if holed.next() != 2 {
+        t.Errorf("merged %v", holed)
+    }
+    
+    s := seqState{floor: 0, entries: []seqEntry{{1, 0, 2, "a"}, {1, 2, 3, "b"}}}
+    s.accept(2, 2, []seqEntry{{2, 2, 1, "d"}})
+    if fmt.Sprint(s.entries) != fmt.Sprint([]seqEntry{{1, 0, 2, "a"}, {2, 2, 1, "d"}}) {
+        t.Errorf("accepted %v", s)
+    }
+    decoded, err := decodeSeqState(s.encode())
+    if err != nil || decoded.floor != s.floor || fmt.Sprint(decoded.entries) != fmt.Sprint(s.entries) {
+        t.Errorf("decoded %v, %v", decoded, err)
+    }
+
+    // the first entries learnt before the retention are forgotten, not those after a recent one
+    old := time.Now().Add(-2 * sequencerRetention)
+    s.entries = append(s.entries, seqEntry{2, 3, 1, "e"})
+    s.learnt = map[string]time.Time{"a": old, "d": time.Now(), "e": old}
+    s.prune()
+    if s.floor != 2 || fmt.Sprint(s.entries) != fmt.Sprint([]seqEntry{{2, 2, 1, "d"}, {2, 3, 1, "e"}}) {
+        t.Errorf("pruned %v", s)
+    }
+}
+
+func startSequencer(t *testing.T, port int, size int) ([]*SequencerReplica, []string) {
+    addresses := make([]string, size)
+    for i := range addresses {
+        addresses[i] = fmt.Sprintf("127.0.0.1:%d", port + i)
+    }
+    replicas := make([]*SequencerReplica, size)
+    for i := range replicas {
+        replicas[i] = NewSequencerReplica(i, addresses)
+        go replicas[i].WorkLoop()
+    }
+    return replicas, addresses
+}
+
+func waitLeader(t *testing.T, replicas []*SequencerReplica) int {
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+        for i, sr := range replicas {
+            if sr.IsLeader() {
+                return i
+            }
+        }
+    }
+    t.Fatal("no leader was elected")
+    return -1
+}
+
+// the mids handed out before and after the leader crashes are all different, with no gaps
+func TestSequencerFailover(t *testing.T) {
+    replicas, addresses := startSequencer(t, 18100, 3)
+    defer func() {
+        for _, sr := range replicas {
+            sr.Terminate()
+        }
+    }()
+    leader := waitLeader(t, replicas)
+    
+    type allocation struct{ first, n int }
+    var lock sync.Mutex
+    allocations := []allocation{}
+    var wg sync.WaitGroup
+    crash := make(chan struct{})
+    // the first two goroutines share a client, whose requests go on at once
+    shared := NewSequencerClient(addresses)
+    defer shared.Close()
+    for c := 0; c < 3; c++ {
+        wg.Add(1)
+        go func(c int) {
+            defer wg.Done()
+            sc := shared
+            if c == 2 {
+                sc = NewSequencerClient(addresses)
+                defer sc.Close()
+            }
+            for i := 0; i < 60; i++ {
+                if i == 20 && c == 0 {
+                    close(crash)
+                }
+                n := 1 + i % 3
+                first, err := sc.Next(n)
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                lock.Lock()
+                allocations = append(allocations, allocation{first, n})
+                lock.Unlock()
+            }
+        }(c)
+    }
+    <- crash
+    replicas[leader].Terminate()
+    wg.Wait()
+    if newLeader := waitLeader(t, replicas); newLeader == leader {
+        t.Errorf("the crashed replica is still the leader")
+    }
+    
+    sort.Slice(allocations, func(i, j int) bool {
+        return allocations[i].first < allocations[j].first
+    })
+    next := 0
+    for _, a := range allocations {
+        if a.first != next {
+            t.Fatalf("mid %d was handed out after %d", a.first, next)
+        }
+        next += a.n
+    }
+    sc := NewSequencerClient(addresses)
+    defer sc.Close()
+    if read, err := sc.Read(); err != nil || read != next {
+        t.Errorf("read %d after %d, %v", read, next, err)
+    }
+}
+
+// the replicas restarted from their state files do not hand out again the mids handed out before
+func TestSequencerStateFile(t *testing.T) {
+    dir := t.TempDir()
+    addresses := []string{"127.0.0.1:18110", "127.0.0.1:18111", "127.0.0.1:18112"}
+    start := func() []*SequencerReplica {
+        replicas := make([]*SequencerReplica, len(addresses))
+        for i := range replicas {
+            replicas[i] = NewSequencerReplica(i, addresses)
+            if err := replicas[i].UseStateFile(fmt.Sprintf("%s/replica%d", dir, i)); err != nil {
+                t.Fatal(err)
+            }
+            go replicas[i].WorkLoop()
+        }
+        return replicas
+    }
+    
+    replicas := start()
+    sc := NewSequencerClient(addresses)
+    next := 0
+    for i := 0; i < 10; i++ {
+        first, err := sc.Next(3)
+        if err != nil || first != next {
+            t.Fatalf("got mid %d after %d, %v", first, next, err)
+        }
+        next += 3
+    }
+    sc.Close()
+    for _, sr := range replicas {
+        sr.Terminate()
+    }
+    
+    replicas = start()
+    defer func() {
+        for _, sr := range replicas {
+            sr.Terminate()
+        }
+    }()
+    sc = NewSequencerClient(addresses)
+    defer sc.Close()
+    if first, err := sc.Next(1); err != nil || first != next {
+        t.Errorf("got mid %d after a restart, instead of %d, %v", first, next, err)
+    }
+}
+
+func TestClusterWithSequencer(t *testing.T) {
+    replicas, addresses := startSequencer(t, 18100, 3)
+    leader := waitLeader(t, replicas)
+    tst := testClusterInfrastructure{sequencerAddresses: addresses}
+    tst.initTest(2000, 2, 2) // the nodes must outlive the election of a new leader
+    comp1, comp2 := NewComponent(tst.agents[0], nil), NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    replicas[leader].Terminate()
+    sendAndReceive(t, comp2, comp1)
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+    for _, sr := range replicas {
+        sr.Terminate()
+    }
+}
+
+// a node that waits for the mids of an agent goes on delivering the messages of the others
+func TestClusterNodeWithoutQuorum(t *testing.T) {
+    replicas, addresses := startSequencer(t, 18100, 3)
+    waitLeader(t, replicas)
+    tst := testClusterInfrastructure{sequencerAddresses: addresses}
+    tst.initTest(2000, 1, 0)
+    listener, port := listenToRandomPort()
+    defer listener.Close()
+    registration, err := connect("127.0.0.1:17997", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    registration.Send("Register", itoa(port))
+    // the registration and the node dial the agent
+    conns := make(chan net.Conn, 2)
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            conns <- conn
+        }
+    }()
+    read := func(cmd string) []string {
+        var conn net.Conn
+        select {
+            case conn = <- conns:
+                defer conn.Close()
+            case <- time.After(2 * time.Second):
+                t.Fatalf("no connection for %s", cmd)
+        }
+        conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+        reader := bufio.NewReader(conn)
+        for {
+            tokens, _, err := readMessage(reader)
+            if err != nil {
+                t.Fatalf("no %s: %v", cmd, err)
+            } else if tokens[0] == cmd {
+                return tokens[1:]
+            }
+        }
+    }
+    cid := read("Registered")[0]
+
+    replicas[0].Terminate()
+    replicas[1].Terminate()
+    queue, err := connect("127.0.0.1:17999", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    queue.Send("add", "REQ", cid)
+    // the node took the request, that no leader answers
+    for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        tst.msgQ.lock.Lock()
+        waiting := len(tst.msgQ.messages)
+        tst.msgQ.lock.Unlock()
+        if waiting == 0 {
+            break
+        } else if time.Now().After(deadline) {
+            t.Fatal("the request was not taken")
+        }
+    }
+    tuple := NewTuple("Ciao")
+    queue.Send("add", "DATA", "999", itoa(atoi(cid) + 1), True().String(), tuple.encode())
+    if params := read("DATA"); params[0] != "999" {
+        t.Errorf("received %q", params)
+    }
+    registration.Send("Leave", cid)
+    queue.Close()
+    registration.Close()
+    tst.teardownTest()
+    replicas[2].Terminate()
+}
@@ -2,10 +2,13 @@ package goat
 
 import (
 	"bufio"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 type CentralServer struct {
@@ -17,22 +20,32 @@ type CentralServer struct {
 	lock *sync.Mutex
 	compConnOut map[int]net.Conn
 	compConnIn map[int]*bufio.Reader
+	compConnRaw map[int]net.Conn
+	compBinary map[int]bool
+	filter *predicateFilter
+	leases *midLeases
+	chnActivity chan struct{}
+	chnQuit chan struct{}
+	terminated bool
+	tlsConfig *tls.Config
 }
 
 func (srv *CentralServer) sendToComponent(cid int, tokens ...string) {
-	escTokens := make([]string, len(tokens))
-	for i, tok := range tokens {
-		escTokens[i] = escape(tok)
-	}
 	//dprintln("Dialing", cid)
 	for successComm := false; !successComm; {
-		conn := srv.compConnOut[cid]//, err := net.Dial("tcp", srv.compAddresses[cid])
+		conn, has := srv.compConnOut[cid]//, err := net.Dial("tcp", srv.compAddresses[cid])
+		if !has {
+		    return
+		}
 //		if err == nil {
 		    dprintln("Dialed", cid)
 	        dprintln("Writing", cid)
-			_, errf := fmt.Fprintf(conn, "%s\n", strings.Join(escTokens, " "))
+			errf := writeMessage(conn, srv.compBinary[cid], tokens)
 			if errf != nil {
-			    panic(errf)
+			    // the component is gone: forget it instead of stopping the server
+			    dprintln("Component", cid, "failed:", errf)
+			    srv.removeComponent(cid)
+			    return
 			}
 	        dprintln("Written", cid)
 			srv.messagesExchanged++
@@ -43,9 +56,87 @@ func (srv *CentralServer) sendToComponent(cid int, tokens ...string) {
 	}
 }
 
+/*
+SetPolicy makes the server check the rules of policy before delivering a message
+to the components (see Policy).
+*/
+func (srv *CentralServer) SetPolicy(policy *Policy) {
+	srv.lock.Lock()
+	srv.filter.setPolicy(policy)
+	srv.lock.Unlock()
+}
+
+/*
+SetMidLease sets how long the server waits for the message of a mid given to a
+component, once every previous mid is settled, before filling it with an empty
+message; a message that arrives later is dropped (see Component.OnExpired).
+With d <= 0, the default, the server waits forever, unless the component is gone.
+*/
+func (srv *CentralServer) SetMidLease(d time.Duration) {
+	srv.lock.Lock()
+	srv.leases.duration = d
+	srv.lock.Unlock()
+}
+
+// expireLeases fills the mids whose lease expired, until the server is terminated
+func (srv *CentralServer) expireLeases() {
+	ticker := time.NewTicker(leaseTick)
+	defer ticker.Stop()
+	for {
+		select {
+			case <- srv.chnQuit:
+				return
+			case now := <- ticker.C:
+				srv.lock.Lock()
+				for {
+					mid := srv.leases.lowest()
+					owner, expired := srv.leases.expire(mid, now)
+					if !expired {
+						break
+					}
+					dprintln("Filling mid", mid, "of component", owner)
+					srv.broadcast(emptyDataMessage(mid, owner)[1:])
+				}
+				srv.lock.Unlock()
+		}
+	}
+}
+
+// broadcast sends the DATA with params to every component but the sender; the caller must hold srv.lock
+func (srv *CentralServer) broadcast(params []string) {
+	senderid := atoi(params[1])
+	for cid := range srv.compConnOut {
+		if senderid != cid && srv.filter.excludesData(senderid, cid, params[2], params[3]) {
+		    dprintln("Filtering msg to",cid,params)
+			mid := atoi(params[0])
+			from := srv.filter.skip(cid, skippedMessage{mid: mid, sender: senderid, params: append([]string{"DATA"}, params...)})
+			srv.sendToComponent(cid, skipParams(mid, from)...)
+		} else if senderid != cid {
+		    dprintln("Sending msg to",cid,params)
+			srv.sendToComponent(cid, append([]string{"DATA"}, params...)...)
+			dprintln("Sent msg to",cid,params, srv.nextMsgId)
+		} else {
+		    dprintln("Skipping msg to",cid,params)
+		}
+	}
+}
+
+/*
+Terminate closes the listener and the connections to the components, and stops the
+goroutines of the server.
+*/
 func (srv *CentralServer) Terminate() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.terminated {
+		return
+	}
+	srv.terminated = true
+	close(srv.chnQuit)
 	srv.listener.Close()
-
+	for cid := range srv.compConnOut {
+		srv.removeComponent(cid)
+	}
 }
 /*
 func (srv *CentralServer) receive() (string, []string, string) {
@@ -80,19 +171,37 @@ func (srv *CentralServer) GetMessagesExchanged() int {
 
 func (srv *CentralServer) ListenReg() {
     for{
-        conn, _ := srv.listener.Accept()
+        conn, err := srv.listener.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            return
+        } else if err != nil {
+            continue
+        }
+        if err := handshake(conn); err != nil {
+            log.Printf("goat: server: rejected connection from %v: %v", conn.RemoteAddr(), err)
+            conn.Close()
+            continue
+        }
         bconn := bufio.NewReader(conn)
 	    myAddressPort := conn.RemoteAddr().String()
 	    portIndex := strings.LastIndex(myAddressPort, ":")
 	    address := myAddressPort[:portIndex]
         dprintln("!")
-	    serverMsg, err := bufio.NewReader(conn).ReadString('\n')
+	    tokens, _, err := readMessage(bconn)
+	    isBinary := false
+	    if err == nil && tokens[0] == "HELLO" {
+	        // the agent reads the answer on its connection, and the server answers with the same protocol
+	        if isBinary, err = answerHello(conn, tokens[1:]); err == nil {
+	            tokens, _, err = readMessage(bconn)
+	        }
+	    }
 	    if err == nil {
-	        dprintln("Accept:",serverMsg)
-		    escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-		    tokens := make([]string, len(escTokens))
-		    for i, escTok := range escTokens {
-			    tokens[i], _ = unescape(escTok, 0)
+	        signalActivity(srv.chnActivity)
+	        dprintln("Accept:",tokens)
+		    if len(tokens) < 2 || tokens[0] != "Register" {
+		        log.Printf("goat: server: invalid registration %q", tokens)
+		        conn.Close()
+		        continue
 		    }
 		    cPort := tokens[1]
 		    srv.lock.Lock()
@@ -100,7 +209,10 @@ func (srv *CentralServer) ListenReg() {
 			cid := srv.nextCompId
 			srv.nextCompId++
 			srv.compConnIn[cid] = bconn
-			connOut, err := net.Dial("tcp", address + ":" + cPort)
+			srv.compConnRaw[cid] = conn
+			// answer in the protocol agreed with the component
+			srv.compBinary[cid] = isBinary
+			connOut, err := dialTCP(net.JoinHostPort(address, cPort), srv.tlsConfig)
 			if err != nil {
 			    panic(err)
 			}
@@ -108,55 +220,107 @@ func (srv *CentralServer) ListenReg() {
 			srv.sendToComponent(cid, "Registered", itoa(cid), itoa(srv.nextMsgId))
 			go func(id int, bcon *bufio.Reader){srv.ListenConn(id, bcon)}(cid, bconn)
 		    srv.lock.Unlock()
-	    } 
+	    } else {
+	        conn.Close()
+	    }
     }
 }
 
 func (srv *CentralServer) ListenConn(cid int, bconn *bufio.Reader) {
     for{
-        serverMsg, _ := bconn.ReadString('\n')
-        if serverMsg == "" {
-            continue
+        tokens, _, err := readMessage(bconn)
+        if err != nil {
+            srv.lock.Lock()
+            srv.removeComponent(cid)
+            srv.lock.Unlock()
+            return
         }
-        dprintln("Accept:",serverMsg)
-	    escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-	    tokens := make([]string, len(escTokens))
-	    for i, escTok := range escTokens {
-		    tokens[i], _ = unescape(escTok, 0)
-	    }
+        signalActivity(srv.chnActivity)
+        dprintln("Accept:",tokens)
 	    params := tokens[1:]
 	    srv.lock.Lock()
 	    srv.messagesExchanged++
 	    switch(tokens[0]) {
 	        case "DATA":
-				senderid := atoi(params[1])
-				for cid := range srv.compConnOut {
-					if senderid != cid {
-					    dprintln("Sending msg to",cid,params)
-						srv.sendToComponent(cid, append([]string{"DATA"}, params...)...)
-						dprintln("Sent msg to",cid,params, srv.nextMsgId)
-					} else {
-					    dprintln("Skipping msg to",cid,params)
-					}
+				if err := checkDataParams(params); err != nil {
+					log.Printf("goat: server: invalid DATA from component %d: %v", cid, err)
+					break
 				}
+				if !srv.leases.settle(atoi(params[0])) {
+					log.Printf("goat: server: message %s of component %d arrived after its lease expired", params[0], cid)
+					srv.sendToComponent(cid, append([]string{"EXPIRED"}, params...)...)
+					break
+				}
+				srv.broadcast(params)
 			case "REQ":
-				cid := atoi(params[0])
+				// the reply goes to the component on this connection, whatever it claims to be
 				mid := srv.nextMsgId
 				srv.nextMsgId++
+				srv.leases.grant(cid, mid, 1)
 				dprintln("Sending RPLY to",cid)
 				srv.sendToComponent(cid, "RPLY", itoa(mid))
-			
+			case "REQN":
+				n, err := decodeMidCount(params)
+				if err != nil {
+					log.Printf("goat: server: invalid REQN from component %d: %v", cid, err)
+					break
+				}
+				first := srv.nextMsgId
+				srv.nextMsgId += n
+				srv.leases.grant(cid, first, n)
+				srv.sendToComponent(cid, "RPLYN", itoa(first), itoa(n))
+			case "ATTR":
+				if len(params) == 0 {
+					break
+				}
+				from, stale, err := srv.filter.publish(cid, params[1:])
+				if err != nil {
+					log.Printf("goat: server: invalid ATTR from component %d: %v", cid, err)
+					break
+				}
+				srv.filter.resend(cid, stale, func(msg []string) {
+					srv.sendToComponent(cid, msg...)
+				})
+				srv.sendToComponent(cid, "VIEW", itoa(from))
+			case "Leave":
+				srv.removeComponent(cid)
+				srv.lock.Unlock()
+				return
 		}
 		srv.lock.Unlock()
     }
 }
 
+// forgets the component cid and closes its connections; the caller must hold srv.lock
+func (srv *CentralServer) removeComponent(cid int) {
+	if conn, has := srv.compConnOut[cid]; has {
+		conn.Close()
+		srv.compConnRaw[cid].Close()
+		delete(srv.compConnOut, cid)
+		delete(srv.compConnIn, cid)
+		delete(srv.compConnRaw, cid)
+		delete(srv.compBinary, cid)
+		srv.filter.forget(cid)
+		srv.leases.revoke(cid)
+		dprintln("Component", cid, "left")
+	}
+}
+
 func RunCentralServerLoop(port int) *CentralServer {
     return RunCentralServer(port, make(chan struct{}), 0)
 }
 
 func RunCentralServer(port int, term chan struct{}, msec int64) *CentralServer {
+	return RunCentralServerTLS(nil, port, term, msec)
+}
+
+/*
+RunCentralServerTLS runs a server that accepts only TLS connections, and connects
+to the components with TLS, using tlsConfig (see MutualTLSConfig).
+*/
+func RunCentralServerTLS(tlsConfig *tls.Config, port int, term chan struct{}, msec int64) *CentralServer {
 	srv := CentralServer{
+		tlsConfig: tlsConfig,
 		nextCompId:           0,
 		nextMsgId:            0,
 		//compAddresses:        map[int]string{},
@@ -164,12 +328,20 @@ func RunCentralServer(port int, term chan struct{}, msec int64) *CentralServer {
 	    lock: &sync.Mutex{},
 	    compConnOut: map[int]net.Conn{},
 	    compConnIn: map[int]*bufio.Reader{},
+	    compConnRaw: map[int]net.Conn{},
+	    compBinary: map[int]bool{},
+	    filter: newPredicateFilter(),
+	    leases: newMidLeases(),
+	    chnActivity: make(chan struct{}, 1),
+	    chnQuit: make(chan struct{}),
 	}
 	var err error
-	srv.listener, err = net.Listen("tcp", ":"+itoa(port))
+	srv.listener, err = listenTCP(port, tlsConfig)
 	if err != nil{
 	    panic(err)
 	}
+	go waitIdle(srv.chnActivity, srv.chnQuit, msec, term)
+	go srv.expireLeases()
 	go func() {
 	    srv.ListenReg()
 		/*for {
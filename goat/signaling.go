@@ -5,6 +5,7 @@ type signaling struct {
     chnSignal chan struct{}
     chnSignaled chan struct{}
     chnGet chan chan struct{}
+    chnQuit chan struct{}
 }
 
 func (s *signaling) goroutine() {
@@ -15,21 +16,36 @@ func (s *signaling) goroutine() {
                 s.chnEvt = make(chan struct{})
                 s.chnSignaled <- struct{}{}
             case s.chnGet <- s.chnEvt:
+            case <-s.chnQuit:
+                return
         }
     }
 }
 
 func (s *signaling) Get() chan struct{} {
-    return <- s.chnGet
+    select {
+        case chnEvt := <- s.chnGet:
+            return chnEvt
+        case <- s.chnQuit:
+            return make(chan struct{})
+    }
 }
 
 func (s *signaling) Signal() {
-    s.chnSignal <- struct{}{}
-    <- s.chnSignaled
+    select {
+        case s.chnSignal <- struct{}{}:
+            <- s.chnSignaled
+        case <- s.chnQuit:
+    }
+}
+
+// Stop terminates the signaling; afterwards Signal does nothing and Get never fires.
+func (s *signaling) Stop() {
+    close(s.chnQuit)
 }
 
 func newSignaling() *signaling {
-    s := signaling{make(chan struct{}), make(chan struct{}), make(chan struct{}), make(chan chan struct{})}
+    s := signaling{make(chan struct{}), make(chan struct{}), make(chan struct{}), make(chan chan struct{}), make(chan struct{})}
     go func(){s.goroutine()}()
     return &s
 }
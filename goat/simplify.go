@@ -0,0 +1,209 @@
+package goat
+
+/*
+Simplify returns a predicate equivalent to p, possibly smaller: the comparisons
+between constants are computed, nested Ands and Ors are flattened, the true and
+false parts and the duplicates are removed, and the conjunctions that no
+component can satisfy (like receiver.a == 1 && receiver.a == 2, or p && !p)
+become False(). Simplify does not find every unsatisfiable predicate, but when it
+returns False() no component satisfies p.
+*/
+func Simplify(p ClosedPredicate) ClosedPredicate {
+    switch pp := p.(type) {
+        case ccomp:
+            if isConstantOperand(pp.Par1, pp.IsAttr1) && isConstantOperand(pp.Par2, pp.IsAttr2) {
+                return boolPredicate(pp.Satisfy(nil))
+            }
+        case cisin:
+            if isConstantOperand(pp.Par1, pp.IsAttr1) && isConstantOperand(pp.Par2, pp.IsAttr2) {
+                return boolPredicate(pp.Satisfy(nil))
+            }
+        case cnot:
+            switch inner := Simplify(pp.p).(type) {
+                case _true:
+                    return False()
+                case _false:
+                    return True()
+                case cnot:
+                    return inner.p
+                default:
+                    return cnot{inner}
+            }
+        case cand:
+            parts := []ClosedPredicate{}
+            for _, part := range flattenAnd(p, nil) {
+                switch sp := Simplify(part).(type) {
+                    case _true:
+                    case _false:
+                        return False()
+                    case cand:
+                        parts = flattenAnd(sp, parts)
+                    default:
+                        parts = append(parts, sp)
+                }
+            }
+            parts = removeDuplicates(parts)
+            if hasComplement(parts) || hasContradiction(parts) {
+                return False()
+            }
+            return joinPredicates(parts, True(), func(p1, p2 ClosedPredicate) ClosedPredicate { return cand{p1, p2} })
+        case cor:
+            parts := []ClosedPredicate{}
+            for _, part := range flattenOr(p, nil) {
+                switch sp := Simplify(part).(type) {
+                    case _false:
+                    case _true:
+                        return True()
+                    case cor:
+                        parts = flattenOr(sp, parts)
+                    default:
+                        parts = append(parts, sp)
+                }
+            }
+            parts = removeDuplicates(parts)
+            if hasComplement(parts) {
+                return True()
+            }
+            return joinPredicates(parts, False(), func(p1, p2 ClosedPredicate) ClosedPredicate { return cor{p1, p2} })
+    }
+    return p
+}
+
+func boolPredicate(b bool) ClosedPredicate {
+    if b {
+        return True()
+    }
+    return False()
+}
+
+// a constant operand does not depend on the attributes of the receiver
+func isConstantOperand(x interface{}, isAttr bool) bool {
+    if isAttr {
+        return false
+    }
+    _, isExpr := x.(cexpr)
+    return !isExpr
+}
+
+func flattenAnd(p ClosedPredicate, parts []ClosedPredicate) []ClosedPredicate {
+    if a, isAnd := p.(cand); isAnd {
+        return flattenAnd(a.p2, flattenAnd(a.p1, parts))
+    }
+    return append(parts, p)
+}
+
+func flattenOr(p ClosedPredicate, parts []ClosedPredicate) []ClosedPredicate {
+    if o, isOr := p.(cor); isOr {
+        return flattenOr(o.p2, flattenOr(o.p1, parts))
+    }
+    return append(parts, p)
+}
+
+// the parts are joined from the left, as And and Or do
+func joinPredicates(parts []ClosedPredicate, empty ClosedPredicate, join func(ClosedPredicate, ClosedPredicate) ClosedPredicate) ClosedPredicate {
+    if len(parts) == 0 {
+        return empty
+    }
+    res := parts[0]
+    for _, part := range parts[1:] {
+        res = join(res, part)
+    }
+    return res
+}
+
+// predicates with the same encoding are the same predicate
+func removeDuplicates(parts []ClosedPredicate) []ClosedPredicate {
+    seen := map[string]struct{}{}
+    res := []ClosedPredicate{}
+    for _, part := range parts {
+        if _, has := seen[part.String()]; !has {
+            seen[part.String()] = struct{}{}
+            res = append(res, part)
+        }
+    }
+    return res
+}
+
+// true if both p and !p are in parts
+func hasComplement(parts []ClosedPredicate) bool {
+    encoded := map[string]struct{}{}
+    for _, part := range parts {
+        encoded[part.String()] = struct{}{}
+    }
+    for _, part := range parts {
+        if n, isNot := part.(cnot); isNot {
+            if _, has := encoded[n.p.String()]; has {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// mirrored[op] is the operator that gives the same comparison with the operands swapped
+var mirrored = map[string]string{"==": "==", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+/*
+hasContradiction looks for comparisons between an attribute of the receiver and a
+constant that can not hold together: two different values for ==, a value both
+== and !=, a value for == out of a bound, or a lower bound that is not less than
+an upper bound. Since the values that can be compared with each other are of the
+same kind (numbers, strings, times or durations), two bounds that can not be
+compared can not hold together either.
+*/
+func hasContradiction(parts []ClosedPredicate) bool {
+    type bound struct {
+        op string
+        val interface{}
+    }
+    bounds := map[string][]bound{}
+    for _, part := range parts {
+        cmp, isComp := part.(ccomp)
+        if !isComp {
+            continue
+        }
+        if cmp.IsAttr1 && isConstantOperand(cmp.Par2, cmp.IsAttr2) {
+            name := cmp.Par1.(string)
+            bounds[name] = append(bounds[name], bound{cmp.Op, cmp.Par2})
+        } else if cmp.IsAttr2 && isConstantOperand(cmp.Par1, cmp.IsAttr1) {
+            name := cmp.Par2.(string)
+            bounds[name] = append(bounds[name], bound{mirrored[cmp.Op], cmp.Par1})
+        }
+    }
+    for _, bs := range bounds {
+        for i, b1 := range bs {
+            for _, b2 := range bs[i+1:] {
+                if b2.op == "==" {
+                    b1, b2 = b2, b1
+                }
+                switch {
+                    case b1.op == "==" && b2.op == "!=":
+                        if eq, _ := compareValues(b1.val, "==", b2.val); eq {
+                            return true
+                        }
+                    case b1.op == "==":
+                        // the value of the attribute must satisfy the other comparison
+                        if holds, _ := compareValues(b1.val, b2.op, b2.val); !holds {
+                            return true
+                        }
+                    case b1.op == "!=" || b2.op == "!=":
+                    case b1.op[0] == b2.op[0]:
+                        // two lower bounds or two upper bounds
+                    default:
+                        lower, upper := b1, b2
+                        if lower.op[0] == '<' {
+                            lower, upper = b2, b1
+                        }
+                        if less, _ := compareValues(lower.val, "<", upper.val); less {
+                            continue
+                        }
+                        if eq, _ := compareValues(lower.val, "==", upper.val); eq && lower.op == ">=" && upper.op == "<=" {
+                            continue
+                        }
+                        return true
+                }
+            }
+        }
+    }
+    return false
+}
@@ -0,0 +1,63 @@
+package goat
+
+import (
+    "testing"
+)
+
+func TestSimplify(t *testing.T) {
+    InitSend()
+    cases := []struct{
+        pred Predicate
+        want string
+    }{
+        {Equals(1, 1), "TT"},
+        {LessThan("b", "a"), "FF"},
+        {Belong(2, NewTuple(1, 2)), "TT"},
+        {Not(Not(Equals(Receiver("a"), 1))), "=(A|a,I|1)"},
+        {And(True(), Equals(Receiver("a"), 1), Not(False())), "=(A|a,I|1)"},
+        {Or(False(), Equals(Receiver("a"), 1), Equals(2, 3)), "=(A|a,I|1)"},
+        {And(Equals(Receiver("a"), 1), And(Equals(Receiver("b"), 2), Equals(Receiver("a"), 1))), "&(=(A|a,I|1),=(A|b,I|2))"},
+        {Or(Equals(Receiver("a"), 1), Or(Equals(Receiver("b"), 2), Equals(Receiver("c"), 3))), "|(|(=(A|a,I|1),=(A|b,I|2)),=(A|c,I|3))"},
+        {Or(Equals(Receiver("a"), 1), Not(Equals(Receiver("a"), 1))), "TT"},
+        {And(Equals(Receiver("a"), 1), Not(Equals(Receiver("a"), 1))), "FF"},
+        {And(Equals(Receiver("a"), 1), Equals(Receiver("a"), 2)), "FF"},
+        {And(Equals(Receiver("a"), 1), Equals(1.0, Receiver("a"))), "&(=(A|a,I|1),=(F|1,A|a))"},
+        {And(Equals(Receiver("a"), 1), NotEquals(Receiver("a"), 1)), "FF"},
+        {And(Equals(Receiver("a"), 1), NotEquals(Receiver("a"), 2)), "&(=(A|a,I|1),N(A|a,I|2))"},
+        {And(Equals(Receiver("a"), 5), LessThan(Receiver("a"), 3)), "FF"},
+        {And(GreaterThan(Receiver("a"), 5), LessThan(3, Receiver("a"))), "&(>(A|a,I|5),<(I|3,A|a))"},
+        {And(GreaterThan(Receiver("a"), 5), GreaterThan(3, Receiver("a"))), "FF"},
+        {And(GreaterThanOrEqual(Receiver("a"), 5), LessThanOrEqual(Receiver("a"), 5.0)), "&(g(A|a,I|5),l(A|a,F|5))"},
+        {And(GreaterThanOrEqual(Receiver("a"), 5), LessThan(Receiver("a"), 5)), "FF"},
+        {And(GreaterThan(Receiver("a"), 5), LessThan(Receiver("a"), "z")), "FF"},
+        {And(Equals(Receiver("a"), 1), Equals(Receiver("b"), 2), Or(Equals(Receiver("c"), 1), And(Equals(Receiver("c"), 1), Equals(Receiver("c"), 2)))), "&(&(=(A|a,I|1),=(A|b,I|2)),=(A|c,I|1))"},
+        {And(Equals(Receiver("a"), Receiver("b")), Equals(Receiver("a"), Plus(Receiver("b"), 1))), "&(=(A|a,A|b),=(A|a,E|add(A|b,I|1)))"},
+    }
+    for _, c := range cases {
+        closed := c.pred.CloseUnder(nil)
+        simple := Simplify(closed)
+        if simple.String() != c.want {
+            t.Errorf("%s simplified to %s, want %s", closed, simple, c.want)
+        }
+        for _, x := range []interface{}{0, 1, 2, 3, 5, 7, 1.5, "a"} {
+            attr := Attributes{}
+            attr.init(map[string]interface{}{"a": x, "b": 2, "c": 1})
+            if closed.Satisfy(&attr) != simple.Satisfy(&attr) {
+                t.Errorf("%s and %s differ when a = %v", closed, simple, x)
+            }
+        }
+    }
+}
+
+func TestUnsatisfiableMessageIsEmpty(t *testing.T) {
+    InitSend()
+    tpl := NewTuple("secret")
+    msg := makeMessage(messagePredicate{tpl.encode(), And(Equals(Receiver("a"), 1), Equals(Receiver("a"), 2)).CloseUnder(nil), false}, 4)
+    if msg.Id != 4 || !msg.Message.IsLong(0) || msg.Pred.String() != "FF" {
+        t.Errorf("unexpected message %v", msg)
+    }
+    msg = makeMessage(messagePredicate{tpl.encode(), And(True(), Equals(Receiver("a"), 1)).CloseUnder(nil), false}, 5)
+    if msg.Id != 5 || msg.Message.Get(0) != "secret" || msg.Pred.String() != "=(A|a,I|1)" {
+        t.Errorf("unexpected message %v", msg)
+    }
+}
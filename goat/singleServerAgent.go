@@ -1,8 +1,9 @@
 package goat
 
 import(
+    "crypto/tls"
+    "log"
     "net"
-    "fmt"
     "strings"
     "bufio"
 )
@@ -17,16 +18,35 @@ type SingleServerAgent struct{
     chnMessagesIn *unboundChanMessage
     chnMessagesOut chan Message
     chnGetMid *unboundChanUnit
+    chnGetMids *unboundChanInt
+    chnPublish chan []string
+    view *publishedView
+    expired *expiredMessages
     inStrings *unboundChanString
     
-    serverOutConn net.Conn
+    serverOutConn *duplexConn
     serverInConn *bufio.Reader
+    serverInRaw net.Conn
+    chnQuit chan struct{}
+    chnStopped chan struct{}
+    chnInStopped chan struct{}
+    tlsConfig *tls.Config
 }
 
 
 func NewSingleServerAgent(serverAddress string) *SingleServerAgent{
+    return NewSingleServerAgentTLS(nil, serverAddress)
+}
+
+/*
+NewSingleServerAgentTLS returns an agent that connects to the server, and accepts
+its connection, with TLS using tlsConfig (see MutualTLSConfig).
+*/
+func NewSingleServerAgentTLS(tlsConfig *tls.Config, serverAddress string) *SingleServerAgent{
     ssa := SingleServerAgent{
+        tlsConfig: tlsConfig,
         chnGetMid: newUnboundChanUnit(),
+        chnGetMids: newUnboundChanInt(),
         chnMids: newUnboundChanInt(),
         //chnOutbox: make(chan Message, 5),
         //chnInbox: make(chan Message, 5),
@@ -35,14 +55,20 @@ func NewSingleServerAgent(serverAddress string) *SingleServerAgent{
         //inStrings: newUnboundChanString(),
         chnMessagesIn: newUnboundChanMessage(),
         chnMessagesOut: make(chan Message),
+        chnPublish: make(chan []string),
+        view: newPublishedView(),
+        expired: newExpiredMessages(),
         inStrings: newUnboundChanString(),
+        chnQuit: make(chan struct{}),
+        chnStopped: make(chan struct{}),
+        chnInStopped: make(chan struct{}),
     }
     
     return &ssa
 }
 
-func (ssa *SingleServerAgent) Start(){
-    ssa.listener, _ = net.Listen("tcp", ":0")
+func (ssa *SingleServerAgent) Start() error {
+    ssa.listener, _ = listenTCP(0, ssa.tlsConfig)
     myAddressPort := ssa.listener.Addr().String()
     portIndex := strings.LastIndex(myAddressPort, ":")
     ssa.listeningPort = atoi(myAddressPort[portIndex+1:])
@@ -52,6 +78,7 @@ func (ssa *SingleServerAgent) Start(){
     go func(){ssa.doIncomingProcess(chnRegistered)}()
     go func(){ssa.doOutcomingProcess()}()
     <- chnRegistered
+    return nil
 }
 
 func (ssa *SingleServerAgent) GetComponentId() int{
@@ -92,34 +119,71 @@ func (ssa *SingleServerAgent) doIncomingProcess(chnRegistered chan<- bool) {
         }
     }()*/
     conn, _ := ssa.listener.Accept()
+    ssa.serverInRaw = conn
     ssa.serverInConn = bufio.NewReader(conn)
     for {
         dprintln(ssa.componentId,"IP+")
-        cmd, params := ssa.receiveFromServer()
+        cmd, params, err := ssa.receiveFromServer()
+        if err != nil {
+            dprintln(ssa.componentId, "disconnected:", err)
+            ssa.view.close()
+            close(ssa.chnInStopped)
+            return
+        }
         dprintln(ssa.componentId,"IP-")
         switch cmd {
             case "Registered":
-                ssa.componentId = atoi(params[0])
-                ssa.firstMessageId = atoi(params[1])
+                compId, err1 := paramInt(params, 0)
+                firstMid, err2 := paramInt(params, 1)
+                if chnRegistered == nil || err1 != nil || err2 != nil {
+                    log.Printf("goat: agent %d: unexpected Registered %v", ssa.componentId, params)
+                    break
+                }
+                ssa.componentId = compId
+                ssa.firstMessageId = firstMid
                 close(chnRegistered)
+                chnRegistered = nil
             case "RPLY":
-                mid := atoi(params[0])
+                mid, err := paramInt(params, 0)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLY: %v", ssa.componentId, err)
+                    break
+                }
                 dprintln(itoa(ssa.componentId), "got MID",mid)
                 dprintln(ssa.componentId,"M+")
                 ssa.chnMids.In <- mid
                 dprintln(ssa.componentId,"M-")
                 
-            case "DATA":
-                pred, _ := ToPredicate(params[2])
-                mid := atoi(params[0])
-                //cid := atoi(params[1])
-                inMsg := Message {
-                    Id: mid,
-                    //componentId: cid,
-                    Pred: pred,
-                    Message: decodeTuple(params[3]),
+            case "RPLYN":
+                first, n, err := decodeMidRange(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid RPLYN: %v", ssa.componentId, err)
+                    break
+                }
+                for mid := first; mid < first + n; mid++ {
+                    ssa.chnMids.In <- mid
+                }
+                
+            case "EXPIRED":
+                msg, err := decodeDataMessage(params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid EXPIRED: %v", ssa.componentId, err)
+                    break
                 }
-                dprintln("<-", mid)
+                ssa.expired.drop(ssa.componentId, msg)
+                
+            case "VIEW": // the server has the view from the mid in params
+                ssa.view.known(params)
+                
+            case "DATA", "SKIP":
+                inMsg, err := decodeIncomingMessage(cmd, params)
+                if err != nil {
+                    log.Printf("goat: agent %d: invalid %s: %v", ssa.componentId, cmd, err)
+                    if inMsg.Id < 0 {
+                        break
+                    }
+                }
+                dprintln("<-", inMsg.Id)
                 dprintln(ssa.componentId,"D+")
                 ssa.chnMessagesIn.In <- inMsg
                 dprintln(ssa.componentId,"D-")
@@ -129,8 +193,9 @@ func (ssa *SingleServerAgent) doIncomingProcess(chnRegistered chan<- bool) {
 
 func (ssa *SingleServerAgent) doOutcomingProcess() {
     //dprintln("Try dialing:", escTokens)
-    conn, _ := net.Dial("tcp", ssa.server)
-    ssa.serverOutConn = conn
+    conn, _ := dialTCP(ssa.server, ssa.tlsConfig)
+    // the server answers the hello on conn, and sends with the same protocol
+    ssa.serverOutConn, _ = dialedConn(conn)
     //Register
     ssa.sendToServer("Register", itoa(ssa.listeningPort))
 
@@ -141,14 +206,40 @@ func (ssa *SingleServerAgent) doOutcomingProcess() {
         	// TODO: send only when nid >= msg.id
             case msgToSend := <- ssa.chnMessagesOut:
                 dprintln("OutMsg",msgToSend)
-                ssa.sendToServer("DATA", itoa(msgToSend.Id), itoa(ssa.componentId), msgToSend.Pred.String(), msgToSend.Message.encode() )
+                ssa.sendToServer("DATA", itoa(msgToSend.Id), itoa(ssa.componentId), msgToSend.Pred.String(), msgToSend.Message.encodeFor(ssa.serverOutConn.usesBinary()) )
             case <- ssa.chnGetMid.Out:
                 dprintln(itoa(ssa.componentId), "asking for MID")
                 ssa.sendToServer("REQ", itoa(ssa.componentId))
+            case n := <- ssa.chnGetMids.Out:
+                ssa.sendToServer("REQN", itoa(ssa.componentId), itoa(n))
+            case view := <- ssa.chnPublish:
+                ssa.sendToServer(append([]string{"ATTR", itoa(ssa.componentId)}, view...)...)
+            case <- ssa.chnQuit:
+                close(ssa.chnStopped)
+                return
         }
     }
 }
 
+/*
+Close tells the server that the agent is leaving, then closes the connections of
+the agent and stops its goroutines.
+*/
+func (ssa *SingleServerAgent) Close() {
+    close(ssa.chnQuit)
+    <- ssa.chnStopped
+    ssa.sendToServer("Leave", itoa(ssa.componentId))
+    ssa.serverOutConn.Close()
+    <- ssa.chnInStopped
+    ssa.serverInRaw.Close()
+    ssa.listener.Close()
+    ssa.chnGetMid.Close()
+    ssa.chnGetMids.Close()
+    ssa.chnMids.Close()
+    ssa.chnMessagesIn.Close()
+    ssa.inStrings.Close()
+}
+
 func (ssa *SingleServerAgent) GetMessageId() int{
     ssa.chnGetMid.In <- struct{}{}
     //return <- ssa.chnMids.Out
@@ -156,17 +247,11 @@ func (ssa *SingleServerAgent) GetMessageId() int{
 }
 
 func (ssa *SingleServerAgent) sendToServer(tokens... string) {
-    escTokens := make([]string, len(tokens))
-    for i, tok:= range tokens {
-        escTokens[i] = escape(tok)
-    }
     /*dprintln("Try dialing:", escTokens)
     conn, err := net.Dial("tcp", ssa.server)*/
-    dprintln("Try:", escTokens)
-    if n, err := fmt.Fprintf(ssa.serverOutConn, "%s\n", strings.Join(escTokens," ")); err != nil{
+    dprintln("Try:", tokens)
+    if err := ssa.serverOutConn.Send(tokens...); err != nil{
         panic(err)
-    } else {
-        dprintln("Conn:",n)
     }
 }   
 
@@ -174,10 +259,31 @@ func (ssa *SingleServerAgent) SendMessage(msg Message) {
     ssa.chnMessagesOut <- msg
 }
 
+/*
+PublishAttributes sends the view to the server, that will not send the messages
+the component surely does not accept.
+*/
+func (ssa *SingleServerAgent) PublishAttributes(from int, view map[string]interface{}) <-chan struct{} {
+    tokens, chnKnown := ssa.view.publish(from, view)
+    select {
+        case ssa.chnPublish <- tokens:
+        case <- ssa.chnQuit:
+    }
+    return chnKnown
+}
+
 func (ssa *SingleServerAgent) AskMid(){
     ssa.chnGetMid.In <- struct{}{}
 }
 
+func (ssa *SingleServerAgent) AskMids(n int){
+    ssa.chnGetMids.In <- n
+}
+
+func (ssa *SingleServerAgent) OnExpired(handler func(Message)) {
+    ssa.expired.setHandler(handler)
+}
+
 func (ssa *SingleServerAgent) GetRplyChan() *unboundChanInt{
     return ssa.chnMids
     
@@ -186,7 +292,7 @@ func (ssa *SingleServerAgent) GetDataChan() *unboundChanMessage {
     return ssa.chnMessagesIn
 }
 
-func (ssa *SingleServerAgent) receiveFromServer() (string, []string) {
+func (ssa *SingleServerAgent) receiveFromServer() (string, []string, error) {
     /*conn, err := ssa.listener.Accept()
     _ = err
     if err != nil {
@@ -206,22 +312,13 @@ func (ssa *SingleServerAgent) receiveFromServer() (string, []string) {
     }*/
   
     //serverMsg := <- ssa.inStrings.Out
-    serverMsg := ""
-    for serverMsg == ""{
-        dprintln("?")
-        var err error
-        serverMsg, err = ssa.serverInConn.ReadString('\n')
-        if err != nil {
-            panic(err)
-        }
-    }
-    dprintln(serverMsg)
-    escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-    tokens := make([]string, len(escTokens))
-    for i, escTok := range escTokens {
-        tokens[i], _ = unescape(escTok, 0)
+    dprintln("?")
+    tokens, _, err := readMessage(ssa.serverInConn)
+    if err != nil {
+        return "", nil, err
     }
-    return tokens[0], tokens[1:]
+    dprintln(tokens)
+    return tokens[0], tokens[1:], nil
 }
 
 func (ca *SingleServerAgent) GetReceiveTime() map[int]int64{
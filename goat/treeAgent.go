@@ -1,7 +1,13 @@
 package goat
 
+import "crypto/tls"
+
 type TreeAgent = RingAgent
 
 func NewTreeAgent(registrationAddress string) *TreeAgent{
     return NewRingAgent(registrationAddress)
 }
+
+func NewTreeAgentTLS(tlsConfig *tls.Config, registrationAddress string) *TreeAgent{
+    return NewRingAgentTLS(tlsConfig, registrationAddress)
+}
@@ -1,8 +1,11 @@
 package goat
 
 import (
+    "crypto/tls"
+    "log"
     "sync"
     "sync/atomic"
+    "time"
 )
 
 // Contains the set of registered agents, and assigns them to the nodes
@@ -10,22 +13,45 @@ type TreeAgentRegistration = RingAgentRegistration
 func NewTreeAgentRegistration(port int, nodesAddresses []string) *TreeAgentRegistration{
     return NewRingAgentRegistration(port, nodesAddresses)
 }
+func NewTreeAgentRegistrationTLS(tlsConfig *tls.Config, port int, nodesAddresses []string) *TreeAgentRegistration{
+    return NewRingAgentRegistrationTLS(tlsConfig, port, nodesAddresses)
+}
 func NewTreeAgentRegistrationPolicy(port int, nodesAddresses []string, policy func(*RingAgentRegistration, []CandidateNode)int) *TreeAgentRegistration{
     return NewRingAgentRegistrationPolicyPerf(false, port, nodesAddresses, policy)
 }
+func NewTreeAgentRegistrationPolicyTLS(tlsConfig *tls.Config, port int, nodesAddresses []string, policy func(*RingAgentRegistration, []CandidateNode)int) *TreeAgentRegistration{
+    return NewRingAgentRegistrationPolicyTLS(tlsConfig, port, nodesAddresses, policy)
+}
 
 type TreeNode struct{
     counter int //only for the root
+    sequencer *SequencerClient // replaces counter, if set
+    leases *midLeases //only for the root
+    answers map[string]int // the first mid given to each request of an agent, by its key, only for the root
     agents map[int]*duplexConn
     port int
     messages map[int]tnMessageToForward
     nid int
     parentAddress string //except the root, which has ""
+    currentParent string // parentAddress, or the node that replaced the parent
     childNodesAddresses []string
     parentConn *duplexConn //except the root, which has nil
-    childNodesConn []*duplexConn
+    childNodesConn map[int]*duplexConn // the children attached after a repair have negative indexes
+    id int // given by the registration
+    parentId int
+    childIds map[int]int
+    adopted int
+    history map[int][]string
+    requests []treeRequest // forwarded to the parent, without reply
     lock *sync.Mutex
     registrationAddress string
+    regConn *duplexConn
+    filter *predicateFilter
+    listenerConns *unboundChanConn
+    chnActivity chan struct{}
+    chnQuit chan struct{}
+    terminated bool
+    tlsConfig *tls.Config
     
     infrMessagesFromAgents uint64
     infrMessagesSent uint64
@@ -44,16 +70,42 @@ func NewTreeNode(port int, parentAddress string, registrationAddress string, chi
 }
 
 func NewTreeNodePerf(perfTest bool, port int, parentAddress string, registrationAddress string, childNodesAddresses []string) *TreeNode {
+    return newTreeNode(perfTest, nil, port, parentAddress, registrationAddress, childNodesAddresses)
+}
+
+/*
+NewTreeNodeTLS returns a node that uses TLS with tlsConfig for every connection:
+to the agents, to the parent and the children and to the registration.
+*/
+func NewTreeNodeTLS(tlsConfig *tls.Config, port int, parentAddress string, registrationAddress string, childNodesAddresses []string) *TreeNode {
+    return newTreeNode(false, tlsConfig, port, parentAddress, registrationAddress, childNodesAddresses)
+}
+
+func newTreeNode(perfTest bool, tlsConfig *tls.Config, port int, parentAddress string, registrationAddress string, childNodesAddresses []string) *TreeNode {
+    listenerConns, chnReady := listenerTLS(port, tlsConfig)
+    <-chnReady
     return &TreeNode{
         counter: 0,
+        leases: newMidLeases(),
+        answers: map[string]int{},
         agents: map[int]*duplexConn{},
         port: port,
         messages: map[int]tnMessageToForward{},
         nid: 0,
         parentAddress: parentAddress,
+        currentParent: parentAddress,
         childNodesAddresses: childNodesAddresses,
+        childNodesConn: map[int]*duplexConn{},
+        parentId: -1,
+        childIds: map[int]int{},
+        history: map[int][]string{},
         lock: &sync.Mutex{},
         registrationAddress: registrationAddress,
+        tlsConfig: tlsConfig,
+        filter: newPredicateFilter(),
+        listenerConns: listenerConns,
+        chnActivity: make(chan struct{}, 1),
+        chnQuit: make(chan struct{}),
         perfTest: perfTest,
         infrMessagesFromAgents: 0,
         infrMessagesSent: 0,
@@ -147,27 +199,85 @@ func (tn *TreeNode) resolveLastAddress(seq []string) (*duplexConn, []string){
         child "  : RPLY mid compId port0 addr0 port1 addr1
         child "  : RPLY mid compId port0 addr0
         child "  : RPLY mid compId 
-        compId   : RPLY mid
+        compId   : RPLY mid key (the leaf puts the key of the request before compId)
     */
+    // the connection is nil if the child is gone: its request is sent again after the repair
     if atoi(seq[len(seq)-1]) >= len(tn.childNodesAddresses){ // is a component id
-        return tn.agents[atoi(seq[len(seq)-1])-len(tn.childNodesAddresses)], []string{}
+        return tn.agents[atoi(seq[len(seq)-1])-len(tn.childNodesAddresses)], seq[:len(seq)-1] // the key of the request
     } else {
         return tn.childNodesConn[atoi(seq[len(seq)-1])], seq[:len(seq)-1]
     }
 }
 
-func (tn *TreeNode) serveParent() {
-    for{
-        cmd, params := tn.parentConn.Receive()
+func (tn *TreeNode) serveParent(conn *duplexConn) {
+    for live := false; ; live = true {
+        if live { // the parent writes at least every ringHeartbeat once it is up
+            conn.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+        }
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil {
+            tn.lock.Lock()
+            current := conn == tn.parentConn
+            parentId := tn.parentId
+            tn.lock.Unlock()
+            conn.Close()
+            if current {
+                tn.linkDown(parentId)
+            }
+            return
+        }
+        if cmd == "HB" {
+            continue
+        }
+        signalActivity(tn.chnActivity)
         switch(cmd) {
+        case "parent": // parent id nid
+                tn.lock.Lock()
+                tn.attached(conn, params)
+                tn.lock.Unlock()
         case "RPLY": 
+                if len(params) < 2 {
+                    continue
+                }
                 assMid := params[0]
                 path := params[1:]
+                tn.lock.Lock()
+                tn.answered(0, path)
                 childConn, remainder := tn.resolveLastAddress(path)
+                tn.lock.Unlock()
+                if childConn == nil {
+                    dprintln("Tree node", tn.port, "dropped the reply", assMid)
+                    continue
+                }
                 //fmt.Println(tn.childNodesConn)
                 childConn.Send(append([]string{"RPLY", assMid}, remainder...)...)
                 tn.onInfrMsgSent()
                 dprintln("sent rply", append([]string{"RPLY", assMid}, remainder...))
+        case "RPLYN": // RPLYN first n path
+                if len(params) < 3 {
+                    continue
+                }
+                tn.lock.Lock()
+                tn.answered(atoi(params[1]), params[2:])
+                childConn, remainder := tn.resolveLastAddress(params[2:])
+                tn.lock.Unlock()
+                if childConn == nil {
+                    dprintln("Tree node", tn.port, "dropped the reply", params[0])
+                    continue
+                }
+                childConn.Send(append([]string{"RPLYN", params[0], params[1]}, remainder...)...)
+                tn.onInfrMsgSent()
+        case "EXPIRED": // EXPIRED mid src pred msg, for the agent that sent the message
+                tn.lock.Lock()
+                for _, agentConn := range tn.agents {
+                    agentConn.Send(append([]string{"EXPIRED"}, params...)...)
+                    tn.onInfrMsgSent()
+                }
+                for _, nodeConn := range tn.childNodesConn {
+                    nodeConn.Send(append([]string{"EXPIRED"}, params...)...)
+                    tn.onInfrMsgSent()
+                }
+                tn.lock.Unlock()
         case "DATA": // DATA mid src pred msg
                 msg := tnMessageToForward{
                     message: append([]string{"DATA"}, params...),
@@ -177,8 +287,11 @@ func (tn *TreeNode) serveParent() {
                 }
                 msgId := atoi(params[0])
                 tn.lock.Lock()
-                if _, has := tn.messages[msgId]; has {
-                    panic("Got msg "+itoa(msgId)+" twice!")
+                if _, has := tn.messages[msgId]; has || msgId < tn.nid {
+                    // an agent below sent the message of a mid the root filled meanwhile, or a repair sent it again
+                    tn.lock.Unlock()
+                    dprintln("Tree node", tn.port, "got message", msgId, "twice")
+                    continue
                 }
                 tn.messages[msgId] = msg
                 tn.dispatch()
@@ -188,23 +301,50 @@ func (tn *TreeNode) serveParent() {
 }
 
 func (tn *TreeNode) serveChild(childConn *duplexConn, idx int) {
-    amANode := idx < len(tn.childNodesConn)
+    amANode := idx < len(tn.childNodesAddresses)
     if !amANode {
-        dprintln(idx - len(tn.childNodesConn), "with", tn.port)
+        dprintln(idx - len(tn.childNodesAddresses), "with", tn.port)
     }
-    for{
+    for live := false; ; live = true {
+        if live && amANode { // the child node writes at least every ringHeartbeat once it is up
+            childConn.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+        }
         cmd, params,err := childConn.ReceiveErr()
         if err != nil {
-            if amANode {
-                panic(err) 
-            } else {
+            tn.lock.Lock()
+            if !amANode {
+                tn.leases.revoke(idx - len(tn.childNodesAddresses))
+                tn.lock.Unlock()
                 return
             }
+            childId, known := tn.childIds[idx]
+            if tn.childNodesConn[idx] == childConn {
+                delete(tn.childNodesConn, idx)
+                delete(tn.childIds, idx)
+            }
+            tn.lock.Unlock()
+            childConn.Close()
+            if known {
+                tn.linkDown(childId)
+            }
+            return
         }
+        if cmd == "HB" && amANode {
+            continue
+        }
+        signalActivity(tn.chnActivity)
         if !amANode {
             tn.onInfrMsgAgent()
         }
         switch(cmd) {
+        case "child": // child id nid, from a child node that attaches
+                if childId, err := paramInt(params, 0); amANode && err == nil {
+                    tn.lock.Lock()
+                    tn.childIds[idx] = childId
+                    childConn.Send("parent", itoa(tn.id), itoa(tn.nid))
+                    tn.onInfrMsgSent()
+                    tn.lock.Unlock()
+                }
         case "REQ": 
                 //fmt.Println("got req")
                 var corrPath []string
@@ -212,13 +352,15 @@ func (tn *TreeNode) serveChild(childConn *duplexConn, idx int) {
                     path := params
                     corrPath = append(path, itoa(idx))
                 } else {
-                    corrPath = []string{itoa(idx)}
+                    corrPath = []string{requestKey(tn.agentOf(idx), params, 1), itoa(idx)}
                 }
                     
                 if tn.amRoot(){
+                    assMid, ok := tn.nextMids(tn.agentOf(idx), 1, corrPath[0])
+                    if !ok {
+                        continue
+                    }
                     tn.lock.Lock()
-                    assMid := itoa(tn.counter)
-                    tn.counter++
                     //fmt.Println("fwding",corrPath)
                     childC, remainder := tn.resolveLastAddress(corrPath)
                     if childC != childConn {
@@ -229,11 +371,64 @@ func (tn *TreeNode) serveChild(childConn *duplexConn, idx int) {
                     tn.onInfrMsgSent()
                     dprintln("sent rply",append([]string{"RPLY", assMid}, remainder...))
                 } else {
-                    tn.parentConn.Send(append([]string{"REQ"}, corrPath...)...)
-                    tn.onInfrMsgSent()
+                    tn.lock.Lock()
+                    tn.request(treeRequest{0, corrPath})
+                    tn.lock.Unlock()
                     //fmt.Println("sent req",append([]string{"REQ"}, corrPath...))
                 }
+        case "REQN":
+                // from an agent: REQN compId n id, from a node: REQN n path
+                var n string
+                var corrPath []string
+                if amANode {
+                    if len(params) == 0 || checkMidCount(atoi(params[0])) != nil {
+                        log.Printf("goat: tree node %d: invalid REQN from child %d: %v", tn.port, idx, params)
+                        continue
+                    }
+                    n = params[0]
+                    corrPath = append(params[1:], itoa(idx))
+                } else {
+                    count, err := decodeMidCount(params)
+                    if err != nil {
+                        log.Printf("goat: tree node %d: invalid REQN from child %d: %v", tn.port, idx, err)
+                        continue
+                    }
+                    n = itoa(count)
+                    corrPath = []string{requestKey(tn.agentOf(idx), params, 2), itoa(idx)}
+                }
+                if tn.amRoot(){
+                    first, ok := tn.nextMids(tn.agentOf(idx), atoi(n), corrPath[0])
+                    if !ok {
+                        continue
+                    }
+                    tn.lock.Lock()
+                    childC, remainder := tn.resolveLastAddress(corrPath)
+                    tn.lock.Unlock()
+                    childC.Send(append([]string{"RPLYN", first, n}, remainder...)...)
+                    tn.onInfrMsgSent()
+                } else {
+                    tn.lock.Lock()
+                    tn.request(treeRequest{atoi(n), corrPath})
+                    tn.lock.Unlock()
+                }
         case "DATA": // DATA mid src pred msg
+                if err := checkDataParams(params); err != nil {
+                    log.Printf("goat: tree node %d: invalid DATA from child %d: %v", tn.port, idx, err)
+                    continue
+                }
+                if !amANode {
+                    tn.lock.Lock()
+                    _, has := tn.messages[atoi(params[0])]
+                    isOld := atoi(params[0]) < tn.nid
+                    late := isOld && tn.expired(childConn, params)
+                    tn.lock.Unlock()
+                    if late {
+                        continue
+                    } else if has || isOld {
+                        log.Printf("goat: tree node %d: agent %d sent message %s twice", tn.port, idx - len(tn.childNodesAddresses), params[0])
+                        continue
+                    }
+                }
                 //msg := tn.getMessageToForward(srcAddr,params,idx)
                 msg := tnMessageToForward{
                     message: append([]string{"DATA"}, params...),
@@ -244,45 +439,121 @@ func (tn *TreeNode) serveChild(childConn *duplexConn, idx int) {
                     msg.sourceAgent = -1
                 } else {
                     msg.sourceDescendant = -1
-                    msg.sourceAgent = idx - len(tn.childNodesConn)//atoi(params[1])
-                }
-                if !tn.amRoot() {
-                    tn.parentConn.Send(tn.prepareMessageForInfrastructure(msg)...)
-                    tn.onInfrMsgSent()
+                    msg.sourceAgent = idx - len(tn.childNodesAddresses)//atoi(params[1])
                 }
                 msgId := atoi(params[0])
                 tn.lock.Lock()
                 dprintln("got", msgId)
-                if _, has := tn.messages[msgId]; has {
-                    panic("Got msg "+itoa(msgId)+" twice!")
+                if _, has := tn.messages[msgId]; has || msgId < tn.nid {
+                    // the mid was filled meanwhile, or a repair sent the message again
+                    if !tn.expired(childConn, params) {
+                        dprintln("Tree node", tn.port, "got message", msgId, "twice")
+                    }
+                    tn.lock.Unlock()
+                    continue
+                }
+                if tn.amRoot() {
+                    tn.leases.settle(msgId)
+                }
+                if !tn.amRoot() {
+                    tn.parentConn.Send(tn.prepareMessageForInfrastructure(msg)...)
+                    tn.onInfrMsgSent()
                 }
                 tn.messages[msgId] = msg
                 tn.dispatch()
                 tn.lock.Unlock()
+        case "ATTR":
+                if !amANode && len(params) > 0 {
+                    tn.lock.Lock()
+                    agentId := idx - len(tn.childNodesAddresses)
+                    from, stale, err := tn.filter.publish(agentId, params[1:])
+                    if err != nil {
+                        log.Printf("goat: tree node %d: invalid ATTR from agent %d: %v", tn.port, agentId, err)
+                    } else {
+                        // the messages filtered with an older view, then the agent knows the node has the view
+                        tn.filter.resend(agentId, stale, func(msg []string) {
+                            childConn.Send(msg...)
+                            tn.onInfrMsgSent()
+                        })
+                        childConn.Send("VIEW", itoa(from))
+                        tn.onInfrMsgSent()
+                    }
+                    tn.lock.Unlock()
+                }
+        case "Leave":
+                if !amANode {
+                    tn.lock.Lock()
+                    delete(tn.agents, idx - len(tn.childNodesAddresses))
+                    tn.filter.forget(idx - len(tn.childNodesAddresses))
+                    tn.leases.revoke(idx - len(tn.childNodesAddresses))
+                    tn.lock.Unlock()
+                    childConn.Close()
+                    dprintln("Agent", idx - len(tn.childNodesAddresses), "left")
+                    return
+                }
         }
     }
 }
 
-func (tn *TreeNode) handleAgent(idx int, conn *duplexConn) {
-    tn.lock.Lock()
-    conn.Send("Registered", itoa(idx), itoa(tn.nid))
-    tn.onInfrMsgSent()
-    //fmt.Println("Agent", idx, "started at mid",tn.nid, len(tn.childNodesAddresses))
+/*
+handleAgent serves the agent idx; an agent that comes from a failed node (resume)
+first tells where it stopped.
+*/
+func (tn *TreeNode) handleAgent(idx int, conn *duplexConn, resume bool) {
+    if resume {
+        cmd, params, err := conn.ReceiveErr()
+        if err != nil || cmd != "Resume" {
+            log.Printf("goat: tree node %d: agent %d did not resume", tn.port, idx)
+            conn.Close()
+            return
+        }
+        tn.lock.Lock()
+        tn.resumeAgent(idx, conn, params)
+        dprintln("Agent", idx, "resumed at mid", tn.nid)
+    } else {
+        tn.lock.Lock()
+        conn.Send("Registered", itoa(idx), itoa(tn.nid))
+        tn.onInfrMsgSent()
+        //fmt.Println("Agent", idx, "started at mid",tn.nid, len(tn.childNodesAddresses))
+    }
     tn.lock.Unlock()
     tn.serveChild(conn, idx + len(tn.childNodesAddresses))
 }
 
 func (tn *TreeNode) regConnHandlerIn(regConn *duplexConn) {
     for {
-        cmd, params := regConn.Receive()
-        if cmd == "newAgent"{ // a new agent arrived
-            tn.lock.Lock()
-            agCompId := params[0]
-            agAddr := params[1]
-            agConn := connectWith(agAddr)
-            tn.agents[atoi(agCompId)] = agConn
-            go func(idx int, conn *duplexConn){tn.handleAgent(idx, conn)}(atoi(agCompId), agConn)
-            tn.lock.Unlock()
+        cmd, params, err := regConn.ReceiveErr()
+        if err != nil {
+            return
+        }
+        signalActivity(tn.chnActivity)
+        switch cmd {
+            case "newAgent": // newAgent compId address [resume]: a new agent arrived, or one of a failed node
+                if len(params) < 2 {
+                    continue
+                }
+                tn.lock.Lock()
+                if tn.terminated {
+                    tn.lock.Unlock()
+                    return
+                }
+                agCompId := atoi(params[0])
+                resume := len(params) > 2 && params[2] == "resume"
+                agConn, err := connect(params[1], tn.tlsConfig)
+                if err != nil {
+                    tn.lock.Unlock()
+                    log.Printf("goat: tree node %d: can not reach agent %d: %v", tn.port, agCompId, err)
+                    continue
+                }
+                if !resume {
+                    tn.agents[agCompId] = agConn
+                }
+                go tn.handleAgent(agCompId, agConn, resume)
+                tn.lock.Unlock()
+            case "reparent": // reparent address: the parent failed, the node at address replaces it
+                if len(params) > 0 && !tn.amRoot() {
+                    go tn.attach(params[0])
+                }
         }
     }
 }
@@ -295,7 +566,11 @@ func (tn *TreeNode) dispatch() {
             
             mFwdAgent := tn.prepareMessageForAgent(mFwd)
             for agentId, agentConn := range tn.agents {
-                if agentId != mFwd.sourceAgent{
+                if agentId != mFwd.sourceAgent && tn.filter.excludesData(mFwd.sourceAgent, agentId, mFwdAgent[3], mFwdAgent[4]) {
+                    from := tn.filter.skip(agentId, skippedMessage{mid: tn.nid, sender: mFwd.sourceAgent, params: mFwdAgent})
+                    agentConn.Send(skipParams(tn.nid, from)...)
+                    tn.onInfrMsgSent()
+                } else if agentId != mFwd.sourceAgent{
                     agentConn.Send(mFwdAgent...)
                     tn.onInfrMsgSent()
                 }
@@ -308,6 +583,7 @@ func (tn *TreeNode) dispatch() {
                     tn.onInfrMsgSent()
                 }
             }
+            tn.remember(tn.nid, mFwdInfr)
             
             tn.nid++
         } else {
@@ -316,14 +592,163 @@ func (tn *TreeNode) dispatch() {
     }
 }
 
+/*
+SetPolicy makes the node check the rules of policy before delivering a message to
+its agents (see Policy). It must be called before Work.
+*/
+func (tn *TreeNode) SetPolicy(policy *Policy) {
+    tn.filter.setPolicy(policy)
+}
+
+/*
+SetSequencer makes the root ask the mids to a replicated sequencer through sc,
+instead of counting them itself (see SequencerReplica). It must be called before
+Work, and only on the root.
+*/
+func (tn *TreeNode) SetSequencer(sc *SequencerClient) {
+    tn.sequencer = sc
+}
+
+/*
+nextMids reserves n mids at the root for owner (-1 if it is not an agent of the
+root) and returns the first one; it fails if the sequencer is closed. A request
+with the key of one answered already, sent again after a repair, gets the same
+mids.
+*/
+func (tn *TreeNode) nextMids(owner int, n int, key string) (string, bool) {
+    tn.lock.Lock()
+    if first, has := tn.answers[key]; has {
+        tn.lock.Unlock()
+        dprintln("Tree node", tn.port, "answers again the request", key)
+        return itoa(first), true
+    }
+    tn.lock.Unlock()
+    if tn.sequencer != nil {
+        first, err := tn.sequencer.Next(n)
+        if err != nil {
+            log.Printf("goat: tree node %d: no mids: %v", tn.port, err)
+            return "", false
+        }
+        tn.lock.Lock()
+        tn.leases.grant(owner, first, n)
+        tn.rememberAnswer(key, first)
+        tn.lock.Unlock()
+        return itoa(first), true
+    }
+    tn.lock.Lock()
+    defer tn.lock.Unlock()
+    first := tn.counter
+    tn.counter += n
+    tn.leases.grant(owner, first, n)
+    tn.rememberAnswer(key, first)
+    return itoa(first), true
+}
+
+// agentOf returns the agent at the child idx, or -1 if it is a node
+func (tn *TreeNode) agentOf(idx int) int {
+    if idx < len(tn.childNodesAddresses) {
+        return -1
+    }
+    return idx - len(tn.childNodesAddresses)
+}
+
+/*
+SetMidLease sets how long the root waits for the message of a mid, once it is the
+next mid of the root, before filling it with an empty message; a message that
+arrives later is dropped (see Component.OnExpired). With d <= 0, the default,
+the root waits forever, unless the agent is one of its own and it is gone. It
+must be called before Work, and only on the root.
+*/
+func (tn *TreeNode) SetMidLease(d time.Duration) {
+    tn.leases.duration = d
+}
+
+/*
+expireLeases fills the mids whose lease expired, and forgets the old answers,
+until the root is terminated. The empty message goes down the tree like the
+others.
+*/
+func (tn *TreeNode) expireLeases() {
+    ticker := time.NewTicker(leaseTick)
+    defer ticker.Stop()
+    for {
+        select {
+            case <- tn.chnQuit:
+                return
+            case <- ticker.C:
+                tn.lock.Lock()
+                tn.fillExpired()
+                tn.forgetAnswers()
+                tn.lock.Unlock()
+        }
+    }
+}
+
+/*
+expired tells whether the DATA params that came on conn is late: its mid was
+filled meanwhile. The root knows it from its leases, the other nodes because they
+dispatched an empty message in its place. The notice goes down conn to the agent
+that sent it. The caller must hold tn.lock.
+*/
+func (tn *TreeNode) expired(conn *duplexConn, params []string) bool {
+    mid := atoi(params[0])
+    if tn.amRoot() {
+        if !tn.leases.dropFilled(mid) {
+            return false
+        }
+    } else if msg, has := tn.history[mid]; !has || !isEmptyData(msg[1:]) || isEmptyData(params) {
+        return false
+    }
+    log.Printf("goat: tree node %d: message %d arrived after its lease expired", tn.port, mid)
+    conn.Send(append([]string{"EXPIRED"}, params...)...)
+    tn.onInfrMsgSent()
+    return true
+}
+
+// fillExpired dispatches the empty messages of the expired mids; the caller must hold tn.lock
+func (tn *TreeNode) fillExpired() {
+    for {
+        owner, expired := tn.leases.expire(tn.nid, time.Now())
+        if !expired {
+            return
+        }
+        dprintln("Filling mid", tn.nid, "of agent", owner)
+        tn.messages[tn.nid] = tnMessageToForward{
+            message: emptyDataMessage(tn.nid, owner),
+            fromTheParent: false,
+            sourceAgent: owner,
+            sourceDescendant: -1,
+        }
+        tn.dispatch()
+    }
+}
+
 func (tn *TreeNode) WorkLoop() {
     tn.Work(0, make(chan struct{}))
 }
 
+/*
+Work connects the node to the tree and serves it until Terminate is called. It
+returns when no message arrives for timeout msec, closing timedOut, or when the
+node is terminated.
+*/
 func (tn *TreeNode) Work(timeout int64, timedOut chan<- struct{}){
-    listenerConns, chnReady := listener(tn.port)
-    regConn := connectWith(tn.registrationAddress)
-    <-chnReady
+    if tn.connect() {
+        waitIdle(tn.chnActivity, tn.chnQuit, timeout, timedOut)
+    }
+}
+
+// connect joins the tree and starts serving it; it fails if tn is terminated meanwhile
+func (tn *TreeNode) connect() bool {
+    regConn := connectWithTLS(tn.registrationAddress, tn.tlsConfig)
+    tn.lock.Lock()
+    tn.regConn = regConn
+    terminated := tn.terminated
+    tn.lock.Unlock()
+    if terminated {
+        regConn.Close()
+        return false
+    }
     if len(tn.childNodesAddresses) > 0 {
         regConn.Send("ready")
         tn.onInfrMsgSent()
@@ -332,33 +757,85 @@ func (tn *TreeNode) Work(timeout int64, timedOut chan<- struct{}){
         tn.onInfrMsgSent()
     }
     for canConnectParent := false; !canConnectParent;{
-        cmd, _ := regConn.Receive()
-        canConnectParent = cmd == "connNext"
+        cmd, params, err := regConn.ReceiveErr()
+        if err != nil {
+            return false
+        }
+        if canConnectParent = cmd == "connNext"; canConnectParent {
+            tn.id, _ = paramInt(params, 0)
+        }
     }
-    chnConnParent := make(chan struct{})
+    chnConnParent := make(chan *duplexConn, 1)
     if tn.parentAddress == "" {
-        tn.parentConn = nil
-        close(chnConnParent)
+        chnConnParent <- nil
     } else {
         go func() {
-            tn.parentConn = connectWith(tn.parentAddress)
-            close(chnConnParent)
+            chnConnParent <- connectWithTLS(tn.parentAddress, tn.tlsConfig)
         }()
     }
-    tn.childNodesConn = make([]*duplexConn, len(tn.childNodesAddresses))
+    childNodesConn := map[int]*duplexConn{}
     for i := range tn.childNodesAddresses {
-        tn.childNodesConn[i] = <- listenerConns.Out
+        if nd, ok := <- tn.listenerConns.Out; ok {
+            childNodesConn[i] = nd
+        }
+    }
+    parentConn := <-chnConnParent
+    tn.lock.Lock()
+    tn.parentConn = parentConn
+    tn.childNodesConn = childNodesConn
+    if tn.terminated || len(childNodesConn) < len(tn.childNodesAddresses) {
+        tn.lock.Unlock()
+        if parentConn != nil {
+            parentConn.Close()
+        }
+        for _, nd := range childNodesConn {
+            nd.Close()
+        }
+        return false
     }
-    <-chnConnParent
+    if parentConn != nil {
+        parentConn.Send("child", itoa(tn.id), itoa(tn.nid))
+        tn.onInfrMsgSent()
+    }
+    tn.lock.Unlock()
     go func(){tn.regConnHandlerIn(regConn)}()
     if !tn.amRoot() {
-        go func(){tn.serveParent()}()
+        go func(){tn.serveParent(parentConn)}()
     }
     for idx,nd := range tn.childNodesConn{
         go func(n *duplexConn, i int){tn.serveChild(n, i)}(nd, idx)
     }
+    if tn.amRoot() {
+        go tn.expireLeases()
+    }
+    go tn.heartbeat()
+    go tn.adoptChildren()
+    return true
 }
 
+/*
+Terminate closes the listener and every connection of the node, and stops its
+goroutines.
+*/
 func (tn *TreeNode) Terminate(){
-    //tn.listener.Close()
+    tn.lock.Lock()
+    defer tn.lock.Unlock()
+    if tn.terminated {
+        return
+    }
+    tn.terminated = true
+    close(tn.chnQuit)
+    tn.listenerConns.Close()
+    if tn.regConn != nil {
+        tn.regConn.Close()
+    }
+    if tn.parentConn != nil {
+        tn.parentConn.Close()
+    }
+    for _, nd := range tn.childNodesConn {
+        nd.Close()
+    }
+    for _, agConn := range tn.agents {
+        agConn.Close()
+    }
 }
@@ -0,0 +1,347 @@
+package goat
+
+import (
+    "log"
+    "sort"
+    "time"
+)
+
+// treeHistory is how many of the last messages a tree node keeps, to send them again after a repair
+const treeHistory = 4096
+
+/*
+A tree repairs itself when a node other than the root fails. Each node writes at
+least every ringHeartbeat on its links to the parent and to the child nodes. The
+nodes at the other end of the links of a node (its parent and its children) see
+them break, or stay silent for ringLinkTimeout, and declare it down to the
+registration, that tells each orphaned child to attach to the closest live
+ancestor of the failed node ("reparent"), and assigns the agents of the failed
+node to the live nodes. A node keeps the last treeHistory messages it dispatched
+and the requests of mids it forwarded to its parent without reply: when it
+attaches to a new parent, it sends again the requests and the messages the parent
+may not have, and the parent sends it the messages it may not have. A request
+carries the key of the agent that sent it ("compId:id", see requestKey), and the
+root gives again the same mids to a request sent again, so the mids in the
+replies lost with the failed node are not left waiting; the copies of a message
+are dropped.
+
+Besides "ready" and "connNext", the nodes and the registration exchange:
+    node → registration: attached parentId parentAddress | nodeDown otherId | unreachable address
+    registration → node: reparent address | newAgent compId address resume
+and on a link the child writes "child id nid" first, the parent answers "parent id nid",
+then both write "HB" every ringHeartbeat.
+*/
+
+// treeRequest is a request of mids forwarded to the parent: n is 0 for REQ
+type treeRequest struct {
+    n int
+    path []string
+}
+
+/*
+reparent attaches the children of the tree node dead to its closest live
+ancestor. The caller must hold rar.lock.
+*/
+func (rar *RingAgentRegistration) reparent(dead int) {
+    ancestor := rar.members[dead].prev
+    for steps := 0; ancestor >= 0 && !rar.members[ancestor].alive && steps < len(rar.members); steps++ {
+        ancestor = rar.members[ancestor].prev
+    }
+    if ancestor < 0 || !rar.members[ancestor].alive || rar.members[ancestor].address == "" {
+        log.Printf("goat: registration: tree node %d has no live ancestor, its subtree is lost", dead)
+        return
+    }
+    for _, m := range rar.members {
+        if m.alive && m.prev == dead {
+            m.prev = ancestor
+            m.conn.Send("reparent", rar.members[ancestor].address)
+            rar.onInfrMsgSent()
+        }
+    }
+}
+
+////
+
+// remember adds a dispatched message to the history; the caller must hold tn.lock
+func (tn *TreeNode) remember(mid int, msg []string) {
+    tn.history[mid] = append([]string{}, msg...)
+    delete(tn.history, mid - treeHistory)
+}
+
+// request forwards a request of mids to the parent, until it is answered; the caller must hold tn.lock
+func (tn *TreeNode) request(req treeRequest) {
+    tn.requests = append(tn.requests, req)
+    tn.sendRequest(req)
+}
+
+// sendRequest writes req to the parent; the caller must hold tn.lock
+func (tn *TreeNode) sendRequest(req treeRequest) {
+    if req.n == 0 {
+        tn.parentConn.Send(append([]string{"REQ"}, req.path...)...)
+    } else {
+        tn.parentConn.Send(append([]string{"REQN", itoa(req.n)}, req.path...)...)
+    }
+    tn.onInfrMsgSent()
+}
+
+// answered forgets the request of n mids for path, that got its reply; the caller must hold tn.lock
+func (tn *TreeNode) answered(n int, path []string) {
+    for i, req := range tn.requests {
+        if req.n == n && equalStrings(req.path, path) {
+            tn.requests = append(tn.requests[:i], tn.requests[i+1:]...)
+            return
+        }
+    }
+}
+
+/*
+requestKey returns the key of the request of agent, whose id is in params at i:
+the root gives the same mids to the requests with the same key. It is "-", never
+remembered, if the agent sent no id.
+*/
+func requestKey(agent int, params []string, i int) string {
+    id, err := paramInt(params, i)
+    if err != nil || agent < 0 {
+        return "-"
+    }
+    return itoa(agent) + ":" + itoa(id)
+}
+
+// rememberAnswer records that the root gave the mids from first on to the request key; the caller must hold tn.lock
+func (tn *TreeNode) rememberAnswer(key string, first int) {
+    if key != "-" {
+        tn.answers[key] = first
+    }
+}
+
+// forgetAnswers forgets the requests whose mids are older than the history; the caller must hold tn.lock
+func (tn *TreeNode) forgetAnswers() {
+    for key, first := range tn.answers {
+        if first < tn.nid - treeHistory {
+            delete(tn.answers, key)
+        }
+    }
+}
+
+func equalStrings(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+/*
+attached handles "parent id nid" from a new parent: tn sends it the messages from
+nid on, those the parent may not have. The caller must hold tn.lock.
+*/
+func (tn *TreeNode) attached(conn *duplexConn, params []string) {
+    parentId, err := paramInt(params, 0)
+    nid, errNid := paramInt(params, 1)
+    if err != nil || errNid != nil {
+        log.Printf("goat: tree node %d: invalid parent: %v", tn.port, params)
+        return
+    }
+    tn.parentId = parentId
+    mids := []int{}
+    for mid := range tn.history {
+        if mid >= nid {
+            mids = append(mids, mid)
+        }
+    }
+    for mid := range tn.messages {
+        if mid >= nid {
+            mids = append(mids, mid)
+        }
+    }
+    sort.Ints(mids)
+    for _, mid := range mids {
+        if msg, has := tn.history[mid]; has {
+            conn.Send(msg...)
+        } else {
+            conn.Send(tn.prepareMessageForInfrastructure(tn.messages[mid])...)
+        }
+        tn.onInfrMsgSent()
+    }
+    tn.regConn.Send("attached", itoa(parentId), tn.currentParent)
+    tn.onInfrMsgSent()
+}
+
+// adoptChildren serves the children that attach to tn after a repair
+func (tn *TreeNode) adoptChildren() {
+    for conn := range tn.listenerConns.Out {
+        go tn.adoptChild(conn)
+    }
+}
+
+/*
+adoptChild serves a child that attaches to tn after a repair: tn sends it the
+messages from the nid of the child on. It copies them under tn.lock and writes
+them after releasing it; then it sends those dispatched meanwhile and adds the
+child, so that dispatch writes to it the next ones.
+*/
+func (tn *TreeNode) adoptChild(conn *duplexConn) {
+    conn.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+    cmd, params, err := conn.ReceiveErr()
+    childId, errId := paramInt(params, 0)
+    nid, errNid := paramInt(params, 1)
+    if err != nil || cmd != "child" || errId != nil || errNid != nil {
+        log.Printf("goat: tree node %d: invalid link from a child: %s %v", tn.port, cmd, params)
+        conn.Close()
+        return
+    }
+    tn.lock.Lock()
+    upto := tn.nid
+    missed := tn.historyFrom(nid, upto)
+    tn.lock.Unlock()
+    conn.Send("parent", itoa(tn.id), itoa(upto))
+    tn.onInfrMsgSent()
+    for _, msg := range missed {
+        conn.Send(msg...)
+        tn.onInfrMsgSent()
+    }
+    tn.lock.Lock()
+    if tn.terminated {
+        tn.lock.Unlock()
+        conn.Close()
+        return
+    }
+    for _, msg := range tn.historyFrom(upto, tn.nid) {
+        conn.Send(msg...)
+        tn.onInfrMsgSent()
+    }
+    // the children attached later have indexes below -1 (no child), those above the children are agents
+    tn.adopted--
+    idx := tn.adopted - 1
+    tn.childNodesConn[idx] = conn
+    tn.childIds[idx] = childId
+    tn.lock.Unlock()
+    dprintln("Tree node", tn.port, "adopted node", childId)
+    tn.serveChild(conn, idx)
+}
+
+// historyFrom returns the messages of the history from the mid first to last-1; the caller must hold tn.lock
+func (tn *TreeNode) historyFrom(first int, last int) [][]string {
+    msgs := [][]string{}
+    if first < last - treeHistory {
+        first = last - treeHistory
+    }
+    for mid := first; mid < last; mid++ {
+        if msg, has := tn.history[mid]; has {
+            msgs = append(msgs, msg)
+        }
+    }
+    return msgs
+}
+
+/*
+heartbeat writes "HB" on the links to the parent and to the child nodes every
+ringHeartbeat, until tn is terminated: a node that reads nothing on a link for
+ringLinkTimeout, once the link is up, declares the other end down.
+*/
+func (tn *TreeNode) heartbeat() {
+    ticker := time.NewTicker(ringHeartbeat)
+    defer ticker.Stop()
+    for {
+        select {
+            case <- tn.chnQuit:
+                return
+            case <- ticker.C:
+                tn.lock.Lock()
+                if tn.parentConn != nil {
+                    tn.parentConn.Send("HB")
+                }
+                for _, nd := range tn.childNodesConn {
+                    nd.Send("HB")
+                }
+                tn.lock.Unlock()
+        }
+    }
+}
+
+// linkDown reports that the link conn to the node other broke
+func (tn *TreeNode) linkDown(other int) {
+    tn.lock.Lock()
+    terminated := tn.terminated
+    tn.lock.Unlock()
+    if !terminated && other >= 0 {
+        dprintln("Tree node", tn.port, "lost the node", other)
+        tn.regConn.Send("nodeDown", itoa(other))
+        tn.onInfrMsgSent()
+    }
+}
+
+/*
+attach connects tn to the node at address, its new parent, and sends it again the
+requests that the failed parent may have lost.
+*/
+func (tn *TreeNode) attach(address string) {
+    conn, err := connect(address, tn.tlsConfig)
+    if err != nil {
+        log.Printf("goat: tree node %d: can not reach %s: %v", tn.port, address, err)
+        tn.regConn.Send("unreachable", address)
+        tn.onInfrMsgSent()
+        return
+    }
+    tn.lock.Lock()
+    if tn.terminated {
+        tn.lock.Unlock()
+        conn.Close()
+        return
+    }
+    old := tn.parentConn
+    tn.parentConn = conn
+    tn.currentParent = address
+    conn.Send("child", itoa(tn.id), itoa(tn.nid))
+    tn.onInfrMsgSent()
+    for _, req := range tn.requests {
+        tn.sendRequest(req)
+    }
+    tn.lock.Unlock()
+    old.Close()
+    dprintln("Tree node", tn.port, "attached to", address)
+    go tn.serveParent(conn)
+}
+
+/*
+resumeAgent serves an agent moved to tn from a failed node: the agent tells the
+next mid it waits for and the mids it holds, then tn sends it the messages from
+that mid on. The caller must hold tn.lock.
+*/
+func (tn *TreeNode) resumeAgent(idx int, conn *duplexConn, params []string) {
+    next, held, err := decodeResume(params)
+    if err != nil {
+        log.Printf("goat: tree node %d: invalid Resume from agent %d: %v", tn.port, idx, err)
+        next = tn.nid
+    }
+    if tn.amRoot() {
+        for _, mid := range held {
+            if mid >= tn.nid {
+                tn.leases.grant(idx, mid, 1)
+            }
+        }
+    }
+    conn.Send("Registered", itoa(idx), itoa(tn.nid))
+    tn.onInfrMsgSent()
+    if next < tn.nid - treeHistory {
+        log.Printf("goat: tree node %d: agent %d missed messages older than the history", tn.port, idx)
+    }
+    // the agent drops its own messages
+    for mid := next; mid < tn.nid; mid++ {
+        msg, has := tn.history[mid]
+        if !has {
+            continue
+        }
+        if tn.filter.excludesData(-1, idx, msg[3], msg[4]) {
+            conn.Send(skipParams(mid, tn.filter.skip(idx, skippedMessage{mid: mid, sender: -1, params: msg}))...)
+        } else {
+            conn.Send(msg...)
+        }
+        tn.onInfrMsgSent()
+    }
+    tn.agents[idx] = conn
+}
@@ -0,0 +1,211 @@
+package goat
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+/*
+initFixedTest starts the tree 0 → 1, 2 and 1 → 3, 4, so that the node 1 has a
+parent, children and (with 5 agents) an agent. The root gets tti.midLease, if not 0.
+*/
+func (tti *testTreeInfrastructure) initFixedTest(timeout int64, componentNbr int) {
+    registrationAddr := "127.0.0.1:17997"
+    addr := func(i int) string {
+        return fmt.Sprintf("127.0.0.1:%d", 18000+i)
+    }
+    parents := []string{"", addr(0), addr(0), addr(1), addr(1)}
+    childs := [][]string{{addr(1), addr(2)}, {addr(3), addr(4)}, {}, {}, {}}
+    nodesAddr := []string{}
+    for i := range parents {
+        nodesAddr = append(nodesAddr, addr(i))
+    }
+    tti.terms = make([]chan struct{}, 1 + len(parents))
+    for i := range tti.terms {
+        tti.terms[i] = make(chan struct{})
+    }
+    tti.registration = NewTreeAgentRegistration(17997, nodesAddr)
+    tti.nodes = make([]*TreeNode, len(parents))
+    for i := range parents {
+        tti.nodes[i] = NewTreeNode(18000+i, parents[i], registrationAddr, childs[i])
+    }
+    if tti.midLease != 0 {
+        tti.nodes[0].SetMidLease(tti.midLease)
+    }
+    go tti.registration.Work(timeout, tti.terms[0])
+    for i, nd := range tti.nodes {
+        go nd.Work(timeout, tti.terms[1+i])
+    }
+    tti.agents = make([]*TreeAgent, componentNbr)
+    for i := range tti.agents {
+        tti.agents[i] = NewTreeAgent(registrationAddr)
+    }
+}
+
+func TestTreeRepair(t *testing.T) {
+    tst := testTreeInfrastructure{}
+    tst.initFixedTest(3000, 5)
+    comps := []*Component{}
+    for _, agent := range tst.agents {
+        comps = append(comps, NewComponent(agent, nil))
+    }
+    sendAndReceive(t, comps[0], comps[4])
+    // the interior node fails: its children attach to the root, its agent moves
+    tst.nodes[1].Terminate()
+    close(tst.terms[2])
+    for i := range comps {
+        sendAndReceive(t, comps[i], comps[(i+1) % len(comps)])
+    }
+    for _, comp := range comps {
+        comp.Close()
+    }
+    tst.teardownTest()
+}
+
+/*
+the interior node fails while every component sends and its requests of mids are
+on their way: each component still gets the messages of every other one once and
+in order. Without a lease, the root gives again the mids of the replies lost with
+the node.
+*/
+func TestTreeRepairInFlight(t *testing.T) {
+    tst := testTreeInfrastructure{}
+    tst.initFixedTest(6000, 5)
+    comps := []*Component{}
+    for _, agent := range tst.agents {
+        comps = append(comps, NewComponent(agent, nil))
+    }
+    const n = 30
+    chnKill := make(chan struct{})
+    done := []chan struct{}{}
+    for c, comp := range comps {
+        c := c
+        chnDone := make(chan struct{})
+        done = append(done, chnDone)
+        NewProcess(comp).Run(func(p *Process) {
+            defer close(chnDone)
+            next := make([]int, len(comps))
+            for got := 0; got < n * (len(comps) - 1); got++ {
+                msg := p.Receive(func(attr *Attributes, msg Tuple) bool {
+                    return true
+                })
+                sender, i := msg.Get(0).(int), msg.Get(1).(int)
+                if sender == c || i != next[sender] {
+                    t.Errorf("component %d received message %d of %d instead of %d", c, i, sender, next[sender])
+                    return
+                }
+                next[sender]++
+            }
+        })
+        NewProcess(comp).Run(func(p *Process) {
+            for i := 0; i < n; i++ {
+                if i == n / 3 && c == 0 {
+                    close(chnKill)
+                }
+                p.Send(NewTuple(c, i), True())
+            }
+        })
+    }
+    <- chnKill
+    tst.nodes[1].Terminate()
+    close(tst.terms[2])
+    waitAll(t, 20000, done...)
+    for _, comp := range comps {
+        comp.Close()
+    }
+    tst.teardownTest()
+}
+
+// the interior node freezes without closing its links: its parent and its children declare it down
+func TestTreeRepairSilentNode(t *testing.T) {
+    tst := testTreeInfrastructure{}
+    tst.initFixedTest(6000, 5)
+    comps := []*Component{}
+    for _, agent := range tst.agents {
+        comps = append(comps, NewComponent(agent, nil))
+    }
+    sendAndReceive(t, comps[0], comps[4])
+    silent := tst.nodes[1]
+    silent.lock.Lock()
+    sendAndReceiveWithin(t, comps[0], comps[4], 10000)
+    for i := range comps {
+        sendAndReceive(t, comps[i], comps[(i+1) % len(comps)])
+    }
+    silent.lock.Unlock()
+    silent.Terminate()
+    close(tst.terms[2])
+    for _, comp := range comps {
+        comp.Close()
+    }
+    tst.teardownTest()
+}
+
+// a node rejects a child that attaches without its nid
+func TestTreeRejectsMalformedChild(t *testing.T) {
+    tst := testTreeInfrastructure{}
+    tst.initFixedTest(3000, 2)
+    comp1 := NewComponent(tst.agents[0], nil)
+    comp2 := NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    child, err := connect(fmt.Sprintf("127.0.0.1:%d", tst.nodes[0].port), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    child.Send("child", "3")
+    child.conn.SetReadDeadline(time.Now().Add(2 * ringLinkTimeout))
+    if cmd, params, err := child.ReceiveErr(); err == nil {
+        t.Errorf("the node adopted the child: %s %v", cmd, params)
+    }
+    child.Close()
+    tst.nodes[0].lock.Lock()
+    if len(tst.nodes[0].childNodesConn) != 2 {
+        t.Errorf("the node has %d child nodes instead of 2", len(tst.nodes[0].childNodesConn))
+    }
+    tst.nodes[0].lock.Unlock()
+    sendAndReceive(t, comp1, comp2)
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+}
+
+// the root gives the same mid to a request sent again through a new link, as after a repair
+func TestTreeRootAnswersAgain(t *testing.T) {
+    tst := testTreeInfrastructure{}
+    tst.initFixedTest(3000, 2)
+    comp1 := NewComponent(tst.agents[0], nil)
+    comp2 := NewComponent(tst.agents[1], nil)
+    sendAndReceive(t, comp1, comp2)
+    ask := func(key string) string {
+        child, err := connect(fmt.Sprintf("127.0.0.1:%d", tst.nodes[0].port), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer child.Close()
+        child.Send("child", "9", "0")
+        child.Send("REQ", key, "7")
+        child.conn.SetReadDeadline(time.Now().Add(ringLinkTimeout))
+        for {
+            cmd, params, err := child.ReceiveErr()
+            if err != nil {
+                t.Fatalf("no reply to %s: %v", key, err)
+            }
+            if cmd == "RPLY" {
+                if len(params) != 3 || params[1] != key || params[2] != "7" {
+                    t.Errorf("invalid reply %v", params)
+                }
+                return params[0]
+            }
+        }
+    }
+    first := ask("5:0")
+    if again := ask("5:0"); again != first {
+        t.Errorf("the request sent again got mid %s instead of %s", again, first)
+    }
+    if other := ask("5:1"); other == first {
+        t.Errorf("another request got the same mid %s", other)
+    }
+    comp1.Close()
+    comp2.Close()
+    tst.teardownTest()
+}
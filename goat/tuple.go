@@ -2,9 +2,11 @@ package goat
 
 import(
     "bytes"
+    "fmt"
     "encoding/gob"
     "encoding/base64"
     "log"
+    "strings"
 )
 
 type Tuple struct{
@@ -41,7 +43,11 @@ func (t *Tuple) Pop(){
 
 func (t Tuple) Contains(x interface{}) bool {
     for i := 0; i<len(t.Elems); i++ {
-        if t.Elems[i] == x {
+        if eq, ok := compareValues(t.Elems[i], "==", x); ok {
+            if eq {
+                return true
+            }
+        } else if t.Elems[i] == x {
             return true
         }
     }
@@ -82,17 +88,38 @@ func (t *Tuple) encode() string{
 	return base64.StdEncoding.EncodeToString(network.Bytes())
 }
 
-func decodeTuple(encoded string) Tuple{
-    decoded, err := base64.StdEncoding.DecodeString(encoded)
+// encodeFor encodes t for a message sent with the binary protocol (binary true) or the text one
+func (t *Tuple) encodeFor(binary bool) string{
+    if !binary {
+        return t.encode()
+    }
+    var network bytes.Buffer
+    network.WriteString(rawTuplePrefix)
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(t)
 	if err != nil {
-		log.Fatal("Base64 decoding error:", err)
+		log.Fatal("Tuple encoding error:", err)
+	}
+	return network.String()
+}
+
+func decodeTuple(encoded string) (Tuple, error){
+    var t Tuple
+    var decoded []byte
+    if strings.HasPrefix(encoded, rawTuplePrefix) {
+        decoded = []byte(encoded[len(rawTuplePrefix):])
+    } else {
+        var err error
+        decoded, err = base64.StdEncoding.DecodeString(encoded)
+	    if err != nil {
+		    return t, fmt.Errorf("goat: invalid tuple encoding: %v", err)
+	    }
 	}
 	network := bytes.NewBuffer(decoded)
 	dec := gob.NewDecoder(network)
-	var t Tuple
-	err = dec.Decode(&t)
+	err := dec.Decode(&t)
 	if err != nil {
-		log.Fatal("Tuple decoding error:", err)
+		return t, fmt.Errorf("goat: invalid tuple: %v", err)
 	}
-	return t
+	return t, nil
 }
@@ -1,8 +1,11 @@
 package goat
 
+import "net"
+
 type unboundChanUnit struct {
     In chan struct{}
     Out chan struct{}
+    cls chan struct{}
 }
 
 func (uc *unboundChanUnit) start(){
@@ -14,25 +17,37 @@ func (uc *unboundChanUnit) start(){
                     buffer = buffer[1:]
                 case d := <- uc.In:
                     buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
             }
         }
         for len(buffer) == 0 {
-            d := <- uc.In
-            buffer = append(buffer, d)
+            select {
+                case d := <- uc.In:
+                    buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
+            }
         }
     }
 }
 
+// Close stops the channel: buffered items are dropped and In must not be used anymore.
+func (uc *unboundChanUnit) Close() {
+    close(uc.cls)
+}
+
 
 
 
 type unboundChanInt struct {
     In chan int
     Out chan int
+    cls chan struct{}
 }
 
 func newUnboundChanUnit() *unboundChanUnit {
-    uc := unboundChanUnit{make(chan struct{}), make(chan struct{})}
+    uc := unboundChanUnit{In: make(chan struct{}), Out: make(chan struct{}), cls: make(chan struct{})}
     go func(c *unboundChanUnit){c.start()}(&uc)
     return &uc
 }
@@ -46,16 +61,27 @@ func (uc *unboundChanInt) start(){
                     buffer = buffer[1:]
                 case d := <- uc.In:
                     buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
             }
         }
         for len(buffer) == 0 {
-            d := <- uc.In
-            buffer = append(buffer, d)
+            select {
+                case d := <- uc.In:
+                    buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
+            }
         }
     }
 }
+
+// Close stops the channel: buffered items are dropped and In must not be used anymore.
+func (uc *unboundChanInt) Close() {
+    close(uc.cls)
+}
 func newUnboundChanInt() *unboundChanInt {
-    uc := unboundChanInt{make(chan int), make(chan int)}
+    uc := unboundChanInt{In: make(chan int), Out: make(chan int), cls: make(chan struct{})}
     go func(c *unboundChanInt){c.start()}(&uc)
     return &uc
 }
@@ -66,6 +92,7 @@ func newUnboundChanInt() *unboundChanInt {
 type unboundChanString struct {
     In chan string
     Out chan string
+    cls chan struct{}
 }
 func (uc *unboundChanString) start(){
     buffer := []string{}
@@ -76,16 +103,27 @@ func (uc *unboundChanString) start(){
                     buffer = buffer[1:]
                 case d := <- uc.In:
                     buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
             }
         }
         for len(buffer) == 0 {
-            d := <- uc.In
-            buffer = append(buffer, d)
+            select {
+                case d := <- uc.In:
+                    buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
+            }
         }
     }
 }
+
+// Close stops the channel: buffered items are dropped and In must not be used anymore.
+func (uc *unboundChanString) Close() {
+    close(uc.cls)
+}
 func newUnboundChanString() *unboundChanString {
-    uc := unboundChanString{make(chan string), make(chan string)}
+    uc := unboundChanString{In: make(chan string), Out: make(chan string), cls: make(chan struct{})}
     go func(c *unboundChanString){c.start()}(&uc)
     return &uc
 }
@@ -97,6 +135,7 @@ func newUnboundChanString() *unboundChanString {
 type unboundChanMessage struct {
     In chan Message
     Out chan Message
+    cls chan struct{}
 }
 func (uc *unboundChanMessage) start(){
     buffer := []Message{}
@@ -107,16 +146,27 @@ func (uc *unboundChanMessage) start(){
                     buffer = buffer[1:]
                 case d := <- uc.In:
                     buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
             }
         }
         for len(buffer) == 0 {
-            d := <- uc.In
-            buffer = append(buffer, d)
+            select {
+                case d := <- uc.In:
+                    buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
+            }
         }
     }
 }
+
+// Close stops the channel: buffered items are dropped and In must not be used anymore.
+func (uc *unboundChanMessage) Close() {
+    close(uc.cls)
+}
 func newUnboundChanMessage() *unboundChanMessage {
-    uc := unboundChanMessage{make(chan Message), make(chan Message)}
+    uc := unboundChanMessage{In: make(chan Message), Out: make(chan Message), cls: make(chan struct{})}
     go func(c *unboundChanMessage){c.start()}(&uc)
     return &uc
 }
@@ -128,9 +178,17 @@ func newUnboundChanMessage() *unboundChanMessage {
 type unboundChanConn struct {
     In chan *duplexConn
     Out chan *duplexConn
+    cls chan struct{}
+    listener net.Listener
 }
 func (uc *unboundChanConn) start(){
     buffer := []*duplexConn{}
+    defer func(){
+        for _, d := range buffer {
+            d.Close()
+        }
+        close(uc.Out)
+    }()
     for{
         for len(buffer) > 0 {
             select {
@@ -138,16 +196,34 @@ func (uc *unboundChanConn) start(){
                     buffer = buffer[1:]
                 case d := <- uc.In:
                     buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
             }
         }
         for len(buffer) == 0 {
-            d := <- uc.In
-            buffer = append(buffer, d)
+            select {
+                case d := <- uc.In:
+                    buffer = append(buffer, d)
+                case <-uc.cls:
+                    return
+            }
         }
     }
 }
+
+/*
+Close stops accepting connections: the listener (if any) is closed, the connections
+not yet taken are closed, and Out gets closed.
+*/
+func (uc *unboundChanConn) Close() {
+    close(uc.cls)
+    if uc.listener != nil {
+        uc.listener.Close()
+    }
+}
+
 func newUnboundChanConn() *unboundChanConn {
-    uc := unboundChanConn{make(chan *duplexConn), make(chan *duplexConn)}
+    uc := unboundChanConn{In: make(chan *duplexConn), Out: make(chan *duplexConn), cls: make(chan struct{})}
     go func(c *unboundChanConn){c.start()}(&uc)
     return &uc
 }
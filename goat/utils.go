@@ -1,6 +1,7 @@
 package goat
 
 import (
+    "crypto/tls"
     "fmt"
     "strconv"
     "net"
@@ -8,10 +9,13 @@ import (
     "bufio"
     "time"
     "reflect"
+    "math"
     "encoding/gob"
     "os"
     "os/signal"
+    "path/filepath"
     "syscall"
+    "sync"
 )
 
 func itoa(n int) string {
@@ -23,32 +27,65 @@ func atoi(s string) int {
     return n
 }
 
+// writeFileSync writes data to the file path, replacing it only once data is on disk
+func writeFileSync(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*")
+    if err != nil {
+        return err
+    }
+    if _, err = tmp.Write(data); err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    // the rename is on disk only once the directory is
+    dir, err := os.Open(filepath.Dir(path))
+    if err != nil {
+        return err
+    }
+    err = dir.Sync()
+    if cerr := dir.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
 func sendToAddress(address netAddress, tokens... string) {
     sendTo(address.String(), tokens...)
 }
     
 func sendTo(address string, tokens... string) {
-    escTokens := make([]string, len(tokens))
-    for i, tok:= range tokens {
-        escTokens[i] = escape(tok)
-    }
     conn, err := net.Dial("tcp", address)
     if err == nil{
-        fmt.Fprintf(conn, "%s\n", strings.Join(escTokens," "))
+        writeMessage(conn, false, tokens)
+        conn.Close()
     }
 }   
 
 func listenToRandomPort() (net.Listener, int){
-    return ltp(0)
+    return ltp(0, nil)
 }
 
 func listenToPort(port int) net.Listener{
-    lst, _ := ltp(port)
+    lst, _ := ltp(port, nil)
+    return lst
+}
+
+func listenToPortTLS(port int, tlsConfig *tls.Config) net.Listener{
+    lst, _ := ltp(port, tlsConfig)
     return lst
 }
 
-func ltp(num int) (net.Listener, int){
-    listener, err := net.Listen("tcp", ":"+itoa(num))
+func ltp(num int, tlsConfig *tls.Config) (net.Listener, int){
+    listener, err := listenTCP(num, tlsConfig)
     if err != nil{
         panic(err)
     }
@@ -64,12 +101,24 @@ func escapeWithType(x interface{}, isXAttr bool) string{
         return escape("A|"+x.(string))
     } else {
         switch val := x.(type) {
+            case cexpr:
+                return val.String()
             case Tuple:
                 return escape("T|" + val.encode())
             case string:
                 return escape("S|"+val)
             case int:
                 return escape("I|"+itoa(val))
+            case int64:
+                return escape("L|"+strconv.FormatInt(val, 10))
+            case uint64:
+                return escape("U|"+strconv.FormatUint(val, 10))
+            case float64:
+                return escape("F|"+strconv.FormatFloat(val, 'g', -1, 64))
+            case time.Time:
+                return escape("M|"+val.Format(time.RFC3339Nano))
+            case time.Duration:
+                return escape("D|"+strconv.FormatInt(int64(val), 10))
             case bool:
                 if val {
                     return escape("B|true")
@@ -82,52 +131,155 @@ func escapeWithType(x interface{}, isXAttr bool) string{
     }
 }
 
-func unescapeWithType(s string, from int) (interface{}, bool, int) {
+/*
+unescapeWithType reads a value written by escapeWithType starting at s[from], and
+returns it with the position of the first character after it.
+*/
+func unescapeWithType(s string, from int) (interface{}, bool, int, error) {
+    if from >= len(s) {
+        return nil, false, from, &PredicateSyntaxError{s, from, "expected a value, found end of input"}
+    }
+    if s[from] != 'X' && (from+1 >= len(s) || s[from+1] != '|') {
+        return nil, false, from, &PredicateSyntaxError{s, from+1, "expected \"|\" after the type of the value"}
+    }
     switch s[from] {
         case 'A':
         {
             atName, next := unescape(s, from+2)
-            return atName, true, next
+            return atName, true, next, nil
         }
         case 'S':
         {
             str, next := unescape(s, from+2)
-            return str, false, next
+            return str, false, next, nil
         }
         case 'I':
         {
             nbr, next := unescape(s, from+2)
-            return atoi(nbr), false, next
+            n, err := strconv.Atoi(nbr)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(nbr)+" is not a valid integer"}
+            }
+            return n, false, next, nil
+        }
+        case 'L':
+        {
+            nbr, next := unescape(s, from+2)
+            n, err := strconv.ParseInt(nbr, 10, 64)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(nbr)+" is not a valid int64"}
+            }
+            return n, false, next, nil
+        }
+        case 'U':
+        {
+            nbr, next := unescape(s, from+2)
+            n, err := strconv.ParseUint(nbr, 10, 64)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(nbr)+" is not a valid uint64"}
+            }
+            return n, false, next, nil
+        }
+        case 'F':
+        {
+            nbr, next := unescape(s, from+2)
+            f, err := strconv.ParseFloat(nbr, 64)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(nbr)+" is not a valid float64"}
+            }
+            return f, false, next, nil
+        }
+        case 'M':
+        {
+            tstr, next := unescape(s, from+2)
+            t, err := time.Parse(time.RFC3339Nano, tstr)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(tstr)+" is not a valid time"}
+            }
+            return t, false, next, nil
+        }
+        case 'D':
+        {
+            nbr, next := unescape(s, from+2)
+            n, err := strconv.ParseInt(nbr, 10, 64)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(nbr)+" is not a valid duration"}
+            }
+            return time.Duration(n), false, next, nil
         }
         case 'B':
         {
             bval, next := unescape(s, from+2)
             switch bval{
                 case "true":
-                    return true, false, next
+                    return true, false, next, nil
                 case "false":
-                    return false, false, next
+                    return false, false, next, nil
                 default:
-                    panic(bval+" is not a valid boolean!")
+                    return nil, false, from, &PredicateSyntaxError{s, from+2, strconv.Quote(bval)+" is not a valid boolean"}
             }
         }
         case 'T':
         {
             tdata, nextItem := unescape(s, from+2)
-            return decodeTuple(tdata), false, nextItem
+            t, err := decodeTuple(tdata)
+            if err != nil {
+                return nil, false, from, &PredicateSyntaxError{s, from+2, err.Error()}
+            }
+            return t, false, nextItem, nil
+        }
+        case 'E':
+        {
+            return unescapeExpression(s, from)
         }
         case 'X': //TODO gob!
         {
-            return nil, false, from+1
+            return nil, false, from+1, nil
         }
         default:
-            panic(s[from:]+": invalid value or attribute!")
+            return nil, false, from, &PredicateSyntaxError{s, from, "expected a value or an attribute, found "+strconv.Quote(s[from:from+1])}
+    }
+}
+
+/*
+unescapeExpression reads "E|op(arg,...)", where each argument is written by
+escapeWithType.
+*/
+func unescapeExpression(s string, from int) (interface{}, bool, int, error) {
+    open := strings.IndexByte(s[from:], '(')
+    if open < 0 {
+        return nil, false, from, &PredicateSyntaxError{s, from+2, "expected \"(\" after the operation"}
+    }
+    open += from
+    op := s[from+2:open]
+    if !isExpressionOp(op) {
+        return nil, false, from, &PredicateSyntaxError{s, from+2, "unknown operation "+strconv.Quote(op)}
+    }
+    e := cexpr{op, []interface{}{}}
+    for next := open+1; ; next++ {
+        arg, isAttr, end, err := unescapeWithType(s, next)
+        if err != nil {
+            return nil, false, from, err
+        }
+        if isAttr {
+            arg = recattr{arg.(string)}
+        }
+        e.args = append(e.args, arg)
+        if end < len(s) && s[end] == ')' {
+            return e, false, end+1, nil
+        }
+        if err = expectAt(s, end, ','); err != nil {
+            return nil, false, from, err
+        }
+        next = end
     }
 }
 
 func toValue(attr *Attributes, x interface{}, isXAttr bool) (interface{}, bool){
     if isXAttr {
         return (*attr).Get(x.(string))
+    } else if e, isExpr := x.(cexpr); isExpr{
+        return e.eval(attr)
     } else if _, isTr := x.(_true); isTr{
         return true, true
     } else if _, isF := x.(_false); isF{
@@ -142,21 +294,33 @@ func escape(s string) string {
     return rpl.Replace(s)
 }
 func unescape(s string, from int) (string, int) {
-    out := ""
+    if from >= len(s) {
+        return "", from
+    }
+    // without escapes, the token is a substring of s
+    stop := strings.IndexAny(s[from:], "\\,)")
+    if stop < 0 {
+        return s[from:], len(s)
+    } else if s[from+stop] != '\\' {
+        return s[from:from+stop], from+stop
+    }
+    var out strings.Builder
+    out.Grow(len(s) - from)
     escapeRun := false
     i:=from
     for ; i<len(s); i++ {
         if escapeRun {
             switch s[i] {
                 case '_':
-                    out += " "
+                    out.WriteByte(' ')
                 case 'n':
-                    out += "\n"
+                    out.WriteByte('\n')
                 case '\\', ',', ')':
-                    out += string(s[i:i+1])
+                    out.WriteByte(s[i])
                 default:
                     // TODO error!
-                    out += "\\" + string(s[i:i+1])
+                    out.WriteByte('\\')
+                    out.WriteByte(s[i])
             }
             escapeRun = false
         } else {
@@ -164,16 +328,16 @@ func unescape(s string, from int) (string, int) {
                 case '\\':
                     escapeRun = true
                 case ',', ')':
-                    return out, i
+                    return out.String(), i
                 default:
-                    out += string(s[i:i+1])
+                    out.WriteByte(s[i])
             }
         }
     }
     if escapeRun {
-        out += "\\"
+        out.WriteByte('\\')
     }
-    return out, i
+    return out.String(), i
 } 
 
 func receive(listener net.Listener) (string, []string) {
@@ -213,13 +377,9 @@ func receiveWithAddressTimeoutErr(listener net.Listener, msec int64, timedOut *b
     if err != nil {
         return "", []string{}, netAddress{}, err
     }
-    serverMsg, err := bufio.NewReader(conn).ReadString('\n')
+    tokens, _, err := readMessage(bufio.NewReader(conn))
+    conn.Close()
     if err == nil {
-        escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-        tokens := make([]string, len(escTokens))
-        for i, escTok := range escTokens {
-            tokens[i], _ = unescape(escTok, 0)
-        }
         return tokens[0], tokens[1:], newNetAddress(conn.RemoteAddr().String()), nil
     } else {
         return "", []string{}, netAddress{}, err
@@ -246,13 +406,8 @@ func receiveWithAddressTimeout(listener net.Listener, msec int64, timedOut *bool
     if err != nil {
         panic(err)
     }
-    serverMsg, err := bufio.NewReader(conn).ReadString('\n')
+    tokens, _, err := readMessage(bufio.NewReader(conn))
     if err == nil {
-        escTokens := strings.Split(serverMsg[:len(serverMsg)-1], " ")
-        tokens := make([]string, len(escTokens))
-        for i, escTok := range escTokens {
-            tokens[i], _ = unescape(escTok, 0)
-        }
         return tokens[0], tokens[1:], newNetAddress(conn.RemoteAddr().String())
     } else {
         panic(err)
@@ -276,6 +431,12 @@ func ToString(x interface{}) string {
     switch itm := x.(type){
         case int:
             return itoa(itm)
+        case int64:
+            return strconv.FormatInt(itm, 10)
+        case uint64:
+            return strconv.FormatUint(itm, 10)
+        case float64:
+            return strconv.FormatFloat(itm, 'g', -1, 64)
         case bool:
             if itm {
                 return "true"
@@ -284,66 +445,143 @@ func ToString(x interface{}) string {
             }
         case string:
             return itm
+        case time.Time:
+            return itm.Format(time.RFC3339Nano)
+        case time.Duration:
+            return itm.String()
         default:
             return "interface{}"
     }
 }
 
 func Cmp(a interface{}, op string, b interface{}) bool {
-    ia, isAint := a.(int)
-    ib, isBint := b.(int)
-    if isAint && isBint {
-        switch op{
-            case "<":
-                return ia < ib
-            case "<=":
-                return ia <= ib
-            case ">":
-                return ia > ib
-            case ">=":
-                return ia >= ib
-            case "==":
-                return ia == ib
-            case "!=":
-                return ia != ib
-            default:
-                panic("Unknown operator "+op+" between int and int")
-        }
+    res, ok := compareValues(a, op, b)
+    if !ok {
+        panic("Unknown operator "+op+" between "+reflect.TypeOf(a).String()+" and "+reflect.TypeOf(b).String())
     }
-    sa, isAstring := a.(string)
-    sb, isBstring := b.(string)
-    if isAstring && isBstring {
-        switch op{
-            case "<":
-                return sa < sb
-            case "<=":
-                return sa <= sb
-            case ">":
-                return sa > sb
-            case ">=":
-                return sa >= sb
-            case "==":
-                return sa == sb
-            case "!=":
-                return sa != sb
-            default:
-                panic("Unknown operator "+op+" between string and string")
-        }
+    return res
+}
+
+/*
+compareValues evaluates a op b. The numbers (int, int64, uint64 and float64) can
+be compared with each other: integers are compared exactly, and with a float64
+they are compared as float64. time.Time and time.Duration are only compared with
+values of the same type, bools only with == and !=. The second result is false if
+the operator can not be applied to a and b.
+*/
+func compareValues(a interface{}, op string, b interface{}) (bool, bool) {
+    sign, ordered, ok := 0, true, false
+    switch va := a.(type) {
+        case int, int64, uint64, float64:
+            sign, ordered, ok = compareNumbers(va, b)
+        case string:
+            var vb string
+            if vb, ok = b.(string); ok {
+                sign = strings.Compare(va, vb)
+            }
+        case time.Time:
+            var vb time.Time
+            if vb, ok = b.(time.Time); ok {
+                if va.Before(vb) {
+                    sign = -1
+                } else if va.After(vb) {
+                    sign = 1
+                }
+            }
+        case time.Duration:
+            var vb time.Duration
+            if vb, ok = b.(time.Duration); ok {
+                sign = compareInt64(int64(va), int64(vb))
+            }
+        case bool:
+            var vb bool
+            if vb, ok = b.(bool); ok {
+                if va != vb {
+                    sign = 1
+                }
+                ok = op == "==" || op == "!="
+            }
     }
-    ba, isAbool := a.(bool)
-    bb, isBbool := b.(bool)
-    if isAbool && isBbool {
-        switch op{
-            case "==":
-                return ba == bb
-            case "!=":
-                return ba != bb
-            default:
-                panic("Unknown operator "+op+" between bool and bool")
-        }
+    if !ok {
+        return false, false
     }
-    
-    panic("Unknown operator "+op+" between "+reflect.TypeOf(a).String()+" and "+reflect.TypeOf(b).String())
+    switch op {
+        case "==":
+            return ordered && sign == 0, true
+        case "!=":
+            return !ordered || sign != 0, true
+        case "<":
+            return ordered && sign < 0, true
+        case "<=":
+            return ordered && sign <= 0, true
+        case ">":
+            return ordered && sign > 0, true
+        case ">=":
+            return ordered && sign >= 0, true
+    }
+    return false, false
+}
+
+func compareInt64(a int64, b int64) int {
+    if a < b {
+        return -1
+    } else if a > b {
+        return 1
+    }
+    return 0
+}
+
+// returns the sign of a-b and whether a and b are ordered (they are not if one is NaN)
+func compareNumbers(a interface{}, b interface{}) (int, bool, bool) {
+    ia, ua, fa, kindA := splitNumber(a)
+    ib, ub, fb, kindB := splitNumber(b)
+    switch {
+        case kindA == 0 || kindB == 0:
+            return 0, false, false
+        case kindA == 'f' || kindB == 'f':
+            if math.IsNaN(fa) || math.IsNaN(fb) {
+                return 0, false, true
+            }
+            if fa < fb {
+                return -1, true, true
+            } else if fa > fb {
+                return 1, true, true
+            }
+            return 0, true, true
+        case kindA == 'u' && kindB == 'u':
+            if ua < ub {
+                return -1, true, true
+            } else if ua > ub {
+                return 1, true, true
+            }
+            return 0, true, true
+        case kindA == 'u':
+            if ib < 0 {
+                return 1, true, true
+            }
+            return compareNumbers(ua, uint64(ib))
+        case kindB == 'u':
+            if ia < 0 {
+                return -1, true, true
+            }
+            return compareNumbers(uint64(ia), ub)
+    }
+    return compareInt64(ia, ib), true, true
+}
+
+// returns x as int64, uint64 and float64, with 'i', 'u' or 'f' telling which one is exact; 0 if x is not a number
+func splitNumber(x interface{}) (int64, uint64, float64, byte) {
+    switch n := x.(type) {
+        case int:
+            return int64(n), 0, float64(n), 'i'
+        case int64:
+            return n, 0, float64(n), 'i'
+        case uint64:
+            return 0, n, float64(n), 'u'
+        case float64:
+            return 0, 0, n, 'f'
+    }
+    return 0, 0, 0, 0
 }
 
 func timeout(msec int64) <-chan time.Time{
@@ -354,8 +592,19 @@ func timeout(msec int64) <-chan time.Time{
     }
 }
 
+var registerOnce sync.Once
+
+// registerTypes registers the types of the attribute values for gob
+func registerTypes() {
+    registerOnce.Do(func(){
+        gob.Register(NewTuple())
+        gob.Register(time.Time{})
+        gob.Register(time.Duration(0))
+    })
+}
+
 func InitSend() {
-    gob.Register(NewTuple())
+    registerTypes()
     c := make(chan os.Signal, 2)
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
     go func() {
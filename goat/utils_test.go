@@ -1,19 +1,77 @@
 package goat
 
 import (
+	"math"
 	"testing"
 	"reflect"
+	"time"
 )
 
 func TestTupleEncoding(t *testing.T) {
     InitSend()
     t1 := NewTuple(7, "abc", true)
-    if z1, _, _ := unescapeWithType(escapeWithType(t1, false),0); !reflect.DeepEqual(z1, t1) {
+    if z1, _, _, _ := unescapeWithType(escapeWithType(t1, false),0); !reflect.DeepEqual(z1, t1) {
         t.Fail()
     }
     
     t2 := NewTuple(NewTuple("abc"), "abc", NewTuple(), NewTuple(7))
-    if z2, _, _ := unescapeWithType(escapeWithType(t2, false),0); !reflect.DeepEqual(z2, t2) {
+    if z2, _, _, _ := unescapeWithType(escapeWithType(t2, false),0); !reflect.DeepEqual(z2, t2) {
         t.Fail()
     }
 }
+
+func TestValueEncoding(t *testing.T) {
+    InitSend()
+    deadline := time.Date(2024, 3, 1, 12, 30, 0, 5, time.FixedZone("", 3600))
+    values := []interface{}{0.2, -1e-300, math.Inf(-1), int64(-1) << 62, uint64(1) << 63, deadline, 90 * time.Minute}
+    for _, v := range values {
+        back, _, _, err := unescapeWithType(escapeWithType(v, false), 0)
+        if eq, _ := compareValues(back, "==", v); err != nil || !eq {
+            t.Errorf("%v (%T) decoded as %v (%T), %v", v, v, back, back, err)
+        }
+    }
+    tpl := NewTuple(0.5, int64(3), deadline, time.Second)
+    back, _, _, _ := unescapeWithType(escapeWithType(tpl, false), 0)
+    if !back.(Tuple).Contains(deadline) || !back.(Tuple).Contains(time.Second) || !back.(Tuple).Contains(3) {
+        t.Errorf("%v decoded as %v", tpl, back)
+    }
+}
+
+func TestCmpMixedNumbers(t *testing.T) {
+    now := time.Now()
+    cases := []struct{
+        a interface{}
+        op string
+        b interface{}
+        want bool
+    }{
+        {1, "<", 1.5, true},
+        {0.2, "<", 1, true},
+        {2, "==", 2.0, true},
+        {int64(3), ">", 2, true},
+        {uint64(math.MaxUint64), ">", int64(math.MaxInt64), true},
+        {-1, "<", uint64(0), true},
+        {uint64(5), "==", 5, true},
+        {math.NaN(), "==", math.NaN(), false},
+        {math.NaN(), "!=", 1, true},
+        {math.NaN(), ">=", 1, false},
+        {now, "<", now.Add(time.Nanosecond), true},
+        {now.UTC(), "==", now, true},
+        {time.Second, "<", time.Minute, true},
+        {"a", "<", "b", true},
+        {true, "!=", false, true},
+    }
+    for _, c := range cases {
+        if got := Cmp(c.a, c.op, c.b); got != c.want {
+            t.Errorf("%v %s %v: got %v", c.a, c.op, c.b, got)
+        }
+    }
+    for _, c := range [][]interface{}{{1, time.Second}, {1, "1"}, {true, 1}, {now, 1}} {
+        if _, ok := compareValues(c[0], "==", c[1]); ok {
+            t.Errorf("%v and %v should not be comparable", c[0], c[1])
+        }
+    }
+    if _, ok := compareValues(true, "<", false); ok {
+        t.Errorf("bools should not be ordered")
+    }
+}
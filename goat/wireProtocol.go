@@ -0,0 +1,290 @@
+package goat
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "strings"
+)
+
+/*
+Two protocols can be used on a connection. The text protocol sends a message as
+a line of escaped tokens separated by spaces. The binary protocol sends it as a
+frame:
+
+    0x00 version length body
+
+where version is a byte (binaryProtocolVersion), length is the size of the body
+as an uvarint and the body is a kind byte followed by the fields of the message.
+A DATA message with a valid mid and sender has the kind frameData and the fields
+mid, sender (varints), predicate and tuple (uvarint length and bytes); any other
+message has the kind frameTokens, followed by the number of tokens and by each
+token as its length and its bytes.
+
+A text line never starts with 0x00, so the receivers read both protocols on any
+connection. The protocol is chosen for each connection when it is opened: the
+side that dials sends the text line
+
+    HELLO version...
+
+with the versions of the binary protocol it reads, and the other side answers
+
+    PROTOCOL version
+
+where version is the one both sides read, or 0 for the text protocol. Neither side
+waits for the other: each one sends text lines until it read the first message of
+the connection (see duplexConn.negotiate), and binary frames once it is the answer,
+or the hello, that agreed on them. A peer that does not answer, or that dials
+without a hello, keeps the text protocol.
+*/
+const binaryProtocolVersion = 1
+
+const (
+    frameMagic = 0x00
+    frameTokens = 'T'
+    frameData = 'D'
+    // a frame can not be longer than this; the body is read as it arrives
+    maxFrameLength = 1 << 24
+)
+
+/*
+rawTuplePrefix starts a tuple encoded with gob but not with base64, as sent by the
+agents that use the binary protocol. It is converted to base64 when it has to be
+sent with the text protocol; only the token at the tuple position of a message
+(see tupleIndex) is looked at, so the other tokens can start with anything.
+*/
+const rawTuplePrefix = "\x00"
+
+func helloMessage() []string {
+    return []string{"HELLO", itoa(binaryProtocolVersion)}
+}
+
+/*
+answerHello answers on w the hello of a peer that reads the given versions of the
+binary protocol, and returns whether binary frames can be sent to it.
+*/
+func answerHello(w io.Writer, versions []string) (bool, error) {
+    version := 0
+    for _, v := range versions {
+        if v == itoa(binaryProtocolVersion) {
+            version = binaryProtocolVersion
+        }
+    }
+    if err := writeMessage(w, false, []string{"PROTOCOL", itoa(version)}); err != nil {
+        return false, err
+    }
+    return version != 0, nil
+}
+
+// acceptsBinary tells whether the PROTOCOL answer with params agreed on binary frames
+func acceptsBinary(params []string) bool {
+    return len(params) > 0 && params[0] == itoa(binaryProtocolVersion)
+}
+
+/*
+tupleIndex gives the position of the tuple in tokens, or -1: a DATA or an EXPIRED
+message carries it after the mid, the sender and the predicate, also when it is
+queued with add.
+*/
+func tupleIndex(tokens []string) int {
+    start := 0
+    if len(tokens) > 0 && tokens[0] == "add" {
+        start = 1
+    }
+    if len(tokens) == start + 5 && (tokens[start] == "DATA" || tokens[start] == "EXPIRED") {
+        return start + 4
+    }
+    return -1
+}
+
+func encodeTextLine(tokens []string) []byte {
+    var buf bytes.Buffer
+    tuple := tupleIndex(tokens)
+    for i, tok := range tokens {
+        if i > 0 {
+            buf.WriteByte(' ')
+        }
+        if i == tuple && strings.HasPrefix(tok, rawTuplePrefix) {
+            buf.WriteString(base64.StdEncoding.EncodeToString([]byte(tok[len(rawTuplePrefix):])))
+        } else {
+            buf.WriteString(escape(tok))
+        }
+    }
+    buf.WriteByte('\n')
+    return buf.Bytes()
+}
+
+func decodeTextLine(line string) []string {
+    escTokens := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+    tokens := make([]string, len(escTokens))
+    for i, escTok := range escTokens {
+        tokens[i], _ = unescape(escTok, 0)
+    }
+    return tokens
+}
+
+func appendFrameString(body []byte, s string) []byte {
+    body = binary.AppendUvarint(body, uint64(len(s)))
+    return append(body, s...)
+}
+
+func encodeFrame(tokens []string) []byte {
+    body := make([]byte, 0, 64)
+    mid, errMid := paramInt(tokens, 1)
+    sender, errSender := paramInt(tokens, 2)
+    if len(tokens) == 5 && tokens[0] == "DATA" && errMid == nil && errSender == nil {
+        body = append(body, frameData)
+        body = binary.AppendVarint(body, int64(mid))
+        body = binary.AppendVarint(body, int64(sender))
+        body = appendFrameString(body, tokens[3])
+        body = appendFrameString(body, tokens[4])
+    } else {
+        body = append(body, frameTokens)
+        body = binary.AppendUvarint(body, uint64(len(tokens)))
+        for _, tok := range tokens {
+            body = appendFrameString(body, tok)
+        }
+    }
+    frame := make([]byte, 0, len(body) + 2 + binary.MaxVarintLen64)
+    frame = append(frame, frameMagic, binaryProtocolVersion)
+    frame = binary.AppendUvarint(frame, uint64(len(body)))
+    return append(frame, body...)
+}
+
+// frameReader reads the fields of the body of a frame
+type frameReader struct {
+    body []byte
+    err error
+}
+
+func (fr *frameReader) uvarint() uint64 {
+    if fr.err != nil {
+        return 0
+    }
+    x, n := binary.Uvarint(fr.body)
+    if n <= 0 {
+        fr.err = fmt.Errorf("goat: truncated frame")
+        return 0
+    }
+    fr.body = fr.body[n:]
+    return x
+}
+
+func (fr *frameReader) varint() int64 {
+    if fr.err != nil {
+        return 0
+    }
+    x, n := binary.Varint(fr.body)
+    if n <= 0 {
+        fr.err = fmt.Errorf("goat: truncated frame")
+        return 0
+    }
+    fr.body = fr.body[n:]
+    return x
+}
+
+func (fr *frameReader) string() string {
+    size := fr.uvarint()
+    if fr.err != nil {
+        return ""
+    }
+    if size > uint64(len(fr.body)) {
+        fr.err = fmt.Errorf("goat: truncated frame")
+        return ""
+    }
+    s := string(fr.body[:size])
+    fr.body = fr.body[size:]
+    return s
+}
+
+func decodeFrameBody(body []byte) ([]string, error) {
+    if len(body) == 0 {
+        return nil, fmt.Errorf("goat: empty frame")
+    }
+    fr := frameReader{body: body[1:]}
+    var tokens []string
+    switch body[0] {
+        case frameData:
+            mid := fr.varint()
+            sender := fr.varint()
+            pred := fr.string()
+            tuple := fr.string()
+            tokens = []string{"DATA", itoa(int(mid)), itoa(int(sender)), pred, tuple}
+        case frameTokens:
+            count := fr.uvarint()
+            if count == 0 || count > uint64(len(fr.body)) {
+                return nil, fmt.Errorf("goat: frame with %d tokens", count)
+            }
+            tokens = make([]string, count)
+            for i := range tokens {
+                tokens[i] = fr.string()
+            }
+        default:
+            return nil, fmt.Errorf("goat: unknown frame kind %q", body[0])
+    }
+    if fr.err == nil && len(fr.body) > 0 {
+        fr.err = fmt.Errorf("goat: %d bytes after the end of the frame", len(fr.body))
+    }
+    return tokens, fr.err
+}
+
+func readFrame(r *bufio.Reader) ([]string, error) {
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    if header[1] != binaryProtocolVersion {
+        return nil, fmt.Errorf("goat: unsupported protocol version %d", header[1])
+    }
+    size, err := binary.ReadUvarint(r)
+    if err != nil {
+        return nil, err
+    }
+    if size > maxFrameLength {
+        return nil, fmt.Errorf("goat: frame of %d bytes", size)
+    }
+    // the buffer grows with the bytes received, not with the announced size
+    var body bytes.Buffer
+    if _, err := io.CopyN(&body, r, int64(size)); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return decodeFrameBody(body.Bytes())
+}
+
+/*
+readMessage reads a message in either protocol; the second result tells whether
+it was a binary frame. An error in a frame means that the stream can not be read
+anymore.
+*/
+func readMessage(r *bufio.Reader) ([]string, bool, error) {
+    first, err := r.Peek(1)
+    if err != nil {
+        return nil, false, err
+    }
+    if first[0] == frameMagic {
+        tokens, err := readFrame(r)
+        return tokens, true, err
+    }
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, false, err
+    }
+    return decodeTextLine(line), false, nil
+}
+
+// writeMessage writes the tokens with a single Write, as a frame if binary is true
+func writeMessage(w io.Writer, binary bool, tokens []string) error {
+    var err error
+    if binary {
+        _, err = w.Write(encodeFrame(tokens))
+    } else {
+        _, err = w.Write(encodeTextLine(tokens))
+    }
+    return err
+}
@@ -0,0 +1,289 @@
+package goat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWireProtocolRoundTrip(t *testing.T) {
+    InitSend()
+    tpl := NewTuple("a b", 3, true)
+    messages := [][]string{
+        {"DATA", "12", "3", "&(=(A|role,S|worker),TT)", tpl.encodeFor(true)},
+        {"DATA", "12", "3", "TT", tpl.encodeFor(false)},
+        {"DATA", "x", "3", "TT", ""},
+        {"Registered", "0", "7"},
+        {"ATTR", "1", "name", "S|with space\nand newline\\"},
+        {"Leave"},
+        {"SKIP", ""},
+        {"ATTR", "1", "name", rawTuplePrefix + "not a tuple"},
+    }
+    var stream bytes.Buffer
+    for i, msg := range messages {
+        if err := writeMessage(&stream, i % 2 == 0, msg); err != nil {
+            t.Fatal(err)
+        }
+    }
+    r := bufio.NewReader(&stream)
+    for i, msg := range messages {
+        tokens, isBinary, err := readMessage(r)
+        if err != nil {
+            t.Fatalf("message %d: %v", i, err)
+        }
+        if isBinary != (i % 2 == 0) {
+            t.Errorf("message %d: binary is %v", i, isBinary)
+        }
+        if !reflect.DeepEqual(tokens, msg) {
+            t.Errorf("message %d: sent %q, got %q", i, msg, tokens)
+        }
+    }
+}
+
+func TestRawTupleOverText(t *testing.T) {
+    InitSend()
+    tpl := NewTuple("Ciao", 7, NewTuple(1.5))
+    var stream bytes.Buffer
+    writeMessage(&stream, false, []string{"DATA", "0", "1", "TT", tpl.encodeFor(true)})
+    if bytes.IndexByte(stream.Bytes(), 0) >= 0 {
+        t.Fatalf("a raw tuple was sent in a text line: %q", stream.String())
+    }
+    tokens, _, err := readMessage(bufio.NewReader(&stream))
+    if err != nil {
+        t.Fatal(err)
+    }
+    msg, err := decodeDataMessage(tokens[1:])
+    if err != nil || !reflect.DeepEqual(msg.Message, tpl) {
+        t.Errorf("decoded %v, %v instead of %v", msg.Message, err, tpl)
+    }
+}
+
+func TestInvalidFrames(t *testing.T) {
+    valid := encodeFrame([]string{"Registered", "0", "7"})
+    frames := map[string][]byte{
+        "version": append([]byte{frameMagic, binaryProtocolVersion + 1}, valid[2:]...),
+        "truncated": valid[:len(valid)-1],
+        "kind": {frameMagic, binaryProtocolVersion, 1, 'Z'},
+        "no tokens": {frameMagic, binaryProtocolVersion, 2, frameTokens, 0},
+        "trailing": {frameMagic, binaryProtocolVersion, 4, frameTokens, 1, 0, 0},
+        "too long": binary.AppendUvarint([]byte{frameMagic, binaryProtocolVersion}, maxFrameLength + 1),
+        "short body": append(binary.AppendUvarint([]byte{frameMagic, binaryProtocolVersion}, maxFrameLength), frameTokens, 1, 0),
+    }
+    for name, frame := range frames {
+        if tokens, _, err := readMessage(bufio.NewReader(bytes.NewReader(frame))); err == nil {
+            t.Errorf("%s: read %q", name, tokens)
+        }
+    }
+}
+
+func TestUnescape(t *testing.T) {
+    for _, s := range []string{"", "plain", "a b", "a,b)c", "\\", "tail\\", "\n \\_"} {
+        if back, next := unescape(escape(s), 0); back != s || next != len(escape(s)) {
+            t.Errorf("%q unescaped as %q, %d", s, back, next)
+        }
+    }
+    if tok, next := unescape("ab,cd", 0); tok != "ab" || next != 2 {
+        t.Errorf("got %q, %d", tok, next)
+    }
+    if tok, next := unescape("a\\,b)c", 0); tok != "a,b" || next != 4 {
+        t.Errorf("got %q, %d", tok, next)
+    }
+}
+
+func TestBinaryProtocol(t *testing.T) {
+    InitSend()
+    run := func(name string, sender Agent, receiver Agent) {
+        comp1, comp2 := NewComponent(sender, nil), NewComponent(receiver, nil)
+        t.Run(name, func(t *testing.T) {
+            sendAndReceive(t, comp1, comp2)
+            sendAndReceive(t, comp2, comp1)
+        })
+        comp1.Close()
+        comp2.Close()
+    }
+
+    term, srv := initTestCS(300)
+    run("server", NewSingleServerAgent("127.0.0.1:17654"), NewSingleServerAgent("127.0.0.1:17654"))
+    teardownTestCS(term, srv)
+
+    ring := testRingInfrastructure{}
+    ring.initTest(300, 2, 2)
+    run("ring", ring.agents[0], ring.agents[1])
+    if !ring.agents[0].connNode.usesBinary() {
+        t.Errorf("the ring agent did not switch to the binary protocol")
+    }
+    ring.teardownTest()
+
+    tree := testTreeInfrastructure{}
+    tree.initTest(300, 2, 2, 2)
+    run("tree", tree.agents[0], tree.agents[1])
+    tree.teardownTest()
+
+    cluster := testClusterInfrastructure{}
+    cluster.initTest(300, 2, 2)
+    run("cluster", cluster.agents[0], cluster.agents[1])
+    cluster.teardownTest()
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+    conns, _, port := listenerInt(0)
+    defer conns.Close()
+    address := "127.0.0.1:" + itoa(port)
+    accepted := func() *duplexConn {
+        select {
+            case dc := <- conns.Out:
+                return dc
+            case <- time.After(time.Second):
+                t.Fatal("no connection accepted")
+                return nil
+        }
+    }
+
+    // both sides read binary frames, once the hello and its answer arrived
+    dc, err := connect(address, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other := accepted()
+    dc.Send("ping", "a b")
+    if cmd, params, err := other.ReceiveErr(); err != nil || cmd != "ping" || params[0] != "a b" {
+        t.Errorf("received %q %q, %v", cmd, params, err)
+    }
+    other.Send("pong")
+    if cmd, _, err := dc.ReceiveErr(); err != nil || cmd != "pong" {
+        t.Errorf("received %q, %v", cmd, err)
+    }
+    if !dc.usesBinary() || !other.usesBinary() {
+        t.Errorf("binary frames not agreed: %v, %v", dc.usesBinary(), other.usesBinary())
+    }
+    dc.Close()
+    other.Close()
+
+    // a peer that dials without a hello keeps the text protocol
+    conn, err := net.Dial("tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeMessage(conn, false, []string{"ping"})
+    other = accepted()
+    if other.usesBinary() {
+        t.Errorf("binary frames to a peer that did not negotiate")
+    }
+    if cmd, _, err := other.ReceiveErr(); err != nil || cmd != "ping" {
+        t.Errorf("the first message was lost: %q, %v", cmd, err)
+    }
+    other.Send("pong")
+    if tokens, isBinary, err := readMessage(bufio.NewReader(conn)); err != nil || isBinary || tokens[0] != "pong" {
+        t.Errorf("received %q (binary %v), %v", tokens, isBinary, err)
+    }
+    conn.Close()
+    other.Close()
+
+    // a peer that dials without a hello and sends nothing is accepted at once
+    conn, err = net.Dial("tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other = accepted()
+    other.Send("first")
+    if tokens, isBinary, err := readMessage(bufio.NewReader(conn)); err != nil || isBinary || tokens[0] != "first" {
+        t.Errorf("received %q (binary %v), %v", tokens, isBinary, err)
+    }
+    conn.Close()
+    other.Close()
+
+    // a peer that does not answer, or answers with the text protocol, gets text lines
+    for _, answer := range [][]string{nil, {"PROTOCOL", "0"}} {
+        listener, port := listenToRandomPort()
+        go func(answer []string) {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+            reader := bufio.NewReader(conn)
+            readMessage(reader)
+            if answer != nil {
+                writeMessage(conn, false, answer)
+            }
+            if tokens, isBinary, err := readMessage(reader); err != nil || isBinary || tokens[0] != "ping" {
+                t.Errorf("received %q (binary %v), %v", tokens, isBinary, err)
+            }
+        }(answer)
+        start := time.Now()
+        dc, err := connect("127.0.0.1:" + itoa(port), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        dc.Send("ping")
+        if wait := time.Since(start); wait > time.Second {
+            t.Errorf("the first message waited %v for the answer %q", wait, answer)
+        }
+        dc.ReceiveErr()
+        if dc.usesBinary() {
+            t.Errorf("binary frames chosen with the answer %q", answer)
+        }
+        dc.Close()
+        listener.Close()
+    }
+}
+
+// an agent that does not negotiate shares the server with one that uses binary frames
+func TestMixedProtocols(t *testing.T) {
+    InitSend()
+    term, srv := initTestCS(300)
+    comp := NewComponent(NewSingleServerAgent("127.0.0.1:17654"), nil)
+    listener, port := listenToRandomPort()
+    out, err := net.Dial("tcp", "127.0.0.1:17654")
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeMessage(out, false, []string{"Register", itoa(port)})
+    in, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    reader := bufio.NewReader(in)
+    read := func(cmd string) []string {
+        for {
+            tokens, isBinary, err := readMessage(reader)
+            if err != nil {
+                t.Fatal(err)
+            } else if isBinary {
+                t.Errorf("a binary frame to the text agent: %q", tokens)
+            }
+            if tokens[0] == cmd {
+                return tokens[1:]
+            }
+        }
+    }
+    cid := read("Registered")[0]
+
+    received := make(chan struct{})
+    NewProcess(comp).Run(func(p *Process) {
+        p.Send(NewTuple("Ciao"), True())
+        p.Receive(func(attr *Attributes, msg Tuple) bool {
+            return msg.Get(0) == "Hello"
+        })
+        close(received)
+    })
+    tuple, err := decodeTuple(read("DATA")[3])
+    if err != nil || tuple.Get(0) != "Ciao" {
+        t.Errorf("the text agent received %v, %v", tuple, err)
+    }
+    writeMessage(out, false, []string{"REQ", cid})
+    mid := read("RPLY")[0]
+    hello := NewTuple("Hello")
+    writeMessage(out, false, []string{"DATA", mid, cid, True().String(), hello.encode()})
+    waitAll(t, 2000, received)
+    writeMessage(out, false, []string{"Leave", cid})
+    comp.Close()
+    out.Close()
+    in.Close()
+    listener.Close()
+    teardownTestCS(term, srv)
+}